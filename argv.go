@@ -0,0 +1,120 @@
+package spawnexec
+
+import (
+	"os"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// argvBlock holds a program path, argument vector and environment in the
+// form posix_spawn takes them: NUL-terminated strings and NULL-terminated
+// arrays of pointers to them. Everything is packed into one block of
+// memory mapped outside the Go heap, so cgo can be handed pointers into it
+// directly, instead of one C.CString allocation per string.
+//
+// Blocks are recycled through argvBlockCache, so once it is warm a
+// spawn-heavy program marshals argv and env without allocating.
+type argvBlock struct {
+	mem  []byte
+	path unsafe.Pointer // *C.char
+	argv unsafe.Pointer // **C.char
+	envp unsafe.Pointer // **C.char
+}
+
+// maxCachedArgvBlocks is the number of idle argvBlocks kept for reuse.
+const maxCachedArgvBlocks = 16
+
+// argvBlockCache holds idle argvBlocks. It is a plain free list rather than
+// a sync.Pool because the blocks must be unmapped explicitly.
+var argvBlockCache struct {
+	mu     sync.Mutex
+	blocks []*argvBlock
+}
+
+// newArgvBlock returns an argvBlock holding path, argv and env.
+func newArgvBlock(path string, argv, env []string) (*argvBlock, error) {
+	const ptrSize = int(unsafe.Sizeof(uintptr(0)))
+	ptrs := len(argv) + 1 + len(env) + 1
+	size := ptrs*ptrSize + len(path) + 1
+	for _, s := range argv {
+		size += len(s) + 1
+	}
+	for _, s := range env {
+		size += len(s) + 1
+	}
+
+	b, err := getArgvBlock(size)
+	if err != nil {
+		return nil, err
+	}
+
+	// The pointer arrays come first, keeping them aligned, followed by the
+	// strings they point to.
+	off := ptrs * ptrSize
+	putString := func(s string) unsafe.Pointer {
+		p := unsafe.Pointer(&b.mem[off])
+		off += copy(b.mem[off:], s)
+		b.mem[off] = 0
+		off++
+		return p
+	}
+	putArray := func(slot int, strs []string) unsafe.Pointer {
+		array := unsafe.Slice((*uintptr)(unsafe.Pointer(&b.mem[slot*ptrSize])), len(strs)+1)
+		for i, s := range strs {
+			array[i] = uintptr(putString(s))
+		}
+		array[len(strs)] = 0
+		return unsafe.Pointer(&array[0])
+	}
+	b.path = putString(path)
+	b.argv = putArray(0, argv)
+	b.envp = putArray(len(argv)+1, env)
+	return b, nil
+}
+
+// getArgvBlock returns an idle argvBlock of at least size bytes, mapping a
+// new one if none is cached.
+func getArgvBlock(size int) (*argvBlock, error) {
+	c := &argvBlockCache
+	c.mu.Lock()
+	for i := len(c.blocks) - 1; i >= 0; i-- {
+		if b := c.blocks[i]; len(b.mem) >= size {
+			c.blocks = append(c.blocks[:i], c.blocks[i+1:]...)
+			c.mu.Unlock()
+			return b, nil
+		}
+	}
+	c.mu.Unlock()
+
+	// Round up to a power of two number of pages, so that blocks suit a
+	// range of sizes when they are reused.
+	n := os.Getpagesize()
+	for n < size {
+		n *= 2
+	}
+	mem, err := unix.Mmap(-1, 0, n, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		return nil, os.NewSyscallError("mmap", err)
+	}
+	return &argvBlock{mem: mem}, nil
+}
+
+// release returns b to argvBlockCache, or unmaps it if the cache is full.
+// b must not be used afterwards.
+func (b *argvBlock) release() {
+	b.path, b.argv, b.envp = nil, nil, nil
+	c := &argvBlockCache
+	c.mu.Lock()
+	if len(c.blocks) < maxCachedArgvBlocks {
+		if c.blocks == nil {
+			c.blocks = make([]*argvBlock, 0, maxCachedArgvBlocks)
+		}
+		c.blocks = append(c.blocks, b)
+		c.mu.Unlock()
+		return
+	}
+	c.mu.Unlock()
+	unix.Munmap(b.mem)
+}
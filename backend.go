@@ -0,0 +1,114 @@
+package spawnexec
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"sync/atomic"
+)
+
+// Backend is a way of spawning commands.
+type Backend int
+
+const (
+	// BackendPosixSpawn spawns commands with posix_spawn. It is the
+	// default on darwin, and is not available elsewhere.
+	BackendPosixSpawn Backend = iota + 1
+	// BackendOSExec spawns commands with os/exec, as on platforms other
+	// than darwin. On darwin it gives up the benefits of posix_spawn, but
+	// can help tell whether a problem is specific to it. DarwinAttr is
+	// not applied, and BeforeResume is not supported.
+	BackendOSExec
+)
+
+func (b Backend) String() string {
+	switch b {
+	case BackendPosixSpawn:
+		return "posix_spawn"
+	case BackendOSExec:
+		return "os/exec"
+	}
+	return "Backend(" + itoa(int(b)) + ")"
+}
+
+// backend holds the Backend commands are started with.
+var backend atomic.Int64
+
+func init() {
+	b := nativeBackend
+	if os.Getenv("SPAWNEXEC_BACKEND") == BackendOSExec.String() {
+		b = BackendOSExec
+	}
+	backend.Store(int64(b))
+}
+
+// SetBackend sets the Backend with which commands are started from then
+// on, and returns the previous one. Commands already started are waited
+// for with the Backend they were started with. The initial Backend is
+// BackendPosixSpawn on darwin and BackendOSExec elsewhere, unless the
+// environment variable SPAWNEXEC_BACKEND is "os/exec", which forces
+// BackendOSExec without rebuilding. SetBackend fails if b is not available
+// on this platform.
+func SetBackend(b Backend) (Backend, error) {
+	if b != BackendOSExec && b != nativeBackend {
+		return CurrentBackend(), errors.New("exec: backend " + b.String() + " is not available on this platform")
+	}
+	return Backend(backend.Swap(int64(b))), nil
+}
+
+// CurrentBackend returns the Backend with which commands are started.
+func CurrentBackend() Backend {
+	return Backend(backend.Load())
+}
+
+// Capabilities describes what a Backend supports on the running system,
+// so that code built on this package can tell what it may ask for rather
+// than guessing from runtime.GOOS.
+type Capabilities struct {
+	// Chdir reports whether Dir is applied by the spawn itself. If not,
+	// it is applied by a trampoline run in the command's place first.
+	Chdir bool
+	// Setsid reports whether SysProcAttr.Setsid is supported.
+	Setsid bool
+	// Pty reports whether a terminal, such as the replica side of a
+	// pseudo-terminal, can be made the command's controlling terminal and
+	// its process group put in the foreground, with SysProcAttr.Setctty
+	// and Foreground.
+	Pty bool
+	// Credentials reports whether the command can be run as another user
+	// or group. No Backend supports it yet.
+	Credentials bool
+	// Cgroups reports whether SysProcAttr.UseCgroupFD and CgroupPath are
+	// supported.
+	Cgroups bool
+	// UserNamespaces reports whether SysProcAttr.UidMappings and
+	// GidMappings are supported.
+	UserNamespaces bool
+	// BeforeResume reports whether Cmd.BeforeResume is supported.
+	BeforeResume bool
+	// DarwinAttr reports whether Cmd.DarwinAttr is applied.
+	DarwinAttr bool
+}
+
+// Capabilities returns what b supports on the running system. A Backend
+// that is not available on it supports nothing.
+func (b Backend) Capabilities() Capabilities {
+	switch {
+	case b == BackendPosixSpawn && nativeBackend == BackendPosixSpawn:
+		return Capabilities{Chdir: hasChdir(), Setsid: true, Pty: true, BeforeResume: true, DarwinAttr: true}
+	case b == BackendOSExec:
+		return Capabilities{Chdir: true, Setsid: true, Pty: true, Cgroups: runtime.GOOS == "linux", UserNamespaces: runtime.GOOS == "linux", BeforeResume: canWaitStopped}
+	}
+	return Capabilities{}
+}
+
+// Backend returns the Backend c was started with or, if it has not been
+// started, the one it would be started with now. A command started
+// through a Broker is spawned by the broker process, whose own Backend
+// may differ.
+func (c *Cmd) Backend() Backend {
+	if c.backend != 0 {
+		return c.backend
+	}
+	return CurrentBackend()
+}
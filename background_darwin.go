@@ -0,0 +1,26 @@
+//go:build darwin
+
+package spawnexec
+
+/*
+#include <errno.h>
+#include <sys/resource.h>
+
+static int set_darwin_bg(pid_t pid) {
+    return setpriority(PRIO_DARWIN_PROCESS, pid, PRIO_DARWIN_BG) == 0 ? 0 : errno;
+}
+*/
+import "C"
+import (
+	"os"
+	"syscall"
+)
+
+// setBackground gives the process pid the PRIO_DARWIN_BG policy, which
+// throttles its CPU and I/O as a background task's.
+func setBackground(pid int) error {
+	if ret := C.set_darwin_bg(C.pid_t(pid)); ret != 0 {
+		return os.NewSyscallError("setpriority", syscall.Errno(ret))
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+//go:build linux
+
+package spawnexec
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// ioprio_set(2) values selecting the idle I/O class for a process.
+const (
+	ioprioWhoProcess = 1
+	ioprioClassIdle  = 3
+	ioprioClassShift = 13
+)
+
+// setBackground gives the process pid the lowest CPU priority and the
+// idle I/O class, in which its disk I/O is only served when no other
+// process wants the disk.
+func setBackground(pid int) error {
+	if err := unix.Setpriority(unix.PRIO_PROCESS, pid, 19); err != nil {
+		return os.NewSyscallError("setpriority", err)
+	}
+	_, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(pid), ioprioClassIdle<<ioprioClassShift)
+	if errno != 0 {
+		return os.NewSyscallError("ioprio_set", errno)
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux && !darwin
+
+package spawnexec
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// setBackground gives the process pid the lowest CPU priority.
+func setBackground(pid int) error {
+	if err := unix.Setpriority(unix.PRIO_PROCESS, pid, 19); err != nil {
+		return os.NewSyscallError("setpriority", err)
+	}
+	return nil
+}
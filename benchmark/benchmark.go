@@ -0,0 +1,71 @@
+// Package benchmark measures how the cost of spawning a command grows with
+// the memory of the calling process, for spawnexec and for os/exec.
+//
+// Spawning with fork must duplicate the parent's page tables, so its cost
+// grows with the parent's resident set, while posix_spawn's does not. The
+// benchmarks in this package allocate a ballast of a configurable size in
+// the parent before spawning, so that the difference can be measured
+// reproducibly:
+//
+//	go test ./benchmark -run=NONE -bench=. -heap=1GB,4GB,16GB
+//
+// The machine must have enough memory for the largest ballast to stay
+// resident; swapping would distort the results.
+package benchmark
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Ballast returns size bytes of memory allocated on the Go heap, with
+// every page written to so that all of it is resident.
+func Ballast(size int64) []byte {
+	b := make([]byte, size)
+	page := os.Getpagesize()
+	for i := 0; i < len(b); i += page {
+		b[i] = 1
+	}
+	return b
+}
+
+// ParseSize parses a size such as "512MB" or "4GB", in powers of 1024. A
+// size without a unit is in bytes.
+func ParseSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		scale  int64
+	}{
+		{"TB", 1 << 40},
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	}
+	num, scale := strings.ToUpper(strings.TrimSpace(s)), int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(num, u.suffix) {
+			num, scale = strings.TrimSpace(strings.TrimSuffix(num, u.suffix)), u.scale
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("benchmark: invalid size %q", s)
+	}
+	return int64(n * float64(scale)), nil
+}
+
+// FormatSize formats size as ParseSize parses it, in the largest unit
+// that divides it.
+func FormatSize(size int64) string {
+	for _, u := range []string{"B", "KB", "MB", "GB"} {
+		if size%1024 != 0 || size < 1024 {
+			return strconv.FormatInt(size, 10) + u
+		}
+		size /= 1024
+	}
+	return strconv.FormatInt(size, 10) + "TB"
+}
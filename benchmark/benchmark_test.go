@@ -0,0 +1,78 @@
+package benchmark
+
+import (
+	"flag"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/orospakr/spawnexec"
+)
+
+var heapFlag = flag.String("heap", "0,1GB", "comma-separated ballast `sizes` to allocate before spawning, such as 1GB,4GB,32GB")
+
+// heapSizes returns the sizes given by -heap.
+func heapSizes(b *testing.B) []int64 {
+	var sizes []int64
+	for _, s := range strings.Split(*heapFlag, ",") {
+		size, err := ParseSize(s)
+		if err != nil {
+			b.Fatal(err)
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes
+}
+
+// BenchmarkSpawnUnderMemoryPressure benchmarks running "true" with
+// spawnexec and with os/exec while the process holds each ballast size.
+func BenchmarkSpawnUnderMemoryPressure(b *testing.B) {
+	for _, size := range heapSizes(b) {
+		ballast := Ballast(size)
+		b.Run("heap="+FormatSize(size)+"/spawnexec", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := spawnexec.Command("true").Run(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run("heap="+FormatSize(size)+"/os-exec", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := exec.Command("true").Run(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		runtime.KeepAlive(ballast)
+		runtime.GC()
+	}
+}
+
+// TestParseSize tests parsing and formatting sizes.
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		out  string
+	}{
+		{"0", 0, "0B"},
+		{"512MB", 512 << 20, "512MB"},
+		{"1GB", 1 << 30, "1GB"},
+		{"1.5gb", 3 << 29, "1536MB"},
+		{"32GB", 32 << 30, "32GB"},
+		{"100", 100, "100B"},
+	}
+	for _, tt := range tests {
+		got, err := ParseSize(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+		if out := FormatSize(got); out != tt.out {
+			t.Errorf("FormatSize(%d) = %q, want %q", got, out, tt.out)
+		}
+	}
+	if _, err := ParseSize("lots"); err == nil {
+		t.Error(`ParseSize("lots") succeeded`)
+	}
+}
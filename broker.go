@@ -0,0 +1,653 @@
+package spawnexec
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// brokerEnv is the environment variable through which a spawn broker learns
+// the file descriptor of its socket.
+const brokerEnv = "SPAWNEXEC_BROKER_FD"
+
+// maxBrokerFiles is the most file descriptors a spawn request can carry.
+const maxBrokerFiles = 64
+
+// Broker is a spawn broker: a small helper process that spawns commands on
+// behalf of the process that started it. Set Cmd.Broker to have a command
+// spawned through it.
+//
+// Spawning from a process with a very large heap is measurably slower, even
+// with posix_spawn, and on platforms that fall back to os/exec it means
+// forking that heap. A Broker started early, while the heap is still small,
+// keeps the cost of spawning low however large the parent grows. Requests
+// are sent over a Unix socket, with the command's standard I/O and extra
+// files passed as descriptors.
+//
+// The broker is the parent of the commands it spawns. Their Process can be
+// signaled and waited for as usual; the broker reaps them and reports
+// their exit status and resource usage back.
+type Broker struct {
+	conn *net.UnixConn
+	cmd  *Cmd // the broker process
+
+	wmu sync.Mutex // serializes writes to conn
+
+	mu      sync.Mutex
+	nextID  uint64
+	replies map[uint64]chan brokerMsg
+	exits   map[int]chan brokerMsg // by pid
+	err     error                  // set once the connection is lost
+}
+
+// brokerMsg is a request to or a message from a spawn broker.
+type brokerMsg struct {
+	ID uint64 `json:"id,omitempty"`
+	Op string `json:"op"`
+
+	// Spawn requests
+	Path    string      `json:"path,omitempty"`
+	Args    []string    `json:"args,omitempty"`
+	Env     []string    `json:"env,omitempty"`
+	Dir     string      `json:"dir,omitempty"`
+	Files   []bool      `json:"files,omitempty"` // which of fds 0, 1, 2, 3... were sent
+	Opens   []OpenFile  `json:"opens,omitempty"`
+	Paths   [3]string   `json:"paths,omitzero"` // StdinPath, StdoutPath, StderrPath
+	OutFlag int         `json:"outflag,omitempty"`
+	OutPerm uint32      `json:"outperm,omitempty"`
+	Darwin  *DarwinAttr `json:"darwin,omitempty"`
+	Setpgid bool        `json:"setpgid,omitempty"`
+	Pgid    int         `json:"pgid,omitempty"`
+	Setsid  bool        `json:"setsid,omitempty"`
+	BG      bool        `json:"bg,omitempty"`
+	Core    CoreDumps   `json:"core,omitempty"`
+	Shell   bool        `json:"shell,omitempty"`
+
+	// Signal requests
+	Signal int `json:"signal,omitempty"`
+
+	// Replies and exit notifications
+	Pid    int    `json:"pid,omitempty"`
+	Status uint32 `json:"status,omitempty"`
+	Utime  int64  `json:"utime,omitempty"` // nanoseconds
+	Stime  int64  `json:"stime,omitempty"` // nanoseconds
+	Maxrss int64  `json:"maxrss,omitempty"`
+	Done   bool   `json:"done,omitempty"` // the process had already exited
+	Errno  int    `json:"errno,omitempty"`
+	Err    string `json:"err,omitempty"`
+
+	// exit receives the exit of a spawned process; set by readLoop on
+	// successful spawn replies.
+	exit chan brokerMsg
+}
+
+// Broker messages.
+const (
+	brokerSpawn  = "spawn"
+	brokerSignal = "signal"
+	brokerReply  = "reply"
+	brokerExit   = "exit"
+)
+
+// error returns the error carried by m, if any.
+func (m *brokerMsg) error() error {
+	switch {
+	case m.Errno != 0:
+		return syscall.Errno(m.Errno)
+	case m.Err != "":
+		return errors.New(m.Err)
+	}
+	return nil
+}
+
+// StartBroker starts a spawn broker by running the current executable
+// again. Main recognizes this and runs the broker instead of the rest of
+// the program's main function, so the program must call Main, and should
+// call StartBroker early, while the program is still small.
+//
+// Close should be called to stop the broker once it is no longer needed.
+func StartBroker() (*Broker, error) {
+	exe, err := helperExecutable()
+	if err != nil {
+		return nil, fmt.Errorf("spawnexec: starting broker: %w", err)
+	}
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socketpair", err)
+	}
+	unix.CloseOnExec(fds[0])
+	unix.CloseOnExec(fds[1])
+	parent := os.NewFile(uintptr(fds[0]), "broker")
+	child := os.NewFile(uintptr(fds[1]), "broker")
+	defer parent.Close()
+
+	cmd := Command(exe)
+	cmd.Env = append(os.Environ(), brokerEnv+"=3")
+	cmd.ExtraFiles = []*os.File{child}
+	cmd.Stderr = os.Stderr
+	err = cmd.Start()
+	child.Close()
+	if err != nil {
+		return nil, fmt.Errorf("spawnexec: starting broker: %w", err)
+	}
+
+	c, err := net.FileConn(parent)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("spawnexec: starting broker: %w", err)
+	}
+	b := &Broker{
+		conn:    c.(*net.UnixConn),
+		cmd:     cmd,
+		replies: make(map[uint64]chan brokerMsg),
+		exits:   make(map[int]chan brokerMsg),
+	}
+	go b.readLoop()
+	return b, nil
+}
+
+// Close stops the broker and waits for it to exit. Commands it spawned
+// keep running, but can no longer be waited for.
+func (b *Broker) Close() error {
+	b.conn.Close()
+	b.cmd.Wait()
+	return nil
+}
+
+// spawn asks the broker to spawn a command, passing it files as its
+// descriptors 0, 1, 2 and so on; nil entries are left closed, or connected
+// to the null device for standard I/O. It returns the pid and a channel
+// that receives the process's exit.
+func (b *Broker) spawn(req brokerMsg, files []*os.File) (int, chan brokerMsg, error) {
+	req.Op = brokerSpawn
+	req.Files = make([]bool, len(files))
+	var sent []*os.File
+	for i, f := range files {
+		if f != nil {
+			req.Files[i] = true
+			sent = append(sent, f)
+		}
+	}
+	if len(sent) > maxBrokerFiles {
+		return 0, nil, errors.New("spawnexec: too many files for broker")
+	}
+	reply, err := b.request(req, sent)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := reply.error(); err != nil {
+		return 0, nil, err
+	}
+	return reply.Pid, reply.exit, nil
+}
+
+// signal asks the broker to signal the process pid that it spawned.
+func (b *Broker) signal(pid int, sig syscall.Signal) error {
+	reply, err := b.request(brokerMsg{Op: brokerSignal, Pid: pid, Signal: int(sig)}, nil)
+	if err != nil {
+		return err
+	}
+	if reply.Done {
+		return os.ErrProcessDone
+	}
+	return reply.error()
+}
+
+// request sends req to the broker and waits for the reply.
+func (b *Broker) request(req brokerMsg, files []*os.File) (brokerMsg, error) {
+	ch := make(chan brokerMsg, 1)
+	b.mu.Lock()
+	if b.err != nil {
+		b.mu.Unlock()
+		return brokerMsg{}, b.err
+	}
+	b.nextID++
+	req.ID = b.nextID
+	b.replies[req.ID] = ch
+	b.mu.Unlock()
+
+	b.wmu.Lock()
+	err := writeBrokerMsg(b.conn, &req, files)
+	b.wmu.Unlock()
+	if err != nil {
+		b.mu.Lock()
+		delete(b.replies, req.ID)
+		b.mu.Unlock()
+		return brokerMsg{}, fmt.Errorf("spawnexec: broker: %w", err)
+	}
+	return <-ch, nil
+}
+
+// readLoop delivers replies and exit notifications from the broker until
+// the connection is lost.
+func (b *Broker) readLoop() {
+	for {
+		msg, files, err := readBrokerMsg(b.conn)
+		for _, f := range files {
+			f.Close()
+		}
+		if err != nil {
+			b.fail()
+			return
+		}
+
+		b.mu.Lock()
+		switch msg.Op {
+		case brokerReply:
+			if msg.Pid != 0 {
+				msg.exit = make(chan brokerMsg, 1)
+				b.exits[msg.Pid] = msg.exit
+			}
+			if ch, ok := b.replies[msg.ID]; ok {
+				delete(b.replies, msg.ID)
+				ch <- msg
+			}
+		case brokerExit:
+			if ch, ok := b.exits[msg.Pid]; ok {
+				delete(b.exits, msg.Pid)
+				ch <- msg
+			}
+		}
+		b.mu.Unlock()
+		if msg.Op == brokerExit {
+			// Brokered commands raise no SIGCHLD here; wake WaitAny.
+			reaper.mu.Lock()
+			notifyExitWaiters()
+			reaper.mu.Unlock()
+		}
+	}
+}
+
+// fail fails all outstanding requests and waits once the connection to the
+// broker is lost.
+func (b *Broker) fail() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.err = errors.New("spawnexec: broker exited")
+	lost := brokerMsg{Err: b.err.Error()}
+	for id, ch := range b.replies {
+		delete(b.replies, id)
+		ch <- lost
+	}
+	for pid, ch := range b.exits {
+		delete(b.exits, pid)
+		ch <- lost
+	}
+}
+
+// checkBrokeredSysProcAttr refuses the fields of c.SysProcAttr that a
+// Broker cannot apply, rather than have the command started without them.
+// Only Setpgid, Pgid and Setsid are passed on; the controlling terminal
+// fields name descriptors of the calling process.
+func (c *Cmd) checkBrokeredSysProcAttr() error {
+	attr := c.SysProcAttr
+	if attr == nil {
+		return nil
+	}
+	if attr.Setctty || attr.Noctty || attr.Foreground {
+		return errors.New("exec: Setctty, Noctty and Foreground cannot be passed to a Broker")
+	}
+	if attr.Chroot != "" {
+		return errors.New("exec: Chroot cannot be passed to a Broker")
+	}
+	if attr.UidMappings != nil || attr.GidMappings != nil {
+		return errors.New("exec: UidMappings and GidMappings cannot be passed to a Broker")
+	}
+	if attr.UseCgroupFD || attr.CgroupPath != "" {
+		return errors.New("exec: cgroups cannot be passed to a Broker")
+	}
+	return nil
+}
+
+// startBrokered starts c through c.Broker.
+func (c *Cmd) startBrokered() error {
+	if _, err := c.openFiles(); err != nil {
+		return err
+	}
+	if c.BeforeResume != nil {
+		return errors.New("exec: BeforeResume cannot be used with a Broker")
+	}
+	if c.DarwinAttr != nil && len(c.DarwinAttr.ExceptionPorts) > 0 {
+		return errors.New("exec: ExceptionPorts cannot be passed to a Broker")
+	}
+	if c.DarwinAttr != nil && c.DarwinAttr.SpawnAttr != nil {
+		return errors.New("exec: SpawnAttr cannot be passed to a Broker")
+	}
+	if c.DirFD != nil {
+		return errors.New("exec: DirFD cannot be passed to a Broker")
+	}
+	if c.ExecFD != nil {
+		return errors.New("exec: ExecFD cannot be passed to a Broker")
+	}
+	if c.Pinned != nil {
+		return errors.New("exec: Pinned cannot be passed to a Broker")
+	}
+	if err := c.checkBrokeredSysProcAttr(); err != nil {
+		return err
+	}
+	env := c.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	req := brokerMsg{Path: c.Path, Args: c.Args, Env: env, Dir: c.Dir, Opens: c.OpenFiles}
+	req.Paths = [3]string{c.StdinPath, c.StdoutPath, c.StderrPath}
+	req.OutFlag, req.OutPerm = c.OutputFlag, uint32(c.OutputPerm)
+	req.Darwin, req.BG, req.Core, req.Shell = c.DarwinAttr, c.Background, c.CoreDumps, c.ShellFallback
+	if attr := c.SysProcAttr; attr != nil {
+		req.Setpgid, req.Pgid, req.Setsid = attr.Setpgid, attr.Pgid, attr.Setsid
+	}
+
+	extraFiles, err := c.extraFiles()
+	if err != nil {
+		return err
+	}
+	files := make([]*os.File, 3, 3+len(extraFiles))
+	switch r := c.Stdin.(type) {
+	case nil:
+	case *os.File:
+		files[0] = r
+	default:
+		pr, pw, err := inputPipe()
+		if err != nil {
+			return err
+		}
+		c.childIOFiles = append(c.childIOFiles, pr)
+		c.copyInput(pw)
+		files[0] = pr
+	}
+	output := func(w io.Writer, fd int) (*os.File, error) {
+		switch w := w.(type) {
+		case nil:
+			return nil, nil
+		case *os.File:
+			return w, nil
+		}
+		pr, pw, err := outputPipe()
+		if err != nil {
+			return nil, err
+		}
+		c.childIOFiles = append(c.childIOFiles, pw)
+		c.copyOutput(pr, w, fd)
+		return pw, nil
+	}
+	if files[1], err = output(c.Stdout, 1); err != nil {
+		c.closeStartFiles()
+		return err
+	}
+	if c.Stderr == c.Stdout {
+		files[2] = files[1]
+	} else if files[2], err = output(c.Stderr, 2); err != nil {
+		c.closeStartFiles()
+		return err
+	}
+	files = append(files, extraFiles...)
+
+	wd, err := c.startWatchdog()
+	if err != nil {
+		c.closeStartFiles()
+		return err
+	}
+	c.timing.Marshaled = time.Now()
+	pid, exit, err := c.Broker.spawn(req, files)
+	c.timing.Spawned = time.Now()
+	if err != nil {
+		path, _ := execPath(c.Dir, c.Path)
+		err := &Error{Name: c.Path, Path: path, Err: err}
+		c.logSpawned(err)
+		wd.stop()
+		c.closeStartFiles()
+		return err
+	}
+	for _, f := range c.childIOFiles {
+		f.Close()
+	}
+	c.childIOFiles = nil
+
+	c.Process = &Process{Pid: pid, start: time.Now(), broker: c.Broker, brokerExit: exit, watchdog: wd}
+	wd.watch(pid)
+	c.logSpawned(nil)
+	c.startGoroutines()
+	if c.ctx != nil {
+		c.watchContext()
+	}
+	return nil
+}
+
+// brokeredState returns the ProcessState reported by an exit notification
+// from the broker.
+func brokeredState(msg brokerMsg, start time.Time) *ProcessState {
+	return &ProcessState{
+		pid:    msg.Pid,
+		status: unix.WaitStatus(msg.Status),
+		rusage: &unix.Rusage{
+			Utime:  unix.NsecToTimeval(msg.Utime),
+			Stime:  unix.NsecToTimeval(msg.Stime),
+			Maxrss: msg.Maxrss,
+		},
+		start: start,
+		end:   time.Now(),
+	}
+}
+
+// writeBrokerMsg writes msg to conn as a length-prefixed JSON frame, with
+// files attached to it.
+func writeBrokerMsg(conn *net.UnixConn, msg *brokerMsg, files []*os.File) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	frame := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(payload)), uint32(len(payload)))
+	frame = append(frame, payload...)
+
+	var oob []byte
+	if len(files) > 0 {
+		fds := make([]int, len(files))
+		for i, f := range files {
+			fds[i] = int(f.Fd())
+		}
+		oob = unix.UnixRights(fds...)
+	}
+	n, _, err := conn.WriteMsgUnix(frame, oob, nil)
+	if err != nil {
+		return err
+	}
+	// The descriptors went with the first part of the frame.
+	_, err = conn.Write(frame[n:])
+	return err
+}
+
+// readBrokerMsg reads a frame written by writeBrokerMsg from conn.
+func readBrokerMsg(conn *net.UnixConn) (brokerMsg, []*os.File, error) {
+	var msg brokerMsg
+	var hdr [4]byte
+	oob := make([]byte, unix.CmsgSpace(maxBrokerFiles*4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(hdr[:], oob)
+	if err != nil {
+		return msg, nil, err
+	}
+	if n == 0 {
+		return msg, nil, io.EOF
+	}
+
+	var files []*os.File
+	if oobn > 0 {
+		scms, err := unix.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return msg, nil, err
+		}
+		for _, scm := range scms {
+			fds, err := unix.ParseUnixRights(&scm)
+			if err != nil {
+				continue
+			}
+			for _, fd := range fds {
+				unix.CloseOnExec(fd)
+				files = append(files, os.NewFile(uintptr(fd), "broker-fd"))
+			}
+		}
+	}
+
+	if _, err := io.ReadFull(conn, hdr[n:]); err != nil {
+		return msg, files, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(hdr[:]))
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return msg, files, err
+	}
+	return msg, files, json.Unmarshal(payload, &msg)
+}
+
+// brokerServer is the broker side of a Broker.
+type brokerServer struct {
+	conn *net.UnixConn
+	wmu  sync.Mutex
+
+	mu    sync.Mutex
+	procs map[int]*Process
+}
+
+// serveBroker runs a spawn broker on the socket with descriptor fd until
+// the connection to its parent is closed, and returns the exit code.
+func serveBroker(fd string) int {
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "spawnexec: bad %s %q\n", brokerEnv, fd)
+		return 2
+	}
+	f := os.NewFile(uintptr(n), "broker")
+	c, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "spawnexec: broker: %v\n", err)
+		return 2
+	}
+	s := &brokerServer{conn: c.(*net.UnixConn), procs: make(map[int]*Process)}
+	for {
+		msg, files, err := readBrokerMsg(s.conn)
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return 0
+		}
+		switch msg.Op {
+		case brokerSpawn:
+			s.spawn(msg, files)
+		case brokerSignal:
+			s.signal(msg)
+		}
+	}
+}
+
+// spawn handles a spawn request.
+func (s *brokerServer) spawn(req brokerMsg, files []*os.File) {
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	// Match the files that were sent up with the descriptors they are for.
+	fdFiles := make([]*os.File, len(req.Files))
+	next := 0
+	for i, sent := range req.Files {
+		if sent && next < len(files) {
+			fdFiles[i] = files[next]
+			next++
+		}
+	}
+	for len(fdFiles) < 3 {
+		fdFiles = append(fdFiles, nil)
+	}
+
+	cmd := &Cmd{Path: req.Path, Args: req.Args, Env: req.Env, Dir: req.Dir, OpenFiles: req.Opens}
+	cmd.StdinPath, cmd.StdoutPath, cmd.StderrPath = req.Paths[0], req.Paths[1], req.Paths[2]
+	cmd.OutputFlag, cmd.OutputPerm = req.OutFlag, os.FileMode(req.OutPerm)
+	cmd.DarwinAttr = req.Darwin
+	cmd.Background = req.BG
+	cmd.CoreDumps = req.Core
+	cmd.ShellFallback = req.Shell
+	// Avoid storing typed nil pointers in the interfaces.
+	if fdFiles[0] != nil {
+		cmd.Stdin = fdFiles[0]
+	}
+	if fdFiles[1] != nil {
+		cmd.Stdout = fdFiles[1]
+	}
+	if fdFiles[2] != nil {
+		cmd.Stderr = fdFiles[2]
+	}
+	cmd.ExtraFiles = fdFiles[3:]
+	if req.Setpgid || req.Setsid {
+		cmd.SysProcAttr = &SysProcAttr{Setpgid: req.Setpgid, Pgid: req.Pgid, Setsid: req.Setsid}
+	}
+
+	reply := brokerMsg{ID: req.ID, Op: brokerReply}
+	if err := cmd.Start(); err != nil {
+		var errno syscall.Errno
+		if errors.As(err, &errno) {
+			reply.Errno = int(errno)
+		} else {
+			reply.Err = err.Error()
+		}
+		s.send(&reply)
+		return
+	}
+	pid := cmd.Process.Pid
+	s.mu.Lock()
+	s.procs[pid] = cmd.Process
+	s.mu.Unlock()
+	reply.Pid = pid
+	s.send(&reply)
+
+	go func() {
+		cmd.Wait()
+		s.mu.Lock()
+		delete(s.procs, pid)
+		s.mu.Unlock()
+		exit := brokerMsg{Op: brokerExit, Pid: pid}
+		if ps := cmd.ProcessState; ps != nil {
+			exit.Status = uint32(ps.Sys().(unix.WaitStatus))
+			exit.Utime = int64(ps.UserTime())
+			exit.Stime = int64(ps.SystemTime())
+			if ru, ok := ps.SysUsage().(*unix.Rusage); ok && ru != nil {
+				exit.Maxrss = int64(ru.Maxrss)
+			}
+		}
+		s.send(&exit)
+	}()
+}
+
+// signal handles a signal request.
+func (s *brokerServer) signal(req brokerMsg) {
+	reply := brokerMsg{ID: req.ID, Op: brokerReply}
+	s.mu.Lock()
+	p := s.procs[req.Pid]
+	s.mu.Unlock()
+	if p == nil {
+		reply.Done = true
+	} else if err := p.Signal(syscall.Signal(req.Signal)); errors.Is(err, os.ErrProcessDone) {
+		reply.Done = true
+	} else if err != nil {
+		reply.Err = err.Error()
+	}
+	s.send(&reply)
+}
+
+// send writes msg to the broker's parent.
+func (s *brokerServer) send(msg *brokerMsg) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	writeBrokerMsg(s.conn, msg, nil)
+}
@@ -0,0 +1,36 @@
+//go:build linux
+
+package spawnexec
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+
+	"golang.org/x/sys/unix"
+)
+
+// setCgroup has osCmd create its child in the cgroup given by
+// c.SysProcAttr. If the cgroup is given by path, it returns the opened
+// directory, which the caller closes once the child has started.
+func (c *Cmd) setCgroup(osCmd *exec.Cmd) (*os.File, error) {
+	attr := c.SysProcAttr
+	if attr == nil || (!attr.UseCgroupFD && attr.CgroupPath == "") {
+		return nil, nil
+	}
+	if attr.UseCgroupFD && attr.CgroupPath != "" {
+		return nil, errors.New("exec: both CgroupFD and CgroupPath set")
+	}
+	if attr.UseCgroupFD {
+		osCmd.SysProcAttr.UseCgroupFD = true
+		osCmd.SysProcAttr.CgroupFD = attr.CgroupFD
+		return nil, nil
+	}
+	dir, err := os.OpenFile(attr.CgroupPath, unix.O_DIRECTORY|unix.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	osCmd.SysProcAttr.UseCgroupFD = true
+	osCmd.SysProcAttr.CgroupFD = int(dir.Fd())
+	return dir, nil
+}
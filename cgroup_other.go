@@ -0,0 +1,18 @@
+//go:build !linux
+
+package spawnexec
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// setCgroup reports an error if c.SysProcAttr asks for a cgroup: they are
+// only supported on Linux.
+func (c *Cmd) setCgroup(osCmd *exec.Cmd) (*os.File, error) {
+	if attr := c.SysProcAttr; attr != nil && (attr.UseCgroupFD || attr.CgroupPath != "") {
+		return nil, errors.New("exec: cgroups are only supported on Linux")
+	}
+	return nil, nil
+}
@@ -0,0 +1,50 @@
+package spawnexec
+
+import "os"
+
+// Children returns the pids of the running child processes of p. Unlike
+// signaling the process group, this finds children that have moved to a
+// group or session of their own, so supervisors can report and clean up
+// the processes a command leaves behind.
+//
+// It returns os.ErrProcessDone if p has already been reaped: its children
+// have then been reparented and are no longer its own.
+func (p *Process) Children() ([]int, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.released || p.Pid <= 0 {
+		return nil, os.ErrInvalid
+	}
+	if p.state != nil {
+		return nil, os.ErrProcessDone
+	}
+	return listChildren(p.Pid)
+}
+
+// Descendants returns the pids of the running child processes of p, their
+// children, and so on, parents before their children. The process tree is
+// read one process at a time, so processes that start or exit meanwhile
+// may be missed.
+func (p *Process) Descendants() ([]int, error) {
+	pids, err := p.Children()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[int]bool, len(pids))
+	for _, pid := range pids {
+		seen[pid] = true
+	}
+	for i := 0; i < len(pids); i++ {
+		children, err := listChildren(pids[i])
+		if err != nil {
+			continue // exited meanwhile
+		}
+		for _, pid := range children {
+			if !seen[pid] {
+				seen[pid] = true
+				pids = append(pids, pid)
+			}
+		}
+	}
+	return pids, nil
+}
@@ -0,0 +1,44 @@
+//go:build darwin
+
+package spawnexec
+
+/*
+#include <errno.h>
+#include <libproc.h>
+
+// list_child_pids stores up to n of the pids of pid's children in buf and
+// returns how many it stored, or -1 with errno set.
+static int list_child_pids(pid_t pid, pid_t *buf, int n) {
+    int bytes = proc_listpids(PROC_PPID_ONLY, (uint32_t)pid, buf, n * (int)sizeof(pid_t));
+    if (bytes < 0) {
+        return -1;
+    }
+    return bytes / (int)sizeof(pid_t);
+}
+*/
+import "C"
+import "os"
+
+// listChildren returns the pids of the children of pid, using
+// proc_listpids(PROC_PPID_ONLY), on which proc_listchildpids is built.
+func listChildren(pid int) ([]int, error) {
+	n := 64
+	for {
+		buf := make([]C.pid_t, n)
+		got, err := C.list_child_pids(C.pid_t(pid), &buf[0], C.int(n))
+		if got < 0 {
+			return nil, os.NewSyscallError("proc_listpids", err)
+		}
+		if int(got) < n {
+			pids := make([]int, 0, got)
+			for _, child := range buf[:got] {
+				if child != 0 {
+					pids = append(pids, int(child))
+				}
+			}
+			return pids, nil
+		}
+		// The buffer may have been too small.
+		n *= 2
+	}
+}
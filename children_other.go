@@ -0,0 +1,50 @@
+//go:build !darwin
+
+package spawnexec
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+)
+
+// listChildren returns the pids of the children of pid by reading the
+// parent pid of every process from /proc, which works whether or not the
+// kernel provides /proc/<pid>/task/<tid>/children.
+func listChildren(pid int) ([]int, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, e := range entries {
+		child, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := os.ReadFile("/proc/" + e.Name() + "/stat")
+		if err != nil {
+			continue // exited meanwhile
+		}
+		if ppid, ok := statPpid(stat); ok && ppid == pid {
+			pids = append(pids, child)
+		}
+	}
+	return pids, nil
+}
+
+// statPpid returns the parent pid from the contents of /proc/<pid>/stat,
+// which reads "pid (comm) state ppid ...". The command name may itself
+// contain spaces and parentheses, so parsing starts after its last ')'.
+func statPpid(stat []byte) (int, bool) {
+	i := bytes.LastIndexByte(stat, ')')
+	if i < 0 {
+		return 0, false
+	}
+	fields := bytes.Fields(stat[i+1:])
+	if len(fields) < 2 {
+		return 0, false
+	}
+	ppid, err := strconv.Atoi(string(fields[1]))
+	return ppid, err == nil
+}
@@ -0,0 +1,102 @@
+package spawnexec
+
+import (
+	"maps"
+	"slices"
+)
+
+// Clone returns a copy of c's configuration, none of its run state, so
+// that a command can be built once as a template and a fresh copy of it
+// run each time, as a Cmd cannot be run twice.
+//
+// Args, the environment fields, ExtraFiles, FdMap and OpenFiles are
+// copied, as are the SysProcAttr, DarwinAttr, CodeSignature and Workspace
+// structures, so changing the clone does not change c. What cannot be
+// copied is shared: Stdin, Stdout and Stderr, the files, the functions,
+// Logger, Broker and CopyBufferPool; a function bound to c, such as a
+// Cancel of c.CloseStdin, still acts on c. A clone of a CommandContext
+// command has the same context.
+//
+// Start fills in some of the configuration in place, such as Env and,
+// for a Workspace, Dir, so the template itself should not be started;
+// clone it for each run instead.
+func (c *Cmd) Clone() *Cmd {
+	clone := &Cmd{
+		Path:             c.Path,
+		Args:             slices.Clone(c.Args),
+		RedactArgs:       c.RedactArgs,
+		Env:              slices.Clone(c.Env),
+		EnvOverrides:     maps.Clone(c.EnvOverrides),
+		EnvRemove:        slices.Clone(c.EnvRemove),
+		Dir:              c.Dir,
+		DirFD:            c.DirFD,
+		ExecFD:           c.ExecFD,
+		Pinned:           c.Pinned,
+		Stdin:            c.Stdin,
+		Stdout:           c.Stdout,
+		Stderr:           c.Stderr,
+		InheritStdio:     c.InheritStdio,
+		OnStdoutLine:     c.OnStdoutLine,
+		OnStderrLine:     c.OnStderrLine,
+		PeekSize:         c.PeekSize,
+		CopyBufferSize:   c.CopyBufferSize,
+		CopyBufferPool:   c.CopyBufferPool,
+		IgnoreBrokenPipe: c.IgnoreBrokenPipe,
+		StdinPath:        c.StdinPath,
+		StdoutPath:       c.StdoutPath,
+		StderrPath:       c.StderrPath,
+		OutputFlag:       c.OutputFlag,
+		OutputPerm:       c.OutputPerm,
+		ExtraFiles:       slices.Clone(c.ExtraFiles),
+		FdMap:            maps.Clone(c.FdMap),
+		OpenFiles:        slices.Clone(c.OpenFiles),
+		BeforeResume:     c.BeforeResume,
+		DotPolicy:        c.DotPolicy,
+		Translocation:    c.Translocation,
+		ExpectedSHA256:   c.ExpectedSHA256,
+		Verify:           c.Verify,
+		Logger:           c.Logger,
+		Background:       c.Background,
+		CoreDumps:        c.CoreDumps,
+		ShellFallback:    c.ShellFallback,
+		KillOnParentExit: c.KillOnParentExit,
+		Cancel:           c.Cancel,
+		WaitDelay:        c.WaitDelay,
+		StartTimeout:     c.StartTimeout,
+		SingleInstance:   c.SingleInstance,
+		Broker:           c.Broker,
+
+		ctx:         c.ctx,
+		lookPathErr: c.lookPathErr,
+		prepared:    c.prepared,
+	}
+	// Those set up by Output and the pipe methods belong to c's run.
+	if c.ownStdio[0] {
+		clone.Stdin = nil
+	}
+	if c.ownStdio[1] {
+		clone.Stdout = nil
+	}
+	if c.ownStdio[2] {
+		clone.Stderr = nil
+	}
+	if ws := c.Workspace; ws != nil {
+		clone.Workspace = &Workspace{Parent: ws.Parent, Pattern: ws.Pattern, PreserveOnFailure: ws.PreserveOnFailure}
+	}
+	if attr := c.SysProcAttr; attr != nil {
+		a := *attr
+		a.UidMappings = slices.Clone(attr.UidMappings)
+		a.GidMappings = slices.Clone(attr.GidMappings)
+		clone.SysProcAttr = &a
+	}
+	if attr := c.DarwinAttr; attr != nil {
+		a := *attr
+		a.ExceptionPorts = slices.Clone(attr.ExceptionPorts)
+		clone.DarwinAttr = &a
+	}
+	if cs := c.CodeSignature; cs != nil {
+		s := *cs
+		clone.CodeSignature = &s
+	}
+	return clone
+}
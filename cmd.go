@@ -8,12 +8,26 @@ package spawnexec
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"errors"
+	"fmt"
 	"io"
+	"log/slog"
+	"maps"
+	"net"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
 )
 
 // Cmd represents an external command being prepared or run.
@@ -26,6 +40,11 @@ type Cmd struct {
 	// This is the only field that must be set to a non-zero
 	// value. If Path is relative, it is evaluated relative
 	// to Dir.
+	//
+	// As with os/exec, a relative Dir is in turn relative to the calling
+	// process's current directory when the command is started, and a
+	// relative Path is not cleaned, so that ".." is resolved after any
+	// symbolic link it follows, as the kernel resolves it in the child.
 	Path string
 
 	// Args holds command line arguments, including the command as Args[0].
@@ -34,6 +53,14 @@ type Cmd struct {
 	// In typical use, both Path and Args are set by calling Command.
 	Args []string
 
+	// RedactArgs, if non-nil, keeps secrets such as passwords and tokens
+	// passed as arguments out of String, StringEnv and the errors
+	// returned by Start. It is called with the index in Args of each
+	// argument and the argument, Path standing in for Args[0], and returns
+	// what to show in its place; a replacement is shown without quoting.
+	// RedactIndices returns one that hides given arguments entirely.
+	RedactArgs func(i int, arg string) string
+
 	// Env specifies the environment of the process.
 	// Each entry is of the form "key=value".
 	// If Env is nil, the new process uses the current process's
@@ -42,21 +69,77 @@ type Cmd struct {
 	// value in the slice for each duplicate key is used.
 	Env []string
 
+	// EnvOverrides and EnvRemove adjust the environment given by Env, or
+	// inherited if Env is nil, without it having to be copied and edited:
+	// the variables named in EnvRemove are removed, and then those in
+	// EnvOverrides are set, replacing any already set. Start sets Env to
+	// the result; Environ returns it.
+	EnvOverrides map[string]string
+	EnvRemove    []string
+
 	// Dir specifies the working directory of the command.
 	// If Dir is the empty string, Run runs the command in the
 	// calling process's current directory.
 	//
 	// Note: On macOS, posix_spawn does not natively support setting
 	// the working directory. This implementation uses posix_spawn_file_actions_addchdir_np
-	// which is available on macOS 10.15+.
+	// which is available on macOS 10.15+. On older versions, the current
+	// executable is spawned as a trampoline that changes to Dir and then
+	// executes the command, for which the program must call Main.
 	Dir string
 
+	// DirFD, if non-nil, is an open directory to use as the working
+	// directory of the command instead of Dir, which must then be empty.
+	// The command changes to the directory DirFD refers to, wherever it
+	// has been moved, so that nothing can replace it between the caller
+	// checking it and the command starting in it. Path must then be
+	// absolute, and DirFD must stay open until Start returns.
+	//
+	// DirFD is supported on Linux, and on macOS 10.15 and later with
+	// posix_spawn. On Linux the command changes directory through the
+	// link in /proc/self/fd to DirFD, so /proc must be mounted; otherwise
+	// Start fails with the chdir error. It cannot be combined with
+	// a Chroot or a Broker.
+	DirFD *os.File
+
+	// ExecFD, if non-nil, is an open executable to run instead of the file
+	// at Path, such as one that has been checked, a sealed memfd, or one
+	// received over a socket, so that nothing can replace the file between
+	// the caller opening it and the command executing it. Path then only
+	// names the command, for String and errors, and ExpectedSHA256 and
+	// Verify check the contents of ExecFD. ExecFD must stay open until
+	// Start returns.
+	//
+	// ExecFD is made close-on-exec in the new process, so a script with a
+	// #! line run from it fails with ENOENT, as its interpreter cannot
+	// open it. ExecFD is only supported on Linux; the command is started
+	// as a trampoline that executes it with execveat, so the program must
+	// call Main. ExpectedSHA256, Verify and ShellFallback read ExecFD
+	// through /proc/self/fd, so need /proc to be mounted.
+	// It cannot be combined with a Chroot or a Broker.
+	ExecFD *os.File
+
+	// Pinned, if non-nil, is the executable, found by LookPathPinned, that
+	// Path names, to run in place of whatever Path names when the command
+	// starts: on Linux, Pinned's open file is run as ExecFD is, which must
+	// then be nil; elsewhere, Start checks just before spawning that Path
+	// still names the same file, by device and inode, and otherwise fails
+	// with an *Error wrapping ErrExecutableChanged. Pinned cannot be
+	// combined with a Broker.
+	Pinned *PinnedExecutable
+
+	// Workspace, if non-nil, gives the command a private temporary
+	// directory, removed by Wait, which Start sets as TMPDIR in Env and
+	// as Dir if Dir is empty.
+	Workspace *Workspace
+
 	// Stdin specifies the process's standard input.
 	//
 	// If Stdin is nil, the process reads from the null device (os.DevNull).
 	//
 	// If Stdin is an *os.File, the process's standard input is connected
-	// directly to that file.
+	// directly to that file. So is a syscall.Conn, such as a network
+	// connection, as described for Stdout.
 	//
 	// Otherwise, during the execution of the command a separate
 	// goroutine reads from Stdin and delivers that data to the command
@@ -72,7 +155,10 @@ type Cmd struct {
 	// to the null device (os.DevNull).
 	//
 	// If either is an *os.File, the corresponding output from the process
-	// is connected directly to that file.
+	// is connected directly to that file. So is a syscall.Conn, such as a
+	// *net.TCPConn or *net.UnixConn: its descriptor is duplicated into the
+	// process. The connection is put in blocking mode for the process's
+	// sake, so reads and writes by the parent on it each tie up a thread.
 	//
 	// Otherwise, during the execution of the command a separate goroutine
 	// reads from the process over a pipe and delivers that data to the
@@ -85,24 +171,259 @@ type Cmd struct {
 	Stdout io.Writer
 	Stderr io.Writer
 
+	// InheritStdio connects those of Stdin, Stdout and Stderr that are nil
+	// to the parent's own standard input, output and error instead of the
+	// null device, for interactive commands whose I/O is passed through.
+	// Streams redirected by StdinPath, StdoutPath or StderrPath are left
+	// alone.
+	InheritStdio bool
+
+	// OnStdoutLine and OnStderrLine, if non-nil, are called with each line
+	// the process writes to its standard output or error, without the
+	// trailing newline or carriage return, from the goroutine copying that
+	// output. The output is still delivered to Stdout or Stderr as well;
+	// neither can be combined with StdoutPath, StderrPath or the *Pipe
+	// methods. A final line not terminated by a newline is passed once the
+	// output is exhausted, before Wait returns. Overlong lines are split
+	// as by LineWriter. If Stdout and Stderr are the same writer, the two
+	// streams are combined, and each callback set is passed every line.
+	OnStdoutLine func(line string)
+	OnStderrLine func(line string)
+
+	// PeekSize, if positive, is how many of the last bytes of each of
+	// the command's output streams are retained while it runs, for Peek,
+	// combined if Stdout and Stderr are the same writer.
+	// Output going to a file, such as a terminal, is then copied to it
+	// through a pipe, so the command no longer writes to the file itself.
+	PeekSize int
+
+	// CopyBufferSize is the size of the buffers with which the input and
+	// output of the command are copied to and from Stdin, Stdout and
+	// Stderr by goroutines, for larger buffers for high-throughput
+	// commands or smaller ones to save memory. If it is zero, io.Copy's
+	// default of 32 KiB is used. It does not apply to output to the
+	// buffers of Output and CombinedOutput, which are served by a single
+	// shared goroutine.
+	CopyBufferSize int
+
+	// CopyBufferPool, if set, supplies those buffers, so that they are
+	// reused across commands. Its values must be of type *[]byte; buffers
+	// are used whatever their length, and if the pool has none, a buffer
+	// of CopyBufferSize bytes is made, which is put in the pool after use.
+	CopyBufferPool *sync.Pool
+
+	// IgnoreBrokenPipe has Wait not report a broken pipe writing the
+	// command's output to Stdout or Stderr, such as to a reader that has
+	// gone away, as it already does not for Stdin once the command stops
+	// reading. The copying stops either way, and the command, as in a
+	// shell pipeline, gets SIGPIPE or EPIPE on its next write.
+	IgnoreBrokenPipe bool
+
+	// StdinPath, StdoutPath and StderrPath name files to connect to the
+	// process's standard input, output and error instead of Stdin, Stdout
+	// and Stderr, which must then be nil. The files are opened as by
+	// OpenFiles, by the new process itself where possible, so the parent
+	// holds no file handles and runs no copying goroutines for them.
+	// StdinPath is opened for reading; StdoutPath and StderrPath are
+	// opened as OutputFlag and OutputPerm say. If StdoutPath and
+	// StderrPath are equal, both outputs go to a single open file.
+	StdinPath  string
+	StdoutPath string
+	StderrPath string
+
+	// OutputFlag holds the flags StdoutPath and StderrPath are opened
+	// with, besides O_WRONLY. If it is zero, os.O_CREATE|os.O_TRUNC is
+	// used. Set it to os.O_CREATE|os.O_APPEND to have every run append to
+	// the same log, each write landing atomically at its end.
+	//
+	// If OutputFlag includes os.O_APPEND and Stdout or Stderr is an
+	// *os.File, append mode is also set on that file. This changes the
+	// file for the parent and any other process sharing it as well.
+	OutputFlag int
+
+	// OutputPerm holds the permissions, before the umask, of files
+	// created for StdoutPath and StderrPath. If it is zero, 0666 is used.
+	OutputPerm os.FileMode
+
 	// ExtraFiles specifies additional open files to be inherited by the
 	// new process. It does not include standard input, standard output, or
 	// standard error. If non-nil, entry i becomes file descriptor 3+i.
+	// As with os/exec, the files are put in blocking mode, and the
+	// descriptors are inherited whatever their close-on-exec flag.
 	ExtraFiles []*os.File
 
+	// FdMap specifies additional open files to be inherited by the new
+	// process at exact descriptor numbers: FdMap[n] becomes file
+	// descriptor n, for example for a program's --status-fd option.
+	// Descriptors must be at least 3 and must not collide with ExtraFiles.
+	// Descriptors below the highest one that are given by neither
+	// ExtraFiles nor FdMap are closed in the new process.
+	FdMap map[int]*os.File
+
+	// OpenFiles specifies files to be opened by the new process itself,
+	// without the parent opening them at all. They are opened after all
+	// other descriptors are set up, and take precedence over them. A
+	// relative Path is relative to Dir.
+	//
+	// On darwin the files are opened with posix_spawn file actions, and
+	// Start fails if one cannot be opened. Elsewhere the parent opens them
+	// when the command is started and closes them once it has.
+	OpenFiles []OpenFile
+
 	// SysProcAttr holds optional, operating system-specific attributes.
 	// Currently not fully supported in spawnexec.
 	SysProcAttr *SysProcAttr
 
+	// DarwinAttr holds darwin-specific attributes of the new process. It
+	// is ignored on other platforms.
+	DarwinAttr *DarwinAttr
+
+	// BeforeResume, if non-nil, is called by Start with the pid of the new
+	// process once it exists but before it runs any of the command's code,
+	// so that the pid can be registered with monitoring, have probes
+	// attached or task policies set without racing the command. The
+	// process is resumed once BeforeResume returns. If it returns an
+	// error, the process is killed and waited for instead, and Start
+	// returns the error.
+	//
+	// On darwin the process is spawned with POSIX_SPAWN_START_SUSPENDED.
+	// On Linux it is spawned as a trampoline, the current executable run
+	// again, that stops itself before executing the command, so the
+	// program must call Main. It is not supported elsewhere, nor with a
+	// Broker.
+	BeforeResume func(pid int) error
+
+	// DotPolicy says whether the command may start if Command resolved
+	// its name through PATH to an executable relative to the current
+	// directory. If it is zero, the package's policy applies; see
+	// SetDotPolicy.
+	DotPolicy DotPolicy
+
+	// Translocation says what Start does if the executable is in an app
+	// bundle that macOS has translocated. By default, the executable is
+	// run from the bundle's original location, and Start updates Path
+	// accordingly.
+	Translocation TranslocationPolicy
+
+	// ExpectedSHA256, if set, is the hex-encoded SHA-256 digest the
+	// executable must have: Start hashes the file Path resolves to and
+	// fails with a *ChecksumError if it differs, so that only known-good
+	// versions of a tool are run.
+	ExpectedSHA256 string
+
+	// CodeSignature, if non-nil, makes Start check the code signature of
+	// the executable before running it, and fail with a *SignatureError
+	// if it is not valid or does not satisfy CodeSignature. Code
+	// signatures are only checked on darwin; elsewhere Start fails.
+	CodeSignature *CodeSignature
+
+	// Verify, if non-nil, is called by Start with the path of the
+	// executable before it is run, after ExpectedSHA256 and CodeSignature
+	// are checked. If it returns an error, Start fails with an *Error
+	// wrapping it.
+	//
+	// None of these checks can stop the file from being replaced between
+	// the check and the spawn; they are only as good as the protection of
+	// the directory holding it, unless ExecFD is set, when they check the
+	// file that is run, through its link in /proc/self/fd.
+	Verify func(path string) error
+
+	// Logger, if non-nil, is where the internals of starting and waiting
+	// for the command are logged at debug level: the resolved path, the
+	// spawn's file actions, its outcome and the new process's pid, how the
+	// process exited, and when its output has been copied. If it is nil,
+	// the package's logger set with SetLogger is used.
+	Logger *slog.Logger
+
+	// Background runs the command as a background task, as taskpolicy -b
+	// does, so that bulk maintenance work does not hurt interactive
+	// latency. On darwin the process gets the PRIO_DARWIN_BG policy,
+	// throttling its CPU and I/O, while posix_spawn holds it suspended,
+	// so that it never runs unthrottled. Elsewhere it gets the lowest CPU
+	// priority, nice 19, and on Linux the idle I/O class, right after it
+	// has started.
+	Background bool
+
+	// CoreDumps controls whether the command dumps core when it crashes,
+	// so that a crash-prone tool under investigation can leave a core
+	// without changing the calling process's limits or the system's
+	// settings. The command's RLIMIT_CORE is set by a trampoline, the
+	// current executable started in its place, which then executes it;
+	// so the program must call Main, and it cannot be combined with
+	// SysProcAttr.Chroot. Where the core is
+	// written is still up to the system; CoreFile finds it.
+	CoreDumps CoreDumps
+
+	// ShellFallback runs an executable file that the system does not
+	// recognise as a program, failing to execute it with ENOEXEC, as a
+	// script of /bin/sh, as execvp and shells do, so that legacy scripts
+	// without a "#!" line run as they do from a shell. The shell is given
+	// the file's path and Args[1:] as its arguments. The shell is
+	// started by Start once the file has failed to execute, or, if the
+	// command is started through a trampoline anyway, by the trampoline.
+	ShellFallback bool
+
+	// KillOnParentExit makes the command be killed with SIGKILL if the
+	// calling process exits, even by crashing, while the command is
+	// running and unreaped, so that it cannot outlive its parent.
+	//
+	// On Linux the command is started with PR_SET_PDEATHSIG. The kernel
+	// sends the signal when the thread that started the command exits,
+	// which the Go runtime only does for a goroutine that returns while
+	// locked to its thread with runtime.LockOSThread; it is also cleared
+	// by executing a set-user-ID or set-group-ID program.
+	//
+	// There is no PR_SET_PDEATHSIG on darwin, and a command started
+	// through a Broker is not the calling process's child, so there a
+	// watchdog process, the current executable started again, is run
+	// alongside the command and kills it when the calling process's end
+	// of a pipe to it is closed; the program must call Main. Only the
+	// command itself is killed, not processes it has started.
+	KillOnParentExit bool
+
 	// Cancel is called when the context passed to CommandContext is canceled.
 	// By default, Cancel calls the Kill method on the Process.
+	//
+	// Setting Cancel to c.CloseStdin interrupts commands that exit at the
+	// end of their input, such as filters and language servers, by
+	// closing their standard input instead of signaling them.
 	Cancel func() error
 
 	// WaitDelay is the amount of time to wait for the process to finish
-	// after the context is done and Cancel has been called.
-	// Not yet implemented in spawnexec.
+	// after the context is done and Cancel has been called. If the process
+	// is still running when it expires, it is killed. If WaitDelay is zero,
+	// the process is never killed after Cancel.
+	//
+	// WaitDelay also bounds how long Wait waits, once the process has
+	// exited, for the goroutines copying Stdin, Stdout and Stderr to finish,
+	// for example when a grandchild has inherited the pipes. When it
+	// expires the pipes are closed and Wait returns ErrWaitDelay if there
+	// was no other error.
 	WaitDelay int64
 
+	// StartTimeout, if positive, bounds how long Start may take, from
+	// resolving and checking the executable to the spawn itself, for
+	// when a hung network filesystem or a wedged broker would otherwise
+	// block it indefinitely. Start then fails with a *StartTimeoutError,
+	// and a process spawned later regardless is killed and reaped. Wait
+	// may still be called, to release the Cmd's pipes and files once the
+	// spawn has finished, which it waits for; the Cmd must not otherwise
+	// be used again.
+	StartTimeout time.Duration
+
+	// SingleInstance, if not empty, ensures that only one instance of the
+	// command runs at a time across all the processes on the machine, as
+	// periodic maintenance jobs want. It names a lock file, or if it has
+	// no slash, a lock in the system's temporary directory shared by all
+	// users. Start takes an exclusive flock(2) on the file, failing with
+	// an *Error wrapping ErrAlreadyRunning if another instance holds it,
+	// and Wait releases it; so does the calling process exiting.
+	SingleInstance string
+
+	// Broker, if non-nil, is the spawn broker through which the command
+	// is spawned. See StartBroker.
+	Broker *Broker
+
 	// Process is the underlying process, once started.
 	Process *Process
 
@@ -114,45 +435,215 @@ type Cmd struct {
 	// ctx is the context passed to CommandContext
 	ctx       context.Context
 	ctxCancel context.CancelFunc
+	ctxResult chan error    // receives the outcome of watchContext
+	waitDone  chan struct{} // closed when Wait has reaped the process
+
+	// savedCtx and savedCtxCancel are ctx and ctxCancel as they were
+	// before runContext changed them, if ctxSaved is set, for Reset to
+	// restore.
+	savedCtx       context.Context
+	savedCtxCancel context.CancelFunc
+	ctxSaved       bool
 
 	// Internal state
-	lookPathErr    error // LookPath error, if any
-	finished       bool  // true after Wait returns
-	childIOFiles   []*os.File
-	parentIOPipes  []*os.File
-	goroutine      []func() error
-	goroutineErr   []error
-	goroutineMu    sync.Mutex
-	stdinPipeUsed  bool
-	stdoutPipeUsed bool
-	stderrPipeUsed bool
-
-	// osCmd is used on non-darwin platforms to hold the underlying os/exec.Cmd
+	lookPathErr      error         // LookPath error, if any
+	finished         bool          // true after Wait returns
+	startDone        chan struct{} // closed once a Start that timed out has spawned
+	childIOFiles     []*os.File
+	parentIOPipes    []io.Closer
+	goroutine        []func() error
+	goroutineErr     chan error  // receives the result of each goroutine
+	copyPipes        []io.Closer // parent's ends of the goroutines' pipes
+	sharedCopies     []sharedCopy
+	copyStreams      []*copyStream // output being copied by sharedCopier
+	stdinPipeUsed    bool
+	stdoutPipeUsed   bool
+	stderrPipeUsed   bool
+	stdinCloser      io.Closer       // parent's end of the stdin pipe, if any
+	stdinCopyErr     chan error      // result of the fallback's stdin copier
+	lineWriters      []*LineWriter   // feeding OnStdoutLine and OnStderrLine
+	ioStats          [3]atomic.Int64 // bytes copied on descriptors 0, 1 and 2
+	instanceLock     *os.File        // the locked SingleInstance file
+	ownStdio         [3]bool         // Stdin, Stdout, Stderr set by Output or a pipe method
+	trampolineStatus *os.File        // read end of the status pipe of a trampoline
+	muxPipe          *io.PipeWriter  // writing end of the MultiplexedPipe
+	peek             [2]*ringBuffer  // the last output on Stdout and Stderr, for Peek
+
+	// prepared is the PreparedCommand c was created from, if any
+	prepared *PreparedCommand
+
+	// timing records the phases of spawning and waiting; see Timing.
+	timing SpawnTiming
+
+	// backend is the Backend c was started with, once it has been
+	backend Backend
+
+	// osCmd holds the underlying os/exec.Cmd of a command started with
+	// BackendOSExec
 	osCmd interface{}
 }
 
+// OpenFile describes a file for the new process to open; see
+// Cmd.OpenFiles.
+type OpenFile struct {
+	Fd   int         // descriptor the file is opened as
+	Path string      // file to open
+	Flag int         // flags such as os.O_WRONLY|os.O_APPEND|os.O_CREATE
+	Perm os.FileMode // permissions for a created file
+
+	dupStdout bool // Fd duplicates the new standard output; Path is unused
+}
+
+// DarwinAttr holds attributes of a new process that are specific to
+// darwin, where they are applied with posix_spawn.
+type DarwinAttr struct {
+	// SetJetsamPriority places the process in the memorystatus (jetsam)
+	// priority band JetsamPriority. Under memory pressure the kernel
+	// kills processes in lower bands first.
+	SetJetsamPriority bool
+	JetsamPriority    int
+
+	// MemoryLimit, if positive, is the memory footprint in bytes,
+	// rounded up to whole megabytes, past which the kernel kills the
+	// process, so a runaway build step dies instead of paging the whole
+	// machine.
+	//
+	// Both are set with posix_spawnattr_setjetsam_ext, which is private
+	// API; Start fails with ENOTSUP if it is unavailable.
+	MemoryLimit int64
+
+	// ResetExceptionPorts resets all of the process's task exception
+	// ports, rather than letting it inherit those of the parent, so its
+	// crashes are handled by the system's crash reporter.
+	ResetExceptionPorts bool
+
+	// ExceptionPorts sets task exception ports of the process, after any
+	// reset, so that a crash-reporting agent can intercept its crashes.
+	// The ports are Mach port names in the calling task, so they cannot
+	// be given to commands started through a Broker.
+	ExceptionPorts []ExceptionPort
+
+	// IOPolicy, if not zero, is the disk I/O policy of the process, as
+	// set with setiopolicy_np: IOPolicyThrottle or IOPolicyUtility keeps
+	// a backup or indexing child from slowing down interactive work.
+	// setiopolicy_np only applies to the calling process, so the command
+	// is started through a trampoline that sets the policy and then
+	// executes it, inheriting it.
+	IOPolicy IOPolicy
+
+	// QoSClamp, if not QoSClampNone, caps the quality of service of every
+	// thread of the process, as taskpolicy -c does, so that it is
+	// scheduled, throttled and coalesced as background work however it
+	// was written, and is not left to the heuristics of App Nap, which
+	// only a process itself can opt out of.
+	QoSClamp QoSClamp
+
+	// Mitigations opts the process into CPU security mitigations, for
+	// services that process untrusted input.
+	Mitigations Mitigations
+
+	// SpawnAttr, if non-nil, is called right before posix_spawn with a
+	// pointer to the posix_spawnattr_t prepared for the process, so that
+	// attributes this package does not model can be set on it, through
+	// cgo for example, without forking the package. It must neither
+	// destroy the attributes nor keep the pointer. If it returns an
+	// error, Start fails with it. SpawnAttr cannot be given to commands
+	// started through a Broker.
+	SpawnAttr func(attr unsafe.Pointer) error `json:"-"`
+}
+
+// ExceptionPort is a Mach exception port for a new process, as set with
+// posix_spawnattr_setexceptionports_np. See <mach/exception_types.h> for
+// the values of its fields.
+type ExceptionPort struct {
+	Mask     uint32 // exception_mask_t, such as EXC_MASK_CRASH
+	Port     uint32 // mach_port_t holding a send right, or MACH_PORT_NULL
+	Behavior int32  // exception_behavior_t, such as EXCEPTION_DEFAULT
+	Flavor   int32  // thread_state_flavor_t, such as THREAD_STATE_NONE
+}
+
 // SysProcAttr holds optional, operating system-specific attributes.
 type SysProcAttr struct {
 	// Setpgid sets the process group ID of the child to Pgid,
 	// or, if Pgid == 0, to the new child's process ID.
 	Setpgid bool
 
+	// Setsid creates a new session with the child as its leader, and as
+	// the leader of a new process group.
+	Setsid bool
+
 	// Setctty sets the controlling terminal of the child to
 	// file descriptor Ctty. Ctty must be a terminal file descriptor
-	// in the child process.
+	// in the child process. This also requires Setsid.
+	//
+	// posix_spawn cannot acquire a controlling terminal, so on darwin
+	// the child is spawned through a trampoline that does so before
+	// executing the command.
 	Setctty bool
 
-	// Noctty makes the child process not have a controlling terminal.
+	// Noctty makes the child process not have a controlling terminal,
+	// so that it is not sent SIGHUP when the terminal closes.
+	//
+	// On darwin this starts a new session, as Setsid does, since
+	// posix_spawn has no other way to leave the controlling terminal
+	// behind. It therefore cannot be combined with Setpgid or Foreground
+	// there.
 	Noctty bool
 
 	// Ctty is the controlling terminal file descriptor.
 	Ctty int
 
 	// Foreground places the child process group in the foreground.
+	// This implies Setpgid. The terminal is that given by Ctty, which
+	// is the descriptor of the terminal in the parent unless Setctty is
+	// also set.
+	//
+	// On darwin the group is put in the foreground by a trampoline, run
+	// in the child's place before the command, and the terminal is the
+	// child's controlling terminal: Ctty if Setctty is set, and otherwise
+	// the controlling terminal of the parent's session.
 	Foreground bool
 
 	// Pgid is the process group ID.
 	Pgid int
+
+	// UseCgroupFD creates the child directly in the cgroup v2 directory
+	// open as CgroupFD, rather than in the parent's cgroup, so that the
+	// limits of that cgroup apply from its first instruction. CgroupPath
+	// does the same given the directory's path, which is opened for the
+	// duration of Start. Cgroups are only supported on Linux, where the
+	// child is created with clone3(CLONE_INTO_CGROUP).
+	UseCgroupFD bool
+	CgroupFD    int
+	CgroupPath  string
+
+	// UidMappings and GidMappings, if either is set, start the child in
+	// a new user namespace, as CLONE_NEWUSER in syscall.SysProcAttr's
+	// Cloneflags does, with user and group IDs in it mapped to those
+	// outside as they say, so that an unprivileged caller can run it as
+	// root of its own sandbox. GidMappingsEnableSetgroups allows the child
+	// to call setgroups, which the kernel otherwise denies in a namespace
+	// whose group mappings were written without privilege. User
+	// namespaces are only supported on Linux.
+	UidMappings                []SysProcIDMap
+	GidMappings                []SysProcIDMap
+	GidMappingsEnableSetgroups bool
+
+	// Chroot, if not empty, changes the root directory of the child to
+	// it before the command is executed, for build-root style isolation.
+	// Path and Dir are then interpreted inside it, but Command's search
+	// of PATH is not, so Path should be absolute. Changing the root needs
+	// privilege, or root of a user namespace; it is not supported by
+	// posix_spawn on darwin.
+	Chroot string
+}
+
+// SysProcIDMap maps a range of user or group IDs in a child's user
+// namespace to the IDs outside it, as syscall.SysProcIDMap does.
+type SysProcIDMap struct {
+	ContainerID int // first ID in the namespace
+	HostID      int // first ID it maps to outside the namespace
+	Size        int // number of IDs mapped
 }
 
 // Command returns the Cmd struct to execute the named program with
@@ -174,11 +665,21 @@ func Command(name string, arg ...string) *Cmd {
 		Args: append([]string{name}, arg...),
 	}
 	if filepath.Base(name) == name {
+		cmd.timing.LookPathStart = time.Now()
 		lp, err := LookPath(name)
+		cmd.timing.LookPathEnd = time.Now()
+		if lp != "" {
+			// Keep a path found relative to the current directory, in
+			// case DotPolicy lets it run; record it as such even if the
+			// package's policy kept LookPath quiet, in case the Cmd's
+			// own policy rejects it.
+			cmd.Path = lp
+			if err == nil && !filepath.IsAbs(lp) {
+				err = &Error{Name: name, Err: ErrDot}
+			}
+		}
 		if err != nil {
 			cmd.lookPathErr = err
-		} else {
-			cmd.Path = lp
 		}
 	}
 	return cmd
@@ -205,19 +706,147 @@ func CommandContext(ctx context.Context, name string, arg ...string) *Cmd {
 // It is intended only for debugging.
 // In particular, it is not suitable for use as input to a shell.
 // The output of String may vary across Go releases.
+//
+// Arguments that are empty or hold spaces, quotes or other characters
+// special to a shell are quoted, so that the arguments can be told apart
+// in logs. The environment is not shown; see StringEnv.
 func (c *Cmd) String() string {
-	if c.lookPathErr != nil {
-		return strings.Join(c.Args, " ")
-	}
+	return c.StringEnv(EnvElided)
+}
+
+// EnvDisplay selects how StringEnv shows a command's environment.
+type EnvDisplay int
+
+const (
+	// EnvElided leaves the environment out, as String does.
+	EnvElided EnvDisplay = iota
+	// EnvHashed shows a digest of the environment, so that logs can tell
+	// whether commands ran with the same environment without revealing
+	// secrets it may hold.
+	EnvHashed
+	// EnvShown shows the environment in full, as assignments preceding
+	// the command.
+	EnvShown
+)
+
+// StringEnv is like String, but shows c's environment as d selects. An
+// environment is only shown if Env, EnvOverrides or EnvRemove is set; a
+// command that inherits the calling process's environment as it is is
+// described as by String.
+func (c *Cmd) StringEnv(d EnvDisplay) string {
 	var b strings.Builder
-	b.WriteString(c.Path)
-	for _, a := range c.Args[1:] {
+	if c.Env != nil || c.EnvOverrides != nil || c.EnvRemove != nil {
+		env := c.Environ()
+		switch d {
+		case EnvHashed:
+			h := sha256.New()
+			for _, kv := range env {
+				h.Write([]byte(kv))
+				h.Write([]byte{0})
+			}
+			fmt.Fprintf(&b, "env=sha256:%x ", h.Sum(nil)[:6])
+		case EnvShown:
+			for _, kv := range env {
+				b.WriteString(quoteArg(kv))
+				b.WriteByte(' ')
+			}
+		}
+	}
+	args := c.Args
+	if c.lookPathErr == nil {
+		b.WriteString(c.showArg(0, c.Path))
+		if len(args) > 0 {
+			args = args[1:]
+		}
+	} else if len(args) > 0 {
+		b.WriteString(c.showArg(0, args[0]))
+		args = args[1:]
+	}
+	for i, a := range args {
 		b.WriteByte(' ')
-		b.WriteString(a)
+		b.WriteString(c.showArg(i+1, a))
 	}
 	return b.String()
 }
 
+// RedactIndices returns a function for Cmd.RedactArgs that hides the
+// arguments at the given indices of Args.
+func RedactIndices(indices ...int) func(int, string) string {
+	return func(i int, arg string) string {
+		if slices.Contains(indices, i) {
+			return "[redacted]"
+		}
+		return arg
+	}
+}
+
+// showArg returns the argument at index i of Args as String shows it:
+// redacted by RedactArgs, or quoted if need be.
+func (c *Cmd) showArg(i int, arg string) string {
+	if c.RedactArgs != nil {
+		if r := c.RedactArgs(i, arg); r != arg {
+			return r
+		}
+	}
+	return quoteArg(arg)
+}
+
+// validate resolves EnvOverrides and EnvRemove into Env and runs the
+// pre-spawn hooks on c, then reports an InvalidArgError
+// if c's Path, Args, Dir or Env cannot be passed to a new process, with an
+// offending argument redacted by RedactArgs. It then applies Translocation
+// and checks the executable as ExpectedSHA256, CodeSignature and Verify
+// ask.
+func (c *Cmd) validate() error {
+	if c.EnvOverrides != nil || c.EnvRemove != nil {
+		c.Env = c.Environ()
+	}
+	if err := c.runPreSpawnHooks(); err != nil {
+		return err
+	}
+	if c.DirFD != nil {
+		if c.Dir != "" {
+			return errors.New("exec: Dir and DirFD both set")
+		}
+		if !isAbs(c.Path) {
+			return errors.New("exec: DirFD with a relative Path")
+		}
+	}
+	if c.ExecFD != nil && !canExecFD {
+		return errors.New("exec: ExecFD is not supported on this platform")
+	}
+	if c.ExecFD != nil && c.Pinned != nil {
+		return errors.New("exec: ExecFD and Pinned both set")
+	}
+	err := validateArgs(c.Path, c.Args, c.Dir, c.Env)
+	if ae, ok := err.(*InvalidArgError); ok && ae.Field == "Args" && c.RedactArgs != nil {
+		ae.Value = c.RedactArgs(ae.Index, ae.Value)
+	}
+	if err != nil {
+		return err
+	}
+	if err := c.untranslocate(); err != nil {
+		return err
+	}
+	return c.verify()
+}
+
+// quoteArg quotes s for String if it is empty or holds anything but
+// characters that are never special to a shell. Printable strings are
+// single-quoted as a shell would; others are quoted as Go strings, so that
+// control characters are visible.
+func quoteArg(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789%+,-./:=@_") == "" {
+		return s
+	}
+	for _, r := range s {
+		if !unicode.IsPrint(r) {
+			return strconv.Quote(s)
+		}
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
 // Run starts the specified command and waits for it to complete.
 //
 // The returned error is nil if the command runs, has no problems
@@ -246,10 +875,12 @@ func (c *Cmd) Output() ([]byte, error) {
 	}
 	var stdout bytes.Buffer
 	c.Stdout = &stdout
+	c.ownStdio[1] = true
 
 	captureErr := c.Stderr == nil
 	if captureErr {
 		c.Stderr = &prefixSuffixSaver{N: 32 << 10}
+		c.ownStdio[2] = true
 	}
 
 	err := c.Run()
@@ -273,10 +904,158 @@ func (c *Cmd) CombinedOutput() ([]byte, error) {
 	var b bytes.Buffer
 	c.Stdout = &b
 	c.Stderr = &b
+	c.ownStdio[1], c.ownStdio[2] = true, true
 	err := c.Run()
 	return b.Bytes(), err
 }
 
+// OutputBoth runs the command and returns its standard output and standard
+// error, captured separately. If the command fails with an *ExitError, its
+// Stderr field is populated too.
+func (c *Cmd) OutputBoth() (stdout, stderr []byte, err error) {
+	return c.OutputBothLimit(0, 0)
+}
+
+// OutputBothLimit is like OutputBoth but retains at most about stdoutMax
+// bytes of standard output and stderrMax bytes of standard error. When a
+// stream exceeds its limit, the beginning and end of it are kept and the
+// middle is replaced with a note of how many bytes were omitted. A limit
+// of zero or less means no limit.
+func (c *Cmd) OutputBothLimit(stdoutMax, stderrMax int) (stdout, stderr []byte, err error) {
+	if c.Stdout != nil {
+		return nil, nil, errors.New("exec: Stdout already set")
+	}
+	if c.Stderr != nil {
+		return nil, nil, errors.New("exec: Stderr already set")
+	}
+	outBuf := newCaptureBuffer(stdoutMax)
+	errBuf := newCaptureBuffer(stderrMax)
+	c.Stdout = outBuf
+	c.Stderr = errBuf
+	c.ownStdio[1], c.ownStdio[2] = true, true
+
+	err = c.Run()
+	stdout, stderr = outBuf.Bytes(), errBuf.Bytes()
+	if ee, ok := err.(*ExitError); ok {
+		ee.Stderr = stderr
+	}
+	return stdout, stderr, err
+}
+
+// OutputContext is like Output but kills the command, as CommandContext
+// would, once ctx is done, in addition to any context c already has. The
+// output captured until then is returned along with the error, so that a
+// command that timed out can still be diagnosed. If the command leaves
+// behind processes of its own that hold its output open, set WaitDelay so
+// that OutputContext does not wait for them too.
+func (c *Cmd) OutputContext(ctx context.Context) ([]byte, error) {
+	if c.Stdout != nil {
+		return nil, errors.New("exec: Stdout already set")
+	}
+	stdout := &lockedBuffer{b: new(bytes.Buffer)}
+	c.Stdout = stdout
+	c.ownStdio[1] = true
+
+	var stderr *lockedBuffer
+	if c.Stderr == nil {
+		stderr = &lockedBuffer{b: &prefixSuffixSaver{N: 32 << 10}}
+		c.Stderr = stderr
+		c.ownStdio[2] = true
+	}
+
+	err := c.runContext(ctx)
+	if ee, ok := err.(*ExitError); ok && stderr != nil {
+		ee.Stderr = stderr.Bytes()
+	}
+	return stdout.Bytes(), err
+}
+
+// CombinedOutputContext is like CombinedOutput but kills the command once
+// ctx is done, returning the output captured until then along with the
+// error, as OutputContext does.
+func (c *Cmd) CombinedOutputContext(ctx context.Context) ([]byte, error) {
+	if c.Stdout != nil {
+		return nil, errors.New("exec: Stdout already set")
+	}
+	if c.Stderr != nil {
+		return nil, errors.New("exec: Stderr already set")
+	}
+	b := &lockedBuffer{b: new(bytes.Buffer)}
+	c.Stdout = b
+	c.Stderr = b
+	c.ownStdio[1], c.ownStdio[2] = true, true
+	err := c.runContext(ctx)
+	return b.Bytes(), err
+}
+
+// runContext binds c to ctx as well as to any context it already has, and
+// runs it.
+func (c *Cmd) runContext(ctx context.Context) error {
+	if c.Process != nil {
+		return errors.New("exec: already started")
+	}
+	c.savedCtx, c.savedCtxCancel, c.ctxSaved = c.ctx, c.ctxCancel, true
+	if c.ctx == nil {
+		c.ctx = ctx
+	} else {
+		merged, cancel := context.WithCancelCause(c.ctx)
+		stop := context.AfterFunc(ctx, func() { cancel(contextError(ctx)) })
+		prev := c.ctxCancel
+		c.ctxCancel = func() {
+			stop()
+			cancel(nil)
+			if prev != nil {
+				prev()
+			}
+		}
+		c.ctx = merged
+	}
+	if err := c.Start(); err != nil {
+		if c.ctxCancel != nil {
+			c.ctxCancel()
+		}
+		return err
+	}
+	return c.Wait()
+}
+
+// lockedBuffer is a captureBuffer that can be read while it is still
+// being written to, as it can be once WaitDelay has expired and Wait has
+// returned without waiting for the copying goroutines.
+type lockedBuffer struct {
+	mu sync.Mutex
+	b  captureBuffer
+}
+
+func (l *lockedBuffer) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.Write(p)
+}
+
+// Bytes returns a copy of what has been written so far.
+func (l *lockedBuffer) Bytes() []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return bytes.Clone(l.b.Bytes())
+}
+
+// captureBuffer is an io.Writer that keeps everything written to it,
+// optionally only a prefix and suffix of it.
+type captureBuffer interface {
+	io.Writer
+	Bytes() []byte
+}
+
+// newCaptureBuffer returns a captureBuffer retaining about limit bytes,
+// or everything if limit <= 0.
+func newCaptureBuffer(limit int) captureBuffer {
+	if limit <= 0 {
+		return new(bytes.Buffer)
+	}
+	return &prefixSuffixSaver{N: (limit + 1) / 2}
+}
+
 // StdinPipe returns a pipe that will be connected to the command's
 // standard input when the command starts.
 // The pipe will be closed automatically after Wait sees the command exit.
@@ -295,16 +1074,44 @@ func (c *Cmd) StdinPipe() (io.WriteCloser, error) {
 	}
 	c.stdinPipeUsed = true
 
-	pr, pw, err := os.Pipe()
+	pr, pw, err := inputPipe()
 	if err != nil {
 		return nil, err
 	}
+	noSIGPIPE(pw)
 	c.Stdin = pr
+	c.ownStdio[0] = true
 	c.childIOFiles = append(c.childIOFiles, pr)
 	c.parentIOPipes = append(c.parentIOPipes, pw)
+	c.stdinCloser = pw
 	return pw, nil
 }
 
+// CloseStdin closes the parent's end of the pipe connected to the
+// command's standard input, so that the command reads end-of-file. The
+// pipe exists if StdinPipe was used or Stdin is not an *os.File; if there
+// is none, CloseStdin kills the process instead.
+//
+// CloseStdin is meant to be used as Cancel, together with WaitDelay so
+// that a command that does not exit at the end of its input is still
+// killed eventually:
+//
+//	cmd := spawnexec.CommandContext(ctx, "gopls", "serve")
+//	cmd.Cancel = cmd.CloseStdin
+//	cmd.WaitDelay = int64(5 * time.Second)
+func (c *Cmd) CloseStdin() error {
+	if c.Process == nil {
+		return errors.New("exec: not started")
+	}
+	if c.stdinCloser == nil {
+		return c.Process.Kill()
+	}
+	if err := c.stdinCloser.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
 // StdoutPipe returns a pipe that will be connected to the command's
 // standard output when the command starts.
 //
@@ -325,11 +1132,12 @@ func (c *Cmd) StdoutPipe() (io.ReadCloser, error) {
 	}
 	c.stdoutPipeUsed = true
 
-	pr, pw, err := os.Pipe()
+	pr, pw, err := outputPipe()
 	if err != nil {
 		return nil, err
 	}
 	c.Stdout = pw
+	c.ownStdio[1] = true
 	c.childIOFiles = append(c.childIOFiles, pw)
 	c.parentIOPipes = append(c.parentIOPipes, pr)
 	return pr, nil
@@ -355,16 +1163,88 @@ func (c *Cmd) StderrPipe() (io.ReadCloser, error) {
 	}
 	c.stderrPipeUsed = true
 
-	pr, pw, err := os.Pipe()
+	pr, pw, err := outputPipe()
 	if err != nil {
 		return nil, err
 	}
 	c.Stderr = pw
+	c.ownStdio[2] = true
 	c.childIOFiles = append(c.childIOFiles, pw)
 	c.parentIOPipes = append(c.parentIOPipes, pr)
 	return pr, nil
 }
 
+// StdioConn returns a connection to one end of a Unix domain socket pair
+// whose other end will be connected to both the command's standard input
+// and standard output when the command starts. It suits bidirectional
+// protocols such as LSP and JSON-RPC, where a single connection makes
+// framing and shutdown simpler than two pipes. CloseStdin shuts down the
+// writing side of the connection, so the command reads end-of-file while
+// its output can still be read.
+//
+// As with StdoutPipe, Wait closes the connection after seeing the command
+// exit, so it is incorrect to call Wait before all reads from it have
+// completed, or to use Run.
+func (c *Cmd) StdioConn() (*net.UnixConn, error) {
+	if c.Stdin != nil {
+		return nil, errors.New("exec: Stdin already set")
+	}
+	if c.Stdout != nil {
+		return nil, errors.New("exec: Stdout already set")
+	}
+	if c.Process != nil {
+		return nil, errors.New("exec: StdioConn after process started")
+	}
+
+	fds, err := socketpair()
+	if err != nil {
+		return nil, err
+	}
+	child := os.NewFile(uintptr(fds[0]), "|0")
+	parent := os.NewFile(uintptr(fds[1]), "|1")
+	fc, err := net.FileConn(parent)
+	parent.Close()
+	if err != nil {
+		child.Close()
+		return nil, err
+	}
+	conn := fc.(*net.UnixConn)
+	c.Stdin = child
+	c.Stdout = child
+	c.ownStdio[0], c.ownStdio[1] = true, true
+	c.childIOFiles = append(c.childIOFiles, child)
+	c.parentIOPipes = append(c.parentIOPipes, conn)
+	c.stdinCloser = writeCloser{conn}
+	return conn, nil
+}
+
+// socketpair returns a connected pair of close-on-exec Unix domain stream
+// sockets.
+func socketpair() ([2]int, error) {
+	// Hold ForkLock so that no child forked meanwhile inherits the sockets
+	// before they are marked close-on-exec.
+	syscall.ForkLock.RLock()
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err == nil {
+		unix.CloseOnExec(fds[0])
+		unix.CloseOnExec(fds[1])
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return fds, os.NewSyscallError("socketpair", err)
+	}
+	return fds, nil
+}
+
+// writeCloser closes the writing side of a connection.
+type writeCloser struct {
+	conn *net.UnixConn
+}
+
+func (w writeCloser) Close() error {
+	return w.conn.CloseWrite()
+}
+
 // Environ returns a copy of the environment in which the command would be run
 // as it is currently configured.
 func (c *Cmd) Environ() []string {
@@ -372,7 +1252,27 @@ func (c *Cmd) Environ() []string {
 	if env == nil {
 		env = os.Environ()
 	}
-	return env
+	if c.EnvOverrides == nil && c.EnvRemove == nil {
+		return env
+	}
+	return overrideEnv(env, c.EnvOverrides, c.EnvRemove)
+}
+
+// overrideEnv returns env without the variables named in remove or
+// overrides, followed by those in overrides, in order of their names.
+func overrideEnv(env []string, overrides map[string]string, remove []string) []string {
+	out := make([]string, 0, len(env)+len(overrides))
+	for _, kv := range env {
+		k, _, _ := strings.Cut(kv, "=")
+		if _, ok := overrides[k]; ok || slices.Contains(remove, k) {
+			continue
+		}
+		out = append(out, kv)
+	}
+	for _, k := range slices.Sorted(maps.Keys(overrides)) {
+		out = append(out, k+"="+overrides[k])
+	}
+	return out
 }
 
 // prefixSuffixSaver is an io.Writer which retains the first N bytes
@@ -452,3 +1352,409 @@ func min(a, b int) int {
 	}
 	return b
 }
+
+// watchContext monitors the context and interrupts the process if it is
+// done before Wait reaps it. The outcome is delivered on c.ctxResult: a
+// context error if the process was interrupted, an error if interrupting
+// it failed, or nil.
+func (c *Cmd) watchContext() {
+	c.ctxResult = make(chan error, 1)
+	c.waitDone = make(chan struct{})
+	go func() {
+		select {
+		case <-c.waitDone:
+			c.ctxResult <- nil
+			return
+		case <-c.ctx.Done():
+		}
+
+		cancel := c.Cancel
+		if cancel == nil {
+			cancel = c.Process.Kill
+		}
+		var err error
+		if interruptErr := cancel(); interruptErr == nil {
+			err = contextError(c.ctx)
+		} else if !errors.Is(interruptErr, os.ErrProcessDone) && !errors.Is(interruptErr, syscall.ESRCH) {
+			err = wrapError("exec: canceling Cmd: ", interruptErr)
+		}
+
+		// Escalate to SIGKILL if the process outlives WaitDelay
+		if c.WaitDelay > 0 {
+			timer := time.NewTimer(time.Duration(c.WaitDelay))
+			select {
+			case <-c.waitDone:
+				timer.Stop()
+			case <-timer.C:
+				c.Process.Kill()
+			}
+		}
+		c.ctxResult <- err
+	}()
+}
+
+// extraFiles returns the files the new process inherits beyond standard
+// I/O, from ExtraFiles and FdMap. Entry i becomes file descriptor 3+i; nil
+// entries are left closed.
+func (c *Cmd) extraFiles() ([]*os.File, error) {
+	if len(c.FdMap) == 0 {
+		return c.ExtraFiles, nil
+	}
+	n := len(c.ExtraFiles)
+	for fd := range c.FdMap {
+		if fd < 3 {
+			return nil, fmt.Errorf("exec: FdMap descriptor %d is not above standard I/O", fd)
+		}
+		if i := fd - 3; i < len(c.ExtraFiles) && c.ExtraFiles[i] != nil {
+			return nil, fmt.Errorf("exec: FdMap descriptor %d is already given by ExtraFiles", fd)
+		}
+		n = max(n, fd-2)
+	}
+	files := make([]*os.File, n)
+	copy(files, c.ExtraFiles)
+	for fd, f := range c.FdMap {
+		files[fd-3] = f
+	}
+	return files, nil
+}
+
+// execPath returns the path of the program to execute, resolving path
+// relative to dir as os/exec does: the child changes to dir before
+// executing path, so a relative path is relative to dir, and a relative
+// dir to the current directory. The result is absolute if path is relative
+// and dir is not empty, so that it means the same before and after the
+// change of directory, but is not cleaned, leaving ".." to the kernel.
+func execPath(dir, path string) (string, error) {
+	if dir == "" || isAbs(path) {
+		return path, nil
+	}
+	path = joinPath(dir, path)
+	if !isAbs(dir) {
+		wd, err := os.Getwd()
+		if err != nil {
+			return "", err
+		}
+		path = joinPath(wd, path)
+	}
+	return path, nil
+}
+
+// openFiles returns the files the new process opens itself: those named by
+// StdinPath, StdoutPath and StderrPath, followed by OpenFiles. It also
+// puts Stdout and Stderr in append mode if OutputFlag asks for it.
+func (c *Cmd) openFiles() ([]OpenFile, error) {
+	if c.OutputFlag&os.O_APPEND != 0 {
+		for _, w := range []io.Writer{c.Stdout, c.Stderr} {
+			if f, ok := w.(*os.File); ok {
+				if err := setAppend(f); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if c.StdinPath == "" && c.StdoutPath == "" && c.StderrPath == "" {
+		return c.OpenFiles, nil
+	}
+	if c.StdinPath != "" && c.Stdin != nil {
+		return nil, errors.New("exec: Stdin and StdinPath both set")
+	}
+	if c.StdoutPath != "" && c.Stdout != nil {
+		return nil, errors.New("exec: Stdout and StdoutPath both set")
+	}
+	if c.StderrPath != "" && c.Stderr != nil {
+		return nil, errors.New("exec: Stderr and StderrPath both set")
+	}
+	outFlag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if c.OutputFlag != 0 {
+		outFlag = os.O_WRONLY | c.OutputFlag
+	}
+	outPerm := c.OutputPerm
+	if outPerm == 0 {
+		outPerm = 0666
+	}
+	var opens []OpenFile
+	if c.StdinPath != "" {
+		opens = append(opens, OpenFile{Fd: 0, Path: c.StdinPath, Flag: os.O_RDONLY})
+	}
+	if c.StdoutPath != "" {
+		opens = append(opens, OpenFile{Fd: 1, Path: c.StdoutPath, Flag: outFlag, Perm: outPerm})
+	}
+	if c.StderrPath != "" {
+		if c.StderrPath == c.StdoutPath {
+			opens = append(opens, OpenFile{Fd: 2, dupStdout: true})
+		} else {
+			opens = append(opens, OpenFile{Fd: 2, Path: c.StderrPath, Flag: outFlag, Perm: outPerm})
+		}
+	}
+	return append(opens, c.OpenFiles...), nil
+}
+
+// resolveStdio fills in nil Stdin, Stdout and Stderr fields if
+// InheritStdio is set, and replaces values that are syscall.Conns, other
+// than *os.Files, with duplicates of their descriptors, so that the child
+// inherits them directly rather than through copying goroutines. The
+// returned function restores the replaced fields and closes the
+// duplicates; it is called once the child has started or failed to.
+func (c *Cmd) resolveStdio() (restore func(), err error) {
+	var restores []func()
+	var files []*os.File
+	restore = func() {
+		for _, r := range slices.Backward(restores) {
+			r()
+		}
+		closeFiles(files)
+	}
+	if c.InheritStdio {
+		if c.Stdin == nil && c.StdinPath == "" {
+			c.Stdin = os.Stdin
+			restores = append(restores, func() { c.Stdin = nil })
+		}
+		if c.Stdout == nil && c.StdoutPath == "" {
+			c.Stdout = os.Stdout
+			restores = append(restores, func() { c.Stdout = nil })
+		}
+		if c.Stderr == nil && c.StderrPath == "" {
+			c.Stderr = os.Stderr
+			restores = append(restores, func() { c.Stderr = nil })
+		}
+	}
+	if err := c.lineCallbacks(&restores); err != nil {
+		restore()
+		return nil, err
+	}
+	c.peekBuffers(&restores)
+	dup := func(v any) *os.File {
+		if _, ok := v.(*os.File); ok || err != nil {
+			return nil
+		}
+		sc, ok := v.(syscall.Conn)
+		if !ok {
+			return nil
+		}
+		var f *os.File
+		f, err = connFile(sc)
+		if f != nil {
+			files = append(files, f)
+		}
+		return f
+	}
+	stdin, stdout, stderr := c.Stdin, c.Stdout, c.Stderr
+	if f := dup(stdin); f != nil {
+		c.Stdin = f
+		restores = append(restores, func() { c.Stdin = stdin })
+	}
+	if f := dup(stdout); f != nil {
+		c.Stdout = f
+		restores = append(restores, func() { c.Stdout = stdout })
+		if stderr == stdout {
+			c.Stderr = f
+			restores = append(restores, func() { c.Stderr = stderr })
+		}
+	}
+	if stderr != stdout {
+		if f := dup(stderr); f != nil {
+			c.Stderr = f
+			restores = append(restores, func() { c.Stderr = stderr })
+		}
+	}
+	if err != nil {
+		restore()
+		return nil, err
+	}
+	return restore, nil
+}
+
+// lineCallbacks replaces Stdout and Stderr with writers that also feed
+// OnStdoutLine and OnStderrLine, recording how to restore them in
+// restores.
+func (c *Cmd) lineCallbacks(restores *[]func()) error {
+	lineWriter := func(name string, fn func(string), path string, pipeUsed bool) (io.Writer, error) {
+		if fn == nil {
+			return nil, nil
+		}
+		if path != "" {
+			return nil, fmt.Errorf("exec: On%sLine and %sPath both set", name, name)
+		}
+		if pipeUsed {
+			return nil, fmt.Errorf("exec: On%sLine with %sPipe", name, name)
+		}
+		lw := NewLineWriter(lineFunc(fn), func(dst, line []byte) []byte {
+			return append(dst, line...)
+		})
+		c.lineWriters = append(c.lineWriters, lw)
+		return lw, nil
+	}
+	outLines, err := lineWriter("Stdout", c.OnStdoutLine, c.StdoutPath, c.stdoutPipeUsed)
+	if err != nil {
+		return err
+	}
+	errLines, err := lineWriter("Stderr", c.OnStderrLine, c.StderrPath, c.stderrPipeUsed)
+	if err != nil {
+		return err
+	}
+	if outLines == nil && errLines == nil {
+		return nil
+	}
+	stdout, stderr := c.Stdout, c.Stderr
+	*restores = append(*restores, func() { c.Stdout, c.Stderr = stdout, stderr })
+	if stdout != nil && stdout == stderr {
+		// The command writes both streams to one pipe, whose output is
+		// copied by one goroutine to the writer they share, so a single
+		// wrapper passes every line to each callback.
+		w := teeWriter(stdout, outLines, errLines)
+		c.Stdout, c.Stderr = w, w
+		return nil
+	}
+	if outLines != nil {
+		c.Stdout = teeWriter(stdout, outLines)
+	}
+	if errLines != nil {
+		c.Stderr = teeWriter(stderr, errLines)
+	}
+	return nil
+}
+
+// teeWriter returns a writer that writes to w, if it is not nil, and to
+// each of the line writers lws that is not nil.
+func teeWriter(w io.Writer, lws ...io.Writer) io.Writer {
+	var ws []io.Writer
+	if w != nil {
+		ws = append(ws, w)
+	}
+	for _, lw := range lws {
+		if lw != nil {
+			ws = append(ws, lw)
+		}
+	}
+	if len(ws) == 1 {
+		return ws[0]
+	}
+	return io.MultiWriter(ws...)
+}
+
+// lineFunc is a writer that passes each line written to it, as written by
+// a LineWriter, to a line callback.
+type lineFunc func(line string)
+
+func (f lineFunc) Write(p []byte) (int, error) {
+	line := strings.TrimSuffix(string(p), "\n")
+	f(strings.TrimSuffix(line, "\r"))
+	return len(p), nil
+}
+
+// connFile returns a duplicate of the descriptor behind sc. If sc does not
+// expose one, connFile returns nil and sc is copied like any other
+// reader or writer.
+func connFile(sc syscall.Conn) (*os.File, error) {
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil, nil
+	}
+	var dup int
+	var dupErr error
+	err = rc.Control(func(fd uintptr) {
+		dup, dupErr = unix.FcntlInt(fd, unix.F_DUPFD_CLOEXEC, 0)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if dupErr != nil {
+		return nil, os.NewSyscallError("fcntl", dupErr)
+	}
+	// The child expects a blocking descriptor, but os.File only restores
+	// blocking mode on descriptors it made non-blocking itself.
+	if err := unix.SetNonblock(dup, false); err != nil {
+		unix.Close(dup)
+		return nil, os.NewSyscallError("fcntl", err)
+	}
+	return os.NewFile(uintptr(dup), "conn"), nil
+}
+
+// closeFiles closes all the files in the slice.
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// setAppend sets O_APPEND on f's open file description.
+func setAppend(f *os.File) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var fcntlErr error
+	err = rc.Control(func(fd uintptr) {
+		var flags int
+		flags, fcntlErr = unix.FcntlInt(fd, unix.F_GETFL, 0)
+		if fcntlErr == nil && flags&unix.O_APPEND == 0 {
+			_, fcntlErr = unix.FcntlInt(fd, unix.F_SETFL, flags|unix.O_APPEND)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return os.NewSyscallError("fcntl", fcntlErr)
+}
+
+// resume calls BeforeResume with the pid of the new process, which is
+// stopped, and then resumes it. If BeforeResume fails, the process is
+// killed and waited for instead.
+func (c *Cmd) resume() error {
+	if err := c.BeforeResume(c.Process.Pid); err != nil {
+		c.Process.Kill()
+		c.Wait()
+		return err
+	}
+	return c.Process.Signal(syscall.SIGCONT)
+}
+
+// waitProcess waits for the started process to exit and for its I/O to be
+// copied, and reports the outcome as Wait does.
+func (c *Cmd) waitProcess() error {
+	// Wait for the process
+	state, err := c.Process.Wait()
+	c.timing.Waited = time.Now()
+
+	// Collect the outcome of watching the context
+	var ctxErr error
+	if c.ctxResult != nil {
+		close(c.waitDone)
+		ctxErr = <-c.ctxResult
+	}
+
+	if err != nil {
+		c.logReaped(err)
+		return err
+	}
+	c.ProcessState = state
+	c.logReaped(nil)
+
+	// The child has exited, so the copying goroutines see EOF once any
+	// grandchildren holding the pipes exit too.
+	copyErr := c.awaitGoroutines()
+
+	// Close parent side of pipes created by the *Pipe methods
+	for _, f := range c.parentIOPipes {
+		f.Close()
+	}
+	c.parentIOPipes = nil
+
+	if !state.Success() {
+		ee := &ExitError{ProcessState: state}
+		if c.ctx != nil && c.ctx.Err() != nil && errors.Is(ctxErr, c.ctx.Err()) {
+			ee.ctxErr = ctxErr
+		}
+		return ee
+	}
+
+	if ctxErr != nil {
+		return ctxErr
+	}
+
+	if copyErr != nil {
+		return copyErr
+	}
+
+	return nil
+}
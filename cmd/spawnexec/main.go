@@ -0,0 +1,216 @@
+// Command spawnexec runs a command through the spawnexec package and
+// reports how long spawning and running it took, and the resources it
+// used, as JSON on standard error.
+//
+// Usage:
+//
+//	spawnexec [flags] command [arg...]
+//
+// It doubles as a smoke test of the posix_spawn path and as a harness for
+// benchmarking spawning outside Go: with -n it runs the command repeatedly
+// and summarizes the runs. It exits with the exit status of the last run.
+//
+// The flags are:
+//
+//	-timeout duration
+//		kill the command if it runs longer than this
+//	-env KEY=VALUE
+//		set an environment variable; may be repeated
+//	-clearenv
+//		start from an empty environment rather than spawnexec's own
+//	-dir directory
+//		run the command in directory
+//	-output mode
+//		what to do with the command's output: inherit (the default),
+//		capture (into the report) or discard
+//	-n count
+//		run the command count times
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/orospakr/spawnexec"
+	"golang.org/x/sys/unix"
+)
+
+// envFlag collects repeated -env flags.
+type envFlag []string
+
+func (e *envFlag) String() string {
+	return strings.Join(*e, " ")
+}
+
+func (e *envFlag) Set(kv string) error {
+	if !strings.Contains(kv, "=") {
+		return fmt.Errorf("%q is not of the form KEY=VALUE", kv)
+	}
+	*e = append(*e, kv)
+	return nil
+}
+
+// report is the JSON report written once the command has run.
+type report struct {
+	Command []string `json:"command"`
+	Runs    []run    `json:"runs"`
+	// Summary is only set for more than one run.
+	Summary *summary `json:"summary,omitempty"`
+}
+
+// run describes one run of the command. Durations are in nanoseconds.
+type run struct {
+	StartNs    int64                 `json:"start_ns"` // time taken by Start
+	WallNs     int64                 `json:"wall_ns"`  // time from Start to the end of Wait
+	ExitCode   int                   `json:"exit_code"`
+	Signal     string                `json:"signal,omitempty"`
+	Error      string                `json:"error,omitempty"`
+	UserNs     int64                 `json:"user_ns"`
+	SystemNs   int64                 `json:"system_ns"`
+	MaxRSS     int64                 `json:"maxrss"` // as reported by getrusage: bytes on darwin, KiB on Linux
+	Stdout     string                `json:"stdout,omitempty"`
+	Stderr     string                `json:"stderr,omitempty"`
+	RusageInfo *spawnexec.RusageInfo `json:"rusage_info,omitempty"`
+}
+
+// summary summarizes several runs. Durations are in nanoseconds.
+type summary struct {
+	MinStartNs  int64 `json:"min_start_ns"`
+	MeanStartNs int64 `json:"mean_start_ns"`
+	MaxStartNs  int64 `json:"max_start_ns"`
+	MinWallNs   int64 `json:"min_wall_ns"`
+	MeanWallNs  int64 `json:"mean_wall_ns"`
+	MaxWallNs   int64 `json:"max_wall_ns"`
+}
+
+func main() {
+	spawnexec.Main()
+	var env envFlag
+	timeout := flag.Duration("timeout", 0, "kill the command if it runs longer than this")
+	flag.Var(&env, "env", "set an environment variable `KEY=VALUE`; may be repeated")
+	clearEnv := flag.Bool("clearenv", false, "start from an empty environment")
+	dir := flag.String("dir", "", "run the command in `directory`")
+	output := flag.String("output", "inherit", "what to do with the command's output: inherit, capture or discard")
+	n := flag.Int("n", 1, "run the command `count` times")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: spawnexec [flags] command [arg...]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 || *n < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	switch *output {
+	case "inherit", "capture", "discard":
+	default:
+		fmt.Fprintf(os.Stderr, "spawnexec: unknown -output mode %q\n", *output)
+		os.Exit(2)
+	}
+
+	var cmdEnv []string
+	if len(env) > 0 || *clearEnv {
+		if !*clearEnv {
+			cmdEnv = os.Environ()
+		}
+		cmdEnv = append(cmdEnv, env...)
+	}
+
+	rep := report{Command: flag.Args()}
+	for i := 0; i < *n; i++ {
+		r, err := runOnce(flag.Args(), cmdEnv, *dir, *output, *timeout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "spawnexec: %v\n", err)
+			os.Exit(127)
+		}
+		rep.Runs = append(rep.Runs, r)
+	}
+	if *n > 1 {
+		rep.Summary = summarize(rep.Runs)
+	}
+
+	enc := json.NewEncoder(os.Stderr)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(rep); err != nil {
+		fmt.Fprintf(os.Stderr, "spawnexec: %v\n", err)
+		os.Exit(127)
+	}
+	os.Exit(rep.Runs[len(rep.Runs)-1].ExitCode)
+}
+
+// runOnce runs args once and describes the run. It only returns an error
+// if the command could not be started.
+func runOnce(args, env []string, dir, output string, timeout time.Duration) (run, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	cmd := spawnexec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = env
+	cmd.Dir = dir
+	var stdout, stderr strings.Builder
+	switch output {
+	case "inherit":
+		cmd.InheritStdio = true
+	case "capture":
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	}
+
+	begin := time.Now()
+	if err := cmd.Start(); err != nil {
+		return run{}, err
+	}
+	started := time.Now()
+	err := cmd.Wait()
+	end := time.Now()
+
+	r := run{
+		StartNs: started.Sub(begin).Nanoseconds(),
+		WallNs:  end.Sub(begin).Nanoseconds(),
+		Stdout:  stdout.String(),
+		Stderr:  stderr.String(),
+	}
+	var ee *spawnexec.ExitError
+	if err != nil && !errors.As(err, &ee) {
+		r.Error = err.Error()
+	}
+	if ps := cmd.ProcessState; ps != nil {
+		r.ExitCode = ps.ExitCode()
+		if ps.Signaled() {
+			r.Signal = ps.Signal().String()
+			r.ExitCode = 128 + int(ps.Signal())
+		}
+		r.UserNs = ps.UserTime().Nanoseconds()
+		r.SystemNs = ps.SystemTime().Nanoseconds()
+		if ru, ok := ps.SysUsage().(*unix.Rusage); ok && ru != nil {
+			r.MaxRSS = int64(ru.Maxrss)
+		}
+		r.RusageInfo = ps.RusageInfo()
+	}
+	return r, nil
+}
+
+// summarize returns the minimum, mean and maximum durations of runs.
+func summarize(runs []run) *summary {
+	s := &summary{MinStartNs: runs[0].StartNs, MinWallNs: runs[0].WallNs}
+	var startTotal, wallTotal int64
+	for _, r := range runs {
+		s.MinStartNs = min(s.MinStartNs, r.StartNs)
+		s.MaxStartNs = max(s.MaxStartNs, r.StartNs)
+		s.MinWallNs = min(s.MinWallNs, r.WallNs)
+		s.MaxWallNs = max(s.MaxWallNs, r.WallNs)
+		startTotal += r.StartNs
+		wallTotal += r.WallNs
+	}
+	s.MeanStartNs = startTotal / int64(len(runs))
+	s.MeanWallNs = wallTotal / int64(len(runs))
+	return s
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+// TestMain runs the test binary as the spawnexec tool when a test starts
+// it as one.
+func TestMain(m *testing.M) {
+	if os.Getenv("SPAWNEXEC_TEST_TOOL") != "" {
+		os.Args = append([]string{"spawnexec"}, os.Args[1:]...)
+		main()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// runTool runs the tool with args and returns its report and exit code.
+func runTool(t *testing.T, args ...string) (report, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "SPAWNEXEC_TEST_TOOL=1")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	code := 0
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		code = ee.ExitCode()
+	} else if err != nil {
+		t.Fatalf("running the tool: %v", err)
+	}
+	var rep report
+	if err := json.Unmarshal(stderr.Bytes(), &rep); err != nil {
+		t.Fatalf("report %q: %v", stderr.String(), err)
+	}
+	return rep, code
+}
+
+// TestTool tests that the tool runs a command, reports each run and
+// summarizes several, and exits as the last run did.
+func TestTool(t *testing.T) {
+	rep, code := runTool(t, "-output", "capture", "-n", "2", "-env", "GREETING=hi", "sh", "-c", `echo "$GREETING"; exit 3`)
+	if code != 3 {
+		t.Errorf("exit code = %d, want 3", code)
+	}
+	if len(rep.Runs) != 2 || rep.Summary == nil {
+		t.Fatalf("report = %+v, want 2 runs and a summary", rep)
+	}
+	for _, r := range rep.Runs {
+		if r.Stdout != "hi\n" || r.ExitCode != 3 || r.WallNs < r.StartNs {
+			t.Errorf("run = %+v", r)
+		}
+	}
+	if s := rep.Summary; s.MinWallNs > s.MeanWallNs || s.MeanWallNs > s.MaxWallNs {
+		t.Errorf("summary = %+v", s)
+	}
+
+	rep, code = runTool(t, "-output", "discard", "-timeout", "50ms", "sleep", "10")
+	if r := rep.Runs[0]; code != 128+9 || r.Signal != "killed" {
+		t.Errorf("timed out run = %+v, exit code %d", r, code)
+	}
+}
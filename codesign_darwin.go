@@ -0,0 +1,114 @@
+//go:build darwin
+
+package spawnexec
+
+/*
+#cgo LDFLAGS: -framework CoreFoundation -framework Security
+#include <stdlib.h>
+#include <string.h>
+#include <CoreFoundation/CoreFoundation.h>
+#include <Security/Security.h>
+
+// copy_cstring returns a malloc'd UTF-8 copy of s, or NULL.
+static char *copy_cstring(CFStringRef s) {
+    if (s == NULL) {
+        return NULL;
+    }
+    CFIndex n = CFStringGetMaximumSizeForEncoding(CFStringGetLength(s), kCFStringEncodingUTF8) + 1;
+    char *buf = malloc(n);
+    if (buf != NULL && !CFStringGetCString(s, buf, n, kCFStringEncodingUTF8)) {
+        free(buf);
+        buf = NULL;
+    }
+    return buf;
+}
+
+// check_code_signature checks the code signature of the file at path,
+// against the requirement req unless it is NULL. It stores the Team ID of
+// the signature, if any, in *team and a description of a failure in *msg,
+// both to be freed by the caller.
+static OSStatus check_code_signature(const char *path, const char *req, char **team, char **msg) {
+    *team = NULL;
+    *msg = NULL;
+    SecStaticCodeRef code = NULL;
+    SecRequirementRef requirement = NULL;
+    OSStatus st;
+
+    CFURLRef url = CFURLCreateFromFileSystemRepresentation(NULL, (const UInt8 *)path, strlen(path), false);
+    if (url == NULL) {
+        st = errSecParam;
+        goto out;
+    }
+    st = SecStaticCodeCreateWithPath(url, kSecCSDefaultFlags, &code);
+    CFRelease(url);
+    if (st != errSecSuccess) {
+        goto out;
+    }
+    if (req != NULL) {
+        CFStringRef s = CFStringCreateWithCString(NULL, req, kCFStringEncodingUTF8);
+        st = SecRequirementCreateWithString(s, kSecCSDefaultFlags, &requirement);
+        CFRelease(s);
+        if (st != errSecSuccess) {
+            goto out;
+        }
+    }
+
+    CFDictionaryRef info = NULL;
+    if (SecCodeCopySigningInformation(code, kSecCSSigningInformation, &info) == errSecSuccess) {
+        *team = copy_cstring(CFDictionaryGetValue(info, kSecCodeInfoTeamIdentifier));
+        CFRelease(info);
+    }
+    st = SecStaticCodeCheckValidity(code, kSecCSCheckAllArchitectures, requirement);
+
+out:
+    if (st != errSecSuccess) {
+        CFStringRef s = SecCopyErrorMessageString(st, NULL);
+        if (s != NULL) {
+            *msg = copy_cstring(s);
+            CFRelease(s);
+        }
+    }
+    if (requirement != NULL) {
+        CFRelease(requirement);
+    }
+    if (code != NULL) {
+        CFRelease(code);
+    }
+    return st;
+}
+*/
+import "C"
+
+import (
+	"strconv"
+	"unsafe"
+)
+
+// checkCodeSignature checks the code signature of the executable at path
+// with the Security framework, against requirement unless it is empty.
+func checkCodeSignature(path, requirement string) error {
+	cpath := C.CString(path)
+	defer C.free(unsafe.Pointer(cpath))
+	var creq *C.char
+	if requirement != "" {
+		creq = C.CString(requirement)
+		defer C.free(unsafe.Pointer(creq))
+	}
+	var team, msg *C.char
+	st := C.check_code_signature(cpath, creq, &team, &msg)
+	defer C.free(unsafe.Pointer(team))
+	defer C.free(unsafe.Pointer(msg))
+	if st == C.errSecSuccess {
+		return nil
+	}
+	e := &SignatureError{Path: path, Status: int32(st)}
+	if team != nil {
+		e.TeamID = C.GoString(team)
+	}
+	if msg != nil {
+		e.Message = C.GoString(msg)
+	} else {
+		e.Message = "OSStatus " + strconv.Itoa(int(st))
+	}
+	return e
+}
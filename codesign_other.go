@@ -0,0 +1,11 @@
+//go:build !darwin
+
+package spawnexec
+
+import "errors"
+
+// checkCodeSignature reports an error: code signatures are only checked on
+// darwin.
+func checkCodeSignature(path, requirement string) error {
+	return errors.New("exec: code signature verification is not supported on this platform")
+}
@@ -0,0 +1,351 @@
+// Package compat is a drop-in replacement for os/exec implemented on top of
+// spawnexec.
+//
+// Its exported API is identical to that of os/exec: the same functions,
+// the same Cmd fields and methods with the same types, and the same error
+// values. Error, ExitError and the Err* variables are the os/exec ones
+// themselves, so errors.Is and errors.As checks written against os/exec
+// keep working. Switching a code base over only requires changing the
+// import path:
+//
+//	import exec "github.com/orospakr/spawnexec/compat"
+package compat
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/orospakr/spawnexec"
+	"github.com/orospakr/spawnexec/internal/bridge"
+)
+
+// Error is returned by LookPath when it fails to classify a file as an
+// executable.
+type Error = exec.Error
+
+// ExitError reports an unsuccessful exit by a command.
+type ExitError = exec.ExitError
+
+// ErrNotFound is the error resulting if a path search failed to find an
+// executable file.
+var ErrNotFound = exec.ErrNotFound
+
+// ErrDot indicates that a path lookup resolved to an executable in the
+// current directory due to '.' being in the path, either implicitly or
+// explicitly.
+var ErrDot = exec.ErrDot
+
+// ErrWaitDelay is returned by (*Cmd).Wait if the process exits with a
+// successful status code but its output pipes are not closed before the
+// command's WaitDelay expires.
+var ErrWaitDelay = exec.ErrWaitDelay
+
+// LookPath searches for an executable named file in the directories named
+// by the PATH environment variable. It is os/exec's LookPath.
+func LookPath(file string) (string, error) {
+	return exec.LookPath(file)
+}
+
+// Cmd represents an external command being prepared or run. Its fields
+// have the same meaning as those of os/exec.Cmd.
+type Cmd struct {
+	Path         string
+	Args         []string
+	Env          []string
+	Dir          string
+	Stdin        io.Reader
+	Stdout       io.Writer
+	Stderr       io.Writer
+	ExtraFiles   []*os.File
+	SysProcAttr  *syscall.SysProcAttr
+	Process      *os.Process
+	ProcessState *os.ProcessState
+	Err          error // LookPath error, if any.
+	Cancel       func() error
+	WaitDelay    time.Duration
+
+	ctx   context.Context
+	inner *spawnexec.Cmd
+
+	childIOFiles  []*os.File // closed after Start
+	parentIOPipes []*os.File // closed after Wait
+}
+
+// Command returns the Cmd struct to execute the named program with the
+// given arguments, like os/exec.Command.
+func Command(name string, arg ...string) *Cmd {
+	cmd := &Cmd{
+		Path: name,
+		Args: append([]string{name}, arg...),
+	}
+	if filepath.Base(name) == name {
+		lp, err := exec.LookPath(name)
+		if lp != "" {
+			// Update cmd.Path even if err is non-nil.
+			// If err is ErrDot (especially on Windows), lp may include a resolved
+			// extension (like .exe or .bat) that should be preserved.
+			cmd.Path = lp
+		}
+		if err != nil {
+			cmd.Err = err
+		}
+	}
+	return cmd
+}
+
+// CommandContext is like Command but includes a context, like
+// os/exec.CommandContext.
+func CommandContext(ctx context.Context, name string, arg ...string) *Cmd {
+	if ctx == nil {
+		panic("nil Context")
+	}
+	cmd := Command(name, arg...)
+	cmd.ctx = ctx
+	cmd.Cancel = func() error {
+		return cmd.Process.Kill()
+	}
+	return cmd
+}
+
+// String returns a human-readable description of c.
+// It is intended only for debugging.
+func (c *Cmd) String() string {
+	if c.Err != nil {
+		// failed to resolve path; report the original requested path (plus args)
+		return strings.Join(c.Args, " ")
+	}
+	var b strings.Builder
+	b.WriteString(c.Path)
+	for _, a := range c.Args[1:] {
+		b.WriteByte(' ')
+		b.WriteString(a)
+	}
+	return b.String()
+}
+
+// Environ returns a copy of the environment in which the command would be
+// run as it is currently configured.
+func (c *Cmd) Environ() []string {
+	return (&spawnexec.Cmd{Env: c.Env, Dir: c.Dir}).Environ()
+}
+
+// Start starts the specified command but does not wait for it to complete.
+func (c *Cmd) Start() error {
+	if c.Path == "" && c.Err == nil {
+		c.Err = errors.New("exec: no command")
+	}
+	if c.Err != nil {
+		closeDescriptors(c.childIOFiles)
+		closeDescriptors(c.parentIOPipes)
+		return c.Err
+	}
+	if c.Process != nil {
+		return errors.New("exec: already started")
+	}
+	if c.Cancel != nil && c.ctx == nil {
+		return errors.New("exec: command with a non-nil Cancel was not created with CommandContext")
+	}
+
+	inner := &spawnexec.Cmd{}
+	if c.ctx != nil {
+		inner = spawnexec.CommandContext(c.ctx, c.Path)
+	}
+	inner.Path = c.Path
+	inner.Args = c.Args
+	inner.Env = c.Env
+	inner.Dir = c.Dir
+	inner.Stdin = c.Stdin
+	inner.Stdout = c.Stdout
+	inner.Stderr = c.Stderr
+	inner.ExtraFiles = c.ExtraFiles
+	inner.WaitDelay = int64(c.WaitDelay)
+	if attr := c.SysProcAttr; attr != nil {
+		sys, err := sysProcAttr(attr)
+		if err != nil {
+			closeDescriptors(c.childIOFiles)
+			closeDescriptors(c.parentIOPipes)
+			return err
+		}
+		inner.SysProcAttr = sys
+	}
+	// Cancel may refer to c.Process, so hold it back until that is set.
+	started := make(chan struct{})
+	if cancel := c.Cancel; cancel != nil {
+		inner.Cancel = func() error {
+			<-started
+			return cancel()
+		}
+	}
+
+	if err := inner.Start(); err != nil {
+		closeDescriptors(c.childIOFiles)
+		closeDescriptors(c.parentIOPipes)
+		return convertError(err)
+	}
+	c.inner = inner
+	c.Process = bridge.Process(inner.Process)
+	close(started)
+	closeDescriptors(c.childIOFiles)
+	c.childIOFiles = nil
+	return nil
+}
+
+// Wait waits for the command to exit and waits for any copying to stdin or
+// copying from stdout or stderr to complete.
+func (c *Cmd) Wait() error {
+	if c.inner == nil {
+		return errors.New("exec: not started")
+	}
+	if c.ProcessState != nil {
+		return errors.New("exec: Wait was already called")
+	}
+	err := c.inner.Wait()
+	if c.inner.ProcessState != nil {
+		c.ProcessState = bridge.ProcessState(c.inner.ProcessState)
+	}
+	closeDescriptors(c.parentIOPipes)
+	c.parentIOPipes = nil
+	return c.convertExitError(convertError(err))
+}
+
+// Run starts the specified command and waits for it to complete.
+func (c *Cmd) Run() error {
+	if err := c.Start(); err != nil {
+		return err
+	}
+	return c.Wait()
+}
+
+// Output runs the command and returns its standard output.
+// If c.Stderr was nil, Output populates ExitError.Stderr.
+func (c *Cmd) Output() ([]byte, error) {
+	if c.Stdout != nil {
+		return nil, errors.New("exec: Stdout already set")
+	}
+	var stdout, stderr bytes.Buffer
+	c.Stdout = &stdout
+
+	captureErr := c.Stderr == nil
+	if captureErr {
+		c.Stderr = &stderr
+	}
+
+	err := c.Run()
+	if err != nil && captureErr {
+		if ee, ok := err.(*ExitError); ok {
+			ee.Stderr = stderr.Bytes()
+		}
+	}
+	return stdout.Bytes(), err
+}
+
+// CombinedOutput runs the command and returns its combined standard output
+// and standard error.
+func (c *Cmd) CombinedOutput() ([]byte, error) {
+	if c.Stdout != nil {
+		return nil, errors.New("exec: Stdout already set")
+	}
+	if c.Stderr != nil {
+		return nil, errors.New("exec: Stderr already set")
+	}
+	var b bytes.Buffer
+	c.Stdout = &b
+	c.Stderr = &b
+	err := c.Run()
+	return b.Bytes(), err
+}
+
+// StdinPipe returns a pipe that will be connected to the command's standard
+// input when the command starts.
+func (c *Cmd) StdinPipe() (io.WriteCloser, error) {
+	if c.Stdin != nil {
+		return nil, errors.New("exec: Stdin already set")
+	}
+	if c.Process != nil {
+		return nil, errors.New("exec: StdinPipe after process started")
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	c.Stdin = pr
+	c.childIOFiles = append(c.childIOFiles, pr)
+	c.parentIOPipes = append(c.parentIOPipes, pw)
+	return pw, nil
+}
+
+// StdoutPipe returns a pipe that will be connected to the command's
+// standard output when the command starts.
+func (c *Cmd) StdoutPipe() (io.ReadCloser, error) {
+	if c.Stdout != nil {
+		return nil, errors.New("exec: Stdout already set")
+	}
+	if c.Process != nil {
+		return nil, errors.New("exec: StdoutPipe after process started")
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	c.Stdout = pw
+	c.childIOFiles = append(c.childIOFiles, pw)
+	c.parentIOPipes = append(c.parentIOPipes, pr)
+	return pr, nil
+}
+
+// StderrPipe returns a pipe that will be connected to the command's
+// standard error when the command starts.
+func (c *Cmd) StderrPipe() (io.ReadCloser, error) {
+	if c.Stderr != nil {
+		return nil, errors.New("exec: Stderr already set")
+	}
+	if c.Process != nil {
+		return nil, errors.New("exec: StderrPipe after process started")
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	c.Stderr = pw
+	c.childIOFiles = append(c.childIOFiles, pw)
+	c.parentIOPipes = append(c.parentIOPipes, pr)
+	return pr, nil
+}
+
+// closeDescriptors closes all the files in the slice
+func closeDescriptors(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// convertExitError replaces a *spawnexec.ExitError with the equivalent
+// *ExitError.
+func (c *Cmd) convertExitError(err error) error {
+	var ee *spawnexec.ExitError
+	if errors.As(err, &ee) && c.ProcessState != nil {
+		return &ExitError{ProcessState: c.ProcessState, Stderr: ee.Stderr}
+	}
+	return err
+}
+
+// convertError replaces a *spawnexec.Error or spawnexec.ErrWaitDelay with
+// the os/exec equivalent.
+func convertError(err error) error {
+	var se *spawnexec.Error
+	if errors.As(err, &se) {
+		return &Error{Name: se.Name, Err: se.Err}
+	}
+	if err == spawnexec.ErrWaitDelay {
+		return ErrWaitDelay
+	}
+	return err
+}
@@ -0,0 +1,169 @@
+package compat
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestOutput tests that Output behaves like os/exec
+func TestOutput(t *testing.T) {
+	out, err := Command("echo", "hello").Output()
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+	if string(out) != "hello\n" {
+		t.Errorf("Output() = %q, want %q", out, "hello\n")
+	}
+}
+
+// TestExitErrorIsOsExec tests that exit failures are *exec.ExitError
+func TestExitErrorIsOsExec(t *testing.T) {
+	cmd := Command("sh", "-c", "echo oops >&2; exit 3")
+	_, err := cmd.Output()
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("Output() error = %T %v, want *exec.ExitError", err, err)
+	}
+	if exitErr.ExitCode() != 3 {
+		t.Errorf("ExitCode() = %d, want 3", exitErr.ExitCode())
+	}
+	if string(exitErr.Stderr) != "oops\n" {
+		t.Errorf("Stderr = %q, want %q", exitErr.Stderr, "oops\n")
+	}
+
+	osErr := exec.Command("sh", "-c", "exit 3").Run()
+	if err.Error() != osErr.Error() {
+		t.Errorf("Error() = %q, os/exec = %q", err.Error(), osErr.Error())
+	}
+	if cmd.ProcessState == nil || cmd.ProcessState.ExitCode() != 3 {
+		t.Errorf("ProcessState = %v, want exit status 3", cmd.ProcessState)
+	}
+}
+
+// TestNotFound tests that lookup errors match os/exec
+func TestNotFound(t *testing.T) {
+	const name = "this-command-definitely-does-not-exist-xyz123"
+	err := Command(name).Run()
+	osErr := exec.Command(name).Run()
+	if !errors.Is(err, exec.ErrNotFound) {
+		t.Errorf("Run() error = %v, want ErrNotFound", err)
+	}
+	if err == nil || osErr == nil || err.Error() != osErr.Error() {
+		t.Errorf("Run() error = %v, os/exec = %v", err, osErr)
+	}
+}
+
+// TestProcess tests that Process is a usable *os.Process
+func TestProcess(t *testing.T) {
+	cmd := Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	if cmd.Process == nil || cmd.Process.Pid <= 0 {
+		t.Fatalf("Process = %v, want started process", cmd.Process)
+	}
+	if err := cmd.Process.Kill(); err != nil {
+		t.Errorf("Kill() error = %v", err)
+	}
+	err := cmd.Wait()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("Wait() error = %v, want *exec.ExitError", err)
+	}
+	ws := exitErr.Sys().(syscall.WaitStatus)
+	if ws.Signal() != syscall.SIGKILL {
+		t.Errorf("signal = %v, want SIGKILL", ws.Signal())
+	}
+}
+
+// TestPipes tests StdinPipe and StdoutPipe
+func TestPipes(t *testing.T) {
+	cmd := Command("cat")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatalf("StdinPipe() error = %v", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("StdoutPipe() error = %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	go func() {
+		io.WriteString(stdin, "piped")
+		stdin.Close()
+	}()
+	out, err := io.ReadAll(stdout)
+	if err != nil {
+		t.Errorf("ReadAll() error = %v", err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("Wait() error = %v", err)
+	}
+	if string(out) != "piped" {
+		t.Errorf("output = %q, want %q", out, "piped")
+	}
+}
+
+// TestCommandContext tests that a done context kills the command
+func TestCommandContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := CommandContext(ctx, "sleep", "10").Run(); err == nil {
+		t.Error("Run() error = nil, want error")
+	}
+}
+
+// TestErrorStrings tests misuse errors against os/exec
+func TestErrorStrings(t *testing.T) {
+	cmd := Command("true")
+	osCmd := exec.Command("true")
+	if err, osErr := cmd.Wait(), osCmd.Wait(); err.Error() != osErr.Error() {
+		t.Errorf("Wait() error = %q, os/exec = %q", err, osErr)
+	}
+
+	cmd.Cancel = func() error { return nil }
+	osCmd.Cancel = func() error { return nil }
+	if err, osErr := cmd.Start(), osCmd.Start(); err == nil || err.Error() != osErr.Error() {
+		t.Errorf("Start() error = %v, os/exec = %v", err, osErr)
+	}
+}
+
+// TestSysProcAttr tests that SysProcAttr fields are passed on, and that
+// one spawnexec cannot honour is refused rather than ignored
+func TestSysProcAttr(t *testing.T) {
+	cmd := Command("/bin/true")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Chroot: t.TempDir()}
+	if err := cmd.Run(); err == nil {
+		t.Error("Run() with Chroot of an empty directory succeeded, want error")
+	}
+
+	cmd = Command("true")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())},
+	}
+	if err := cmd.Run(); err == nil || !strings.Contains(err.Error(), "Credential") {
+		t.Errorf("Run() with Credential error = %v, want it refused", err)
+	}
+}
+
+// TestString tests String against os/exec
+func TestString(t *testing.T) {
+	got := Command("echo", "a", "b").String()
+	want := exec.Command("echo", "a", "b").String()
+	if got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	if !strings.HasSuffix(got, "echo a b") {
+		t.Errorf("String() = %q, want resolved path", got)
+	}
+}
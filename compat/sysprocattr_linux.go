@@ -0,0 +1,54 @@
+//go:build linux
+
+package compat
+
+import (
+	"errors"
+	"syscall"
+
+	"github.com/orospakr/spawnexec"
+)
+
+// sysProcAttr returns the spawnexec attributes for attr, or an error if
+// attr sets a field that spawnexec cannot honour.
+func sysProcAttr(attr *syscall.SysProcAttr) (*spawnexec.SysProcAttr, error) {
+	switch {
+	case attr.Credential != nil:
+		return nil, errors.New("exec: SysProcAttr.Credential is not supported")
+	case attr.Ptrace:
+		return nil, errors.New("exec: SysProcAttr.Ptrace is not supported")
+	case attr.Pdeathsig != 0:
+		return nil, errors.New("exec: SysProcAttr.Pdeathsig is not supported")
+	case attr.Cloneflags != 0 || attr.Unshareflags != 0:
+		return nil, errors.New("exec: SysProcAttr.Cloneflags and Unshareflags are not supported")
+	case attr.AmbientCaps != nil:
+		return nil, errors.New("exec: SysProcAttr.AmbientCaps is not supported")
+	case attr.PidFD != nil:
+		return nil, errors.New("exec: SysProcAttr.PidFD is not supported")
+	}
+	idMaps := func(maps []syscall.SysProcIDMap) []spawnexec.SysProcIDMap {
+		if maps == nil {
+			return nil
+		}
+		out := make([]spawnexec.SysProcIDMap, len(maps))
+		for i, m := range maps {
+			out[i] = spawnexec.SysProcIDMap{ContainerID: m.ContainerID, HostID: m.HostID, Size: m.Size}
+		}
+		return out
+	}
+	return &spawnexec.SysProcAttr{
+		Setsid:                     attr.Setsid,
+		Setpgid:                    attr.Setpgid,
+		Setctty:                    attr.Setctty,
+		Noctty:                     attr.Noctty,
+		Ctty:                       attr.Ctty,
+		Foreground:                 attr.Foreground,
+		Pgid:                       attr.Pgid,
+		Chroot:                     attr.Chroot,
+		UidMappings:                idMaps(attr.UidMappings),
+		GidMappings:                idMaps(attr.GidMappings),
+		GidMappingsEnableSetgroups: attr.GidMappingsEnableSetgroups,
+		UseCgroupFD:                attr.UseCgroupFD,
+		CgroupFD:                   attr.CgroupFD,
+	}, nil
+}
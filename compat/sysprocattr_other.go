@@ -0,0 +1,31 @@
+//go:build !linux
+
+package compat
+
+import (
+	"errors"
+	"syscall"
+
+	"github.com/orospakr/spawnexec"
+)
+
+// sysProcAttr returns the spawnexec attributes for attr, or an error if
+// attr sets a field that spawnexec cannot honour.
+func sysProcAttr(attr *syscall.SysProcAttr) (*spawnexec.SysProcAttr, error) {
+	switch {
+	case attr.Credential != nil:
+		return nil, errors.New("exec: SysProcAttr.Credential is not supported")
+	case attr.Ptrace:
+		return nil, errors.New("exec: SysProcAttr.Ptrace is not supported")
+	}
+	return &spawnexec.SysProcAttr{
+		Setsid:     attr.Setsid,
+		Setpgid:    attr.Setpgid,
+		Setctty:    attr.Setctty,
+		Noctty:     attr.Noctty,
+		Ctty:       attr.Ctty,
+		Foreground: attr.Foreground,
+		Pgid:       attr.Pgid,
+		Chroot:     attr.Chroot,
+	}, nil
+}
@@ -0,0 +1,399 @@
+package spawnexec
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// sharedCopier copies the output of running commands to their Stdout and
+// Stderr writers. Rather than a goroutine per redirected stream, it
+// multiplexes the read ends of all the output pipes with poll(2) in a
+// single goroutine, which matters when thousands of children run at once.
+//
+// The copier writes to the destination writers from its own goroutine, so
+// a writer that blocks would stall the output of every command. It is
+// therefore only used for writers that never block, such as the buffers
+// behind Output and CombinedOutput; see useSharedCopier. Output going
+// anywhere else is copied by a goroutine of its own, as in os/exec.
+var sharedCopier copier
+
+// copyBufSize is the size of the copier's read buffer.
+const copyBufSize = 32 * 1024
+
+// useSharedCopier reports whether output written to w can be copied by
+// sharedCopier: whether w is known to never block.
+func useSharedCopier(w io.Writer) bool {
+	switch w.(type) {
+	case *bytes.Buffer, *prefixSuffixSaver:
+		return true
+	}
+	return false
+}
+
+// copier multiplexes copying from many pipes to their destinations.
+type copier struct {
+	once sync.Once
+	// wakeW is written to interrupt poll when the set of streams changes.
+	wakeR, wakeW int
+	startErr     error
+
+	mu      sync.Mutex
+	streams []*copyStream
+}
+
+// copyStream is one pipe being copied by a copier.
+type copyStream struct {
+	r       *os.File
+	fd      int
+	dst     io.Writer
+	n       *atomic.Int64 // counts the bytes copied
+	done    chan error    // receives the outcome of the copy
+	aborted atomic.Bool
+
+	wmu sync.Mutex // held while writing to dst
+}
+
+// add starts copying from r, the read end of a pipe, to dst until r
+// reaches EOF, counting the bytes copied in n. The outcome of the copy is
+// delivered on the returned stream's done channel, after which r has been
+// closed.
+func (cp *copier) add(r *os.File, dst io.Writer, n *atomic.Int64) (*copyStream, error) {
+	cp.once.Do(cp.start)
+	if cp.startErr != nil {
+		return nil, cp.startErr
+	}
+	s := &copyStream{r: r, dst: dst, n: n, done: make(chan error, 1)}
+	// The fd stays in non-blocking mode, as os.Pipe left it; r is only
+	// closed by the copier, so the fd remains valid until then.
+	rc, err := r.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	rc.Control(func(fd uintptr) { s.fd = int(fd) })
+
+	cp.mu.Lock()
+	cp.streams = append(cp.streams, s)
+	cp.mu.Unlock()
+	cp.wake()
+	return s, nil
+}
+
+// abort stops copying s, for example once WaitDelay has expired. Its done
+// channel receives ErrWaitDelay. abort returns once a write to s's
+// writer that is in progress has finished, after which none are started,
+// so that the caller may use the writer.
+func (cp *copier) abort(s *copyStream) {
+	s.wmu.Lock()
+	s.aborted.Store(true)
+	s.wmu.Unlock()
+	cp.wake()
+}
+
+// start creates the wakeup pipe and starts the copying goroutine.
+func (cp *copier) start() {
+	var p [2]int
+	if err := unix.Pipe(p[:]); err != nil {
+		cp.startErr = os.NewSyscallError("pipe", err)
+		return
+	}
+	for _, fd := range p {
+		unix.CloseOnExec(fd)
+		unix.SetNonblock(fd, true)
+	}
+	cp.wakeR, cp.wakeW = p[0], p[1]
+	go cp.loop()
+}
+
+// wake interrupts the copying goroutine's poll. If the wakeup pipe is
+// full, a wakeup is already pending and the write is dropped.
+func (cp *copier) wake() {
+	unix.Write(cp.wakeW, []byte{0})
+}
+
+// loop polls the pipes of all streams and copies whatever is readable.
+func (cp *copier) loop() {
+	buf := make([]byte, copyBufSize)
+
+	var fds []unix.PollFd
+	var streams []*copyStream
+	for {
+		cp.mu.Lock()
+		streams = streams[:0]
+		for _, s := range cp.streams {
+			if s.aborted.Load() {
+				cp.finish(s, ErrWaitDelay)
+				continue
+			}
+			streams = append(streams, s)
+		}
+		cp.streams = append(cp.streams[:0], streams...)
+		cp.mu.Unlock()
+
+		fds = append(fds[:0], unix.PollFd{Fd: int32(cp.wakeR), Events: unix.POLLIN})
+		for _, s := range streams {
+			fds = append(fds, unix.PollFd{Fd: int32(s.fd), Events: unix.POLLIN})
+		}
+		if _, err := unix.Poll(fds, -1); err != nil {
+			if err != unix.EINTR {
+				cp.failAll(os.NewSyscallError("poll", err))
+			}
+			continue
+		}
+
+		if fds[0].Revents != 0 {
+			unix.Read(cp.wakeR, buf)
+		}
+		for i, s := range streams {
+			if fds[i+1].Revents == 0 {
+				continue
+			}
+			n, err := unix.Read(s.fd, buf)
+			if err == unix.EAGAIN || err == unix.EINTR {
+				continue
+			}
+			if n > 0 {
+				s.wmu.Lock()
+				if s.aborted.Load() {
+					s.wmu.Unlock()
+					continue
+				}
+				written, werr := s.dst.Write(buf[:n])
+				s.wmu.Unlock()
+				s.n.Add(int64(written))
+				if werr != nil {
+					cp.remove(s, werr)
+				}
+				continue
+			}
+			if err != nil {
+				cp.remove(s, os.NewSyscallError("read", err))
+			} else {
+				cp.remove(s, nil) // EOF
+			}
+		}
+	}
+}
+
+// remove stops copying s and reports err as its outcome.
+func (cp *copier) remove(s *copyStream, err error) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	for i, t := range cp.streams {
+		if t == s {
+			cp.streams = append(cp.streams[:i], cp.streams[i+1:]...)
+			break
+		}
+	}
+	cp.finish(s, err)
+}
+
+// failAll stops copying every stream and reports err as their outcome,
+// when polling their pipes fails.
+func (cp *copier) failAll(err error) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	for _, s := range cp.streams {
+		cp.finish(s, err)
+	}
+	cp.streams = cp.streams[:0]
+}
+
+// finish closes the pipe of s, which has been removed from cp.streams,
+// and delivers err. cp.mu must be held.
+func (cp *copier) finish(s *copyStream, err error) {
+	if closeErr := s.r.Close(); err == nil && closeErr != nil && !errors.Is(closeErr, os.ErrClosed) {
+		err = closeErr
+	}
+	s.done <- err
+}
+
+// copyInput arranges for a goroutine to copy c.Stdin to pw, the parent's
+// end of the pipe read by the command, once the command has started.
+func (c *Cmd) copyInput(pw *os.File) {
+	noSIGPIPE(pw)
+	c.stdinCloser = pw
+	c.copyPipes = append(c.copyPipes, pw)
+	c.goroutine = append(c.goroutine, func() error {
+		n, err := c.copyBuffer(pw, c.Stdin)
+		c.ioStats[0].Add(n)
+		pw.Close()
+		// A child that exits without reading all of its input, or whose
+		// input was closed by CloseStdin, is not an error.
+		if errors.Is(err, syscall.EPIPE) || errors.Is(err, os.ErrClosed) {
+			err = nil
+		}
+		return err
+	})
+}
+
+// closeStartFiles closes the pipes set up for a command that failed to
+// start.
+func (c *Cmd) closeStartFiles() {
+	for _, f := range c.childIOFiles {
+		f.Close()
+	}
+	c.childIOFiles = nil
+	for _, sc := range c.sharedCopies {
+		sc.r.Close()
+	}
+	c.sharedCopies = nil
+	// The goroutines that were to copy through these never started.
+	closeClosers(c.copyPipes)
+	c.copyPipes, c.goroutine = nil, nil
+	if c.trampolineStatus != nil {
+		c.trampolineStatus.Close()
+		c.trampolineStatus = nil
+	}
+	c.closeMuxPipe()
+}
+
+// copyOutput arranges for the output the command writes to the pipe read
+// by r to be copied to w once the command has started, by sharedCopier if
+// w allows it and by a goroutine otherwise. fd is the command's
+// descriptor the pipe is on, whose bytes the copy counts.
+func (c *Cmd) copyOutput(r *os.File, w io.Writer, fd int) {
+	if useSharedCopier(w) {
+		c.sharedCopies = append(c.sharedCopies, sharedCopy{r: r, w: w, n: &c.ioStats[fd]})
+		return
+	}
+	c.goCopyOutput(r, w, &c.ioStats[fd])
+}
+
+// goCopyOutput arranges for a goroutine to copy from r to w, counting the
+// bytes copied in n.
+func (c *Cmd) goCopyOutput(r *os.File, w io.Writer, n *atomic.Int64) {
+	c.copyPipes = append(c.copyPipes, r)
+	c.goroutine = append(c.goroutine, func() error {
+		_, err := c.copyBuffer(countingWriter{w, n}, r)
+		r.Close()
+		if c.IgnoreBrokenPipe && errors.Is(err, syscall.EPIPE) {
+			err = nil
+		}
+		return err
+	})
+}
+
+// customCopyBuffer reports whether CopyBufferSize or CopyBufferPool ask
+// for buffers other than io.Copy's.
+func (c *Cmd) customCopyBuffer() bool {
+	return c.CopyBufferSize > 0 || c.CopyBufferPool != nil
+}
+
+// copyBuffer copies from src to dst as io.Copy does, but with a buffer
+// as CopyBufferSize and CopyBufferPool ask for, if they are set.
+func (c *Cmd) copyBuffer(dst io.Writer, src io.Reader) (int64, error) {
+	if !c.customCopyBuffer() {
+		return io.Copy(dst, src)
+	}
+	size := c.CopyBufferSize
+	if size <= 0 {
+		size = copyBufSize
+	}
+	var buf *[]byte
+	if pool := c.CopyBufferPool; pool != nil {
+		buf, _ = pool.Get().(*[]byte)
+		defer func() { pool.Put(buf) }()
+	}
+	if buf == nil || len(*buf) == 0 {
+		b := make([]byte, size)
+		buf = &b
+	}
+	// An *os.File's ReadFrom and WriteTo, short of a zero-copy path,
+	// fall back to io.Copy with a buffer of its own, so they are hidden.
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
+}
+
+// sharedCopy is an output pipe waiting to be handed to sharedCopier.
+type sharedCopy struct {
+	r *os.File
+	w io.Writer
+	n *atomic.Int64
+}
+
+// startGoroutines starts the I/O copying goroutines and hands the shared
+// copies to sharedCopier.
+func (c *Cmd) startGoroutines() {
+	for _, sc := range c.sharedCopies {
+		s, err := sharedCopier.add(sc.r, sc.w, sc.n)
+		if err != nil {
+			c.goCopyOutput(sc.r, sc.w, sc.n)
+			continue
+		}
+		c.copyStreams = append(c.copyStreams, s)
+	}
+	c.sharedCopies = nil
+
+	c.goroutineErr = make(chan error, len(c.goroutine))
+	for _, fn := range c.goroutine {
+		go func() {
+			c.goroutineErr <- fn()
+		}()
+	}
+}
+
+// awaitGoroutines waits for the I/O copying goroutines and shared copies
+// to finish and returns the first error any of them reported. If WaitDelay
+// is set and they are still running when it expires, their pipes are
+// closed to unblock them and ErrWaitDelay is returned without waiting
+// further. Either way, it then flushes the writers feeding OnStdoutLine
+// and OnStderrLine.
+func (c *Cmd) awaitGoroutines() error {
+	// Pass on any final unterminated lines once the output is exhausted.
+	defer func() {
+		for _, lw := range c.lineWriters {
+			lw.Flush()
+		}
+	}()
+
+	var timeout <-chan time.Time
+	if c.WaitDelay > 0 {
+		timer := time.NewTimer(time.Duration(c.WaitDelay))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var copyErr error
+	record := func(err error) {
+		if err != nil && copyErr == nil {
+			copyErr = err
+		}
+	}
+	abort := func() error {
+		if l := c.log(); l != nil {
+			l.Debug("spawnexec: WaitDelay expired before output was copied", "pid", c.Process.Pid, "wait_delay", time.Duration(c.WaitDelay))
+		}
+		closeClosers(c.copyPipes)
+		for _, s := range c.copyStreams {
+			sharedCopier.abort(s)
+		}
+		return ErrWaitDelay
+	}
+	for range c.goroutine {
+		select {
+		case err := <-c.goroutineErr:
+			record(err)
+		case <-timeout:
+			return abort()
+		}
+	}
+	for _, s := range c.copyStreams {
+		select {
+		case err := <-s.done:
+			record(err)
+		case <-timeout:
+			return abort()
+		}
+	}
+	if l := c.log(); l != nil {
+		l.Debug("spawnexec: output copied", "pid", c.Process.Pid, "goroutines", len(c.goroutine), "shared", len(c.copyStreams), "err", copyErr)
+	}
+	return copyErr
+}
@@ -0,0 +1,182 @@
+package spawnexec
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// CoreDumps controls whether a command dumps core when it crashes. See
+// Cmd.CoreDumps.
+type CoreDumps int
+
+const (
+	// CoreDumpsInherit leaves the command with the RLIMIT_CORE of the
+	// calling process.
+	CoreDumpsInherit CoreDumps = iota
+
+	// CoreDumpsEnabled raises the command's RLIMIT_CORE soft limit to its
+	// hard limit. Start fails if the hard limit is 0.
+	CoreDumpsEnabled
+
+	// CoreDumpsDisabled lowers the command's RLIMIT_CORE soft limit to 0.
+	// A system that hands cores to a program, as systemd-coredump does,
+	// runs it regardless; the program is left to honour the limit.
+	CoreDumpsDisabled
+)
+
+// setCoreDumps sets the RLIMIT_CORE soft limit of the calling process, a
+// trampoline, for the command it executes to inherit.
+func setCoreDumps(cd CoreDumps) error {
+	var lim unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_CORE, &lim); err != nil {
+		return os.NewSyscallError("getrlimit", err)
+	}
+	switch cd {
+	case CoreDumpsEnabled:
+		if lim.Max == 0 {
+			return errors.New("core dumps are disabled by the RLIMIT_CORE hard limit")
+		}
+		lim.Cur = lim.Max
+	case CoreDumpsDisabled:
+		lim.Cur = 0
+	default:
+		return fmt.Errorf("unknown CoreDumps %d", cd)
+	}
+	return os.NewSyscallError("setrlimit", unix.Setrlimit(unix.RLIMIT_CORE, &lim))
+}
+
+// coreProcess describes a process that dumped core, for expanding the
+// specifiers of the system's core file pattern.
+type coreProcess struct {
+	pid  int
+	uid  int
+	gid  int
+	sig  int
+	path string // the executable, absolute
+}
+
+// CoreFile returns the path of the core file the system wrote for the
+// command, once Wait has reported that it dumped core.
+//
+// Where cores are written is set for the whole system, by the
+// kern.corefile sysctl on darwin and kernel.core_pattern on Linux, and
+// CoreFile expands that pattern for the command. Specifiers whose values
+// are not known, such as the time of the dump, are matched against the
+// files that exist, the newest match winning. CoreFile fails if the
+// system hands cores to a program rather than writing them to a file, as
+// systemd-coredump and apport do.
+func (c *Cmd) CoreFile() (string, error) {
+	ps := c.ProcessState
+	if ps == nil {
+		return "", errors.New("exec: CoreFile called before Wait")
+	}
+	if !ps.CoreDumped() {
+		return "", errors.New("exec: " + c.Path + ": process did not dump core")
+	}
+	pattern, err := corePattern()
+	if err != nil {
+		return "", err
+	}
+
+	dir := c.Dir
+	if dir == "" {
+		dir = "."
+	}
+	if dir, err = filepath.Abs(dir); err != nil {
+		return "", err
+	}
+	path := c.Path
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	p := &coreProcess{pid: ps.Pid(), uid: os.Getuid(), gid: os.Getgid(), sig: int(ps.Signal()), path: path}
+
+	// A relative pattern is relative to the working directory of the
+	// process that dumped core.
+	name, glob := expandCorePattern(pattern, func(verb byte) (string, bool) {
+		return coreSpecifier(verb, p)
+	})
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(escapeGlob(dir, glob), name)
+	}
+	if !glob {
+		return name, nil
+	}
+	matches, _ := filepath.Glob(name)
+	var newest string
+	var newestInfo os.FileInfo
+	for _, m := range matches {
+		fi, err := os.Stat(m)
+		if err != nil {
+			continue
+		}
+		if newestInfo == nil || fi.ModTime().After(newestInfo.ModTime()) {
+			newest, newestInfo = m, fi
+		}
+	}
+	if newest == "" {
+		return "", errors.New("exec: no core file matches " + name)
+	}
+	return newest, nil
+}
+
+// expandCorePattern expands the %-specifiers of pattern with spec, which
+// reports the value of a specifier and whether it is known. Unknown
+// specifiers become a "*" wildcard, in which case glob is true and the
+// rest of the name is escaped for filepath.Match.
+func expandCorePattern(pattern string, spec func(verb byte) (string, bool)) (name string, glob bool) {
+	type part struct {
+		s        string
+		wildcard bool
+	}
+	var parts []part
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' || i+1 == len(pattern) {
+			parts = append(parts, part{s: pattern[i : i+1]})
+			continue
+		}
+		i++
+		if pattern[i] == '%' {
+			parts = append(parts, part{s: "%"})
+			continue
+		}
+		v, ok := spec(pattern[i])
+		if !ok {
+			glob = true
+		}
+		parts = append(parts, part{s: v, wildcard: !ok})
+	}
+	var b strings.Builder
+	for _, p := range parts {
+		if p.wildcard {
+			b.WriteString("*")
+		} else {
+			b.WriteString(escapeGlob(p.s, glob))
+		}
+	}
+	return b.String(), glob
+}
+
+// escapeGlob escapes the filepath.Match metacharacters in s if glob is
+// set.
+func escapeGlob(s string, glob bool) string {
+	if !glob || !strings.ContainsAny(s, `*?[\`) {
+		return s
+	}
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
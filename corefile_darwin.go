@@ -0,0 +1,36 @@
+package spawnexec
+
+import (
+	"path/filepath"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// corePattern returns the kern.corefile sysctl.
+func corePattern() (string, error) {
+	pattern, err := unix.Sysctl("kern.corefile")
+	if err != nil {
+		return "", wrapError("exec: sysctl kern.corefile: ", err)
+	}
+	return pattern, nil
+}
+
+// coreSpecifier returns the value of the kern.corefile specifier verb for
+// p, and whether it is known.
+func coreSpecifier(verb byte, p *coreProcess) (string, bool) {
+	switch verb {
+	case 'P':
+		return strconv.Itoa(p.pid), true
+	case 'U':
+		return strconv.Itoa(p.uid), true
+	case 'N':
+		// The process name, which is truncated to MAXCOMLEN bytes.
+		name := filepath.Base(p.path)
+		if len(name) > 16 {
+			name = name[:16]
+		}
+		return name, true
+	}
+	return "", false
+}
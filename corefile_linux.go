@@ -0,0 +1,54 @@
+package spawnexec
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// corePattern returns kernel.core_pattern, with ".%p" appended as the
+// kernel does when kernel.core_uses_pid is set and it has no %p.
+func corePattern() (string, error) {
+	b, err := os.ReadFile("/proc/sys/kernel/core_pattern")
+	if err != nil {
+		return "", err
+	}
+	pattern := strings.TrimSuffix(string(b), "\n")
+	if strings.HasPrefix(pattern, "|") {
+		return "", errors.New("exec: cores are piped to a program, by kernel.core_pattern " + strconv.Quote(pattern))
+	}
+	if b, err := os.ReadFile("/proc/sys/kernel/core_uses_pid"); err == nil && strings.TrimSpace(string(b)) != "0" && !strings.Contains(pattern, "%p") {
+		pattern += ".%p"
+	}
+	return pattern, nil
+}
+
+// coreSpecifier returns the value of the kernel.core_pattern specifier
+// verb for p, and whether it is known.
+func coreSpecifier(verb byte, p *coreProcess) (string, bool) {
+	switch verb {
+	case 'p', 'P':
+		return strconv.Itoa(p.pid), true
+	case 'u':
+		return strconv.Itoa(p.uid), true
+	case 'g':
+		return strconv.Itoa(p.gid), true
+	case 's':
+		return strconv.Itoa(p.sig), true
+	case 'e':
+		// The command name, which execve truncates to 15 bytes.
+		name := filepath.Base(p.path)
+		if len(name) > 15 {
+			name = name[:15]
+		}
+		return name, true
+	case 'E':
+		return strings.ReplaceAll(p.path, "/", "!"), true
+	case 'h':
+		host, err := os.Hostname()
+		return host, err == nil
+	}
+	return "", false
+}
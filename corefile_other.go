@@ -0,0 +1,16 @@
+//go:build !darwin && !linux
+
+package spawnexec
+
+import "errors"
+
+// corePattern reports an error: where cores are written is only known on
+// darwin and Linux.
+func corePattern() (string, error) {
+	return "", errors.New("exec: CoreFile is not supported on this platform")
+}
+
+// coreSpecifier knows no specifiers.
+func coreSpecifier(verb byte, p *coreProcess) (string, bool) {
+	return "", false
+}
@@ -0,0 +1,32 @@
+package spawnexec
+
+import (
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// dirFDPath returns a path for os/exec to change directory to that leads
+// to the directory open as f whatever has become of its name: its link in
+// /proc/self/fd. The child follows it before it rearranges its
+// descriptors, while it still has the parent's, so it reaches f itself.
+func dirFDPath(f *os.File) (string, error) {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	var fd int
+	var st unix.Stat_t
+	rc.Control(func(sysfd uintptr) {
+		fd = int(sysfd)
+		err = unix.Fstat(fd, &st)
+	})
+	if err != nil {
+		return "", &os.PathError{Op: "fstat", Path: f.Name(), Err: err}
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		return "", &os.PathError{Op: "chdir", Path: f.Name(), Err: unix.ENOTDIR}
+	}
+	return "/proc/self/fd/" + strconv.Itoa(fd), nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package spawnexec
+
+import (
+	"errors"
+	"os"
+)
+
+// dirFDPath reports an error: os/exec can only be given DirFD on Linux.
+// On darwin, posix_spawn changes to DirFD itself.
+func dirFDPath(f *os.File) (string, error) {
+	return "", errors.New("exec: DirFD is not supported on this platform")
+}
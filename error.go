@@ -1,15 +1,21 @@
 package spawnexec
 
 import (
+	"context"
 	"errors"
-	"os"
+	"strconv"
+	"strings"
+	"syscall"
 )
 
 // Error is returned by LookPath when it fails to classify a file as an
-// executable.
+// executable, and by Start when the system fails to execute the command.
 type Error struct {
 	// Name is the file name for which the error occurred.
 	Name string
+	// Path is the resolved path of the executable, when Start failed to
+	// execute it.
+	Path string
 	// Err is the underlying error.
 	Err error
 }
@@ -22,6 +28,40 @@ func (e *Error) Unwrap() error {
 	return e.Err
 }
 
+// Is reports whether e is a failure to execute the command of the kind
+// target names: ErrExecutableNotFound, ErrPermission or ErrBadFormat.
+func (e *Error) Is(target error) bool {
+	if e.Err == ErrNotFound {
+		return target == ErrExecutableNotFound
+	}
+	errno, ok := e.Err.(syscall.Errno)
+	if !ok {
+		return false
+	}
+	switch target {
+	case ErrExecutableNotFound:
+		return errno == syscall.ENOENT || errno == syscall.ENOTDIR
+	case ErrPermission:
+		return errno == syscall.EACCES || errno == syscall.EPERM
+	case ErrBadFormat:
+		return isBadFormat(errno)
+	}
+	return false
+}
+
+// ErrExecutableNotFound, ErrPermission and ErrBadFormat classify the
+// failures to execute a command: the *Error Start returns matches one of
+// them under errors.Is when the executable, or a directory on the way to
+// it or its interpreter, does not exist; when it may not be executed; and
+// when the system does not recognise it as an executable it can run. An
+// *Error from LookPath wrapping ErrNotFound matches ErrExecutableNotFound
+// too.
+var (
+	ErrExecutableNotFound = errors.New("executable not found")
+	ErrPermission         = errors.New("permission denied")
+	ErrBadFormat          = errors.New("exec format error")
+)
+
 // ExitError reports an unsuccessful exit by a command.
 type ExitError struct {
 	// ProcessState holds information about the exited process.
@@ -38,12 +78,27 @@ type ExitError struct {
 	// Stderr is provided for debugging, for inclusion in error messages.
 	// Users with other needs should redirect Cmd.Stderr as needed.
 	Stderr []byte
+
+	// ctxErr is set if the process was interrupted because the context
+	// passed to CommandContext was done.
+	ctxErr error
 }
 
 func (e *ExitError) Error() string {
+	if e.ctxErr != nil {
+		return e.ProcessState.String() + " (" + e.ctxErr.Error() + ")"
+	}
 	return e.ProcessState.String()
 }
 
+// Unwrap returns the reason the process was interrupted, if it was killed
+// because the context passed to CommandContext was done. The returned
+// error is context.Cause of the context and also satisfies errors.Is with
+// context.Canceled or context.DeadlineExceeded.
+func (e *ExitError) Unwrap() error {
+	return e.ctxErr
+}
+
 // Exited reports whether the program has exited.
 // On Unix systems this reports true if the program exited due to calling exit,
 // but false if the program terminated due to a signal.
@@ -57,6 +112,108 @@ func (e *ExitError) ExitCode() int {
 	return e.ProcessState.ExitCode()
 }
 
+// Signaled reports whether the program was terminated by a signal.
+func (e *ExitError) Signaled() bool {
+	return e.ProcessState.Signaled()
+}
+
+// Signal returns the signal that terminated the program, or -1 if it was
+// not terminated by a signal.
+func (e *ExitError) Signal() syscall.Signal {
+	return e.ProcessState.Signal()
+}
+
+// Is reports whether target is an ExitCodeError for the code e's process
+// exited with.
+func (e *ExitError) Is(target error) bool {
+	code, ok := target.(exitCodeError)
+	return ok && e.Exited() && e.ExitCode() == int(code)
+}
+
+// ExitCodeError returns an error that an *ExitError for a process that
+// exited with the given code matches under errors.Is, so that callers can
+// branch on exit codes without type assertions:
+//
+//	if errors.Is(err, spawnexec.ExitCodeError(2)) {
+//		// usage error
+//	}
+func ExitCodeError(code int) error {
+	return exitCodeError(code)
+}
+
+// exitCodeError is the error returned by ExitCodeError.
+type exitCodeError int
+
+func (e exitCodeError) Error() string {
+	return "exit status " + strconv.Itoa(int(e))
+}
+
+// ExitCode returns the exit code reported by err and true if err is or
+// wraps an *ExitError for a process that exited, rather than being
+// terminated by a signal. Otherwise it returns -1 and false.
+func ExitCode(err error) (int, bool) {
+	var ee *ExitError
+	if !errors.As(err, &ee) || !ee.Exited() {
+		return -1, false
+	}
+	return ee.ExitCode(), true
+}
+
+// IsExitCode reports whether err is or wraps an *ExitError for a process
+// that exited with the given code.
+func IsExitCode(err error, code int) bool {
+	return errors.Is(err, exitCodeError(code))
+}
+
+// InvalidArgError is returned by Start when the command's Path, Args, Dir
+// or Env cannot be passed to the new process as they are: a value holding
+// a NUL byte would be cut short at it, and an environment entry must be
+// of the form "key=value".
+type InvalidArgError struct {
+	// Field is the offending field: "Path", "Args", "Dir" or "Env".
+	Field string
+	// Index is the index of the offending entry of Args or Env, or -1.
+	Index int
+	// Value is the offending value.
+	Value string
+	// Reason describes what is wrong with it.
+	Reason string
+}
+
+func (e *InvalidArgError) Error() string {
+	field := e.Field
+	if e.Index >= 0 {
+		field += "[" + strconv.Itoa(e.Index) + "]"
+	}
+	return "exec: invalid " + field + " " + strconv.Quote(e.Value) + ": " + e.Reason
+}
+
+// validateArgs reports an InvalidArgError if path, args, dir or env cannot
+// be passed to a new process.
+func validateArgs(path string, args []string, dir string, env []string) error {
+	const nul = "contains NUL byte"
+	if strings.IndexByte(path, 0) >= 0 {
+		return &InvalidArgError{Field: "Path", Index: -1, Value: path, Reason: nul}
+	}
+	for i, arg := range args {
+		if strings.IndexByte(arg, 0) >= 0 {
+			return &InvalidArgError{Field: "Args", Index: i, Value: arg, Reason: nul}
+		}
+	}
+	if strings.IndexByte(dir, 0) >= 0 {
+		return &InvalidArgError{Field: "Dir", Index: -1, Value: dir, Reason: nul}
+	}
+	for i, kv := range env {
+		if strings.IndexByte(kv, 0) >= 0 {
+			return &InvalidArgError{Field: "Env", Index: i, Value: kv, Reason: nul}
+		}
+		if !strings.Contains(kv, "=") {
+			return &InvalidArgError{Field: "Env", Index: i, Value: kv, Reason: `not of the form "key=value"`}
+		}
+	}
+	return nil
+}
+
 // ErrNotFound is the error resulting if a path search failed to find an executable file.
 var ErrNotFound = errors.New("executable file not found in $PATH")
 
@@ -70,6 +227,31 @@ var ErrDot = errors.New("cannot run executable found relative to current directo
 // command's WaitDelay expires.
 var ErrWaitDelay = errors.New("exec: WaitDelay expired before I/O complete")
 
+// contextError returns the error reporting why ctx is done: its
+// context.Cause, which also matches ctx.Err() under errors.Is.
+func contextError(ctx context.Context) error {
+	err := ctx.Err()
+	cause := context.Cause(ctx)
+	if cause == nil || errors.Is(cause, err) {
+		return cause
+	}
+	return &causeError{cause: cause, err: err}
+}
+
+// causeError is a context cause that also unwraps to the context's Err.
+type causeError struct {
+	cause error
+	err   error
+}
+
+func (e *causeError) Error() string {
+	return e.cause.Error()
+}
+
+func (e *causeError) Unwrap() []error {
+	return []error{e.cause, e.err}
+}
+
 // wrappedError wraps an error with a message prefix.
 type wrappedError struct {
 	prefix string
@@ -91,12 +273,3 @@ func wrapError(prefix string, err error) error {
 	}
 	return &wrappedError{prefix: prefix, err: err}
 }
-
-// isExecutable reports whether the file at path is executable.
-func isExecutable(path string) bool {
-	fi, err := os.Stat(path)
-	if err != nil {
-		return false
-	}
-	return fi.Mode().IsRegular() && fi.Mode()&0111 != 0
-}
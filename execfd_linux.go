@@ -0,0 +1,54 @@
+package spawnexec
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// canExecFD reports whether Cmd.ExecFD is supported.
+const canExecFD = true
+
+// execFDPath returns the link in /proc/self/fd to the executable open as
+// f, through which it can be read whatever has become of its name, for
+// ExpectedSHA256 and Verify, and run as a script by ShellFallback.
+func execFDPath(f *os.File) (string, error) {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	var fd int
+	rc.Control(func(sysfd uintptr) {
+		fd = int(sysfd)
+	})
+	return procFDPath(fd), nil
+}
+
+// procFDPath returns the link in /proc/self/fd to the descriptor fd.
+func procFDPath(fd int) string {
+	return "/proc/self/fd/" + strconv.Itoa(fd)
+}
+
+// execveat executes the program open on fd with argv and envv, as fexecve
+// does but without needing /proc: execveat with an empty path and
+// AT_EMPTY_PATH executes fd itself. It only returns if that fails.
+func execveat(fd int, argv, envv []string) error {
+	argvp, err := syscall.SlicePtrFromStrings(argv)
+	if err != nil {
+		return err
+	}
+	envvp, err := syscall.SlicePtrFromStrings(envv)
+	if err != nil {
+		return err
+	}
+	empty := []byte{0}
+	_, _, errno := unix.Syscall6(unix.SYS_EXECVEAT, uintptr(fd),
+		uintptr(unsafe.Pointer(&empty[0])),
+		uintptr(unsafe.Pointer(&argvp[0])),
+		uintptr(unsafe.Pointer(&envvp[0])),
+		unix.AT_EMPTY_PATH, 0)
+	return errno
+}
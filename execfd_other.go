@@ -0,0 +1,27 @@
+//go:build !linux
+
+package spawnexec
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// canExecFD reports whether Cmd.ExecFD is supported.
+const canExecFD = false
+
+// execFDPath reports an error: ExecFD is only supported on Linux.
+func execFDPath(f *os.File) (string, error) {
+	return "", errors.New("exec: ExecFD is not supported on this platform")
+}
+
+// procFDPath is never called: ExecFD is only supported on Linux.
+func procFDPath(fd int) string {
+	return ""
+}
+
+// execveat reports ENOSYS: ExecFD is only supported on Linux.
+func execveat(fd int, argv, envv []string) error {
+	return syscall.ENOSYS
+}
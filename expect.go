@@ -0,0 +1,118 @@
+package spawnexec
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// ErrSessionExited is reported by Expect when the command exits before
+// its output matches.
+var ErrSessionExited = errors.New("exec: session exited")
+
+// ExpectError is returned by Expect when the output does not match in
+// time.
+type ExpectError struct {
+	// Pattern is the expression that did not match.
+	Pattern string
+	// Output is the unconsumed output at the time, for debugging.
+	Output []byte
+	// Err is ErrSessionTimeout or ErrSessionExited.
+	Err error
+}
+
+func (e *ExpectError) Error() string {
+	return "exec: expecting " + strconv.Quote(e.Pattern) + ": " + e.Err.Error()
+}
+
+func (e *ExpectError) Unwrap() error {
+	return e.Err
+}
+
+// Expect waits until the unconsumed output matches re, then consumes the
+// output up to the end of the match and returns the match and its
+// submatches, as regexp.FindSubmatch does. It fails with an *ExpectError
+// if the output has not matched within timeout, or the command exits
+// first; a timeout of zero or less means no limit.
+func (s *Session) Expect(re *regexp.Regexp, timeout time.Duration) ([]string, error) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	for {
+		s.mu.Lock()
+		loc := re.FindSubmatchIndex(s.buf)
+		if loc != nil {
+			m := make([]string, len(loc)/2)
+			for i := range m {
+				if loc[2*i] >= 0 {
+					m[i] = string(s.buf[loc[2*i]:loc[2*i+1]])
+				}
+			}
+			s.buf = append(s.buf[:0], s.buf[loc[1]:]...)
+			s.mu.Unlock()
+			return m, nil
+		}
+		changed := s.changed
+		exited := s.exited()
+		s.mu.Unlock()
+		if exited {
+			return nil, &ExpectError{Pattern: re.String(), Output: s.Output(), Err: ErrSessionExited}
+		}
+		select {
+		case <-changed:
+		case <-expired:
+			return nil, &ExpectError{Pattern: re.String(), Output: s.Output(), Err: ErrSessionTimeout}
+		}
+	}
+}
+
+// ExpectString is like Expect but waits for the literal text str.
+func (s *Session) ExpectString(str string, timeout time.Duration) error {
+	_, err := s.Expect(regexp.MustCompile(regexp.QuoteMeta(str)), timeout)
+	return err
+}
+
+// ExpectStep is one step of a script run by ExpectBatch.
+type ExpectStep struct {
+	// Expect, if not nil, is waited for before sending.
+	Expect *regexp.Regexp
+
+	// Send is then written to the command's input, as it is, if it is
+	// not empty.
+	Send string
+
+	// Timeout limits the wait for Expect. If it is zero, the timeout
+	// passed to ExpectBatch is used.
+	Timeout time.Duration
+}
+
+// ExpectBatch runs a script of steps, waiting for each prompt and
+// answering it in turn. It returns the matches of the steps run, and
+// stops at the first step that fails.
+func (s *Session) ExpectBatch(steps []ExpectStep, timeout time.Duration) ([][]string, error) {
+	var matches [][]string
+	for _, step := range steps {
+		var m []string
+		if step.Expect != nil {
+			d := step.Timeout
+			if d == 0 {
+				d = timeout
+			}
+			var err error
+			if m, err = s.Expect(step.Expect, d); err != nil {
+				return matches, err
+			}
+		}
+		matches = append(matches, m)
+		if step.Send != "" {
+			if err := s.Send(step.Send); err != nil {
+				return matches, err
+			}
+		}
+	}
+	return matches, nil
+}
@@ -2,4 +2,4 @@ module github.com/orospakr/spawnexec
 
 go 1.25.2
 
-require golang.org/x/sys v0.38.0 // indirect
+require golang.org/x/sys v0.38.0
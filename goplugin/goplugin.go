@@ -0,0 +1,269 @@
+// Package goplugin starts subprocess plugins written with
+// hashicorp/go-plugin, spawning them through spawnexec so that large
+// hosts do not pay the cost of fork for each plugin.
+//
+// Start runs the plugin with the handshake environment go-plugin
+// expects, reads the handshake line it prints, connects to the network
+// address it negotiated, and returns a Client holding the connection and
+// the negotiated protocol. The package depends on neither gRPC nor
+// yamux, so the host sets up the protocol itself over that connection. A
+// gRPC plugin is reached through it:
+//
+//	client, err := goplugin.Start(spawnexec.Command("./kv-plugin"), goplugin.Options{
+//		Handshake: goplugin.HandshakeConfig{
+//			ProtocolVersion:  1,
+//			MagicCookieKey:   "KV_PLUGIN",
+//			MagicCookieValue: "hello",
+//		},
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	defer client.Close()
+//
+//	conn, err := grpc.NewClient("passthrough:///plugin", grpc.WithContextDialer(
+//		func(context.Context, string) (net.Conn, error) { return client.Dial() }),
+//		grpc.WithTransportCredentials(insecure.NewCredentials()))
+//
+// gRPC dials a connection of its own with Dial, and may dial more; the
+// Client's Conn can be closed if it is not used. go-plugin's net/rpc
+// protocol multiplexes streams with yamux over a single connection; hosts
+// using it layer their yamux session over Conn. Automatic mutual TLS is
+// not negotiated.
+package goplugin
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/orospakr/spawnexec"
+)
+
+// coreProtocolVersion is the version of the handshake itself.
+const coreProtocolVersion = 1
+
+// closeWaitDelay is how long Close waits for the plugin's output to be
+// copied once it has been killed, in case it has passed its standard
+// output or error on to processes of its own.
+const closeWaitDelay = 5 * time.Second
+
+// Protocols a plugin may negotiate.
+const (
+	ProtocolNetRPC = "netrpc"
+	ProtocolGRPC   = "grpc"
+)
+
+// HandshakeConfig is the handshake agreed between host and plugin, as in
+// go-plugin.
+type HandshakeConfig struct {
+	// ProtocolVersion is the version of the application protocol the
+	// host speaks.
+	ProtocolVersion uint
+
+	// MagicCookieKey and MagicCookieValue are set in the plugin's
+	// environment, so that the plugin can tell it was started as one.
+	MagicCookieKey   string
+	MagicCookieValue string
+}
+
+// Options configures Start.
+type Options struct {
+	Handshake HandshakeConfig
+
+	// StartTimeout is how long to wait for the handshake. If it is zero,
+	// one minute is used.
+	StartTimeout time.Duration
+
+	// MinPort and MaxPort bound the TCP ports a plugin may listen on
+	// where Unix domain sockets are not used. If they are zero, 10000
+	// and 25000 are used.
+	MinPort, MaxPort uint
+
+	// Stdout receives what the plugin writes to its standard output
+	// after the handshake line. If it is nil, that output is discarded.
+	Stdout io.Writer
+}
+
+// Client is a running plugin.
+type Client struct {
+	cmd *spawnexec.Cmd
+
+	// Addr is the address the plugin listens on.
+	Addr net.Addr
+	// Protocol is ProtocolNetRPC or ProtocolGRPC.
+	Protocol string
+	// ProtocolVersion is the application protocol version the plugin
+	// chose.
+	ProtocolVersion int
+	// ServerCert is the plugin's DER-encoded TLS certificate, if it
+	// announced one.
+	ServerCert []byte
+
+	// Conn is the connection to Addr made once the handshake completed,
+	// over which the host speaks Protocol. Close closes it.
+	Conn net.Conn
+
+	copied chan struct{} // closed once the plugin's standard output is copied
+}
+
+// Start starts cmd as a plugin, completes the handshake and connects to
+// the plugin. cmd's Stdout must be nil; its Stderr is left as it is, for
+// the plugin's logs. If cmd's WaitDelay is zero, it is set so that Close
+// does not wait indefinitely for the plugin's output. If the handshake
+// fails or does not finish within StartTimeout, or the plugin cannot be
+// connected to, the plugin is killed.
+func Start(cmd *spawnexec.Cmd, opts Options) (*Client, error) {
+	if opts.Handshake.MagicCookieKey == "" || opts.Handshake.MagicCookieValue == "" {
+		return nil, errors.New("goplugin: handshake without a magic cookie")
+	}
+	if opts.StartTimeout <= 0 {
+		opts.StartTimeout = time.Minute
+	}
+	if opts.MinPort == 0 && opts.MaxPort == 0 {
+		opts.MinPort, opts.MaxPort = 10000, 25000
+	}
+	if opts.Stdout == nil {
+		opts.Stdout = io.Discard
+	}
+
+	env := cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	cmd.Env = append(env[:len(env):len(env)],
+		opts.Handshake.MagicCookieKey+"="+opts.Handshake.MagicCookieValue,
+		"PLUGIN_MIN_PORT="+strconv.FormatUint(uint64(opts.MinPort), 10),
+		"PLUGIN_MAX_PORT="+strconv.FormatUint(uint64(opts.MaxPort), 10),
+		"PLUGIN_PROTOCOL_VERSIONS="+strconv.FormatUint(uint64(opts.Handshake.ProtocolVersion), 10),
+	)
+	if cmd.WaitDelay == 0 {
+		cmd.WaitDelay = int64(closeWaitDelay)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	type handshake struct {
+		line string
+		err  error
+	}
+	lines := make(chan handshake, 1)
+	c := &Client{cmd: cmd, copied: make(chan struct{})}
+	go func() {
+		defer close(c.copied)
+		r := bufio.NewReader(stdout)
+		line, err := r.ReadString('\n')
+		lines <- handshake{line, err}
+		io.Copy(opts.Stdout, r)
+	}()
+
+	timer := time.NewTimer(opts.StartTimeout)
+	defer timer.Stop()
+	select {
+	case h := <-lines:
+		if h.err != nil {
+			err = errors.New("goplugin: plugin exited before completing the handshake")
+		} else {
+			err = c.parseHandshake(strings.TrimSpace(h.line), opts.Handshake.ProtocolVersion)
+		}
+	case <-timer.C:
+		err = errors.New("goplugin: timed out waiting for the plugin handshake")
+	}
+	if err == nil {
+		c.Conn, err = c.Dial()
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// parseHandshake parses the line
+//
+//	CORE-VERSION|APP-VERSION|NETWORK|ADDRESS|PROTOCOL|CERT
+//
+// of which the last two fields are optional.
+func (c *Client) parseHandshake(line string, version uint) error {
+	parts := strings.Split(line, "|")
+	if len(parts) < 4 {
+		return fmt.Errorf("goplugin: unrecognized handshake %q", line)
+	}
+	core, err := strconv.Atoi(parts[0])
+	if err != nil || core != coreProtocolVersion {
+		return fmt.Errorf("goplugin: incompatible core protocol version %q", parts[0])
+	}
+	if c.ProtocolVersion, err = strconv.Atoi(parts[1]); err != nil || c.ProtocolVersion != int(version) {
+		return fmt.Errorf("goplugin: plugin speaks protocol version %q, want %d", parts[1], version)
+	}
+	switch parts[2] {
+	case "unix":
+		c.Addr, err = net.ResolveUnixAddr("unix", parts[3])
+	case "tcp":
+		c.Addr, err = net.ResolveTCPAddr("tcp", parts[3])
+	default:
+		err = fmt.Errorf("goplugin: unknown network %q", parts[2])
+	}
+	if err != nil {
+		return err
+	}
+	c.Protocol = ProtocolNetRPC
+	if len(parts) > 4 && parts[4] != "" {
+		c.Protocol = parts[4]
+	}
+	if c.Protocol != ProtocolNetRPC && c.Protocol != ProtocolGRPC {
+		return fmt.Errorf("goplugin: unknown protocol %q", c.Protocol)
+	}
+	if len(parts) > 5 && parts[5] != "" {
+		if c.ServerCert, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+			return fmt.Errorf("goplugin: bad server certificate: %w", err)
+		}
+	}
+	return nil
+}
+
+// Cmd returns the plugin's command.
+func (c *Client) Cmd() *spawnexec.Cmd {
+	return c.cmd
+}
+
+// Dial makes another connection to the plugin.
+func (c *Client) Dial() (net.Conn, error) {
+	return net.Dial(c.Addr.Network(), c.Addr.String())
+}
+
+// Close closes Conn, kills the plugin and waits for it to exit. It
+// returns the error from waiting for the plugin, unless the plugin was
+// ended by Close's own kill: for example, that of a plugin that had
+// already failed.
+func (c *Client) Close() error {
+	if c.Conn != nil {
+		c.Conn.Close()
+	}
+	c.cmd.Process.Kill()
+	// Wait closes the pipe from the plugin's standard output once the
+	// plugin has exited, which ends the copy.
+	err := c.cmd.Wait()
+	<-c.copied
+	if addr, ok := c.Addr.(*net.UnixAddr); ok {
+		os.Remove(addr.Name)
+	}
+	var exitErr *spawnexec.ExitError
+	if errors.As(err, &exitErr) && exitErr.Signaled() && exitErr.Signal() == syscall.SIGKILL {
+		return nil
+	}
+	return err
+}
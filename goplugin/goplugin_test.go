@@ -0,0 +1,171 @@
+package goplugin
+
+import (
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/orospakr/spawnexec"
+)
+
+var handshake = HandshakeConfig{
+	ProtocolVersion:  2,
+	MagicCookieKey:   "GOPLUGIN_TEST_COOKIE",
+	MagicCookieValue: "d5bf2a",
+}
+
+// TestMain runs the test binary as a plugin when it is started by a test.
+func TestMain(m *testing.M) {
+	if mode := os.Getenv("GOPLUGIN_TEST_PLUGIN"); mode != "" {
+		plugin(mode)
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// Echo is the service the test plugin serves.
+type Echo struct{}
+
+func (Echo) Echo(in string, out *string) error {
+	*out = in
+	return nil
+}
+
+// plugin serves Echo the way go-plugin's server would announce it.
+func plugin(mode string) {
+	if os.Getenv(handshake.MagicCookieKey) != handshake.MagicCookieValue {
+		fmt.Fprintln(os.Stderr, "This binary is a plugin.")
+		os.Exit(1)
+	}
+	if mode == "hang" {
+		time.Sleep(time.Minute)
+		os.Exit(1)
+	}
+	dir, err := os.MkdirTemp("", "plugin")
+	if err != nil {
+		os.Exit(1)
+	}
+	defer os.RemoveAll(dir)
+	l, err := net.Listen("unix", filepath.Join(dir, "plugin.sock"))
+	if err != nil {
+		os.Exit(1)
+	}
+	if os.Getenv("GOPLUGIN_TEST_GRANDCHILD") != "" {
+		// A process of the plugin's own keeps its standard output open.
+		grandchild := exec.Command("sleep", "30")
+		grandchild.Stdout = os.Stdout
+		grandchild.Start()
+	}
+	srv := rpc.NewServer()
+	srv.Register(Echo{})
+	// The plugin only speaks version 2 of the application protocol.
+	fmt.Printf("1|2|unix|%s|%s\n", l.Addr(), mode)
+	fmt.Println("after the handshake")
+	if os.Getenv("GOPLUGIN_TEST_FAIL") != "" {
+		conn, err := l.Accept()
+		if err == nil {
+			conn.Close()
+		}
+		os.Exit(3)
+	}
+	srv.Accept(l)
+}
+
+// startPlugin starts the test binary as a plugin in mode, with env added
+// to its environment.
+func startPlugin(mode string, opts Options, env ...string) (*Client, error) {
+	cmd := spawnexec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "GOPLUGIN_TEST_PLUGIN="+mode)
+	cmd.Env = append(cmd.Env, env...)
+	return Start(cmd, opts)
+}
+
+// TestStart tests the handshake and reaching the plugin.
+func TestStart(t *testing.T) {
+	var stdout strings.Builder
+	client, err := startPlugin(ProtocolNetRPC, Options{Handshake: handshake, Stdout: &stdout})
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	if client.Protocol != ProtocolNetRPC || client.ProtocolVersion != 2 || client.Addr.Network() != "unix" || client.Conn == nil {
+		t.Errorf("Start() = %+v", client)
+	}
+	var out string
+	if err := rpc.NewClient(client.Conn).Call("Echo.Echo", "hi", &out); err != nil || out != "hi" {
+		t.Errorf("Echo.Echo over Conn = %q, %v, want hi", out, err)
+	}
+	conn, err := client.Dial()
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	rc := rpc.NewClient(conn)
+	if err := rc.Call("Echo.Echo", "again", &out); err != nil || out != "again" {
+		t.Errorf("Echo.Echo over Dial = %q, %v, want again", out, err)
+	}
+	rc.Close()
+	if err := client.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+	if client.Cmd().ProcessState == nil {
+		t.Error("plugin not waited for by Close()")
+	}
+	if got := stdout.String(); got != "after the handshake\n" {
+		t.Errorf("Stdout = %q, want the output after the handshake", got)
+	}
+}
+
+// TestClose tests that Close reports a plugin that failed, and does not
+// wait indefinitely for output held open by the plugin's own processes.
+func TestClose(t *testing.T) {
+	client, err := startPlugin(ProtocolNetRPC, Options{Handshake: handshake}, "GOPLUGIN_TEST_FAIL=1")
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	client.Cmd().Process.Wait()
+	if err := client.Close(); err == nil || !strings.Contains(err.Error(), "exit status 3") {
+		t.Errorf("Close() of a failed plugin error = %v, want exit status 3", err)
+	}
+
+	client, err = startPlugin(ProtocolNetRPC, Options{Handshake: handshake}, "GOPLUGIN_TEST_GRANDCHILD=1")
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	start := time.Now()
+	client.Close()
+	if d := time.Since(start); d > 20*time.Second {
+		t.Errorf("Close() with the plugin's output held open took %v", d)
+	}
+}
+
+// TestStartFailures tests handshakes that fail.
+func TestStartFailures(t *testing.T) {
+	bad := handshake
+	bad.MagicCookieValue = "wrong"
+	if _, err := startPlugin(ProtocolGRPC, Options{Handshake: bad}); err == nil || !strings.Contains(err.Error(), "exited") {
+		t.Errorf("Start() with the wrong cookie error = %v, want the plugin to exit", err)
+	}
+
+	newer := handshake
+	newer.ProtocolVersion = 3
+	if _, err := startPlugin(ProtocolGRPC, Options{Handshake: newer}); err == nil || !strings.Contains(err.Error(), "version") {
+		t.Errorf("Start() with another protocol version error = %v", err)
+	}
+
+	if _, err := startPlugin("carrier-pigeon", Options{Handshake: handshake}); err == nil || !strings.Contains(err.Error(), "protocol") {
+		t.Errorf("Start() with an unknown protocol error = %v", err)
+	}
+
+	start := time.Now()
+	if _, err := startPlugin("hang", Options{Handshake: handshake, StartTimeout: 100 * time.Millisecond}); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Start() of a hung plugin error = %v, want a timeout", err)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("Start() of a hung plugin took %v", d)
+	}
+}
@@ -0,0 +1,194 @@
+package spawnexec
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Graph runs commands that depend on one another, like a tiny make: each
+// command is started as soon as all those it depends on have succeeded,
+// so that as many run at once as the dependencies allow. As soon as one
+// fails, the others still running are killed and no more are started.
+//
+// The zero value is an empty Graph ready to use.
+type Graph struct {
+	// MaxParallel, if positive, is the most commands run at once.
+	MaxParallel int
+
+	nodes []*graphNode
+}
+
+// graphNode is a command of a Graph.
+type graphNode struct {
+	name string
+	cmd  *Cmd
+	deps []string
+
+	output *prefixSuffixSaver // captures the output of a command without its own
+}
+
+// GraphError is returned by Graph.Run when a command fails.
+type GraphError struct {
+	// Name is the name the command was added with.
+	Name string
+	// Output is the beginning and end of the command's combined standard
+	// output and error, if neither was set, as for ExitError.Stderr.
+	Output []byte
+	// Err is the error the command failed with.
+	Err error
+}
+
+func (e *GraphError) Error() string {
+	return "exec: graph command " + strconv.Quote(e.Name) + ": " + e.Err.Error()
+}
+
+func (e *GraphError) Unwrap() error {
+	return e.Err
+}
+
+// Add adds cmd to the graph under name, to be run once the commands named
+// in deps have succeeded. The commands deps names may be added before or
+// after cmd. Run reports names that are added twice, missing or
+// depending on one another in a cycle.
+func (g *Graph) Add(name string, cmd *Cmd, deps ...string) {
+	g.nodes = append(g.nodes, &graphNode{name: name, cmd: cmd, deps: slices.Clone(deps)})
+}
+
+// Run runs the commands of the graph and waits for them. It returns nil
+// if all of them succeed, and otherwise a *GraphError for the first that
+// failed, once the others still running have been killed, or canceled by
+// their Cancel functions, and have exited. If ctx is done first, the
+// running commands are stopped in the same way and Run returns the
+// context's error.
+//
+// The combined output of a command whose Stdout and Stderr are both nil
+// is captured for the GraphError.
+func (g *Graph) Run(ctx context.Context) error {
+	dependents, waiting, err := g.check()
+	if err != nil {
+		return err
+	}
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		n   *graphNode
+		err error
+	}
+	results := make(chan result)
+	var ready []*graphNode
+	for _, n := range g.nodes {
+		if waiting[n] == 0 {
+			ready = append(ready, n)
+		}
+	}
+	running := 0
+	var failure error
+	for {
+		for failure == nil && runCtx.Err() == nil && len(ready) > 0 && (g.MaxParallel <= 0 || running < g.MaxParallel) {
+			n := ready[0]
+			ready = ready[1:]
+			running++
+			go func() {
+				results <- result{n, n.run(runCtx)}
+			}()
+		}
+		if running == 0 {
+			break
+		}
+		r := <-results
+		running--
+		if r.err != nil {
+			if failure == nil {
+				failure = r.err
+				cancel()
+			}
+			continue
+		}
+		for _, d := range dependents[r.n] {
+			if waiting[d]--; waiting[d] == 0 {
+				ready = append(ready, d)
+			}
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return failure
+}
+
+// check checks that the names of g's commands are unique and their
+// dependencies exist and have no cycles. It returns the commands that
+// depend on each command, and how many commands each depends on.
+func (g *Graph) check() (dependents map[*graphNode][]*graphNode, waiting map[*graphNode]int, err error) {
+	byName := make(map[string]*graphNode, len(g.nodes))
+	for _, n := range g.nodes {
+		if byName[n.name] != nil {
+			return nil, nil, errors.New("exec: graph command " + strconv.Quote(n.name) + " added twice")
+		}
+		byName[n.name] = n
+	}
+	dependents = make(map[*graphNode][]*graphNode)
+	waiting = make(map[*graphNode]int)
+	for _, n := range g.nodes {
+		for _, dep := range n.deps {
+			d := byName[dep]
+			if d == nil {
+				return nil, nil, errors.New("exec: graph command " + strconv.Quote(n.name) + " depends on unknown " + strconv.Quote(dep))
+			}
+			dependents[d] = append(dependents[d], n)
+			waiting[n]++
+		}
+	}
+
+	// Remove commands whose dependencies have all been removed until none
+	// are left, or only those in or behind a cycle.
+	left := maps.Clone(waiting)
+	var ready []*graphNode
+	for _, n := range g.nodes {
+		if left[n] == 0 {
+			ready = append(ready, n)
+		}
+	}
+	for len(ready) > 0 {
+		n := ready[len(ready)-1]
+		ready = ready[:len(ready)-1]
+		for _, d := range dependents[n] {
+			if left[d]--; left[d] == 0 {
+				ready = append(ready, d)
+			}
+		}
+	}
+	var cycle []string
+	for _, n := range g.nodes {
+		if left[n] > 0 {
+			cycle = append(cycle, strconv.Quote(n.name))
+		}
+	}
+	if len(cycle) > 0 {
+		return nil, nil, errors.New("exec: graph has a dependency cycle among " + strings.Join(cycle, ", "))
+	}
+	return dependents, waiting, nil
+}
+
+// run runs n's command, bound to ctx as by OutputContext.
+func (n *graphNode) run(ctx context.Context) error {
+	cmd := n.cmd
+	if cmd.Stdout == nil && cmd.Stderr == nil {
+		n.output = &prefixSuffixSaver{N: 32 << 10}
+		cmd.Stdout, cmd.Stderr = n.output, n.output
+	}
+	err := cmd.runContext(ctx)
+	if err == nil {
+		return nil
+	}
+	gerr := &GraphError{Name: n.name, Err: err}
+	if n.output != nil {
+		gerr.Output = n.output.Bytes()
+	}
+	return gerr
+}
@@ -0,0 +1,148 @@
+package spawnexec
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Group runs cooperating commands whose lifetimes are tied together, in
+// the manner of golang.org/x/sync/errgroup: the commands are bound to the
+// group's context, and as soon as one of them fails to start or exits
+// unsuccessfully the context is canceled, which tears down the others.
+//
+// A Group must be created with NewGroup.
+type Group struct {
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	mu      sync.Mutex
+	cmds    []*Cmd
+	started int // cmds[:started] have been started or failed to
+	errs    []error
+	failed  bool
+	usage   Usage // of the commands that have exited
+}
+
+// groupFailure is the cause with which a Group cancels its context once a
+// command has failed. The commands it then tears down fail with errors
+// wrapping it, which Wait leaves out.
+type groupFailure struct {
+	err error
+}
+
+func (e *groupFailure) Error() string {
+	return "exec: group command failed: " + e.err.Error()
+}
+
+func (e *groupFailure) Unwrap() error {
+	return e.err
+}
+
+// NewGroup returns a new Group and the context bound to it, derived from
+// ctx. The context is canceled when a command of the group fails or when
+// Wait returns, whichever comes first.
+func NewGroup(ctx context.Context) (*Group, context.Context) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	return &Group{ctx: ctx, cancel: cancel}, ctx
+}
+
+// Command returns a Cmd bound to the group's context, as CommandContext
+// does, and adds it to the group. It is started by Start or Wait unless it
+// has been started already; its Wait method must not be called directly.
+func (g *Group) Command(name string, arg ...string) *Cmd {
+	cmd := CommandContext(g.ctx, name, arg...)
+	g.mu.Lock()
+	g.cmds = append(g.cmds, cmd)
+	g.mu.Unlock()
+	return cmd
+}
+
+// Start starts the commands of the group that have not been started yet.
+// If one fails to start, the group's context is canceled and Start
+// returns the error; Wait must still be called to collect the commands
+// that did start.
+func (g *Group) Start() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for ; g.started < len(g.cmds); g.started++ {
+		cmd := g.cmds[g.started]
+		if cmd.Process != nil || g.failed {
+			continue
+		}
+		if err := cmd.Start(); err != nil {
+			err = wrapError(cmd.String()+": ", err)
+			g.fail(err)
+			g.started++
+			return err
+		}
+	}
+	return nil
+}
+
+// Wait starts any commands of the group that have not been started yet,
+// waits for all of them to exit and then cancels the group's context. It
+// returns the errors of the commands that failed, joined with errors.Join,
+// leaving out those of the commands torn down because another failed.
+func (g *Group) Wait() error {
+	defer g.cancel(context.Canceled)
+	g.Start()
+
+	g.mu.Lock()
+	var cmds []*Cmd
+	for _, cmd := range g.cmds {
+		if cmd.Process != nil {
+			cmds = append(cmds, cmd)
+		}
+	}
+	g.mu.Unlock()
+
+	collect := func(cmd *Cmd, err error) {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		g.usage.Add(cmd.ProcessState)
+		if err != nil {
+			g.fail(wrapError(cmd.String()+": ", err))
+		}
+	}
+	for {
+		i, err := WaitAny(cmds...)
+		if i >= 0 {
+			collect(cmds[i], err)
+			continue
+		}
+		// WaitAny failing with commands left to wait for is recorded,
+		// and the rest are waited for in turn instead.
+		for _, cmd := range cmds {
+			if cmd.finished {
+				continue
+			}
+			if err != nil {
+				g.mu.Lock()
+				g.fail(err)
+				g.mu.Unlock()
+				err = nil
+			}
+			collect(cmd, cmd.Wait())
+		}
+		break
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return errors.Join(g.errs...)
+}
+
+// fail records err and cancels the group's context, unless err is the
+// result of that cancellation. g.mu must be held.
+func (g *Group) fail(err error) {
+	var gf *groupFailure
+	if errors.As(err, &gf) {
+		return
+	}
+	g.errs = append(g.errs, err)
+	if !g.failed {
+		g.failed = true
+		g.cancel(&groupFailure{err: err})
+	}
+}
@@ -0,0 +1,65 @@
+package spawnexec
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// PreSpawnHook is a function run by Start before every command is
+// spawned; see RegisterPreSpawnHook.
+type PreSpawnHook func(*Cmd) error
+
+var (
+	preSpawnMu sync.Mutex // serializes changes to preSpawnHooks
+	// preSpawnHooks holds the registered hooks. It is replaced, never
+	// modified, so that Start can read it without locking.
+	preSpawnHooks atomic.Pointer[[]*PreSpawnHook]
+)
+
+// RegisterPreSpawnHook registers hook to be called by Start, and by
+// SubmitLaunchdJob, with every command before it is spawned, giving one
+// place to enforce a policy on all the commands a program runs, to scrub
+// their environments or to log them. If hook returns an error, the
+// command is not spawned and Start fails with an *Error wrapping it. A
+// hook may modify the Cmd; the command is validated after all the hooks
+// have run.
+//
+// Hooks run in the order they were registered, on the goroutine calling
+// Start, and must be safe for concurrent use. The returned function
+// unregisters hook.
+func RegisterPreSpawnHook(hook PreSpawnHook) (unregister func()) {
+	h := &hook
+	preSpawnMu.Lock()
+	defer preSpawnMu.Unlock()
+	var hooks []*PreSpawnHook
+	if p := preSpawnHooks.Load(); p != nil {
+		hooks = slices.Clone(*p)
+	}
+	hooks = append(hooks, h)
+	preSpawnHooks.Store(&hooks)
+
+	return func() {
+		preSpawnMu.Lock()
+		defer preSpawnMu.Unlock()
+		hooks := slices.DeleteFunc(slices.Clone(*preSpawnHooks.Load()), func(x *PreSpawnHook) bool {
+			return x == h
+		})
+		preSpawnHooks.Store(&hooks)
+	}
+}
+
+// runPreSpawnHooks runs the registered hooks on c, stopping at the first
+// that fails.
+func (c *Cmd) runPreSpawnHooks() error {
+	p := preSpawnHooks.Load()
+	if p == nil {
+		return nil
+	}
+	for _, hook := range *p {
+		if err := (*hook)(c); err != nil {
+			return &Error{Name: c.Path, Err: err}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package spawnexec
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrAlreadyRunning is wrapped by the error Start returns when another
+// instance of a command with SingleInstance set holds its lock.
+var ErrAlreadyRunning = errors.New("another instance is already running")
+
+// instanceLockPath returns the lock file named by SingleInstance.
+func instanceLockPath(name string) string {
+	if strings.Contains(name, "/") {
+		return name
+	}
+	// os.TempDir is per user on darwin; the lock is to be machine-wide.
+	return filepath.Join("/tmp", "spawnexec-"+name+".lock")
+}
+
+// lockInstance takes the SingleInstance lock of c, if it has one.
+func (c *Cmd) lockInstance() error {
+	if c.SingleInstance == "" {
+		return nil
+	}
+	path := instanceLockPath(c.SingleInstance)
+	// flock needs no write access, so another user's lock file can be
+	// locked read-only.
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o666)
+	if errors.Is(err, os.ErrPermission) {
+		f, err = os.Open(path)
+	}
+	if err != nil {
+		return &Error{Name: c.Path, Err: err}
+	}
+	for {
+		err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if err != unix.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		f.Close()
+		if err == unix.EWOULDBLOCK {
+			return &Error{Name: c.Path, Err: ErrAlreadyRunning}
+		}
+		return &Error{Name: c.Path, Err: os.NewSyscallError("flock", err)}
+	}
+	c.instanceLock = f
+	return nil
+}
+
+// unlockInstance releases the SingleInstance lock of c, if it holds it.
+func (c *Cmd) unlockInstance() {
+	if c.instanceLock != nil {
+		c.instanceLock.Close()
+		c.instanceLock = nil
+	}
+}
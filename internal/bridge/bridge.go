@@ -0,0 +1,17 @@
+// Package bridge gives the subpackages of spawnexec access to the os
+// package values that back spawnexec's Process and ProcessState, without
+// adding them to spawnexec's exported API.
+//
+// The functions are installed by package spawnexec when it is initialized.
+package bridge
+
+import "os"
+
+var (
+	// Process returns the *os.Process backing a *spawnexec.Process.
+	Process func(p any) *os.Process
+
+	// ProcessState returns the *os.ProcessState backing a
+	// *spawnexec.ProcessState, or nil if it has none.
+	ProcessState func(ps any) *os.ProcessState
+)
@@ -0,0 +1,42 @@
+package spawnexec
+
+// IOPolicy is a darwin disk I/O policy, one of the IOPOL_* levels of
+// setiopolicy_np. The zero IOPolicy leaves the policy inherited from the
+// calling process.
+type IOPolicy int
+
+const (
+	// IOPolicyImportant is the normal policy, with I/O never throttled
+	// on behalf of other processes.
+	IOPolicyImportant IOPolicy = 1
+	// IOPolicyPassive issues I/O that neither throttles nor is
+	// throttled, such as for backup readers.
+	IOPolicyPassive IOPolicy = 2
+	// IOPolicyThrottle throttles I/O whenever important I/O is under way,
+	// the policy of background tasks.
+	IOPolicyThrottle IOPolicy = 3
+	// IOPolicyUtility throttles I/O less aggressively than
+	// IOPolicyThrottle.
+	IOPolicyUtility IOPolicy = 4
+	// IOPolicyStandard throttles I/O slightly, under interactive I/O.
+	IOPolicyStandard IOPolicy = 5
+)
+
+// QoSClamp is a darwin quality-of-service ceiling for all of a process's
+// threads, one of the POSIX_SPAWN_QOS_CLAMP_* values of
+// posix_spawnattr_set_qos_clamp_np.
+type QoSClamp uint64
+
+const (
+	// QoSClampNone leaves the quality of service unclamped.
+	QoSClampNone QoSClamp = 0
+	// QoSClampUtility clamps to the utility class, for long-running
+	// work the user is aware of.
+	QoSClampUtility QoSClamp = 1
+	// QoSClampBackground clamps to the background class, for work the
+	// user is not waiting for, with CPU, I/O and timers throttled.
+	QoSClampBackground QoSClamp = 2
+	// QoSClampMaintenance clamps to the maintenance class, below
+	// background.
+	QoSClampMaintenance QoSClamp = 3
+)
@@ -0,0 +1,43 @@
+package spawnexec
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// IOStats counts the bytes copied to and from a command's standard input,
+// output and error.
+type IOStats struct {
+	Stdin  int64
+	Stdout int64
+	Stderr int64
+}
+
+// IOStats returns the bytes copied so far between the command and its
+// Stdin, Stdout and Stderr. Once Wait has returned they are final, so
+// that the volume of data can be logged, and input the command did not
+// read in full, or output cut short by WaitDelay, noticed.
+//
+// Only what the package copies is counted: not data that goes directly
+// to or from an *os.File or a Path, nor through the pipes returned by
+// StdinPipe, StdoutPipe and StderrPipe. When Stdout and Stderr are the
+// same writer, the output of both is counted as Stdout.
+func (c *Cmd) IOStats() IOStats {
+	return IOStats{
+		Stdin:  c.ioStats[0].Load(),
+		Stdout: c.ioStats[1].Load(),
+		Stderr: c.ioStats[2].Load(),
+	}
+}
+
+// countingWriter counts the bytes written through it to w.
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (cw countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n.Add(int64(n))
+	return n, err
+}
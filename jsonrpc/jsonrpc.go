@@ -0,0 +1,367 @@
+// Package jsonrpc hosts plugins that speak JSON-RPC 2.0 over their
+// standard input and output, framed with Content-Length headers as the
+// Language Server Protocol does.
+//
+// Start spawns the plugin and returns a Conn that correlates requests
+// with their responses, delivers the plugin's own requests and
+// notifications to a Handler, and shuts the plugin down:
+//
+//	conn, err := jsonrpc.Start(spawnexec.Command("my-plugin"), handler)
+//	if err != nil {
+//		return err
+//	}
+//	defer conn.Close()
+//
+//	var result InitializeResult
+//	err = conn.Call(ctx, "initialize", params, &result)
+//
+// NewConn speaks the same protocol over any stream, such as a plugin's
+// own os.Stdin and os.Stdout.
+package jsonrpc
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/orospakr/spawnexec"
+)
+
+// Error codes defined by JSON-RPC 2.0.
+const (
+	ParseError     = -32700
+	InvalidRequest = -32600
+	MethodNotFound = -32601
+	InvalidParams  = -32602
+	InternalError  = -32603
+)
+
+// ErrClosed is returned by calls on a Conn that has been closed, or whose
+// peer has closed its end.
+var ErrClosed = errors.New("jsonrpc: connection closed")
+
+// Error is an error response. A Handler may return one to choose the code
+// and data sent to the peer.
+type Error struct {
+	Code    int64           `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return "jsonrpc: " + e.Message + " (" + strconv.FormatInt(e.Code, 10) + ")"
+}
+
+// Handler handles a request or notification from the peer. The result of
+// a request is sent back encoded as JSON; for a notification it is
+// discarded. ctx is canceled when the Conn is closed.
+//
+// Requests are handled concurrently, each in its own goroutine.
+// Notifications are handled one at a time, in the order they arrive, so
+// a Handler must not wait for a Call to return while handling one.
+type Handler func(ctx context.Context, method string, params json.RawMessage) (result any, err error)
+
+// message is any JSON-RPC 2.0 message: a request, a notification or a
+// response.
+type message struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+	Result  json.RawMessage  `json:"result,omitempty"`
+	Error   *Error           `json:"error,omitempty"`
+}
+
+// Conn is a JSON-RPC 2.0 connection.
+type Conn struct {
+	r       *bufio.Reader
+	w       io.WriteCloser
+	handler Handler
+	cmd     *spawnexec.Cmd
+
+	ctx    context.Context // for handlers, canceled by Close
+	cancel context.CancelFunc
+
+	wmu sync.Mutex // serializes writes
+
+	mu      sync.Mutex
+	nextID  int64
+	pending map[int64]chan *message
+	err     error // why reading stopped
+
+	done chan struct{} // closed once reading stops
+}
+
+// NewConn returns a Conn reading messages from r and writing them to w.
+// handler may be nil, in which case requests from the peer fail with
+// MethodNotFound and notifications are ignored.
+func NewConn(r io.Reader, w io.WriteCloser, handler Handler) *Conn {
+	c := &Conn{
+		r:       bufio.NewReader(r),
+		w:       w,
+		handler: handler,
+		pending: make(map[int64]chan *message),
+		done:    make(chan struct{}),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	go c.read()
+	return c
+}
+
+// Start starts cmd and returns a Conn speaking to it over its standard
+// input and output. cmd's Stdin and Stdout must be nil; its Stderr is
+// left as it is, for the plugin's logs.
+func Start(cmd *spawnexec.Cmd, handler Handler) (*Conn, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	c := NewConn(stdout, stdin, handler)
+	c.cmd = cmd
+	return c, nil
+}
+
+// Cmd returns the command started by Start, or nil.
+func (c *Conn) Cmd() *spawnexec.Cmd {
+	return c.cmd
+}
+
+// Call sends a request and waits for its response, decoding the result
+// into result unless it is nil. An error response is returned as an
+// *Error. If ctx is done first, Call returns its error; the response is
+// then discarded when it arrives.
+func (c *Conn) Call(ctx context.Context, method string, params, result any) error {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	c.nextID++
+	id := c.nextID
+	ch := make(chan *message, 1)
+	c.pending[id] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	raw := json.RawMessage(strconv.FormatInt(id, 10))
+	if err := c.send(&message{ID: &raw, Method: method}, params); err != nil {
+		return err
+	}
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return ErrClosed
+		}
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if result == nil {
+			return nil
+		}
+		return json.Unmarshal(resp.Result, result)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Notify sends a notification, which has no response.
+func (c *Conn) Notify(method string, params any) error {
+	return c.send(&message{Method: method}, params)
+}
+
+// send encodes params into m and writes it.
+func (c *Conn) send(m *message, params any) error {
+	if params != nil {
+		b, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		m.Params = b
+	}
+	return c.write(m)
+}
+
+// write writes m with its Content-Length header.
+func (c *Conn) write(m *message) error {
+	m.JSONRPC = "2.0"
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if _, err := fmt.Fprintf(c.w, "Content-Length: %d\r\n\r\n%s", len(b), b); err != nil {
+		if errors.Is(err, os.ErrClosed) {
+			return ErrClosed
+		}
+		return err
+	}
+	return nil
+}
+
+// read reads and dispatches messages until the stream ends.
+func (c *Conn) read() {
+	tp := textproto.NewReader(c.r)
+	var err error
+	for {
+		var m *message
+		if m, err = readMessage(tp, c.r); err != nil {
+			break
+		}
+		switch {
+		case m.Method != "" && m.ID != nil:
+			go c.handle(m)
+		case m.Method != "":
+			if c.handler != nil {
+				c.handler(c.ctx, m.Method, m.Params)
+			}
+		case m.ID != nil:
+			id, perr := strconv.ParseInt(string(*m.ID), 10, 64)
+			if perr != nil {
+				continue
+			}
+			c.mu.Lock()
+			ch := c.pending[id]
+			delete(c.pending, id)
+			c.mu.Unlock()
+			if ch != nil {
+				ch <- m
+			}
+		}
+	}
+	if err == io.EOF || errors.Is(err, os.ErrClosed) {
+		err = ErrClosed
+	}
+	c.mu.Lock()
+	c.err = err
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+	c.mu.Unlock()
+	close(c.done)
+}
+
+// readMessage reads one framed message.
+func readMessage(tp *textproto.Reader, r io.Reader) (*message, error) {
+	h, err := tp.ReadMIMEHeader()
+	if err != nil {
+		if len(h) == 0 && (err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF)) {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	n, err := strconv.Atoi(h.Get("Content-Length"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("jsonrpc: bad Content-Length %q", h.Get("Content-Length"))
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	m := new(message)
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("jsonrpc: %w", err)
+	}
+	return m, nil
+}
+
+// handle runs the handler for a request and sends its response.
+func (c *Conn) handle(m *message) {
+	resp := &message{ID: m.ID}
+	var result any
+	var err error
+	if c.handler == nil {
+		err = &Error{Code: MethodNotFound, Message: "method not found: " + m.Method}
+	} else {
+		result, err = c.handler(c.ctx, m.Method, m.Params)
+	}
+	if err == nil {
+		resp.Result, err = json.Marshal(result)
+	}
+	if err != nil {
+		rpcErr, ok := err.(*Error)
+		if !ok {
+			rpcErr = &Error{Code: InternalError, Message: err.Error()}
+		}
+		resp.Result, resp.Error = nil, rpcErr
+	}
+	c.write(resp)
+}
+
+// Done returns a channel that is closed once the peer has closed its end
+// of the connection, or reading from it has failed.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection stopped, ErrClosed if the peer closed
+// it, or nil while it is open.
+func (c *Conn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Shutdown shuts the plugin down the way the Language Server Protocol
+// does: it calls "shutdown", sends the "exit" notification, closes the
+// plugin's input and waits for it to exit. If ctx is done first, the
+// plugin is killed. Shutdown returns the error of the call or of
+// Cmd.Wait.
+func (c *Conn) Shutdown(ctx context.Context) error {
+	err := c.Call(ctx, "shutdown", nil, nil)
+	if err == nil {
+		err = c.Notify("exit", nil)
+	}
+	c.w.Close()
+	if c.cmd == nil {
+		c.cancel()
+		return err
+	}
+	waited := make(chan error, 1)
+	go func() { waited <- c.cmd.Wait() }()
+	var werr error
+	select {
+	case werr = <-waited:
+	case <-ctx.Done():
+		c.cmd.Process.Kill()
+		werr = <-waited
+	}
+	c.cancel()
+	if err != nil {
+		return err
+	}
+	return werr
+}
+
+// Close closes the connection without ceremony: it closes the plugin's
+// input, kills the plugin if there is one, and waits for it. Handlers
+// still running see their context canceled.
+func (c *Conn) Close() error {
+	c.cancel()
+	err := c.w.Close()
+	if c.cmd == nil {
+		return err
+	}
+	c.cmd.Process.Kill()
+	c.cmd.Wait()
+	return nil
+}
@@ -0,0 +1,135 @@
+package jsonrpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/orospakr/spawnexec"
+)
+
+// TestMain runs the test binary as a plugin when it is started by a test.
+func TestMain(m *testing.M) {
+	if os.Getenv("JSONRPC_TEST_PLUGIN") == "1" {
+		plugin()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// plugin serves a few methods over standard input and output.
+func plugin() {
+	var conn *Conn
+	conn = NewConn(os.Stdin, os.Stdout, func(ctx context.Context, method string, params json.RawMessage) (any, error) {
+		switch method {
+		case "add":
+			var args [2]int
+			if err := json.Unmarshal(params, &args); err != nil {
+				return nil, &Error{Code: InvalidParams, Message: err.Error()}
+			}
+			return args[0] + args[1], nil
+		case "ping":
+			// Calls back into the host.
+			var pong string
+			err := conn.Call(ctx, "pong", nil, &pong)
+			return pong, err
+		case "shout":
+			conn.Notify("shouted", string(params))
+			return nil, nil
+		case "shutdown":
+			return nil, nil
+		case "exit":
+			os.Exit(0)
+		}
+		return nil, &Error{Code: MethodNotFound, Message: "no " + method}
+	})
+	<-conn.Done()
+	os.Exit(1)
+}
+
+// startPlugin starts the test binary as a plugin.
+func startPlugin(t *testing.T, handler Handler) *Conn {
+	t.Helper()
+	cmd := spawnexec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "JSONRPC_TEST_PLUGIN=1")
+	conn, err := Start(cmd, handler)
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	return conn
+}
+
+// TestCall tests requests, notifications and calls from the plugin.
+func TestCall(t *testing.T) {
+	shouted := make(chan string, 1)
+	conn := startPlugin(t, func(ctx context.Context, method string, params json.RawMessage) (any, error) {
+		switch method {
+		case "pong":
+			return "pong!", nil
+		case "shouted":
+			var s string
+			json.Unmarshal(params, &s)
+			shouted <- s
+			return nil, nil
+		}
+		return nil, errors.New("unexpected " + method)
+	})
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var sum int
+	if err := conn.Call(ctx, "add", []int{2, 3}, &sum); err != nil || sum != 5 {
+		t.Errorf("Call(add) = %d, %v, want 5", sum, err)
+	}
+	var pong string
+	if err := conn.Call(ctx, "ping", nil, &pong); err != nil || pong != "pong!" {
+		t.Errorf("Call(ping) = %q, %v, want pong!", pong, err)
+	}
+	var rpcErr *Error
+	if err := conn.Call(ctx, "missing", nil, nil); !errors.As(err, &rpcErr) || rpcErr.Code != MethodNotFound {
+		t.Errorf("Call(missing) error = %v, want MethodNotFound", err)
+	}
+	if err := conn.Call(ctx, "add", "nope", nil); !errors.As(err, &rpcErr) || rpcErr.Code != InvalidParams {
+		t.Errorf("Call(add) with bad params error = %v, want InvalidParams", err)
+	}
+
+	if err := conn.Notify("shout", "hi"); err != nil {
+		t.Fatalf("Notify() error = %v", err)
+	}
+	select {
+	case s := <-shouted:
+		if s != `"hi"` {
+			t.Errorf("shouted %q, want %q", s, `"hi"`)
+		}
+	case <-ctx.Done():
+		t.Fatal("no notification from the plugin")
+	}
+}
+
+// TestShutdown tests shutting a plugin down and losing one.
+func TestShutdown(t *testing.T) {
+	conn := startPlugin(t, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := conn.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown() error = %v", err)
+	}
+	if err := conn.Call(ctx, "add", []int{1, 1}, nil); !errors.Is(err, ErrClosed) {
+		t.Errorf("Call() after Shutdown error = %v, want ErrClosed", err)
+	}
+
+	conn = startPlugin(t, nil)
+	conn.Cmd().Process.Kill()
+	if err := conn.Call(ctx, "add", []int{1, 1}, nil); err == nil {
+		t.Error("Call() to a killed plugin succeeded")
+	}
+	<-conn.Done()
+	if err := conn.Err(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Err() = %v, want ErrClosed", err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,213 @@
+package spawnexec
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// LaunchdJob is a command submitted to launchd as a transient job by
+// SubmitLaunchdJob. launchd rather than the calling process is its parent,
+// so it outlives the caller, and in the user domain it survives logout.
+type LaunchdJob struct {
+	// Label is the job's launchd label.
+	Label string
+	// Domain is the launchd domain holding the job, such as "user/501".
+	Domain string
+}
+
+// LaunchdStatus describes the state of a launchd job, as reported by
+// launchctl print.
+type LaunchdStatus struct {
+	// Running reports whether the job's process is running, and Pid is
+	// its pid if so.
+	Running bool
+	Pid     int
+	// LastExitCode is the exit code of the job's last run, or -1 if it
+	// has not exited.
+	LastExitCode int
+}
+
+// SubmitLaunchdJob submits cmd to launchd as a transient job with the
+// given label in domain, such as "gui/501" or "user/501". If domain is
+// empty, the user domain of the calling user is used. The job is started
+// at once and is not restarted when it exits; it is forgotten by launchd
+// when removed or when the machine restarts.
+//
+// The job is described by cmd's Path, Args, Env, Dir and its StdinPath,
+// StdoutPath and StderrPath; launchd opens the files itself. Its Stdin,
+// Stdout and Stderr must be nil, since launchd cannot be handed the
+// calling process's readers and writers. If Env is nil, the job gets
+// launchd's default environment rather than the caller's.
+//
+// SubmitLaunchdJob is only supported on darwin.
+func SubmitLaunchdJob(label string, cmd *Cmd, domain string) (*LaunchdJob, error) {
+	if label == "" {
+		return nil, errors.New("exec: launchd job label is empty")
+	}
+	if err := lookPathError(cmd.lookPathErr, cmd.DotPolicy); err != nil {
+		return nil, err
+	}
+	if err := cmd.validate(); err != nil {
+		return nil, err
+	}
+	if cmd.Stdin != nil || cmd.Stdout != nil || cmd.Stderr != nil {
+		return nil, errors.New("exec: launchd jobs take StdinPath, StdoutPath and StderrPath, not Stdin, Stdout or Stderr")
+	}
+	if domain == "" {
+		domain = "user/" + strconv.Itoa(os.Getuid())
+	}
+
+	plist, err := os.CreateTemp("", "spawnexec-*.plist")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(plist.Name())
+	_, err = plist.Write(launchdPlist(label, cmd))
+	if closeErr := plist.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := launchctl("bootstrap", domain, plist.Name()); err != nil {
+		return nil, err
+	}
+	return &LaunchdJob{Label: label, Domain: domain}, nil
+}
+
+// Status reports the state of the job.
+func (j *LaunchdJob) Status() (LaunchdStatus, error) {
+	out, err := Command("launchctl", "print", j.target()).CombinedOutput()
+	if err != nil {
+		return LaunchdStatus{}, launchctlError("print", out, err)
+	}
+	return parseLaunchdStatus(out), nil
+}
+
+// Remove stops the job, if it is running, and removes it from launchd.
+func (j *LaunchdJob) Remove() error {
+	return launchctl("bootout", j.target())
+}
+
+// target returns the launchctl service target naming j.
+func (j *LaunchdJob) target() string {
+	return j.Domain + "/" + j.Label
+}
+
+// launchctl runs launchctl with the given arguments.
+func launchctl(args ...string) error {
+	out, err := Command("launchctl", args...).CombinedOutput()
+	if err != nil {
+		return launchctlError(args[0], out, err)
+	}
+	return nil
+}
+
+// launchctlError wraps the failure of a launchctl subcommand with its
+// output.
+func launchctlError(subcommand string, out []byte, err error) error {
+	if msg := strings.TrimSpace(string(out)); msg != "" {
+		return fmt.Errorf("launchctl %s: %w: %s", subcommand, err, msg)
+	}
+	return fmt.Errorf("launchctl %s: %w", subcommand, err)
+}
+
+// launchdPlist returns the property list describing cmd as a transient
+// launchd job.
+func launchdPlist(label string, cmd *Cmd) []byte {
+	var b bytes.Buffer
+	str := func(s string) {
+		b.WriteString("<string>")
+		xml.EscapeText(&b, []byte(s))
+		b.WriteString("</string>\n")
+	}
+	key := func(k string) {
+		b.WriteString("<key>")
+		xml.EscapeText(&b, []byte(k))
+		b.WriteString("</key>\n")
+	}
+	keyString := func(k, v string) {
+		if v != "" {
+			key(k)
+			str(v)
+		}
+	}
+
+	b.WriteString(xml.Header)
+	b.WriteString(`<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">` + "\n")
+	b.WriteString("<plist version=\"1.0\">\n<dict>\n")
+	keyString("Label", label)
+	keyString("Program", cmd.Path)
+	key("ProgramArguments")
+	b.WriteString("<array>\n")
+	args := cmd.Args
+	if len(args) == 0 {
+		args = []string{cmd.Path}
+	}
+	for _, arg := range args {
+		str(arg)
+	}
+	b.WriteString("</array>\n")
+	keyString("WorkingDirectory", cmd.Dir)
+	if cmd.Env != nil {
+		key("EnvironmentVariables")
+		b.WriteString("<dict>\n")
+		// As for a spawned process, the last value of a duplicated
+		// variable wins.
+		last := make(map[string]int, len(cmd.Env))
+		for i, kv := range cmd.Env {
+			k, _, _ := strings.Cut(kv, "=")
+			last[k] = i
+		}
+		for i, kv := range cmd.Env {
+			k, v, _ := strings.Cut(kv, "=")
+			if last[k] == i {
+				key(k)
+				str(v)
+			}
+		}
+		b.WriteString("</dict>\n")
+	}
+	keyString("StandardInPath", cmd.StdinPath)
+	keyString("StandardOutPath", cmd.StdoutPath)
+	keyString("StandardErrorPath", cmd.StderrPath)
+	key("RunAtLoad")
+	b.WriteString("<true/>\n")
+	key("KeepAlive")
+	b.WriteString("<false/>\n")
+	key("AbandonProcessGroup")
+	b.WriteString("<true/>\n")
+	b.WriteString("</dict>\n</plist>\n")
+	return b.Bytes()
+}
+
+// parseLaunchdStatus parses the output of launchctl print for a service.
+func parseLaunchdStatus(out []byte) LaunchdStatus {
+	st := LaunchdStatus{LastExitCode: -1}
+	for _, line := range strings.Split(string(out), "\n") {
+		k, v, ok := strings.Cut(strings.TrimSpace(line), " = ")
+		if !ok {
+			continue
+		}
+		switch k {
+		case "state":
+			st.Running = v == "running"
+		case "pid":
+			st.Pid, _ = strconv.Atoi(v)
+		case "last exit code":
+			if code, err := strconv.Atoi(v); err == nil {
+				st.LastExitCode = code
+			}
+		}
+	}
+	if !st.Running {
+		st.Pid = 0
+	}
+	return st
+}
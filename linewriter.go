@@ -0,0 +1,112 @@
+package spawnexec
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+)
+
+// maxLineWriterLine is the longest line a LineWriter buffers. Longer lines
+// are broken up so that a child that never writes a newline cannot make
+// the buffer grow without bound.
+const maxLineWriterLine = 64 * 1024
+
+// TimestampFormat is the time layout used by NewTimestampWriter.
+const TimestampFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// LineWriter is an io.Writer that splits the data written to it into
+// lines and writes each line to an underlying writer after decorating it,
+// for example with a prefix. Each decorated line is written with a single
+// Write call.
+//
+// A LineWriter is safe for concurrent use, so the same one can be used as
+// both Cmd.Stdout and Cmd.Stderr, or shared between several commands
+// without lines being interleaved. A final line that is not terminated by
+// a newline is held back until Flush is called.
+type LineWriter struct {
+	w        io.Writer
+	decorate func(dst, line []byte) []byte
+
+	mu  sync.Mutex
+	buf []byte // incomplete line
+	out []byte // scratch space for decorated lines
+}
+
+// NewLineWriter returns a LineWriter that writes each line to w as
+// decorate(dst, line) would append it to dst. The line passed to decorate
+// includes its trailing newline.
+func NewLineWriter(w io.Writer, decorate func(dst, line []byte) []byte) *LineWriter {
+	return &LineWriter{w: w, decorate: decorate}
+}
+
+// NewPrefixWriter returns a LineWriter that writes each line to w preceded
+// by prefix, for example "worker-3 | ".
+func NewPrefixWriter(prefix string, w io.Writer) *LineWriter {
+	return NewLineWriter(w, func(dst, line []byte) []byte {
+		dst = append(dst, prefix...)
+		return append(dst, line...)
+	})
+}
+
+// NewTimestampWriter returns a LineWriter that writes each line to w
+// preceded by the time it was completed, in TimestampFormat, and a space.
+func NewTimestampWriter(w io.Writer) *LineWriter {
+	return NewLineWriter(w, func(dst, line []byte) []byte {
+		dst = time.Now().AppendFormat(dst, TimestampFormat)
+		dst = append(dst, ' ')
+		return append(dst, line...)
+	})
+}
+
+// Write writes every complete line in p to the underlying writer and
+// buffers any remainder.
+func (l *LineWriter) Write(p []byte) (n int, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n = len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			l.buf = append(l.buf, p...)
+			if len(l.buf) >= maxLineWriterLine {
+				err = l.writeLine(append(l.buf, '\n'))
+				l.buf = l.buf[:0]
+			}
+			return n, err
+		}
+		line := p[:i+1]
+		if len(l.buf) > 0 {
+			l.buf = append(l.buf, line...)
+			line = l.buf
+		}
+		err = l.writeLine(line)
+		l.buf = l.buf[:0]
+		if err != nil {
+			return n, err
+		}
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// Flush writes any buffered incomplete line, terminated with a newline.
+// Call it after Wait to make sure the last line of output is not lost.
+func (l *LineWriter) Flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.buf) == 0 {
+		return nil
+	}
+	err := l.writeLine(append(l.buf, '\n'))
+	l.buf = l.buf[:0]
+	return err
+}
+
+// writeLine decorates line and writes it. l.mu must be held.
+func (l *LineWriter) writeLine(line []byte) error {
+	l.out = l.decorate(l.out[:0], line)
+	_, err := l.w.Write(l.out)
+	return err
+}
@@ -0,0 +1,65 @@
+package spawnexec
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+)
+
+// logger holds the package's Logger, if any.
+var logger atomic.Pointer[slog.Logger]
+
+// SetLogger sets the logger to which the internals of spawning and
+// waiting for commands whose Logger is nil are logged, at debug level,
+// and returns the previous one. The logger is nil, and nothing is logged,
+// unless SetLogger is called.
+func SetLogger(l *slog.Logger) *slog.Logger {
+	return logger.Swap(l)
+}
+
+// log returns the logger for c, or nil if debug logging is off for it, so
+// that callers build no log attributes unless they are wanted.
+func (c *Cmd) log() *slog.Logger {
+	l := c.Logger
+	if l == nil {
+		l = logger.Load()
+	}
+	if l == nil || !l.Enabled(context.Background(), slog.LevelDebug) {
+		return nil
+	}
+	return l
+}
+
+// logStart logs that c is being started and how.
+func (c *Cmd) logStart() {
+	if l := c.log(); l != nil {
+		l.Debug("spawnexec: starting", "cmd", c.String(), "path", c.Path, "dir", c.Dir, "backend", c.backend)
+	}
+}
+
+// logSpawned logs the outcome of spawning c: err, or the new process.
+func (c *Cmd) logSpawned(err error) {
+	l := c.log()
+	if l == nil {
+		return
+	}
+	took := c.timing.Spawned.Sub(c.timing.Marshaled)
+	if err != nil {
+		l.Debug("spawnexec: spawn failed", "path", c.Path, "err", err, "took", took)
+		return
+	}
+	l.Debug("spawnexec: spawned", "path", c.Path, "pid", c.Process.Pid, "took", took)
+}
+
+// logReaped logs the outcome of waiting for c's process.
+func (c *Cmd) logReaped(err error) {
+	l := c.log()
+	if l == nil {
+		return
+	}
+	if c.ProcessState == nil {
+		l.Debug("spawnexec: wait failed", "pid", c.Process.Pid, "err", err)
+		return
+	}
+	l.Debug("spawnexec: reaped", "pid", c.Process.Pid, "status", c.ProcessState.String(), "err", err)
+}
@@ -1,42 +1,158 @@
 package spawnexec
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 )
 
-// LookPath searches for an executable named file in the directories named
+// DotPolicy says what to do with an executable that a PATH lookup finds
+// relative to the current directory, because PATH holds "." or an empty
+// or relative entry. Running it is usually a mistake, and can be an
+// attack if the current directory is not trusted.
+type DotPolicy int
+
+const (
+	// RejectDot, the package's initial policy, matches os/exec: LookPath
+	// returns the relative path along with an error wrapping ErrDot, and
+	// a command resolved to it fails to start with that error.
+	RejectDot DotPolicy = iota + 1
+	// AllowDot lets a command resolved to a relative path start, as
+	// clearing Cmd.Err does with os/exec, while LookPath still reports
+	// ErrDot.
+	AllowDot
+	// LegacyImplicitDot restores the behaviour of Go before 1.19, as
+	// GODEBUG=execerrdot=0 does: LookPath does not report ErrDot at all
+	// and commands resolved to relative paths start.
+	LegacyImplicitDot
+)
+
+// dotPolicy holds the package's DotPolicy.
+var dotPolicy atomic.Int64
+
+func init() {
+	p := RejectDot
+	for _, kv := range strings.Split(os.Getenv("GODEBUG"), ",") {
+		if strings.TrimSpace(kv) == "execerrdot=0" {
+			p = LegacyImplicitDot
+		}
+	}
+	dotPolicy.Store(int64(p))
+}
+
+// SetDotPolicy sets the DotPolicy of LookPath, Prepare and of commands
+// whose DotPolicy field is zero, and returns the previous one. The
+// initial policy is RejectDot, or LegacyImplicitDot if GODEBUG holds
+// execerrdot=0. SetDotPolicy panics if p is not one of the policies.
+func SetDotPolicy(p DotPolicy) DotPolicy {
+	if p < RejectDot || p > LegacyImplicitDot {
+		panic("spawnexec: SetDotPolicy with unknown policy")
+	}
+	return DotPolicy(dotPolicy.Swap(int64(p)))
+}
+
+// allowsDot reports whether p, or the package's policy if p is zero, lets
+// a command resolved to a relative path start.
+func (p DotPolicy) allowsDot() bool {
+	if p == 0 {
+		p = DotPolicy(dotPolicy.Load())
+	}
+	return p == AllowDot || p == LegacyImplicitDot
+}
+
+// lookPathError returns the error that keeps a command resolved by
+// LookPath with err from starting under policy, if any.
+func lookPathError(err error, policy DotPolicy) error {
+	if errors.Is(err, ErrDot) && policy.allowsDot() {
+		return nil
+	}
+	return err
+}
+
+// Resolver resolves the name of a command to the executable to run. The
+// package's Resolver, set with SetResolver, is used by LookPath and so by
+// Command and Prepare.
+type Resolver interface {
+	// LookPath returns the path of the executable named file, or an error,
+	// as the package-level LookPath does.
+	LookPath(file string) (string, error)
+}
+
+// PathResolver is a Resolver that searches a list of directories, as
+// LookPath does by default. It can also try a list of extensions, as
+// Windows does with PATHEXT, so that "foo" resolves to "foo.exe" or
+// "foo.bat", for example for Windows executables run through WSL interop.
+type PathResolver struct {
+	// Path is the list of directories to search, in the form of PATH. If
+	// it is empty, PATH as it is at the time of the lookup is used.
+	Path string
+	// PathExt is the list of extensions to try, in the form of PATHEXT,
+	// such as ".COM;.EXE;.BAT". A name is tried as it is first and then
+	// with each extension in turn, unless it already ends with one of
+	// them. Extensions are matched without regard to case.
+	PathExt string
+}
+
+// resolver holds the package's Resolver.
+var resolver atomic.Pointer[Resolver]
+
+// SetResolver sets the Resolver used by LookPath, and so by Command and
+// Prepare, and returns the previous one. The initial Resolver is the zero
+// PathResolver; if r is nil, it is restored.
+func SetResolver(r Resolver) Resolver {
+	if r == nil {
+		r = PathResolver{}
+	}
+	if prev := resolver.Swap(&r); prev != nil {
+		return *prev
+	}
+	return PathResolver{}
+}
+
+// LookPath searches for an executable named file using the package's
+// Resolver; see SetResolver. By default, it searches the directories named
 // by the PATH environment variable. If file contains a slash, it is tried
 // directly and the PATH is not consulted. Otherwise, on success, the result
 // is an absolute path.
 //
 // In older versions of Go, LookPath could return a path relative to the current
 // directory. As of Go 1.19, LookPath will instead return that path along with
-// an error satisfying errors.Is(err, ErrDot). See the package documentation for
-// more details.
+// an error satisfying errors.Is(err, ErrDot), unless the package's DotPolicy
+// is LegacyImplicitDot; see SetDotPolicy.
 func LookPath(file string) (string, error) {
+	if r := resolver.Load(); r != nil {
+		return (*r).LookPath(file)
+	}
+	return PathResolver{}.LookPath(file)
+}
+
+// LookPath implements Resolver.
+func (r PathResolver) LookPath(file string) (string, error) {
+	exts := r.exts(file)
+
 	// If file contains a slash, try it directly.
 	if strings.Contains(file, "/") {
-		err := findExecutable(file)
+		path, err := findExecutableExt(file, exts)
 		if err == nil {
-			return file, nil
+			return path, nil
 		}
 		return "", &Error{Name: file, Err: err}
 	}
 
-	path := os.Getenv("PATH")
-	for _, dir := range filepath.SplitList(path) {
+	list := r.Path
+	if list == "" {
+		list = os.Getenv("PATH")
+	}
+	for _, dir := range filepath.SplitList(list) {
 		if dir == "" {
 			// Unix shell semantics: path element "" means "."
 			dir = "."
 		}
-		path := filepath.Join(dir, file)
-		if err := findExecutable(path); err == nil {
-			if !filepath.IsAbs(path) {
-				if execErr := isExecutable(path); execErr {
-					return path, &Error{Name: file, Err: ErrDot}
-				}
+		if path, err := findExecutableExt(filepath.Join(dir, file), exts); err == nil {
+			if !filepath.IsAbs(path) && DotPolicy(dotPolicy.Load()) != LegacyImplicitDot {
+				return path, &Error{Name: file, Err: ErrDot}
 			}
 			return path, nil
 		}
@@ -44,6 +160,46 @@ func LookPath(file string) (string, error) {
 	return "", &Error{Name: file, Err: ErrNotFound}
 }
 
+// exts returns the extensions to try after file itself: none if file
+// already has one of r.PathExt.
+func (r PathResolver) exts(file string) []string {
+	var exts []string
+	for _, ext := range strings.Split(r.PathExt, ";") {
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if strings.EqualFold(filepath.Ext(file), ext) {
+			return nil
+		}
+		exts = append(exts, ext)
+	}
+	return exts
+}
+
+// findExecutableExt returns the first of path and path with each of exts
+// appended that is executable. As PATHEXT lists extensions in upper case
+// but file systems other than Windows' are case sensitive, each extension
+// is also tried in lower case. If none is executable, findExecutableExt
+// returns the error for path itself.
+func findExecutableExt(path string, exts []string) (string, error) {
+	err := findExecutable(path)
+	if err == nil {
+		return path, nil
+	}
+	for _, ext := range exts {
+		if findExecutable(path+ext) == nil {
+			return path + ext, nil
+		}
+		if lower := strings.ToLower(ext); lower != ext && findExecutable(path+lower) == nil {
+			return path + lower, nil
+		}
+	}
+	return "", err
+}
+
 // findExecutable checks if the file at path exists and is executable.
 func findExecutable(file string) error {
 	fi, err := os.Stat(file)
@@ -0,0 +1,49 @@
+package spawnexec
+
+import (
+	"errors"
+	"os"
+	"sync/atomic"
+)
+
+// mainCalled is set by Main once it has found that the process is not one
+// of the package's helpers.
+var mainCalled atomic.Bool
+
+// errNoMain is returned when a command needs one of the package's helper
+// processes but the program has not called Main.
+var errNoMain = errors.New("exec: the program must call spawnexec.Main to start helper processes")
+
+// Main runs the process as one of the package's helper processes, and
+// exits, if the package started it as one, and otherwise returns. Some
+// features start the current executable as a helper: the trampoline that
+// sets a process up where posix_spawn cannot, used by BeforeResume,
+// CoreDumps, ExecFD and Pinned on Linux, and on darwin by settings
+// posix_spawn lacks; StartBroker; and the watchdog of KillOnParentExit.
+// A program using them must call Main first thing in its main function,
+// and in TestMain for tests; until it does, they fail to start.
+//
+// Importing the package alone never turns the process into a helper, so a
+// program that does not call Main cannot be made to run as one by its
+// environment.
+func Main() {
+	if path, ok := os.LookupEnv(trampolinePathEnv); ok {
+		os.Exit(runTrampoline(path))
+	}
+	if fd := os.Getenv(brokerEnv); fd != "" {
+		os.Exit(serveBroker(fd))
+	}
+	if _, ok := os.LookupEnv(watchdogEnv); ok {
+		os.Exit(runWatchdog(os.Stdin))
+	}
+	mainCalled.Store(true)
+}
+
+// helperExecutable returns the path of the current executable, to start
+// as a helper process, provided Main has been called.
+func helperExecutable() (string, error) {
+	if !mainCalled.Load() {
+		return "", errNoMain
+	}
+	return os.Executable()
+}
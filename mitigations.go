@@ -0,0 +1,31 @@
+package spawnexec
+
+// Mitigations selects darwin CPU security mitigations for a process.
+// They are set with posix_spawnattr_set_csm_np, which is private API;
+// Start fails with ENOTSUP if it is unavailable, and the kernel ignores
+// those the hardware does not need or support.
+type Mitigations struct {
+	// All enables every mitigation the kernel offers.
+	All bool
+	// NoSMT keeps the process's threads off a core whose other hardware
+	// thread runs another process's.
+	NoSMT bool
+	// TECS enables the kernel's mitigations against speculative
+	// execution side channels on entry to and exit from the kernel.
+	TECS bool
+}
+
+// flags returns the POSIX_SPAWN_NP_CSM_* flags selecting m.
+func (m Mitigations) flags() uint32 {
+	var flags uint32
+	if m.All {
+		flags |= 0x1
+	}
+	if m.NoSMT {
+		flags |= 0x2
+	}
+	if m.TECS {
+		flags |= 0x4
+	}
+	return flags
+}
@@ -0,0 +1,126 @@
+package spawnexec
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// MuxStdout and MuxStderr identify the streams in the frames of
+// MultiplexedPipe's output, as in the stream format of docker attach.
+const (
+	MuxStdout = 1
+	MuxStderr = 2
+)
+
+// muxHeaderLen is the length of a frame header: the stream id, three zero
+// bytes and the length of the payload as a big-endian uint32.
+const muxHeaderLen = 8
+
+// MultiplexedPipe returns a pipe on which both the standard output and the
+// standard error of the command are delivered once it starts, framed so
+// that they can be told apart, for shipping them over a single connection
+// without losing which stream each chunk came from.
+//
+// Each chunk of output is a frame: an 8-byte header, holding the stream
+// id, MuxStdout or MuxStderr, three zero bytes and the length of the
+// payload as a big-endian uint32, followed by the payload. This is the
+// format of docker attach; Demultiplex splits it up again.
+//
+// The pipe has no buffer, so the command blocks writing its output until
+// it is read. It is closed once Wait has seen the command exit and copied
+// its output, so the reads must proceed concurrently with Wait, and
+// should continue to EOF.
+func (c *Cmd) MultiplexedPipe() (io.ReadCloser, error) {
+	if c.Stdout != nil {
+		return nil, errors.New("exec: Stdout already set")
+	}
+	if c.Stderr != nil {
+		return nil, errors.New("exec: Stderr already set")
+	}
+	if c.Process != nil {
+		return nil, errors.New("exec: MultiplexedPipe after process started")
+	}
+	pr, pw := io.Pipe()
+	mux := &muxWriter{w: pw}
+	c.Stdout = &muxStream{mux: mux, id: MuxStdout}
+	c.Stderr = &muxStream{mux: mux, id: MuxStderr}
+	c.ownStdio[1], c.ownStdio[2] = true, true
+	c.muxPipe = pw
+	return pr, nil
+}
+
+// closeMuxPipe closes the writing end of c's MultiplexedPipe, if it has
+// one, once nothing more will be written to it.
+func (c *Cmd) closeMuxPipe() {
+	if c.muxPipe != nil {
+		c.muxPipe.Close()
+		c.muxPipe = nil
+	}
+}
+
+// muxWriter writes the frames of several streams to w, one at a time.
+type muxWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// muxStream is a writer framing what is written to it as stream id of
+// mux.
+type muxStream struct {
+	mux *muxWriter
+	id  byte
+}
+
+func (s *muxStream) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	var hdr [muxHeaderLen]byte
+	hdr[0] = s.id
+	binary.BigEndian.PutUint32(hdr[4:], uint32(len(p)))
+
+	s.mux.mu.Lock()
+	defer s.mux.mu.Unlock()
+	if _, err := s.mux.w.Write(hdr[:]); err != nil {
+		return 0, err
+	}
+	return s.mux.w.Write(p)
+}
+
+// Demultiplex copies the output framed by MultiplexedPipe from r to
+// stdout and stderr, by stream, until r reaches EOF. A nil writer
+// discards its stream. It returns an error if r ends in the middle of a
+// frame or holds a stream it does not know.
+func Demultiplex(r io.Reader, stdout, stderr io.Writer) error {
+	var hdr [muxHeaderLen]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		var w io.Writer
+		switch hdr[0] {
+		case MuxStdout:
+			w = stdout
+		case MuxStderr:
+			w = stderr
+		default:
+			return errors.New("exec: unknown multiplexed stream " + strconv.Itoa(int(hdr[0])))
+		}
+		if w == nil {
+			w = io.Discard
+		}
+		n := int64(binary.BigEndian.Uint32(hdr[4:]))
+		if copied, err := io.CopyN(w, r, n); err != nil {
+			if err == io.EOF && copied < n {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,22 @@
+//go:build linux
+
+package spawnexec
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setParentDeathSignal has the kernel kill osCmd's child with SIGKILL when
+// the calling process exits, if c.KillOnParentExit is set, and reports
+// that no watchdog is needed.
+func (c *Cmd) setParentDeathSignal(osCmd *exec.Cmd) bool {
+	if !c.KillOnParentExit {
+		return true
+	}
+	if osCmd.SysProcAttr == nil {
+		osCmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	osCmd.SysProcAttr.Pdeathsig = syscall.SIGKILL
+	return true
+}
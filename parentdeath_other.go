@@ -0,0 +1,11 @@
+//go:build !linux
+
+package spawnexec
+
+import "os/exec"
+
+// setParentDeathSignal reports that a watchdog is needed for
+// KillOnParentExit: only Linux has PR_SET_PDEATHSIG.
+func (c *Cmd) setParentDeathSignal(osCmd *exec.Cmd) bool {
+	return false
+}
@@ -0,0 +1,110 @@
+package spawnexec
+
+import (
+	"io"
+	"os"
+	"slices"
+	"sync"
+)
+
+// Peek returns the last n bytes the command has written to its standard
+// output and standard error so far, or as many as PeekSize retains if n
+// is not positive or more than that, for showing what a stuck command is
+// printing without taking its output from the writers it is meant for.
+// Peek may be called from any goroutine once Start has returned, while
+// the command runs and after it exits. It returns nil for a stream that
+// is not retained.
+func (c *Cmd) Peek(n int) (stdout, stderr []byte) {
+	return c.peek[0].last(n), c.peek[1].last(n)
+}
+
+// peekBuffers has Stdout and Stderr also written to ring buffers
+// retaining the last PeekSize bytes of each for Peek, recording how to
+// restore them in restores. Streams the command writes itself, to
+// StdoutPath or StderrPath or to the pipes of the pipe methods, are not
+// retained. If Stdout and Stderr are the same writer, the command writes
+// both streams to one pipe, and one ring buffer retains them combined.
+func (c *Cmd) peekBuffers(restores *[]func()) {
+	c.peek = [2]*ringBuffer{}
+	if c.PeekSize <= 0 {
+		return
+	}
+	wrap := func(i int, w *io.Writer, path string) {
+		if path != "" {
+			return
+		}
+		if f, ok := (*w).(*os.File); ok && slices.Contains(c.childIOFiles, f) {
+			return
+		}
+		ring := newRingBuffer(c.PeekSize)
+		c.peek[i] = ring
+		orig := *w
+		if orig == nil {
+			*w = ring
+		} else {
+			*w = io.MultiWriter(ring, orig)
+		}
+		*restores = append(*restores, func() { *w = orig })
+	}
+	if c.Stdout != nil && c.Stdout == c.Stderr && c.StdoutPath == "" && c.StderrPath == "" {
+		// Wrapping them apart would have their output copied by two
+		// goroutines writing to the same writer at once.
+		stderr := c.Stderr
+		wrap(0, &c.Stdout, "")
+		c.Stderr, c.peek[1] = c.Stdout, c.peek[0]
+		*restores = append(*restores, func() { c.Stderr = stderr })
+		return
+	}
+	wrap(0, &c.Stdout, c.StdoutPath)
+	wrap(1, &c.Stderr, c.StderrPath)
+}
+
+// ringBuffer is a writer that retains the last bytes written to it.
+type ringBuffer struct {
+	mu   sync.Mutex
+	buf  []byte
+	pos  int  // where the next byte goes
+	full bool // whether buf has wrapped around
+}
+
+// newRingBuffer returns a ringBuffer retaining size bytes.
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{buf: make([]byte, size)}
+}
+
+func (r *ringBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(p) > len(r.buf) {
+		p = p[len(p)-len(r.buf):]
+	}
+	for len(p) > 0 {
+		copied := copy(r.buf[r.pos:], p)
+		p = p[copied:]
+		r.pos += copied
+		if r.pos == len(r.buf) {
+			r.pos, r.full = 0, true
+		}
+	}
+	return n, nil
+}
+
+// last returns a copy of the last n bytes retained, or of all of them if
+// n is not positive or more than that. A nil r retains nothing.
+func (r *ringBuffer) last(n int) []byte {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var b []byte
+	if r.full {
+		b = append(b, r.buf[r.pos:]...)
+	}
+	b = append(b, r.buf[:r.pos]...)
+	if n > 0 && n < len(b) {
+		b = b[len(b)-n:]
+	}
+	return b
+}
@@ -0,0 +1,94 @@
+package spawnexec
+
+import (
+	"errors"
+	"os"
+)
+
+// ErrExecutableChanged is wrapped by the *Error Start returns when the
+// path of a command with Cmd.Pinned set no longer names the executable
+// that was pinned.
+var ErrExecutableChanged = errors.New("executable changed since it was pinned")
+
+// PinnedExecutable is an executable found by LookPathPinned and held
+// open, so that the commands run from it run the file that was found,
+// even if another is put in its place afterwards, as by a package
+// upgrade or by someone who can write to a directory in PATH.
+type PinnedExecutable struct {
+	// Name is the name the executable was looked up by, and Path the path
+	// it was found at.
+	Name string
+	Path string
+
+	file *os.File
+	info os.FileInfo
+}
+
+// LookPathPinned looks up the executable named file as LookPath does,
+// and opens it. It fails where LookPath fails, including with ErrDot, and
+// if the file cannot be opened or is not an executable regular file. The
+// PinnedExecutable must be closed once no more commands are to be started
+// from it.
+func LookPathPinned(file string) (*PinnedExecutable, error) {
+	path, err := LookPath(file)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, &Error{Name: file, Err: err}
+	}
+	fi, err := f.Stat()
+	if err == nil && (!fi.Mode().IsRegular() || fi.Mode()&0o111 == 0) {
+		err = os.ErrPermission
+	}
+	if err != nil {
+		f.Close()
+		return nil, &Error{Name: file, Err: err}
+	}
+	return &PinnedExecutable{Name: file, Path: path, file: f, info: fi}, nil
+}
+
+// Command returns a Cmd to run the pinned executable with the given
+// arguments, with Path, Args and Pinned set as Command would set Path and
+// Args for p.Name.
+func (p *PinnedExecutable) Command(arg ...string) *Cmd {
+	return &Cmd{Path: p.Path, Args: append([]string{p.Name}, arg...), Pinned: p}
+}
+
+// Close closes the pinned executable. Commands already started from it
+// are unaffected.
+func (p *PinnedExecutable) Close() error {
+	return p.file.Close()
+}
+
+// execFD returns the open executable c is to run, if any: ExecFD, or
+// Pinned's file where ExecFD is supported.
+func (c *Cmd) execFD() *os.File {
+	if c.ExecFD == nil && c.Pinned != nil && canExecFD {
+		return c.Pinned.file
+	}
+	return c.ExecFD
+}
+
+// checkPinned checks, where the pinned executable cannot be run from its
+// descriptor, that c's Path still names it: the same file, by device and
+// inode, as was opened. It is called just before the command is spawned,
+// to leave as little time as possible for the file to be replaced.
+func (c *Cmd) checkPinned() error {
+	if c.Pinned == nil || canExecFD {
+		return nil
+	}
+	path, err := execPath(c.Dir, c.Path)
+	if err != nil {
+		return wrapError("exec: ", err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return &Error{Name: c.Path, Path: path, Err: err}
+	}
+	if !os.SameFile(fi, c.Pinned.info) {
+		return &Error{Name: c.Path, Path: path, Err: ErrExecutableChanged}
+	}
+	return nil
+}
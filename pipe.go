@@ -0,0 +1,39 @@
+package spawnexec
+
+import (
+	"os"
+	"sync/atomic"
+)
+
+// pipesMade counts the pipes made by inputPipe and outputPipe.
+var pipesMade atomic.Int64
+
+// PipesMade returns how many pipes the package has made so far to connect
+// commands' standard input, output and error, and the trampoline's status,
+// for measuring what redirecting them costs a spawn-heavy program. Each
+// holds two descriptors until the command has started, and one of them
+// until its copying is done.
+//
+// Pipes are not reused: a command reads end-of-file only once every write
+// end of its pipe has been closed, including any inherited by commands it
+// started, so none can be handed safely to another command. Making one
+// is instead kept to the fewest system calls: on Linux, the command's end
+// is neither put in non-blocking mode nor registered with the runtime's
+// poller only to be taken out of it again when it is passed on.
+func PipesMade() int64 {
+	return pipesMade.Load()
+}
+
+// inputPipe returns a new pipe that a command reads from: r is the
+// command's end, in blocking mode, and w the parent's, in non-blocking
+// mode so that closing it interrupts writes. Both are close-on-exec.
+func inputPipe() (r, w *os.File, err error) {
+	return makePipe(1)
+}
+
+// outputPipe returns a new pipe that a command writes to: w is the
+// command's end, in blocking mode, and r the parent's, in non-blocking
+// mode so that closing it interrupts reads. Both are close-on-exec.
+func outputPipe() (r, w *os.File, err error) {
+	return makePipe(0)
+}
@@ -0,0 +1,25 @@
+package spawnexec
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// makePipe makes a pipe with pipe2(2), whose end parent, 0 for the read
+// end or 1 for the write end, is the parent's, in non-blocking mode. The
+// other end is left as pipe2 made it, so that os.NewFile does not
+// register it with the runtime's poller.
+func makePipe(parent int) (r, w *os.File, err error) {
+	var p [2]int
+	if err := unix.Pipe2(p[:], unix.O_CLOEXEC); err != nil {
+		return nil, nil, os.NewSyscallError("pipe2", err)
+	}
+	if err := unix.SetNonblock(p[parent], true); err != nil {
+		unix.Close(p[0])
+		unix.Close(p[1])
+		return nil, nil, os.NewSyscallError("fcntl", err)
+	}
+	pipesMade.Add(1)
+	return os.NewFile(uintptr(p[0]), "|0"), os.NewFile(uintptr(p[1]), "|1"), nil
+}
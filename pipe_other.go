@@ -0,0 +1,26 @@
+//go:build !linux
+
+package spawnexec
+
+import (
+	"os"
+)
+
+// makePipe makes a pipe with os.Pipe, whose end parent, 0 for the read end
+// or 1 for the write end, is the parent's. Without pipe2(2) to make it
+// close-on-exec atomically, os.Pipe is relied on for that, and the other
+// end is put back in blocking mode.
+func makePipe(parent int) (r, w *os.File, err error) {
+	r, w, err = os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	// Fd puts a file in blocking mode and takes it out of the poller.
+	if parent == 0 {
+		w.Fd()
+	} else {
+		r.Fd()
+	}
+	pipesMade.Add(1)
+	return r, w, nil
+}
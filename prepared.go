@@ -0,0 +1,118 @@
+package spawnexec
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// PreparedCommand is a command set up once to be run many times. Its
+// executable path is resolved, and its arguments and environment
+// marshaled into the form posix_spawn takes, when it is prepared, so that
+// each run only pays for setting up its standard I/O and spawning.
+//
+// A PreparedCommand is safe for concurrent use.
+type PreparedCommand struct {
+	path string
+	args []string
+	env  []string
+
+	mu     sync.RWMutex // held for reading while block is in use
+	block  *argvBlock
+	closed bool
+}
+
+// Prepare resolves name like Command does and prepares it to be run with
+// the given arguments and environment. If env is nil, the environment of
+// the current process at the time of the call is used.
+//
+// Unlike Command, Prepare reports a failure to find the executable
+// directly. Close should be called once the PreparedCommand is no longer
+// needed.
+func Prepare(name string, args []string, env []string) (*PreparedCommand, error) {
+	path := name
+	if filepath.Base(name) == name {
+		lp, err := LookPath(name)
+		if err := lookPathError(err, 0); err != nil {
+			return nil, err
+		}
+		path = lp
+	}
+	p := &PreparedCommand{
+		path: path,
+		args: append([]string{name}, args...),
+		env:  env,
+	}
+	if err := validateArgs(p.path, p.args, "", env); err != nil {
+		return nil, err
+	}
+	if p.env == nil {
+		p.env = os.Environ()
+	}
+	block, err := newArgvBlock(p.path, p.args, p.env)
+	if err != nil {
+		return nil, err
+	}
+	p.block = block
+	return p, nil
+}
+
+// Command returns a Cmd that runs the prepared command. Only its standard
+// I/O and other per-run fields, such as Dir and ExtraFiles, need be set
+// before starting it. If its Path, Args or Env are changed, it is
+// marshaled from scratch when started, like any other Cmd.
+func (p *PreparedCommand) Command() *Cmd {
+	return &Cmd{
+		Path:     p.path,
+		Args:     slices.Clone(p.args),
+		Env:      slices.Clone(p.env),
+		prepared: p,
+	}
+}
+
+// CommandContext is like Command but includes a context, like the
+// package-level CommandContext.
+func (p *PreparedCommand) CommandContext(ctx context.Context) *Cmd {
+	if ctx == nil {
+		panic("nil Context")
+	}
+	cmd := p.Command()
+	cmd.ctx = ctx
+	return cmd
+}
+
+// Close releases the marshaled arguments and environment. Commands
+// created from p may still be run afterwards, but are marshaled from
+// scratch.
+func (p *PreparedCommand) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.closed {
+		p.closed = true
+		p.block.release()
+		p.block = nil
+	}
+	return nil
+}
+
+// acquireBlock returns the prepared argvBlock for c, or nil if c no longer
+// matches the prepared command or p has been closed. If it returns a
+// block, releaseBlock must be called once the spawn is done.
+func (p *PreparedCommand) acquireBlock(c *Cmd, path string) *argvBlock {
+	if path != p.path || !slices.Equal(c.Args, p.args) || !slices.Equal(c.Env, p.env) {
+		return nil
+	}
+	p.mu.RLock()
+	if p.closed {
+		p.mu.RUnlock()
+		return nil
+	}
+	return p.block
+}
+
+// releaseBlock ends the use of the block returned by acquireBlock.
+func (p *PreparedCommand) releaseBlock() {
+	p.mu.RUnlock()
+}
@@ -3,15 +3,104 @@ package spawnexec
 import (
 	"fmt"
 	"os"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/orospakr/spawnexec/internal/bridge"
 	"golang.org/x/sys/unix"
 )
 
+func init() {
+	bridge.Process = func(p any) *os.Process {
+		return p.(*Process).handle()
+	}
+	bridge.ProcessState = func(ps any) *os.ProcessState {
+		return ps.(*ProcessState).osState
+	}
+}
+
 // Process stores the information about a process created by Start.
+//
+// The methods of a Process are safe for concurrent use. In particular a
+// goroutine may Signal or Kill a Process while another is blocked in Wait:
+// once the process has been reaped, Signal reports os.ErrProcessDone rather
+// than signaling a pid that may have been reused, and a process is never
+// reaped twice.
 type Process struct {
 	Pid int
+
+	// osProc is the os.Process for Pid. It reaps the child and signals
+	// it, and is itself safe against signaling a reaped process.
+	osProc *os.Process
+	// start is when the process was spawned.
+	start time.Time
+
+	// adopted is set for processes found with FindProcess, which need
+	// not be children of this process.
+	adopted bool
+
+	// broker is set for processes spawned through a Broker, which signals
+	// and reaps them; brokerExit receives their exit.
+	broker     *Broker
+	brokerExit chan brokerMsg
+
+	// watchdog is set for commands started with KillOnParentExit, and is
+	// stopped once the process has been reaped.
+	watchdog *watchdog
+
+	// reaperDone is set for processes handed to the shared reaper, which
+	// closes it once it has reaped the process or failed to, recording
+	// why in reaperErr.
+	reaperDone chan struct{}
+	reaperErr  error
+
+	// waitMu is held by whichever of Wait and TryWait is reaping the
+	// process, so that it is reaped only once.
+	waitMu sync.Mutex
+
+	// mu is held for writing while recording that the process has been
+	// reaped or released and for reading while signaling it.
+	mu       sync.RWMutex
+	state    *ProcessState // set once the process has been reaped
+	released bool
+}
+
+// FindProcess looks for a running process by its pid, so that a program
+// restarted after a crash can re-adopt the children it recorded, for
+// example in a pidfile. It returns an error wrapping os.ErrProcessDone if
+// there is no process with that pid.
+//
+// The returned Process need not be a child of the calling process. It can
+// be signaled, and Wait and TryWait report when it exits, using kqueue on
+// darwin. The exit status of a process that is not a child cannot be
+// known, however; its ProcessState reports neither an exit code nor a
+// signal, and Success reports false.
+func FindProcess(pid int) (*Process, error) {
+	if pid <= 0 {
+		return nil, os.ErrInvalid
+	}
+	if err := unix.Kill(pid, 0); err == unix.ESRCH {
+		return nil, fmt.Errorf("find process %d: %w", pid, os.ErrProcessDone)
+	}
+	// FindProcess always succeeds on Unix systems.
+	osProc, _ := os.FindProcess(pid)
+	return &Process{Pid: pid, osProc: osProc, adopted: true}, nil
+}
+
+// newProcess returns a Process for pid, which has just been spawned. If
+// osProc is nil, one is looked up.
+func newProcess(pid int, osProc *os.Process) *Process {
+	if osProc == nil {
+		// FindProcess always succeeds on Unix systems.
+		osProc, _ = os.FindProcess(pid)
+	}
+	return &Process{Pid: pid, osProc: osProc, start: time.Now()}
+}
+
+// handle returns the os.Process for p.Pid.
+func (p *Process) handle() *os.Process {
+	return p.osProc
 }
 
 // Kill causes the Process to exit immediately. Kill does not wait until
@@ -21,53 +110,293 @@ func (p *Process) Kill() error {
 	return p.Signal(syscall.SIGKILL)
 }
 
-// Signal sends a signal to the Process.
+// Signal sends a signal to the Process. It returns os.ErrProcessDone if
+// the Process has already been reaped.
 func (p *Process) Signal(sig os.Signal) error {
-	if p.Pid <= 0 {
+	if _, ok := sig.(syscall.Signal); !ok {
 		return os.ErrInvalid
 	}
-	s, ok := sig.(syscall.Signal)
-	if !ok {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.released || p.Pid <= 0 {
 		return os.ErrInvalid
 	}
-	return unix.Kill(p.Pid, s)
+	if p.state != nil {
+		return os.ErrProcessDone
+	}
+	if p.broker != nil {
+		return p.broker.signal(p.Pid, sig.(syscall.Signal))
+	}
+	return p.osProc.Signal(sig)
 }
 
 // Release releases any resources associated with the Process p,
 // rendering it unusable in the future.
 // Release only needs to be called if Wait is not.
+//
+// A child that has not been reaped is detached rather than forgotten: it
+// is handed to the shared reaper (see EnableReaper), which reaps it once
+// it exits, so that the caller need not. A Process spawned through a
+// Broker is left to the Broker, which reaps it in any case.
 func (p *Process) Release() error {
-	// For posix_spawn-based processes, there's not much to release
-	// since we don't keep extra file descriptors open.
+	p.detach()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.released {
+		return nil
+	}
+	p.released = true
 	p.Pid = -1
-	return nil
+	if p.osProc == nil {
+		return nil
+	}
+	return p.osProc.Release()
 }
 
 // Wait waits for the Process to exit, and then returns a
 // ProcessState describing its status and an error, if any.
 // Wait releases any resources associated with the Process.
+//
+// Wait may be called more than once, and concurrently; every call returns
+// the same ProcessState.
 func (p *Process) Wait() (*ProcessState, error) {
-	if p.Pid <= 0 {
+	p.waitMu.Lock()
+	defer p.waitMu.Unlock()
+	if ps := p.reaped(); ps != nil {
+		return ps, nil
+	}
+	if !p.valid() {
 		return nil, os.ErrInvalid
 	}
+	if p.broker != nil {
+		msg := <-p.brokerExit
+		if err := msg.error(); err != nil {
+			return nil, err
+		}
+		ps := brokeredState(msg, p.start)
+		p.setReaped(ps)
+		return ps, nil
+	}
+	if p.reaperDone != nil {
+		<-p.reaperDone
+		if ps := p.reaped(); ps != nil {
+			return ps, nil
+		}
+		return nil, p.reaperErr
+	}
+	if p.adopted {
+		ps, notChild, err := p.tryWait()
+		if ps != nil || err != nil {
+			return ps, err
+		}
+		if notChild {
+			if err := waitExit(p.Pid); err != nil {
+				return nil, err
+			}
+			return p.exitedNotChild(), nil
+		}
+	}
+	info := collectRusageInfo(p.Pid)
+	state, err := p.osProc.Wait()
+	if err != nil {
+		return nil, err
+	}
+	ps := newProcessState(state, p.start)
+	ps.rusageInfo = info
+	p.setReaped(ps)
+	return ps, nil
+}
+
+// TryWait checks whether the Process has exited without blocking. If it
+// has, TryWait reaps it and returns its ProcessState and true; if it is
+// still running, TryWait returns nil and false. While another goroutine is
+// blocked in Wait, TryWait leaves the reaping to it.
+//
+// TryWait lets a poller check on many children cheaply, without a
+// goroutine blocked in Wait for each. Once TryWait has returned a
+// ProcessState, Wait returns that same ProcessState immediately, so a Cmd
+// whose process was reaped by TryWait must still be waited for with
+// Cmd.Wait to finish its I/O. A ProcessState obtained by TryWait carries
+// no RusageInfo.
+func (p *Process) TryWait() (*ProcessState, bool, error) {
+	if !p.waitMu.TryLock() {
+		ps := p.reaped()
+		return ps, ps != nil, nil
+	}
+	defer p.waitMu.Unlock()
+	if ps := p.reaped(); ps != nil {
+		return ps, true, nil
+	}
+	if !p.valid() {
+		return nil, false, os.ErrInvalid
+	}
+	if p.broker != nil {
+		select {
+		case msg := <-p.brokerExit:
+			if err := msg.error(); err != nil {
+				return nil, false, err
+			}
+			ps := brokeredState(msg, p.start)
+			p.setReaped(ps)
+			return ps, true, nil
+		default:
+			return nil, false, nil
+		}
+	}
+	if p.reaperDone != nil {
+		select {
+		case <-p.reaperDone:
+			ps := p.reaped()
+			return ps, ps != nil, p.reaperErr
+		default:
+			return nil, false, nil
+		}
+	}
+	ps, _, err := p.tryWait()
+	return ps, ps != nil, err
+}
+
+// tryWait reaps p if it has exited, returning nil if it has not. It also
+// reports whether p was found not to be a child of the calling process.
+// p.waitMu must be held, unless p has been handed to the shared reaper,
+// which is then the only caller.
+func (p *Process) tryWait() (ps *ProcessState, notChild bool, err error) {
+	// Hold off Signal while the pid might be freed.
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	var status unix.WaitStatus
 	var rusage unix.Rusage
-	pid, err := unix.Wait4(p.Pid, &status, 0, &rusage)
+	var pid int
+	for {
+		pid, err = unix.Wait4(p.Pid, &status, unix.WNOHANG, &rusage)
+		if err != unix.EINTR {
+			break
+		}
+	}
+	if err == unix.ECHILD && p.adopted {
+		if unix.Kill(p.Pid, 0) == unix.ESRCH {
+			p.state = p.notChildState()
+			return p.state, true, nil
+		}
+		return nil, true, nil
+	}
 	if err != nil {
-		return nil, err
+		return nil, false, os.NewSyscallError("wait", err)
 	}
-	return &ProcessState{
+	if pid == 0 {
+		return nil, false, nil
+	}
+	p.state = &ProcessState{
 		pid:    pid,
 		status: status,
 		rusage: &rusage,
-	}, nil
+		start:  p.start,
+		end:    time.Now(),
+	}
+	p.watchdog.stop()
+	return p.state, false, nil
+}
+
+// exitedNotChild records that p, which is not a child of the calling
+// process, has exited, and returns its ProcessState.
+func (p *Process) exitedNotChild() *ProcessState {
+	ps := p.notChildState()
+	p.setReaped(ps)
+	return ps
+}
+
+// notChildState returns a ProcessState for p, which is not a child of the
+// calling process and has exited.
+func (p *Process) notChildState() *ProcessState {
+	return &ProcessState{pid: p.Pid, noStatus: true, start: p.start, end: time.Now()}
+}
+
+// valid reports whether p can still be waited for or signaled.
+func (p *Process) valid() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return !p.released && p.Pid > 0
+}
+
+// reaped returns the ProcessState of p if it has been reaped, or nil.
+func (p *Process) reaped() *ProcessState {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.state
+}
+
+// setReaped records that p has been reaped.
+func (p *Process) setReaped(ps *ProcessState) {
+	p.mu.Lock()
+	p.state = ps
+	p.mu.Unlock()
+	p.watchdog.stop()
+}
+
+// NewProcessState returns a ProcessState for the process pid that finished
+// with the given wait status. Processes started by this package get their
+// ProcessState from Wait; NewProcessState exists for test doubles, such as
+// the spawntest package, that need to fabricate one.
+func NewProcessState(pid int, status unix.WaitStatus) *ProcessState {
+	return &ProcessState{pid: pid, status: status}
 }
 
 // ProcessState stores information about a process, as reported by Wait.
 type ProcessState struct {
-	pid    int             // The process's id.
-	status unix.WaitStatus // The status returned by wait syscall
-	rusage *unix.Rusage    // Resource usage info
+	pid     int              // The process's id.
+	status  unix.WaitStatus  // The status returned by wait syscall
+	rusage  *unix.Rusage     // Resource usage info
+	osState *os.ProcessState // The os package's view, if reaped through it
+	start   time.Time        // When the process was spawned
+	end     time.Time        // When the process was reaped
+	// noStatus is set for processes that were not our children, whose
+	// exit status cannot be known.
+	noStatus bool
+
+	rusageInfo *RusageInfo // Extended resource usage, darwin only
+}
+
+// newProcessState converts the os.ProcessState of a process spawned at
+// start, which has just been reaped, into a ProcessState.
+func newProcessState(state *os.ProcessState, start time.Time) *ProcessState {
+	var rusage *unix.Rusage
+	if r, ok := state.SysUsage().(*syscall.Rusage); ok && r != nil {
+		rusage = convertSyscallRusage(r)
+	}
+	return &ProcessState{
+		pid:     state.Pid(),
+		status:  unix.WaitStatus(state.Sys().(syscall.WaitStatus)),
+		rusage:  rusage,
+		osState: state,
+		start:   start,
+		end:     time.Now(),
+	}
+}
+
+// convertSyscallRusage converts syscall.Rusage to unix.Rusage
+func convertSyscallRusage(r *syscall.Rusage) *unix.Rusage {
+	if r == nil {
+		return nil
+	}
+	return &unix.Rusage{
+		Utime:    unix.NsecToTimeval(r.Utime.Nano()),
+		Stime:    unix.NsecToTimeval(r.Stime.Nano()),
+		Maxrss:   r.Maxrss,
+		Ixrss:    r.Ixrss,
+		Idrss:    r.Idrss,
+		Isrss:    r.Isrss,
+		Minflt:   r.Minflt,
+		Majflt:   r.Majflt,
+		Nswap:    r.Nswap,
+		Inblock:  r.Inblock,
+		Oublock:  r.Oublock,
+		Msgsnd:   r.Msgsnd,
+		Msgrcv:   r.Msgrcv,
+		Nsignals: r.Nsignals,
+		Nvcsw:    r.Nvcsw,
+		Nivcsw:   r.Nivcsw,
+	}
 }
 
 // Pid returns the process id of the exited process.
@@ -79,19 +408,51 @@ func (p *ProcessState) Pid() int {
 // On Unix systems this reports true if the program exited due to calling exit,
 // but false if the program terminated due to a signal.
 func (p *ProcessState) Exited() bool {
+	if p.noStatus {
+		return false
+	}
 	return p.status.Exited()
 }
 
+// Signaled reports whether the program was terminated by a signal.
+func (p *ProcessState) Signaled() bool {
+	if p.noStatus {
+		return false
+	}
+	return p.status.Signaled()
+}
+
+// Signal returns the signal that terminated the program, or -1 if it was
+// not terminated by a signal.
+func (p *ProcessState) Signal() syscall.Signal {
+	if !p.Signaled() {
+		return -1
+	}
+	return p.status.Signal()
+}
+
+// CoreDumped reports whether the program dumped core when a signal
+// terminated it.
+func (p *ProcessState) CoreDumped() bool {
+	if p.noStatus {
+		return false
+	}
+	return p.status.CoreDump()
+}
+
 // Success reports whether the program exited successfully,
 // such as with exit status 0 on Unix.
 func (p *ProcessState) Success() bool {
+	if p.noStatus {
+		return false
+	}
 	return p.status.ExitStatus() == 0
 }
 
 // ExitCode returns the exit code of the exited process, or -1
 // if the process hasn't exited or was terminated by a signal.
 func (p *ProcessState) ExitCode() int {
-	if !p.status.Exited() {
+	if !p.Exited() {
 		return -1
 	}
 	return p.status.ExitStatus()
@@ -125,11 +486,35 @@ func (p *ProcessState) UserTime() time.Duration {
 	return time.Duration(p.rusage.Utime.Nano()) * time.Nanosecond
 }
 
+// StartTime returns the time at which the process was spawned, or the zero
+// time if it is not known.
+func (p *ProcessState) StartTime() time.Time {
+	return p.start
+}
+
+// EndTime returns the time at which the exited process was reaped, or the
+// zero time if it is not known.
+func (p *ProcessState) EndTime() time.Time {
+	return p.end
+}
+
+// Duration returns the wall-clock time the process ran for, from StartTime
+// to EndTime. It returns 0 if either is not known.
+func (p *ProcessState) Duration() time.Duration {
+	if p.start.IsZero() || p.end.IsZero() {
+		return 0
+	}
+	return p.end.Sub(p.start)
+}
+
 // String returns a human-readable string representation of the ProcessState.
 func (p *ProcessState) String() string {
 	if p == nil {
 		return "<nil>"
 	}
+	if p.noStatus {
+		return "exit status unknown"
+	}
 	status := p.Sys().(unix.WaitStatus)
 	switch {
 	case status.Exited():
@@ -0,0 +1,50 @@
+package spawnexec
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// procExitPollInterval is how often pollExit checks whether a process has
+// exited, and waitAnyReaped checks processes that are not children.
+const procExitPollInterval = 10 * time.Millisecond
+
+// pollExit blocks until the process pid, which need not be a child of the
+// calling process, has exited, by polling for the pid to disappear.
+func pollExit(pid int) {
+	for unix.Kill(pid, 0) != unix.ESRCH {
+		time.Sleep(procExitPollInterval)
+	}
+}
+
+// waitAnyReaped blocks until one of procs has exited, and returns its
+// index, reaping the one that exited with TryWait. It checks them again
+// each time the shared reaper is notified of SIGCHLD or a Broker of a
+// command's exit, so that one goroutine serves every waiter; only
+// processes that are not children, whose exits raise no SIGCHLD, are
+// also checked at intervals.
+func waitAnyReaped(procs []*Process) (int, error) {
+	wake, stop := exitWaiter()
+	defer stop()
+	var tick <-chan time.Time
+	for _, p := range procs {
+		if p.adopted {
+			ticker := time.NewTicker(procExitPollInterval)
+			defer ticker.Stop()
+			tick = ticker.C
+			break
+		}
+	}
+	for {
+		for i, p := range procs {
+			if _, done, err := p.TryWait(); done || err != nil {
+				return i, err
+			}
+		}
+		select {
+		case <-wake:
+		case <-tick:
+		}
+	}
+}
@@ -0,0 +1,95 @@
+//go:build darwin
+
+package spawnexec
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// waitExit blocks until the process pid, which need not be a child of the
+// calling process, has exited, using a kqueue EVFILT_PROC filter.
+func waitExit(pid int) error {
+	kq, err := unix.Kqueue()
+	if err != nil {
+		return os.NewSyscallError("kqueue", err)
+	}
+	defer unix.Close(kq)
+
+	changes := make([]unix.Kevent_t, 1)
+	unix.SetKevent(&changes[0], pid, unix.EVFILT_PROC, unix.EV_ADD|unix.EV_ONESHOT)
+	changes[0].Fflags = unix.NOTE_EXIT
+	if _, err := unix.Kevent(kq, changes, nil, nil); err != nil {
+		if err == unix.ESRCH {
+			// The process has already exited.
+			return nil
+		}
+		return os.NewSyscallError("kevent", err)
+	}
+
+	events := make([]unix.Kevent_t, 1)
+	for {
+		n, err := unix.Kevent(kq, nil, events, nil)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return os.NewSyscallError("kevent", err)
+		}
+		if n > 0 {
+			return nil
+		}
+	}
+}
+
+// waitAnyExit blocks until one of procs has exited, and returns its index.
+// The processes are watched with a single kqueue and left unreaped.
+func waitAnyExit(procs []*Process) (int, error) {
+	for i, p := range procs {
+		if p.reaped() != nil {
+			return i, nil
+		}
+	}
+
+	kq, err := unix.Kqueue()
+	if err != nil {
+		return -1, os.NewSyscallError("kqueue", err)
+	}
+	defer unix.Close(kq)
+
+	index := make(map[int]int, len(procs))
+	changes := make([]unix.Kevent_t, 1)
+	for i, p := range procs {
+		unix.SetKevent(&changes[0], p.Pid, unix.EVFILT_PROC, unix.EV_ADD|unix.EV_ONESHOT)
+		changes[0].Fflags = unix.NOTE_EXIT
+		if _, err := unix.Kevent(kq, changes, nil, nil); err != nil {
+			if err == unix.ESRCH {
+				// The process has already exited.
+				return i, nil
+			}
+			return -1, os.NewSyscallError("kevent", err)
+		}
+		index[p.Pid] = i
+	}
+
+	events := make([]unix.Kevent_t, 1)
+	for {
+		n, err := unix.Kevent(kq, nil, events, nil)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return -1, os.NewSyscallError("kevent", err)
+		}
+		if n > 0 {
+			return index[int(events[0].Ident)], nil
+		}
+	}
+}
+
+// pidKiller returns a function that kills the process pid with SIGKILL.
+// Without pidfds it signals the pid itself.
+func pidKiller(pid int) func() {
+	return func() { unix.Kill(pid, unix.SIGKILL) }
+}
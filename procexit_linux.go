@@ -0,0 +1,110 @@
+package spawnexec
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// waitExit blocks until the process pid, which need not be a child of the
+// calling process, has exited and been reaped. It polls a pidfd for it,
+// which becomes readable once it has exited, and only then checks for
+// its parent to have reaped it, as that usually follows at once. Where
+// pidfds are not supported, it polls for the pid to disappear.
+func waitExit(pid int) error {
+	fd, err := unix.PidfdOpen(pid, 0)
+	if err == unix.ESRCH {
+		return nil
+	}
+	if err != nil {
+		pollExit(pid)
+		return nil
+	}
+	defer unix.Close(fd)
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	for {
+		_, err := unix.Poll(fds, -1)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return os.NewSyscallError("poll", err)
+		}
+		pollExit(pid)
+		return nil
+	}
+}
+
+// waitAnyExit blocks until one of procs has exited, and returns its index.
+// The processes are watched with a pidfd each, polled together, and left
+// unreaped. Where pidfds are not supported, or a process cannot have one,
+// it falls back on waitAnyReaped.
+func waitAnyExit(procs []*Process) (int, error) {
+	fds := make([]unix.PollFd, 0, len(procs))
+	defer func() {
+		for _, fd := range fds {
+			unix.Close(int(fd.Fd))
+		}
+	}()
+	for i, p := range procs {
+		fd, exited, err := p.pidfd()
+		if exited {
+			return i, nil
+		}
+		if err != nil {
+			return waitAnyReaped(procs)
+		}
+		fds = append(fds, unix.PollFd{Fd: int32(fd), Events: unix.POLLIN})
+	}
+	for {
+		_, err := unix.Poll(fds, -1)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return -1, os.NewSyscallError("poll", err)
+		}
+		for i, fd := range fds {
+			if fd.Revents != 0 {
+				return i, nil
+			}
+		}
+	}
+}
+
+// pidfd opens a pidfd for p, unless p has already been reaped, which is
+// reported as exited. It is opened while p cannot be reaped, so that it
+// refers to p rather than to a process that has since been given its pid.
+// Processes spawned through a Broker are reaped by the broker instead, so
+// no pidfd is opened for them.
+func (p *Process) pidfd() (fd int, exited bool, err error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.state != nil {
+		return -1, true, nil
+	}
+	if p.broker != nil || p.released || p.Pid <= 0 {
+		return -1, false, os.ErrInvalid
+	}
+	fd, err = unix.PidfdOpen(p.Pid, unix.PIDFD_NONBLOCK)
+	if err != nil {
+		return -1, false, os.NewSyscallError("pidfd_open", err)
+	}
+	return fd, false, nil
+}
+
+// pidKiller returns a function that kills the process pid, which need not
+// be a child of the calling process, with SIGKILL. It signals a pidfd
+// opened now, so that a process given the pid once this one has been
+// reaped is never killed in its place. Where pidfds are not supported, it
+// signals the pid.
+func pidKiller(pid int) func() {
+	fd, err := unix.PidfdOpen(pid, 0)
+	if err == unix.ESRCH {
+		return func() {}
+	}
+	if err != nil {
+		return func() { unix.Kill(pid, unix.SIGKILL) }
+	}
+	return func() { unix.PidfdSendSignal(fd, unix.SIGKILL, nil, 0) }
+}
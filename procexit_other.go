@@ -0,0 +1,26 @@
+//go:build !darwin && !linux
+
+package spawnexec
+
+import "golang.org/x/sys/unix"
+
+// waitExit blocks until the process pid, which need not be a child of the
+// calling process, has exited. Without kqueue or pidfds it polls for the
+// pid to disappear.
+func waitExit(pid int) error {
+	pollExit(pid)
+	return nil
+}
+
+// waitAnyExit blocks until one of procs has exited, and returns its index.
+// Without kqueue or pidfds it relies on the shared reaper's SIGCHLD
+// notifications, reaping the one that exited with TryWait.
+func waitAnyExit(procs []*Process) (int, error) {
+	return waitAnyReaped(procs)
+}
+
+// pidKiller returns a function that kills the process pid with SIGKILL.
+// Without pidfds it signals the pid itself.
+func pidKiller(pid int) func() {
+	return func() { unix.Kill(pid, unix.SIGKILL) }
+}
@@ -0,0 +1,62 @@
+//go:build darwin
+
+package spawnexec
+
+/*
+#include <errno.h>
+#include <fcntl.h>
+#include <stdlib.h>
+#include <sys/ioctl.h>
+#include <unistd.h>
+
+// open_pty opens a new pseudo-terminal's controller side and stores the
+// path of its replica side in name. It returns the descriptor, or -1 and
+// sets *err.
+static int open_pty(char *name, size_t len, int *err) {
+    int fd = posix_openpt(O_RDWR | O_NOCTTY);
+    if (fd < 0) {
+        *err = errno;
+        return -1;
+    }
+    // ptsname is not thread-safe and ptsname_r is only available on
+    // recent releases, so the name is fetched with the ioctl behind them.
+    if (grantpt(fd) != 0 || unlockpt(fd) != 0 || ioctl(fd, TIOCPTYGNAME, name) != 0) {
+        *err = errno;
+        close(fd);
+        return -1;
+    }
+    return fd;
+}
+*/
+import "C"
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// openPTY opens a new pseudo-terminal and returns its controller side,
+// in non-blocking mode so that closing it interrupts reads, and its
+// replica side.
+func openPTY() (controller, replica *os.File, err error) {
+	var name [128]C.char
+	var cerr C.int
+	fd := C.open_pty(&name[0], C.size_t(len(name)), &cerr)
+	if fd < 0 {
+		return nil, nil, os.NewSyscallError("posix_openpt", syscall.Errno(cerr))
+	}
+	unix.CloseOnExec(int(fd))
+	if err := unix.SetNonblock(int(fd), true); err != nil {
+		unix.Close(int(fd))
+		return nil, nil, os.NewSyscallError("fcntl", err)
+	}
+	controller = os.NewFile(uintptr(fd), "/dev/ptmx")
+	replica, err = os.OpenFile(C.GoString(&name[0]), os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		controller.Close()
+		return nil, nil, err
+	}
+	return controller, replica, nil
+}
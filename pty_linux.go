@@ -0,0 +1,34 @@
+package spawnexec
+
+import (
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// openPTY opens a new pseudo-terminal and returns its controller side,
+// in non-blocking mode so that closing it interrupts reads, and its
+// replica side.
+func openPTY() (controller, replica *os.File, err error) {
+	fd, err := unix.Open("/dev/ptmx", unix.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, nil, os.NewSyscallError("open /dev/ptmx", err)
+	}
+	controller = os.NewFile(uintptr(fd), "/dev/ptmx")
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		controller.Close()
+		return nil, nil, os.NewSyscallError("ioctl TIOCSPTLCK", err)
+	}
+	n, err := unix.IoctlGetUint32(fd, unix.TIOCGPTN)
+	if err != nil {
+		controller.Close()
+		return nil, nil, os.NewSyscallError("ioctl TIOCGPTN", err)
+	}
+	replica, err = os.OpenFile("/dev/pts/"+strconv.Itoa(int(n)), os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		controller.Close()
+		return nil, nil, err
+	}
+	return controller, replica, nil
+}
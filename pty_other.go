@@ -0,0 +1,26 @@
+//go:build !linux && !darwin
+
+package spawnexec
+
+import (
+	"errors"
+	"os"
+)
+
+// openPTY reports an error: pseudo-terminals are only supported on darwin
+// and Linux.
+func openPTY() (controller, replica *os.File, err error) {
+	return nil, nil, errors.New("exec: pseudo-terminals are not supported on this platform")
+}
+
+// setPTYSize reports an error: pseudo-terminals are only supported on
+// darwin and Linux.
+func setPTYSize(f *os.File, rows, cols int) error {
+	return errors.New("exec: pseudo-terminals are not supported on this platform")
+}
+
+// ptySize reports an error: pseudo-terminals are only supported on darwin
+// and Linux.
+func ptySize(f *os.File) (rows, cols int, err error) {
+	return 0, 0, errors.New("exec: pseudo-terminals are not supported on this platform")
+}
@@ -0,0 +1,38 @@
+//go:build linux || darwin
+
+package spawnexec
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// setPTYSize sets the window size of the terminal f.
+func setPTYSize(f *os.File, rows, cols int) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	ws := &unix.Winsize{Row: uint16(rows), Col: uint16(cols)}
+	if cerr := rc.Control(func(fd uintptr) { err = unix.IoctlSetWinsize(int(fd), unix.TIOCSWINSZ, ws) }); cerr != nil {
+		return cerr
+	}
+	return os.NewSyscallError("ioctl TIOCSWINSZ", err)
+}
+
+// ptySize returns the window size of the terminal f.
+func ptySize(f *os.File) (rows, cols int, err error) {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+	var ws *unix.Winsize
+	if cerr := rc.Control(func(fd uintptr) { ws, err = unix.IoctlGetWinsize(int(fd), unix.TIOCGWINSZ) }); cerr != nil {
+		return 0, 0, cerr
+	}
+	if err != nil {
+		return 0, 0, os.NewSyscallError("ioctl TIOCGWINSZ", err)
+	}
+	return int(ws.Row), int(ws.Col), nil
+}
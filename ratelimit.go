@@ -0,0 +1,83 @@
+package spawnexec
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimitedWriter is an io.Writer that delivers data to an underlying
+// writer no faster than a configured rate, using a token bucket.
+//
+// Used as Cmd.Stdout or Cmd.Stderr, it slows down the goroutine copying
+// the child's output. Once the pipe buffer fills up, the child itself
+// blocks in write, so a chatty child is throttled rather than its output
+// being buffered without bound or dropped.
+type RateLimitedWriter struct {
+	w     io.Writer
+	rate  float64 // bytes per second
+	burst int
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimitedWriter returns a writer that passes data on to w at no more
+// than bytesPerSecond bytes per second on average. Up to burst bytes may be
+// written at once after a quiet period; if burst is zero or less it
+// defaults to bytesPerSecond. NewRateLimitedWriter panics if
+// bytesPerSecond is not positive.
+func NewRateLimitedWriter(w io.Writer, bytesPerSecond, burst int) *RateLimitedWriter {
+	if bytesPerSecond <= 0 {
+		panic("spawnexec: NewRateLimitedWriter with non-positive rate")
+	}
+	if burst <= 0 {
+		burst = bytesPerSecond
+	}
+	return &RateLimitedWriter{
+		w:      w,
+		rate:   float64(bytesPerSecond),
+		burst:  burst,
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Write writes p to the underlying writer in chunks of at most the burst
+// size, sleeping as needed to stay within the rate.
+func (l *RateLimitedWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := min(len(p), l.burst)
+		l.take(chunk)
+		m, err := l.w.Write(p[:chunk])
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[chunk:]
+	}
+	return n, nil
+}
+
+// take removes n tokens from the bucket, sleeping until the bucket has
+// recovered if it goes into debt.
+func (l *RateLimitedWriter) take(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > float64(l.burst) {
+		l.tokens = float64(l.burst)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
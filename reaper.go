@@ -0,0 +1,150 @@
+package spawnexec
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// The reaper is the shared background reaper turned on by EnableReaper,
+// which also reaps the children detached by Process.Release.
+var reaper struct {
+	mu      sync.Mutex
+	enabled bool                       // reap every command started
+	procs   map[*Process]struct{}      // children not yet reaped
+	kick    chan os.Signal             // receives SIGCHLD
+	waiters map[chan struct{}]struct{} // notified after each SIGCHLD
+}
+
+// EnableReaper turns on a shared background reaper for the commands
+// started from then on. A single goroutine notified of SIGCHLD reaps each
+// of them as soon as it exits, whether or not Wait is ever called, so
+// that forgotten commands do not accumulate as zombies, and Wait receives
+// the result from it rather than blocking a thread in the wait system
+// call for every outstanding command.
+//
+// The reaper only reaps the processes this package started; children
+// started with os/exec or through a Broker are left alone. Once turned on
+// it cannot be turned off. As with TryWait, a ProcessState obtained from
+// the reaper carries no RusageInfo.
+func EnableReaper() {
+	reaper.mu.Lock()
+	defer reaper.mu.Unlock()
+	if reaper.enabled {
+		return
+	}
+	reaper.enabled = true
+	startReaper()
+}
+
+// startReaper starts the reaper's goroutine if it is not running.
+// reaper.mu must be held.
+func startReaper() {
+	if reaper.kick != nil {
+		return
+	}
+	reaper.procs = make(map[*Process]struct{})
+	reaper.kick = make(chan os.Signal, 1)
+	signal.Notify(reaper.kick, syscall.SIGCHLD)
+	go runReaper()
+}
+
+// reap hands p, which has just been spawned, to the reaper if it is
+// enabled.
+func (p *Process) reap() {
+	reaper.mu.Lock()
+	defer reaper.mu.Unlock()
+	if !reaper.enabled {
+		return
+	}
+	p.reaperDone = make(chan struct{})
+	addReaped(p)
+}
+
+// detach hands p, which is being released, to the reaper unless it has
+// been reaped, so that it does not linger as a zombie once exited. The
+// reaper is given a copy of p, since releasing p forgets its pid; p
+// itself no longer waits on the reaper.
+func (p *Process) detach() {
+	reaper.mu.Lock()
+	defer reaper.mu.Unlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.released || p.state != nil || p.adopted || p.broker != nil || p.Pid <= 0 {
+		return
+	}
+	startReaper()
+	if p.reaperDone != nil {
+		delete(reaper.procs, p)
+		p.reaperErr = os.ErrInvalid
+		close(p.reaperDone)
+	}
+	addReaped(&Process{
+		Pid:        p.Pid,
+		osProc:     p.osProc,
+		start:      p.start,
+		watchdog:   p.watchdog,
+		reaperDone: make(chan struct{}),
+	})
+}
+
+// addReaped adds p to the children the reaper reaps. reaper.mu must be
+// held.
+func addReaped(p *Process) {
+	reaper.procs[p] = struct{}{}
+	// p may have exited before it was added, its SIGCHLD unheeded.
+	select {
+	case reaper.kick <- syscall.SIGCHLD:
+	default:
+	}
+}
+
+// runReaper reaps the children that have exited each time SIGCHLD is
+// received. Signals are coalesced, so every child is checked each time.
+func runReaper() {
+	for range reaper.kick {
+		reaper.mu.Lock()
+		for p := range reaper.procs {
+			ps, _, err := p.tryWait()
+			if ps == nil && err == nil {
+				continue
+			}
+			p.reaperErr = err
+			close(p.reaperDone)
+			delete(reaper.procs, p)
+		}
+		notifyExitWaiters()
+		reaper.mu.Unlock()
+	}
+}
+
+// exitWaiter returns a channel that receives whenever a child may have
+// exited, having started the reaper's goroutine if needed, without
+// turning reaping on, and a function to stop the notifications.
+func exitWaiter() (<-chan struct{}, func()) {
+	reaper.mu.Lock()
+	defer reaper.mu.Unlock()
+	startReaper()
+	if reaper.waiters == nil {
+		reaper.waiters = make(map[chan struct{}]struct{})
+	}
+	ch := make(chan struct{}, 1)
+	reaper.waiters[ch] = struct{}{}
+	return ch, func() {
+		reaper.mu.Lock()
+		defer reaper.mu.Unlock()
+		delete(reaper.waiters, ch)
+	}
+}
+
+// notifyExitWaiters notifies the channels returned by exitWaiter.
+// reaper.mu must be held.
+func notifyExitWaiters() {
+	for ch := range reaper.waiters {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
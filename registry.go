@@ -0,0 +1,155 @@
+package spawnexec
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// The registry tracks the commands started while it is enabled, turned on
+// by EnableRegistry, until they are waited for.
+var registry struct {
+	mu      sync.Mutex
+	enabled bool
+	cmds    map[*Cmd]struct{}
+}
+
+// EnableRegistry turns on tracking of the commands started from then on,
+// so that a long-running program can find out what children it is
+// running, with RegisteredCommands or DumpRegistry, when debugging or
+// when stopping them all on shutdown.
+//
+// A command is tracked from when Start succeeds until Wait returns, so
+// one that is never waited for stays tracked. Once turned on, tracking
+// cannot be turned off.
+func EnableRegistry() {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if registry.enabled {
+		return
+	}
+	registry.enabled = true
+	registry.cmds = make(map[*Cmd]struct{})
+}
+
+// CommandState is the state of a tracked command.
+type CommandState int
+
+const (
+	// CommandRunning is a command that has not been seen to exit.
+	CommandRunning CommandState = iota
+
+	// CommandExited is a command that has exited and been reaped, by
+	// Wait, TryWait or the shared reaper, but whose Wait has not
+	// returned.
+	CommandExited
+)
+
+func (s CommandState) String() string {
+	switch s {
+	case CommandRunning:
+		return "running"
+	case CommandExited:
+		return "exited"
+	}
+	return "CommandState(" + itoa(int(s)) + ")"
+}
+
+// CommandInfo describes a command tracked by the registry.
+type CommandInfo struct {
+	// Cmd is the command, through which it can be signaled or waited
+	// for.
+	Cmd *Cmd
+
+	// Pid is the process id of the command.
+	Pid int
+
+	// Args is the command line, as in Cmd.Args, with the arguments
+	// redacted by Cmd.RedactArgs.
+	Args []string
+
+	// Start is when the command was spawned.
+	Start time.Time
+
+	// State is the command's state when RegisteredCommands was called.
+	State CommandState
+}
+
+// register adds c, which has just started, to the registry if it is
+// enabled.
+func (c *Cmd) register() {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if registry.enabled {
+		registry.cmds[c] = struct{}{}
+	}
+}
+
+// unregister removes c, which has been waited for, from the registry.
+func (c *Cmd) unregister() {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	delete(registry.cmds, c)
+}
+
+// RegisteredCommands returns the commands the registry is tracking, the
+// longest running first. It returns nil unless EnableRegistry has been
+// called.
+func RegisteredCommands() []CommandInfo {
+	registry.mu.Lock()
+	cmds := make([]*Cmd, 0, len(registry.cmds))
+	for c := range registry.cmds {
+		cmds = append(cmds, c)
+	}
+	registry.mu.Unlock()
+
+	var infos []CommandInfo
+	for _, c := range cmds {
+		info := CommandInfo{Cmd: c, Args: slices.Clone(c.Args)}
+		if len(info.Args) == 0 {
+			info.Args = []string{c.Path}
+		}
+		if c.RedactArgs != nil {
+			for i, arg := range info.Args {
+				info.Args[i] = c.RedactArgs(i, arg)
+			}
+		}
+		p := c.Process
+		p.mu.RLock()
+		info.Pid, info.Start = p.Pid, p.start
+		if p.state != nil {
+			info.State = CommandExited
+		}
+		p.mu.RUnlock()
+		infos = append(infos, info)
+	}
+	slices.SortFunc(infos, func(a, b CommandInfo) int {
+		if n := a.Start.Compare(b.Start); n != 0 {
+			return n
+		}
+		return cmp.Compare(a.Pid, b.Pid)
+	})
+	return infos
+}
+
+// DumpRegistry writes a table of the commands the registry is tracking
+// to w, as RegisteredCommands lists them: the pid, state and running time
+// of each, and its command line as Cmd.String shows it, leaving out its
+// environment and redacting its arguments as the Cmd asks.
+func DumpRegistry(w io.Writer) error {
+	now := time.Now()
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PID\tSTATE\tELAPSED\tCOMMAND")
+	for _, info := range RegisteredCommands() {
+		elapsed := "-"
+		if !info.Start.IsZero() {
+			elapsed = now.Sub(info.Start).Round(time.Millisecond).String()
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", info.Pid, info.State, elapsed, info.Cmd)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,71 @@
+package spawnexec
+
+import (
+	"errors"
+)
+
+// Reset readies c to be run again once Wait has returned, or Start has
+// failed, for retry loops and tools that rerun the same command. It
+// clears the run state, such as Process and ProcessState, and undoes
+// what Output, StdioConn and the pipe methods set up, closing pipes that
+// were never used, so that they can be called again. The rest of the
+// configuration is kept; a Workspace gets a new directory on the next
+// run. The context of a CommandContext command is kept too, so a command
+// whose context is done cannot be run again.
+//
+// Reset fails if c has been started and not waited for. A Start that
+// failed with a *StartTimeoutError is waited for, and what it spawned
+// reaped, before c is reset.
+func (c *Cmd) Reset() error {
+	if c.startDone != nil {
+		<-c.startDone
+		if c.Process != nil && !c.finished {
+			c.Wait()
+		}
+		c.startDone = nil
+	}
+	if c.Process != nil && !c.finished {
+		return errors.New("exec: Reset of a running command")
+	}
+
+	c.closeStartFiles()
+	closeClosers(c.parentIOPipes)
+	c.parentIOPipes = nil
+	if c.ownStdio[0] {
+		c.Stdin = nil
+	}
+	if c.ownStdio[1] {
+		c.Stdout = nil
+	}
+	if c.ownStdio[2] {
+		c.Stderr = nil
+	}
+	c.ownStdio = [3]bool{}
+	c.stdinPipeUsed, c.stdoutPipeUsed, c.stderrPipeUsed = false, false, false
+	c.stdinCloser, c.stdinCopyErr = nil, nil
+	c.goroutine, c.goroutineErr, c.copyPipes = nil, nil, nil
+	c.copyStreams, c.lineWriters = nil, nil
+	c.peek = [2]*ringBuffer{}
+	for i := range c.ioStats {
+		c.ioStats[i].Store(0)
+	}
+
+	if c.ctxSaved {
+		c.ctx, c.ctxCancel = c.savedCtx, c.savedCtxCancel
+		c.savedCtx, c.savedCtxCancel, c.ctxSaved = nil, nil, false
+	}
+	c.ctxResult, c.waitDone = nil, nil
+
+	if ws := c.Workspace; ws != nil && ws.Path != "" {
+		if c.Dir == ws.Path {
+			c.Dir = ""
+		}
+		ws.Path = ""
+	}
+
+	c.Process, c.ProcessState = nil, nil
+	c.finished = false
+	c.timing = SpawnTiming{LookPathStart: c.timing.LookPathStart, LookPathEnd: c.timing.LookPathEnd}
+	c.osCmd = nil
+	return nil
+}
@@ -0,0 +1,207 @@
+package spawnexec
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// RotateOptions configures a RotatingWriter.
+type RotateOptions struct {
+	// MaxSize is the size in bytes beyond which the log is rotated. A
+	// single write is never split, so a log can exceed it by less than the
+	// size of one write.
+	MaxSize int64
+	// MaxFiles is the number of rotated logs kept besides the current
+	// one, as path.1, path.2 and so on, path.1 being the most recent. Older
+	// ones are removed. If it is zero, rotated logs are not kept at all.
+	MaxFiles int
+	// Compress makes rotated logs be compressed with gzip, as path.1.gz
+	// and so on. Compression happens in the background, so that it holds
+	// up neither the writer nor the command.
+	Compress bool
+}
+
+// RotatingWriter is an io.WriteCloser that appends to a log file and
+// rotates it once it grows past a maximum size, keeping a bounded number
+// of old logs. Used as Cmd.Stdout or Cmd.Stderr of a long-running daemon,
+// it keeps the daemon's output from filling the disk.
+//
+// The methods of a RotatingWriter are safe for concurrent use, so Stdout
+// and Stderr can share one.
+type RotatingWriter struct {
+	path string
+	opts RotateOptions
+
+	mu          sync.Mutex
+	f           *os.File
+	size        int64
+	compressing sync.WaitGroup
+	compressErr error // set by the background compressor
+}
+
+// NewRotatingWriter opens the log at path for appending, creating it if
+// need be, and returns a RotatingWriter for it. NewRotatingWriter panics
+// if opts.MaxSize is not positive.
+func NewRotatingWriter(path string, opts RotateOptions) (*RotatingWriter, error) {
+	if opts.MaxSize <= 0 {
+		panic("spawnexec: NewRotatingWriter with non-positive MaxSize")
+	}
+	w := &RotatingWriter{path: path, opts: opts}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Write appends p to the log, rotating it first if p would take it past
+// the maximum size.
+func (w *RotatingWriter) Write(p []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return 0, os.ErrClosed
+	}
+	if w.size > 0 && w.size+int64(len(p)) > w.opts.MaxSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err = w.f.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Rotate rotates the log now, for example when asked to by a signal.
+func (w *RotatingWriter) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return os.ErrClosed
+	}
+	return w.rotate()
+}
+
+// Close closes the log, after waiting for any rotated log to be
+// compressed. It returns the first error compressing one encountered.
+func (w *RotatingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return os.ErrClosed
+	}
+	err := w.f.Close()
+	w.f = nil
+	w.compressing.Wait()
+	if w.compressErr != nil {
+		return w.compressErr
+	}
+	return err
+}
+
+// open opens the log at w.path for appending. w.mu must be held.
+func (w *RotatingWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f, w.size = f, fi.Size()
+	return nil
+}
+
+// rotated returns the name of the nth most recent rotated log.
+func (w *RotatingWriter) rotated(n int) string {
+	name := w.path + "." + strconv.Itoa(n)
+	if w.opts.Compress {
+		name += ".gz"
+	}
+	return name
+}
+
+// rotate moves the current log aside, shifting the older ones along, and
+// opens a new one. w.mu must be held.
+func (w *RotatingWriter) rotate() error {
+	err := w.f.Close()
+	w.f = nil
+	if err == nil {
+		err = w.shift()
+	}
+	// The log is reopened even if rotating it failed, to go on appending
+	// to whatever is at w.path, so that the writer is not left closed.
+	if openErr := w.open(); err == nil {
+		err = openErr
+	}
+	return err
+}
+
+// shift moves the closed current log aside, shifting the older ones
+// along. w.mu must be held.
+func (w *RotatingWriter) shift() error {
+	// The previous rotated log must be compressed before it is shifted.
+	w.compressing.Wait()
+
+	if w.opts.MaxFiles <= 0 {
+		if err := os.Remove(w.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	os.Remove(w.rotated(w.opts.MaxFiles))
+	for n := w.opts.MaxFiles - 1; n >= 1; n-- {
+		if err := os.Rename(w.rotated(n), w.rotated(n+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if !w.opts.Compress {
+		return os.Rename(w.path, w.rotated(1))
+	}
+
+	// Compress from a temporary name, so that the new log can be opened
+	// at once.
+	tmp := w.path + ".rotating"
+	if err := os.Rename(w.path, tmp); err != nil {
+		return err
+	}
+	w.compressing.Add(1)
+	go func() {
+		defer w.compressing.Done()
+		if err := gzipFile(tmp, w.rotated(1)); err != nil && w.compressErr == nil {
+			w.compressErr = err
+		}
+	}()
+	return nil
+}
+
+// gzipFile compresses the file src into dst and removes src.
+func gzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
@@ -0,0 +1,80 @@
+package spawnexec
+
+import (
+	"context"
+	"io"
+)
+
+// Runner is the behaviour of a single command, as implemented by *Cmd.
+//
+// Application code that depends on Runner rather than *Cmd can be tested
+// with a double (see the spawntest package) instead of spawning real
+// processes. The Set methods exist so that a command can be configured
+// through the interface; they are equivalent to assigning the
+// corresponding Cmd fields.
+type Runner interface {
+	Run() error
+	Start() error
+	Wait() error
+	Output() ([]byte, error)
+	CombinedOutput() ([]byte, error)
+	StdinPipe() (io.WriteCloser, error)
+	StdoutPipe() (io.ReadCloser, error)
+	StderrPipe() (io.ReadCloser, error)
+	String() string
+
+	SetDir(dir string)
+	SetEnv(env []string)
+	SetStdin(in io.Reader)
+	SetStdout(out io.Writer)
+	SetStderr(out io.Writer)
+}
+
+// Commander creates Runners. It mirrors the package-level Command and
+// CommandContext functions.
+type Commander interface {
+	Command(name string, arg ...string) Runner
+	CommandContext(ctx context.Context, name string, arg ...string) Runner
+}
+
+// DefaultCommander is a Commander that creates real commands using
+// Command and CommandContext.
+var DefaultCommander Commander = commander{}
+
+var _ Runner = (*Cmd)(nil)
+
+// commander is the Commander backed by this package.
+type commander struct{}
+
+func (commander) Command(name string, arg ...string) Runner {
+	return Command(name, arg...)
+}
+
+func (commander) CommandContext(ctx context.Context, name string, arg ...string) Runner {
+	return CommandContext(ctx, name, arg...)
+}
+
+// SetDir sets c.Dir.
+func (c *Cmd) SetDir(dir string) {
+	c.Dir = dir
+}
+
+// SetEnv sets c.Env.
+func (c *Cmd) SetEnv(env []string) {
+	c.Env = env
+}
+
+// SetStdin sets c.Stdin.
+func (c *Cmd) SetStdin(in io.Reader) {
+	c.Stdin = in
+}
+
+// SetStdout sets c.Stdout.
+func (c *Cmd) SetStdout(out io.Writer) {
+	c.Stdout = out
+}
+
+// SetStderr sets c.Stderr.
+func (c *Cmd) SetStderr(out io.Writer) {
+	c.Stderr = out
+}
@@ -0,0 +1,61 @@
+package spawnexec
+
+import "time"
+
+// RusageInfo holds extended resource usage information about an exited
+// process, as reported by proc_pid_rusage(RUSAGE_INFO_V4) on darwin. It is
+// collected just before the process is reaped, so it describes the process
+// itself and not its children.
+type RusageInfo struct {
+	// UserTime and SystemTime are the CPU time spent by the process.
+	UserTime   time.Duration
+	SystemTime time.Duration
+
+	// PhysFootprint is the physical memory footprint of the process at
+	// exit, and LifetimeMaxPhysFootprint its peak over the process
+	// lifetime, in bytes. This is what Activity Monitor reports as
+	// "Memory".
+	PhysFootprint            uint64
+	LifetimeMaxPhysFootprint uint64
+
+	// ResidentSize and WiredSize are the resident and wired memory of
+	// the process at exit, in bytes.
+	ResidentSize uint64
+	WiredSize    uint64
+
+	// Pageins is the number of page-ins the process incurred.
+	Pageins uint64
+
+	// Instructions and Cycles are the retired instructions and CPU
+	// cycles of the process.
+	Instructions uint64
+	Cycles       uint64
+
+	// BilledEnergy and ServicedEnergy are the energy used by the process,
+	// in nanojoules.
+	BilledEnergy   uint64
+	ServicedEnergy uint64
+
+	// PkgIdleWakeups and InterruptWakeups count the times the process
+	// woke the CPU package from idle and was woken by interrupts.
+	PkgIdleWakeups   uint64
+	InterruptWakeups uint64
+
+	// DiskBytesRead and DiskBytesWritten are the bytes of disk I/O
+	// performed by the process, and LogicalWrites the bytes it wrote
+	// including those absorbed by caches.
+	DiskBytesRead    uint64
+	DiskBytesWritten uint64
+	LogicalWrites    uint64
+
+	// RunnableTime is how long the process was runnable but waiting for
+	// a CPU.
+	RunnableTime time.Duration
+}
+
+// RusageInfo returns the extended resource usage of the exited process,
+// or nil if it is not available. It is only collected on darwin, and only
+// for processes reaped by this package.
+func (p *ProcessState) RusageInfo() *RusageInfo {
+	return p.rusageInfo
+}
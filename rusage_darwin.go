@@ -0,0 +1,73 @@
+//go:build darwin
+
+package spawnexec
+
+/*
+#include <errno.h>
+#include <libproc.h>
+#include <mach/mach_time.h>
+#include <sys/resource.h>
+#include <sys/wait.h>
+
+// wait_exited_nowait blocks until pid has exited, leaving it unreaped.
+static int wait_exited_nowait(pid_t pid) {
+    siginfo_t si;
+    int ret;
+    do {
+        ret = waitid(P_PID, pid, &si, WEXITED | WNOWAIT);
+    } while (ret == -1 && errno == EINTR);
+    return ret == -1 ? errno : 0;
+}
+
+static int pid_rusage_v4(pid_t pid, struct rusage_info_v4 *info) {
+    if (proc_pid_rusage(pid, RUSAGE_INFO_V4, (rusage_info_t *)info) != 0) {
+        return errno;
+    }
+    return 0;
+}
+
+// abstime_to_nanos converts mach absolute time units to nanoseconds.
+static uint64_t abstime_to_nanos(uint64_t t) {
+    static mach_timebase_info_data_t tb;
+    if (tb.denom == 0) {
+        mach_timebase_info(&tb);
+    }
+    return t * tb.numer / tb.denom;
+}
+*/
+import "C"
+import "time"
+
+// collectRusageInfo waits for pid to exit without reaping it and returns
+// its extended resource usage, or nil if it cannot be collected.
+func collectRusageInfo(pid int) *RusageInfo {
+	if C.wait_exited_nowait(C.pid_t(pid)) != 0 {
+		return nil
+	}
+	var ri C.struct_rusage_info_v4
+	if C.pid_rusage_v4(C.pid_t(pid), &ri) != 0 {
+		return nil
+	}
+	nanos := func(t C.uint64_t) time.Duration {
+		return time.Duration(C.abstime_to_nanos(t))
+	}
+	return &RusageInfo{
+		UserTime:                 nanos(ri.ri_user_time),
+		SystemTime:               nanos(ri.ri_system_time),
+		PhysFootprint:            uint64(ri.ri_phys_footprint),
+		LifetimeMaxPhysFootprint: uint64(ri.ri_lifetime_max_phys_footprint),
+		ResidentSize:             uint64(ri.ri_resident_size),
+		WiredSize:                uint64(ri.ri_wired_size),
+		Pageins:                  uint64(ri.ri_pageins),
+		Instructions:             uint64(ri.ri_instructions),
+		Cycles:                   uint64(ri.ri_cycles),
+		BilledEnergy:             uint64(ri.ri_billed_energy),
+		ServicedEnergy:           uint64(ri.ri_serviced_energy),
+		PkgIdleWakeups:           uint64(ri.ri_pkg_idle_wkups),
+		InterruptWakeups:         uint64(ri.ri_interrupt_wkups),
+		DiskBytesRead:            uint64(ri.ri_diskio_bytesread),
+		DiskBytesWritten:         uint64(ri.ri_diskio_byteswritten),
+		LogicalWrites:            uint64(ri.ri_logical_writes),
+		RunnableTime:             nanos(ri.ri_runnable_time),
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !darwin
+
+package spawnexec
+
+// collectRusageInfo returns nil: extended resource usage is only
+// available on darwin.
+func collectRusageInfo(pid int) *RusageInfo {
+	return nil
+}
@@ -0,0 +1,86 @@
+package spawnexec
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+)
+
+// MaxScanTokenSize is the maximum length of a line accepted by the
+// scanners returned by StdoutScanner and StderrScanner. It is larger than
+// bufio.MaxScanTokenSize, which long log lines regularly exceed.
+const MaxScanTokenSize = 1 << 20
+
+// StdoutScanner returns a bufio.Scanner that splits the command's standard
+// output into lines. It must be called before Start, like StdoutPipe.
+//
+// The scanner accepts lines of up to MaxScanTokenSize bytes. Wait closes
+// the underlying pipe; a scanner that is still in use when that happens
+// stops as if it had reached the end of the output rather than failing
+// with a "file already closed" error.
+func (c *Cmd) StdoutScanner() (*bufio.Scanner, error) {
+	r, err := c.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	return newLineScanner(r), nil
+}
+
+// StderrScanner is like StdoutScanner but for the command's standard error.
+func (c *Cmd) StderrScanner() (*bufio.Scanner, error) {
+	r, err := c.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	return newLineScanner(r), nil
+}
+
+// ForEachLine starts the command, calls fn with each line of its standard
+// output (without the line terminator) and waits for it to finish.
+//
+// If a line is longer than MaxScanTokenSize, the rest of the output is
+// discarded so that the command is not blocked writing it, and
+// bufio.ErrTooLong is returned once the command has exited.
+func (c *Cmd) ForEachLine(fn func(line string)) error {
+	r, err := c.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := c.Start(); err != nil {
+		return err
+	}
+	sc := newLineScanner(r)
+	for sc.Scan() {
+		fn(sc.Text())
+	}
+	scanErr := sc.Err()
+	if scanErr != nil {
+		io.Copy(io.Discard, r)
+	}
+	if err := c.Wait(); err != nil {
+		return err
+	}
+	return scanErr
+}
+
+// newLineScanner returns a line scanner over r that treats r being closed
+// as the end of input.
+func newLineScanner(r io.Reader) *bufio.Scanner {
+	sc := bufio.NewScanner(closedAsEOFReader{r})
+	sc.Buffer(make([]byte, 0, 64*1024), MaxScanTokenSize)
+	return sc
+}
+
+// closedAsEOFReader reports reads from a closed file as io.EOF.
+type closedAsEOFReader struct {
+	r io.Reader
+}
+
+func (r closedAsEOFReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if errors.Is(err, os.ErrClosed) {
+		err = io.EOF
+	}
+	return n, err
+}
@@ -0,0 +1,121 @@
+package spawnexec
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Script runs commands one after another, as the steps of a provisioning
+// recipe, in a shared working directory and environment, and keeps a
+// transcript of what each of them printed.
+//
+// The zero value is an empty Script ready to use.
+type Script struct {
+	// Dir and Env are the working directory and environment of the
+	// commands whose own Dir and Env are not set.
+	Dir string
+	Env []string
+
+	// ContinueOnError runs the remaining commands after one fails, rather
+	// than stopping there.
+	ContinueOnError bool
+
+	cmds []*Cmd
+
+	mu         sync.Mutex
+	transcript bytes.Buffer
+}
+
+// Add appends cmds to the script.
+func (s *Script) Add(cmds ...*Cmd) {
+	s.cmds = append(s.cmds, cmds...)
+}
+
+// Command returns a Cmd to run the named program with the given
+// arguments, as Command does, and appends it to the script.
+func (s *Script) Command(name string, arg ...string) *Cmd {
+	cmd := Command(name, arg...)
+	s.Add(cmd)
+	return cmd
+}
+
+// Run runs the commands of the script in order, each bound to ctx as by
+// OutputContext, until one fails, or all of them if ContinueOnError is
+// set. It returns the errors of the commands that failed, each prefixed
+// with the command, joined with errors.Join, and ctx's error if ctx was
+// done before the script finished. A script can only be run once.
+func (s *Script) Run(ctx context.Context) error {
+	var errs []error
+	for _, cmd := range s.cmds {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		if cmd.Dir == "" {
+			cmd.Dir = s.Dir
+		}
+		if cmd.Env == nil {
+			cmd.Env = s.Env
+		}
+		s.record(cmd)
+
+		io.WriteString(transcriptWriter{s}, "$ "+cmd.String()+"\n")
+		err := cmd.runContext(ctx)
+		if err == nil {
+			continue
+		}
+		io.WriteString(transcriptWriter{s}, "# "+err.Error()+"\n")
+		errs = append(errs, wrapError(cmd.String()+": ", err))
+		if !s.ContinueOnError {
+			break
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// record has the output cmd writes to its Stdout and Stderr also, or
+// only, written to the transcript.
+func (s *Script) record(cmd *Cmd) {
+	tw := transcriptWriter{s}
+	if cmd.Stdout == nil && cmd.Stderr == nil {
+		cmd.Stdout, cmd.Stderr = tw, tw
+		return
+	}
+	tee := func(w io.Writer) io.Writer {
+		if w == nil {
+			return tw
+		}
+		return io.MultiWriter(w, tw)
+	}
+	stdout, stderr := cmd.Stdout, cmd.Stderr
+	cmd.Stdout = tee(stdout)
+	if stderr == stdout {
+		cmd.Stderr = cmd.Stdout
+	} else {
+		cmd.Stderr = tee(stderr)
+	}
+}
+
+// Transcript returns the transcript of the commands run so far: each
+// command, as its String method shows it, on a line starting with "$ ",
+// followed by its standard output and error as they were written and, if
+// it failed, a line starting with "# " giving the error.
+func (s *Script) Transcript() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return bytes.Clone(s.transcript.Bytes())
+}
+
+// transcriptWriter writes to the transcript of a Script.
+type transcriptWriter struct {
+	s *Script
+}
+
+func (w transcriptWriter) Write(p []byte) (int, error) {
+	w.s.mu.Lock()
+	defer w.s.mu.Unlock()
+	return w.s.transcript.Write(p)
+}
@@ -0,0 +1,361 @@
+package spawnexec
+
+import (
+	"errors"
+	"io"
+	"math"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrSessionTimeout is returned by Session methods that give up waiting.
+var ErrSessionTimeout = errors.New("exec: session timed out")
+
+// maxSessionBuffer is the most output a Session keeps unconsumed; older
+// output is dropped beyond it.
+const maxSessionBuffer = 1 << 20
+
+// sessionDrainDelay is how long a Session on a pseudo-terminal keeps
+// reading after the command has exited, for output still held by
+// processes it left behind.
+const sessionDrainDelay = 250 * time.Millisecond
+
+// SessionOptions configures a Session.
+type SessionOptions struct {
+	// PTY runs the command on a new pseudo-terminal, as its controlling
+	// terminal and its standard input, output and error, for programs that
+	// only prompt or echo when run interactively. Otherwise the command's
+	// standard input is a pipe, and its standard output and error are
+	// both captured.
+	PTY bool
+
+	// Terminal, if set for a session on a pseudo-terminal, is the
+	// terminal whose window size the pseudo-terminal follows, typically
+	// os.Stdin: its size is copied when the session starts and again
+	// whenever this process receives SIGWINCH, so that full-screen
+	// programs such as vim render correctly when relayed to it. Nothing
+	// is copied while Terminal is not a terminal.
+	Terminal *os.File
+
+	// CloseTimeout is how long Close waits for the command to exit at
+	// each step before escalating. If it is zero, one second is used.
+	CloseTimeout time.Duration
+}
+
+// Session drives a long-lived interactive command, such as sftp, a Python
+// REPL or a debugger: it sends it input and buffers its output until it
+// is consumed, without the caller juggling pipes and goroutines.
+type Session struct {
+	cmd   *Cmd
+	opts  SessionOptions
+	stdin io.WriteCloser
+	pty   *os.File // controller side of the pseudo-terminal, if any
+
+	mu      sync.Mutex
+	buf     []byte        // output not yet consumed
+	last    time.Time     // when output was last received
+	changed chan struct{} // closed and replaced when buf or done change
+	waitErr error
+
+	done     chan struct{} // closed once the command has exited and its output is in
+	readDone chan struct{} // closed once the pseudo-terminal reader returns
+}
+
+// StartSession starts cmd as an interactive session. cmd's Stdin, Stdout
+// and Stderr must be nil; the Session provides them.
+func StartSession(cmd *Cmd, opts SessionOptions) (*Session, error) {
+	if cmd.Stdin != nil || cmd.Stdout != nil || cmd.Stderr != nil {
+		return nil, errors.New("exec: StartSession with Stdin, Stdout or Stderr set")
+	}
+	if opts.CloseTimeout <= 0 {
+		opts.CloseTimeout = time.Second
+	}
+	s := &Session{
+		cmd:     cmd,
+		opts:    opts,
+		last:    time.Now(),
+		changed: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	if opts.PTY {
+		controller, replica, err := openPTY()
+		if err != nil {
+			return nil, err
+		}
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = replica, replica, replica
+		attr := SysProcAttr{}
+		if cmd.SysProcAttr != nil {
+			attr = *cmd.SysProcAttr
+		}
+		attr.Setsid, attr.Setctty, attr.Ctty = true, true, 0
+		cmd.SysProcAttr = &attr
+		var winch chan os.Signal
+		if opts.Terminal != nil {
+			// Notified before the size is copied, so that no change is
+			// missed.
+			winch = make(chan os.Signal, 1)
+			signal.Notify(winch, syscall.SIGWINCH)
+			copyPTYSize(controller, opts.Terminal)
+		}
+		err = cmd.Start()
+		replica.Close()
+		if err != nil {
+			if winch != nil {
+				signal.Stop(winch)
+			}
+			controller.Close()
+			return nil, err
+		}
+		s.stdin, s.pty = controller, controller
+		s.readDone = make(chan struct{})
+		go s.read()
+		if winch != nil {
+			go s.followTerminal(winch)
+		}
+	} else {
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		w := sessionWriter{s}
+		cmd.Stdout, cmd.Stderr = w, w
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+		s.stdin = stdin
+	}
+	go s.wait()
+	return s, nil
+}
+
+// sessionWriter receives a Session's output from the command's copiers.
+type sessionWriter struct {
+	s *Session
+}
+
+func (w sessionWriter) Write(p []byte) (int, error) {
+	w.s.append(p)
+	return len(p), nil
+}
+
+// append adds output to the buffer.
+func (s *Session) append(p []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buf = append(s.buf, p...)
+	if len(s.buf) > maxSessionBuffer {
+		s.buf = append(s.buf[:0], s.buf[len(s.buf)-maxSessionBuffer:]...)
+	}
+	s.last = time.Now()
+	s.notify()
+}
+
+// notify wakes up those waiting for a change. s.mu must be held.
+func (s *Session) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// read copies output from the pseudo-terminal until the command and
+// anything it left behind have closed it.
+func (s *Session) read() {
+	defer close(s.readDone)
+	buf := make([]byte, copyBufSize)
+	for {
+		n, err := s.pty.Read(buf)
+		if n > 0 {
+			s.append(buf[:n])
+		}
+		if err != nil {
+			// Linux reports EIO once the replica side is closed.
+			return
+		}
+	}
+}
+
+// wait waits for the command to exit and its output to be read.
+func (s *Session) wait() {
+	err := s.cmd.Wait()
+	if s.pty != nil {
+		select {
+		case <-s.readDone:
+		case <-time.After(sessionDrainDelay):
+		}
+		s.pty.Close()
+		<-s.readDone
+	}
+	s.mu.Lock()
+	s.waitErr = err
+	close(s.done)
+	s.notify()
+	s.mu.Unlock()
+}
+
+// followTerminal copies the size of the Terminal to the pseudo-terminal on
+// each SIGWINCH received on winch, until the command has exited.
+func (s *Session) followTerminal(winch chan os.Signal) {
+	defer signal.Stop(winch)
+	for {
+		select {
+		case <-winch:
+			copyPTYSize(s.pty, s.opts.Terminal)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// copyPTYSize gives the pseudo-terminal pty the window size of terminal,
+// if it is one.
+func copyPTYSize(pty, terminal *os.File) {
+	if rows, cols, err := ptySize(terminal); err == nil {
+		setPTYSize(pty, rows, cols)
+	}
+}
+
+// SetSize sets the window size of the session's pseudo-terminal to rows
+// by cols characters, which sends the command SIGWINCH, for relaying a
+// terminal's resizes by hand, such as one in a browser. It returns an
+// error if the session is not on a pseudo-terminal.
+func (s *Session) SetSize(rows, cols int) error {
+	if s.pty == nil {
+		return errors.New("exec: SetSize of a session without a pseudo-terminal")
+	}
+	if rows < 0 || rows > math.MaxUint16 || cols < 0 || cols > math.MaxUint16 {
+		return errors.New("exec: SetSize with an invalid size")
+	}
+	return setPTYSize(s.pty, rows, cols)
+}
+
+// Size returns the window size of the session's pseudo-terminal, in rows
+// and columns. It returns an error if the session is not on a
+// pseudo-terminal.
+func (s *Session) Size() (rows, cols int, err error) {
+	if s.pty == nil {
+		return 0, 0, errors.New("exec: Size of a session without a pseudo-terminal")
+	}
+	return ptySize(s.pty)
+}
+
+// Cmd returns the command the Session runs.
+func (s *Session) Cmd() *Cmd {
+	return s.cmd
+}
+
+// Send writes text to the command's input as it is.
+func (s *Session) Send(text string) error {
+	_, err := io.WriteString(s.stdin, text)
+	return err
+}
+
+// SendLine writes line to the command's input followed by a newline.
+func (s *Session) SendLine(line string) error {
+	return s.Send(line + "\n")
+}
+
+// Output returns the output received and not yet consumed. On a
+// pseudo-terminal it includes the terminal's echo of the input.
+func (s *Session) Output() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]byte(nil), s.buf...)
+}
+
+// TakeOutput returns the output received and not yet consumed, and
+// consumes it.
+func (s *Session) TakeOutput() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.buf
+	s.buf = nil
+	return b
+}
+
+// LastOutput returns when output was last received, or when the session
+// started if there has been none.
+func (s *Session) LastOutput() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+// WaitIdle waits until the command has produced no output for quiet, as
+// an interactive program does once it is waiting for input, or has
+// exited. It returns ErrSessionTimeout if that has not happened within
+// timeout; a timeout of zero or less means no limit.
+func (s *Session) WaitIdle(quiet, timeout time.Duration) error {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	for {
+		s.mu.Lock()
+		idle := time.Until(s.last.Add(quiet))
+		changed := s.changed
+		exited := s.exited()
+		s.mu.Unlock()
+		if idle <= 0 || exited {
+			return nil
+		}
+		t := time.NewTimer(idle)
+		select {
+		case <-t.C:
+		case <-changed:
+		case <-expired:
+			t.Stop()
+			return ErrSessionTimeout
+		}
+		t.Stop()
+	}
+}
+
+// exited reports whether the command has exited and its output is in.
+func (s *Session) exited() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Done returns a channel that is closed once the command has exited and
+// all its output has been received.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Wait waits for the command to exit and returns the error Cmd.Wait
+// reported.
+func (s *Session) Wait() error {
+	<-s.done
+	return s.waitErr
+}
+
+// Close ends the session: it closes the command's input, and, if the
+// command has not exited within CloseTimeout, sends it SIGTERM, then
+// after as long again SIGKILL. On a pseudo-terminal the signals go to the
+// whole session's process group. Close returns the error Cmd.Wait
+// reported, which reflects any signal that was needed.
+func (s *Session) Close() error {
+	s.stdin.Close()
+	for _, sig := range []syscall.Signal{syscall.SIGTERM, syscall.SIGKILL} {
+		select {
+		case <-s.done:
+			return s.waitErr
+		case <-time.After(s.opts.CloseTimeout):
+		}
+		if s.pty != nil {
+			syscall.Kill(-s.cmd.Process.Pid, sig)
+		} else {
+			s.cmd.Process.Signal(sig)
+		}
+	}
+	return s.Wait()
+}
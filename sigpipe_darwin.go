@@ -0,0 +1,28 @@
+//go:build darwin
+
+package spawnexec
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// noSIGPIPE has writes to w, the parent's end of a pipe to a command,
+// fail with EPIPE once the command has closed the other end, rather than
+// raise SIGPIPE, which kills a process that embeds Go in C and leaves
+// SIGPIPE at its default action. Errors are ignored: the write then
+// behaves as before.
+func noSIGPIPE(w any) {
+	sc, ok := w.(syscall.Conn)
+	if !ok {
+		return
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return
+	}
+	rc.Control(func(fd uintptr) {
+		unix.FcntlInt(fd, unix.F_SETNOSIGPIPE, 1)
+	})
+}
@@ -0,0 +1,8 @@
+//go:build !darwin
+
+package spawnexec
+
+// noSIGPIPE does nothing: F_SETNOSIGPIPE is only available on darwin.
+// Elsewhere the Go runtime has writes to a broken pipe other than
+// standard output and error fail with EPIPE.
+func noSIGPIPE(w any) {}
@@ -10,6 +10,7 @@ package spawnexec
 #include <signal.h>
 #include <unistd.h>
 #include <fcntl.h>
+#include <mach/mach.h>
 
 // posix_spawn_file_actions helpers
 int init_file_actions(posix_spawn_file_actions_t *actions) {
@@ -28,6 +29,17 @@ int add_dup2_action(posix_spawn_file_actions_t *actions, int fd, int newfd) {
     return posix_spawn_file_actions_adddup2(actions, fd, newfd);
 }
 
+// add_inherit_action makes fd available as newfd in the child. A dup2 of a
+// descriptor onto itself leaves its close-on-exec flag alone, so under
+// POSIX_SPAWN_CLOEXEC_DEFAULT such a descriptor must be marked inherited
+// instead.
+int add_inherit_action(posix_spawn_file_actions_t *actions, int fd, int newfd) {
+    if (fd == newfd) {
+        return posix_spawn_file_actions_addinherit_np(actions, fd);
+    }
+    return posix_spawn_file_actions_adddup2(actions, fd, newfd);
+}
+
 int add_open_action(posix_spawn_file_actions_t *actions, int fd, const char *path, int oflag, mode_t mode) {
     return posix_spawn_file_actions_addopen(actions, fd, path, oflag, mode);
 }
@@ -69,6 +81,27 @@ int has_chdir_np() {
     #pragma clang diagnostic pop
     return result;
 }
+
+// The fchdir file action arrived alongside chdir, and is deprecated
+// alongside it too.
+extern int posix_spawn_file_actions_addfchdir(posix_spawn_file_actions_t *file_actions, int fd) __attribute__((weak_import));
+#pragma clang diagnostic push
+#pragma clang diagnostic ignored "-Wdeprecated-declarations"
+extern int posix_spawn_file_actions_addfchdir_np(posix_spawn_file_actions_t *file_actions, int fd) __attribute__((weak_import));
+#pragma clang diagnostic pop
+
+int add_fchdir_action(posix_spawn_file_actions_t *actions, int fd) {
+    if (posix_spawn_file_actions_addfchdir != NULL) {
+        return posix_spawn_file_actions_addfchdir(actions, fd);
+    }
+    #pragma clang diagnostic push
+    #pragma clang diagnostic ignored "-Wdeprecated-declarations"
+    if (posix_spawn_file_actions_addfchdir_np != NULL) {
+        return posix_spawn_file_actions_addfchdir_np(actions, fd);
+    }
+    #pragma clang diagnostic pop
+    return ENOSYS;
+}
 #else
 int add_chdir_action(posix_spawn_file_actions_t *actions, const char *path) {
     return ENOSYS;
@@ -76,6 +109,9 @@ int add_chdir_action(posix_spawn_file_actions_t *actions, const char *path) {
 int has_chdir_np() {
     return 0;
 }
+int add_fchdir_action(posix_spawn_file_actions_t *actions, int fd) {
+    return ENOSYS;
+}
 #endif
 
 // posix_spawnattr helpers
@@ -103,6 +139,69 @@ int set_spawnattr_sigmask(posix_spawnattr_t *attr, sigset_t *sigmask) {
     return posix_spawnattr_setsigmask(attr, sigmask);
 }
 
+// posix_spawnattr_setjetsam_ext is private API from <spawn_private.h>,
+// used by launchd to set the memorystatus (jetsam) attributes of the
+// processes it spawns.
+extern int posix_spawnattr_setjetsam_ext(posix_spawnattr_t *attr, short flags,
+    int priority, int memlimit_active, int memlimit_inactive) __attribute__((weak_import));
+
+#define POSIX_SPAWN_JETSAM_MEMLIMIT_ACTIVE_FATAL   0x04
+#define POSIX_SPAWN_JETSAM_MEMLIMIT_INACTIVE_FATAL 0x08
+
+// set_spawnattr_jetsam sets the jetsam priority band of the child and its
+// memory limit in megabytes, past which the kernel kills it. -1 leaves
+// either at its default.
+int set_spawnattr_jetsam(posix_spawnattr_t *attr, int priority, int limit_mb) {
+    if (posix_spawnattr_setjetsam_ext == NULL) {
+        return ENOTSUP;
+    }
+    short flags = 0;
+    if (limit_mb > 0) {
+        flags |= POSIX_SPAWN_JETSAM_MEMLIMIT_ACTIVE_FATAL | POSIX_SPAWN_JETSAM_MEMLIMIT_INACTIVE_FATAL;
+    }
+    return posix_spawnattr_setjetsam_ext(attr, flags, priority, limit_mb, limit_mb);
+}
+
+// posix_spawnattr_set_csm_np is private API from <spawn_private.h>,
+// selecting CPU security mitigations for the child.
+extern int posix_spawnattr_set_csm_np(const posix_spawnattr_t *attr,
+    uint32_t flags) __attribute__((weak_import));
+
+// set_spawnattr_csm sets the POSIX_SPAWN_NP_CSM_* mitigation flags of the
+// child.
+int set_spawnattr_csm(posix_spawnattr_t *attr, uint32_t flags) {
+    if (posix_spawnattr_set_csm_np == NULL) {
+        return ENOTSUP;
+    }
+    return posix_spawnattr_set_csm_np(attr, flags);
+}
+
+// posix_spawnattr_set_qos_clamp_np is private API from <spawn_private.h>,
+// capping the quality of service of all of the child's threads.
+extern int posix_spawnattr_set_qos_clamp_np(posix_spawnattr_t *attr,
+    uint64_t qos_clamp) __attribute__((weak_import));
+
+// set_spawnattr_qos_clamp sets the POSIX_SPAWN_PROC_CLAMP_* clamp of the
+// child.
+int set_spawnattr_qos_clamp(posix_spawnattr_t *attr, uint64_t clamp) {
+    if (posix_spawnattr_set_qos_clamp_np == NULL) {
+        return ENOTSUP;
+    }
+    return posix_spawnattr_set_qos_clamp_np(attr, clamp);
+}
+
+int set_spawnattr_exceptionport(posix_spawnattr_t *attr, exception_mask_t mask,
+    mach_port_t port, exception_behavior_t behavior, thread_state_flavor_t flavor) {
+    return posix_spawnattr_setexceptionports_np(attr, mask, port, behavior, flavor);
+}
+
+// reset_spawnattr_exceptionports resets all of the child's task exception
+// ports instead of having it inherit the parent's.
+int reset_spawnattr_exceptionports(posix_spawnattr_t *attr) {
+    return posix_spawnattr_setexceptionports_np(attr, EXC_MASK_ALL, MACH_PORT_NULL,
+        EXCEPTION_DEFAULT, THREAD_STATE_NONE);
+}
+
 // Spawn wrapper
 int do_posix_spawn(pid_t *pid, const char *path,
                    posix_spawn_file_actions_t *file_actions,
@@ -134,8 +233,10 @@ import (
 	"errors"
 	"io"
 	"os"
+	"strconv"
 	"sync"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
@@ -149,29 +250,27 @@ const (
 	_POSIX_SPAWN_SETSIGMASK      = C.POSIX_SPAWN_SETSIGMASK
 	_POSIX_SPAWN_SETEXEC         = 0x0040 // macOS specific
 	_POSIX_SPAWN_START_SUSPENDED = 0x0080 // macOS specific
+	_POSIX_SPAWN_SETSID          = 0x0400 // macOS 10.15+
 	_POSIX_SPAWN_CLOEXEC_DEFAULT = 0x4000 // macOS specific
 )
 
+// nativeBackend is the Backend used unless SetBackend says otherwise.
+const nativeBackend = BackendPosixSpawn
+
 // hasChdir reports whether posix_spawn_file_actions_addchdir_np is available.
 func hasChdir() bool {
 	return C.has_chdir_np() != 0
 }
 
-// Start starts the specified command but does not wait for it to complete.
-//
-// If Start returns successfully, the c.Process field will be set.
-//
-// After a successful call to Start the Wait method must be called in
-// order to release associated system resources.
-func (c *Cmd) Start() error {
-	if c.lookPathErr != nil {
-		return c.lookPathErr
-	}
-	if c.Process != nil {
-		return errors.New("exec: already started")
+// start starts c with posix_spawn, or as its backend or broker says, for
+// Start.
+func (c *Cmd) start() (err error) {
+	c.timing.Start = time.Now()
+	if err := lookPathError(c.lookPathErr, c.DotPolicy); err != nil {
+		return err
 	}
-	if c.finished {
-		return errors.New("exec: already finished")
+	if err := c.validate(); err != nil {
+		return err
 	}
 
 	// Check if context is already done
@@ -183,11 +282,45 @@ func (c *Cmd) Start() error {
 		}
 	}
 
+	// The command is validated before its SingleInstance lock is taken,
+	// which Start releases if this fails.
+	if err := c.lockInstance(); err != nil {
+		return err
+	}
+	if err := c.createWorkspace(); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			c.removeWorkspace(err)
+		}
+	}()
+
+	restoreStdio, err := c.resolveStdio()
+	if err != nil {
+		return err
+	}
+	defer restoreStdio()
+
+	c.backend = CurrentBackend()
+	c.logStart()
+	if c.Broker != nil {
+		return c.startBrokered()
+	}
+	if c.backend == BackendOSExec {
+		return c.startOSExec()
+	}
+	openFiles, err := c.openFiles()
+	if err != nil {
+		return err
+	}
+
 	// Resolve path
-	path := c.Path
-	if c.Dir != "" && !isAbs(path) {
-		path = joinPath(c.Dir, path)
+	path, err := execPath(c.Dir, c.Path)
+	if err != nil {
+		return wrapError("exec: ", err)
 	}
+	execFile := path
 
 	// Setup environment
 	env := c.Env
@@ -195,6 +328,40 @@ func (c *Cmd) Start() error {
 		env = os.Environ()
 	}
 
+	// What posix_spawn cannot do is left to a trampoline: changing
+	// directory without posix_spawn_file_actions_addchdir, acquiring a
+	// controlling terminal, and setting the I/O policy and RLIMIT_CORE.
+	var tr trampoline
+	if c.Dir != "" && !hasChdir() {
+		tr.dir = c.Dir
+	}
+	if attr := c.SysProcAttr; attr != nil && attr.Setctty {
+		if !attr.Setsid {
+			return errors.New("exec: Setctty requires Setsid")
+		}
+		tr.setctty, tr.ctty = true, attr.Ctty
+	}
+	if attr := c.SysProcAttr; attr != nil && attr.Foreground {
+		tr.foreground = true
+	}
+	if da := c.DarwinAttr; da != nil {
+		if da.IOPolicy < 0 || da.IOPolicy > IOPolicyStandard {
+			return errors.New("exec: unknown IOPolicy " + strconv.Itoa(int(da.IOPolicy)))
+		}
+		tr.ioPolicy = da.IOPolicy
+	}
+	if c.CoreDumps < CoreDumpsInherit || c.CoreDumps > CoreDumpsDisabled {
+		return errors.New("exec: unknown CoreDumps " + strconv.Itoa(int(c.CoreDumps)))
+	}
+	tr.coreDumps = c.CoreDumps
+	if tr.needed() {
+		// posix_spawn's ENOEXEC would be the trampoline's.
+		tr.shell = c.ShellFallback
+		if path, env, err = tr.spawnArgs(path, env); err != nil {
+			return wrapError("exec: ", err)
+		}
+	}
+
 	// Setup file actions for I/O redirection
 	var fileActions C.posix_spawn_file_actions_t
 	if ret := C.init_file_actions(&fileActions); ret != 0 {
@@ -202,6 +369,17 @@ func (c *Cmd) Start() error {
 	}
 	defer C.destroy_file_actions(&fileActions)
 
+	// Change to DirFD before any descriptor is rearranged, so that it
+	// cannot have been replaced by then.
+	if c.DirFD != nil {
+		if ret := C.add_fchdir_action(&fileActions, C.int(c.DirFD.Fd())); ret != 0 {
+			if syscall.Errno(ret) == syscall.ENOSYS {
+				return errors.New("exec: DirFD requires macOS 10.15 or later")
+			}
+			return syscall.Errno(ret)
+		}
+	}
+
 	// Track file descriptors to close in parent after spawn
 	var closeAfterSpawn []int
 	var closersToClose []io.Closer
@@ -244,24 +422,54 @@ func (c *Cmd) Start() error {
 		closeAfterSpawn = append(closeAfterSpawn, stderrFd)
 	}
 
-	// Setup extra files
-	for i, f := range c.ExtraFiles {
-		if f != nil {
-			fd := int(f.Fd())
-			targetFd := 3 + i
-			if ret := C.add_dup2_action(&fileActions, C.int(fd), C.int(targetFd)); ret != 0 {
-				closeClosers(closersToClose)
-				return syscall.Errno(ret)
-			}
+	// Setup extra files. Each file is first duplicated to a temporary
+	// descriptor above all the others, so that a file whose descriptor is
+	// the target of another is not clobbered before it has been moved. The
+	// dup2 actions also clear close-on-exec on the final descriptors, which
+	// POSIX_SPAWN_CLOEXEC_DEFAULT would otherwise close.
+	extraFiles, err := c.extraFiles()
+	if err != nil {
+		closeClosers(closersToClose)
+		return err
+	}
+	extraFds := make([]int, len(extraFiles))
+	tmpBase := 3 + len(extraFiles)
+	for i, f := range extraFiles {
+		extraFds[i] = -1
+		if f == nil {
+			continue
 		}
+		if extraFds[i], err = c.childFd(f, -1); err != nil {
+			closeClosers(closersToClose)
+			return wrapError("exec: ", err)
+		}
+		tmpBase = max(tmpBase, extraFds[i]+1)
 	}
-
-	// Setup working directory if specified
-	if c.Dir != "" {
-		if !hasChdir() {
+	for i, fd := range extraFds {
+		if fd < 0 {
+			continue
+		}
+		if ret := C.add_dup2_action(&fileActions, C.int(fd), C.int(tmpBase+i)); ret != 0 {
+			closeClosers(closersToClose)
+			return syscall.Errno(ret)
+		}
+	}
+	for i, fd := range extraFds {
+		if fd < 0 {
+			continue
+		}
+		if ret := C.add_dup2_action(&fileActions, C.int(tmpBase+i), C.int(3+i)); ret != 0 {
 			closeClosers(closersToClose)
-			return errors.New("exec: setting Dir requires macOS 10.15+")
+			return syscall.Errno(ret)
+		}
+		if ret := C.add_close_action(&fileActions, C.int(tmpBase+i)); ret != 0 {
+			closeClosers(closersToClose)
+			return syscall.Errno(ret)
 		}
+	}
+
+	// Setup working directory if specified
+	if c.Dir != "" && tr.dir == "" {
 		cDir := C.CString(c.Dir)
 		defer C.free(unsafe.Pointer(cDir))
 		if ret := C.add_chdir_action(&fileActions, cDir); ret != 0 {
@@ -270,6 +478,34 @@ func (c *Cmd) Start() error {
 		}
 	}
 
+	// Setup files to be opened by the child. They come after chdir, so
+	// relative paths are resolved against Dir as they are in the child;
+	// a trampoline only changes directory later, so they are joined to it
+	// here instead.
+	for _, of := range openFiles {
+		if tr.dir != "" && !of.dupStdout && !isAbs(of.Path) {
+			of.Path = joinPath(tr.dir, of.Path)
+		}
+		if of.dupStdout {
+			if ret := C.add_dup2_action(&fileActions, 1, C.int(of.Fd)); ret != 0 {
+				closeClosers(closersToClose)
+				return syscall.Errno(ret)
+			}
+			continue
+		}
+		cOpenPath := C.CString(of.Path)
+		defer C.free(unsafe.Pointer(cOpenPath))
+		if ret := C.add_open_action(&fileActions, C.int(of.Fd), cOpenPath, C.int(of.Flag), C.mode_t(of.Perm.Perm())); ret != 0 {
+			closeClosers(closersToClose)
+			return syscall.Errno(ret)
+		}
+	}
+
+	if l := c.log(); l != nil {
+		l.Debug("spawnexec: file actions", "path", path, "stdin", stdinFd, "stdout", stdoutFd, "stderr", stderrFd,
+			"extra", extraFds, "opens", len(openFiles), "chdir", c.Dir != "" && tr.dir == "" || c.DirFD != nil, "trampoline", tr.needed())
+	}
+
 	// Setup spawn attributes
 	var attr C.posix_spawnattr_t
 	if ret := C.init_spawnattr(&attr); ret != 0 {
@@ -284,9 +520,37 @@ func (c *Cmd) Start() error {
 	// Reset signals to default in child
 	flags |= _POSIX_SPAWN_SETSIGDEF | _POSIX_SPAWN_SETSIGMASK
 
+	// Hold the process until BeforeResume has seen it, or it has been
+	// made a background task
+	if c.BeforeResume != nil || c.Background {
+		flags |= _POSIX_SPAWN_START_SUSPENDED
+	}
+
 	// Handle SysProcAttr
 	if c.SysProcAttr != nil {
-		if c.SysProcAttr.Setpgid {
+		if c.SysProcAttr.UseCgroupFD || c.SysProcAttr.CgroupPath != "" {
+			closeClosers(closersToClose)
+			return errors.New("exec: cgroups are not supported on darwin")
+		}
+		if c.SysProcAttr.UidMappings != nil || c.SysProcAttr.GidMappings != nil {
+			closeClosers(closersToClose)
+			return errors.New("exec: user namespaces are not supported on darwin")
+		}
+		if c.SysProcAttr.Chroot != "" {
+			closeClosers(closersToClose)
+			return errors.New("exec: Chroot is not supported by posix_spawn on darwin")
+		}
+		// posix_spawn can only leave the controlling terminal behind by
+		// starting a new session, which rules out joining another group.
+		if c.SysProcAttr.Noctty && (c.SysProcAttr.Setpgid || c.SysProcAttr.Foreground) {
+			closeClosers(closersToClose)
+			return errors.New("exec: Noctty cannot be combined with Setpgid or Foreground on darwin")
+		}
+		if c.SysProcAttr.Setsid || c.SysProcAttr.Noctty {
+			flags |= _POSIX_SPAWN_SETSID
+		}
+		// Foreground implies Setpgid, and Setsid a new process group.
+		if c.SysProcAttr.Setpgid || (c.SysProcAttr.Foreground && !c.SysProcAttr.Setsid) {
 			flags |= _POSIX_SPAWN_SETPGROUP
 			C.set_spawnattr_pgroup(&attr, C.pid_t(c.SysProcAttr.Pgid))
 		}
@@ -294,6 +558,49 @@ func (c *Cmd) Start() error {
 
 	C.set_spawnattr_flags(&attr, flags)
 
+	if da := c.DarwinAttr; da != nil && (da.SetJetsamPriority || da.MemoryLimit > 0) {
+		priority := C.int(-1)
+		if da.SetJetsamPriority {
+			priority = C.int(da.JetsamPriority)
+		}
+		limitMB := C.int(-1)
+		if da.MemoryLimit > 0 {
+			limitMB = C.int((da.MemoryLimit + 1<<20 - 1) >> 20)
+		}
+		if ret := C.set_spawnattr_jetsam(&attr, priority, limitMB); ret != 0 {
+			closeClosers(closersToClose)
+			return syscall.Errno(ret)
+		}
+	}
+	if da := c.DarwinAttr; da != nil {
+		if da.QoSClamp != QoSClampNone {
+			if ret := C.set_spawnattr_qos_clamp(&attr, C.uint64_t(da.QoSClamp)); ret != 0 {
+				closeClosers(closersToClose)
+				return syscall.Errno(ret)
+			}
+		}
+		if flags := da.Mitigations.flags(); flags != 0 {
+			if ret := C.set_spawnattr_csm(&attr, C.uint32_t(flags)); ret != 0 {
+				closeClosers(closersToClose)
+				return syscall.Errno(ret)
+			}
+		}
+		if da.ResetExceptionPorts {
+			if ret := C.reset_spawnattr_exceptionports(&attr); ret != 0 {
+				closeClosers(closersToClose)
+				return syscall.Errno(ret)
+			}
+		}
+		for _, ep := range da.ExceptionPorts {
+			ret := C.set_spawnattr_exceptionport(&attr, C.exception_mask_t(ep.Mask), C.mach_port_t(ep.Port),
+				C.exception_behavior_t(ep.Behavior), C.thread_state_flavor_t(ep.Flavor))
+			if ret != 0 {
+				closeClosers(closersToClose)
+				return syscall.Errno(ret)
+			}
+		}
+	}
+
 	// Set signal defaults and masks
 	var sigdefault, sigmask C.sigset_t
 	C.sigset_fill(&sigdefault)
@@ -301,38 +608,63 @@ func (c *Cmd) Start() error {
 	C.set_spawnattr_sigdefault(&attr, &sigdefault)
 	C.set_spawnattr_sigmask(&attr, &sigmask)
 
-	// Convert path to C string
-	cPath := C.CString(path)
-	defer C.free(unsafe.Pointer(cPath))
-
-	// Convert args to C strings
+	// Marshal path, args and env into a single block of C memory
 	args := c.Args
 	if len(args) == 0 {
 		args = []string{c.Path}
 	}
-	cArgs := make([]*C.char, len(args)+1)
-	for i, arg := range args {
-		cArgs[i] = C.CString(arg)
-		defer C.free(unsafe.Pointer(cArgs[i]))
+	var block *argvBlock
+	if c.prepared != nil {
+		if block = c.prepared.acquireBlock(c, path); block != nil {
+			defer c.prepared.releaseBlock()
+		}
+	}
+	if block == nil {
+		block, err = newArgvBlock(path, args, env)
+		if err != nil {
+			closeClosers(closersToClose)
+			return wrapError("exec: ", err)
+		}
+		defer block.release()
 	}
-	cArgs[len(args)] = nil
 
-	// Convert env to C strings
-	cEnv := make([]*C.char, len(env)+1)
-	for i, e := range env {
-		cEnv[i] = C.CString(e)
-		defer C.free(unsafe.Pointer(cEnv[i]))
+	if da := c.DarwinAttr; da != nil && da.SpawnAttr != nil {
+		if err := da.SpawnAttr(unsafe.Pointer(&attr)); err != nil {
+			closeClosers(closersToClose)
+			return err
+		}
+	}
+
+	if err := c.checkPinned(); err != nil {
+		closeClosers(closersToClose)
+		return err
+	}
+	wd, err := c.startWatchdog()
+	if err != nil {
+		closeClosers(closersToClose)
+		return err
 	}
-	cEnv[len(env)] = nil
 
 	// Spawn the process
 	var pid C.pid_t
-	ret := C.do_posix_spawn(&pid, cPath, &fileActions, &attr,
-		(**C.char)(unsafe.Pointer(&cArgs[0])),
-		(**C.char)(unsafe.Pointer(&cEnv[0])))
+	c.timing.Marshaled = time.Now()
+	ret := C.do_posix_spawn(&pid, (*C.char)(block.path), &fileActions, &attr,
+		(**C.char)(block.argv), (**C.char)(block.envp))
+	if syscall.Errno(ret) == syscall.ENOEXEC && c.ShellFallback && !tr.needed() {
+		shBlock, err := newArgvBlock(shellPath, shellArgs(execFile, args), env)
+		if err == nil {
+			defer shBlock.release()
+			ret = C.do_posix_spawn(&pid, (*C.char)(shBlock.path), &fileActions, &attr,
+				(**C.char)(shBlock.argv), (**C.char)(shBlock.envp))
+		}
+	}
+	c.timing.Spawned = time.Now()
 	if ret != 0 {
+		err := &Error{Name: c.Path, Path: execFile, Err: syscall.Errno(ret)}
+		c.logSpawned(err)
+		wd.stop()
 		closeClosers(closersToClose)
-		return &Error{Name: c.Path, Err: syscall.Errno(ret)}
+		return err
 	}
 
 	// Close child-side file descriptors in parent
@@ -346,7 +678,11 @@ func (c *Cmd) Start() error {
 	}
 	c.childIOFiles = nil
 
-	c.Process = &Process{Pid: int(pid)}
+	c.Process = newProcess(int(pid), nil)
+	c.Process.watchdog = wd
+	wd.watch(c.Process.Pid)
+	c.Process.reap()
+	c.logSpawned(nil)
 
 	// Start goroutines for I/O copying if needed
 	c.startGoroutines()
@@ -356,9 +692,41 @@ func (c *Cmd) Start() error {
 		c.watchContext()
 	}
 
+	if c.Background {
+		if err := setBackground(c.Process.Pid); err != nil {
+			c.Process.Kill()
+			c.Wait()
+			return err
+		}
+	}
+	if c.BeforeResume != nil {
+		return c.resume()
+	}
+	if c.Background {
+		return c.Process.Signal(syscall.SIGCONT)
+	}
 	return nil
 }
 
+// childFd returns the descriptor from which f is to be duplicated to
+// target in the child, putting f in blocking mode as the child expects.
+// File actions replace descriptors 0, 1 and 2 before any others are
+// duplicated, so if f is one of those and not target itself, it is first
+// duplicated above them in the parent; the duplicate is closed once the
+// child has started.
+func (c *Cmd) childFd(f *os.File, target int) (int, error) {
+	fd := int(f.Fd())
+	if fd > 2 || fd == target {
+		return fd, nil
+	}
+	dup, err := unix.FcntlInt(uintptr(fd), unix.F_DUPFD_CLOEXEC, 3)
+	if err != nil {
+		return -1, os.NewSyscallError("fcntl", err)
+	}
+	c.childIOFiles = append(c.childIOFiles, os.NewFile(uintptr(dup), f.Name()))
+	return dup, nil
+}
+
 // setupStdin sets up stdin file actions and returns the fd to close after spawn
 func (c *Cmd) setupStdin(fileActions *C.posix_spawn_file_actions_t) (int, io.Closer, error) {
 	if c.Stdin == nil {
@@ -371,15 +739,18 @@ func (c *Cmd) setupStdin(fileActions *C.posix_spawn_file_actions_t) (int, io.Clo
 	}
 
 	if f, ok := c.Stdin.(*os.File); ok {
-		fd := int(f.Fd())
-		if ret := C.add_dup2_action(fileActions, C.int(fd), 0); ret != 0 {
+		fd, err := c.childFd(f, 0)
+		if err != nil {
+			return -1, nil, err
+		}
+		if ret := C.add_inherit_action(fileActions, C.int(fd), 0); ret != 0 {
 			return -1, nil, syscall.Errno(ret)
 		}
 		return -1, nil, nil
 	}
 
 	// Create a pipe for stdin
-	pr, pw, err := os.Pipe()
+	pr, pw, err := inputPipe()
 	if err != nil {
 		return -1, nil, err
 	}
@@ -390,13 +761,7 @@ func (c *Cmd) setupStdin(fileActions *C.posix_spawn_file_actions_t) (int, io.Clo
 		return -1, nil, syscall.Errno(ret)
 	}
 	c.childIOFiles = append(c.childIOFiles, pr)
-
-	// Start goroutine to copy from c.Stdin to pw
-	c.goroutine = append(c.goroutine, func() error {
-		_, err := io.Copy(pw, c.Stdin)
-		pw.Close()
-		return err
-	})
+	c.copyInput(pw)
 
 	return fd, nil, nil
 }
@@ -413,15 +778,18 @@ func (c *Cmd) setupStdout(fileActions *C.posix_spawn_file_actions_t) (int, io.Cl
 	}
 
 	if f, ok := c.Stdout.(*os.File); ok {
-		fd := int(f.Fd())
-		if ret := C.add_dup2_action(fileActions, C.int(fd), 1); ret != 0 {
+		fd, err := c.childFd(f, 1)
+		if err != nil {
+			return -1, nil, err
+		}
+		if ret := C.add_inherit_action(fileActions, C.int(fd), 1); ret != 0 {
 			return -1, nil, syscall.Errno(ret)
 		}
 		return -1, nil, nil
 	}
 
 	// Create a pipe for stdout
-	pr, pw, err := os.Pipe()
+	pr, pw, err := outputPipe()
 	if err != nil {
 		return -1, nil, err
 	}
@@ -432,13 +800,7 @@ func (c *Cmd) setupStdout(fileActions *C.posix_spawn_file_actions_t) (int, io.Cl
 		return -1, nil, syscall.Errno(ret)
 	}
 	c.childIOFiles = append(c.childIOFiles, pw)
-
-	// Start goroutine to copy from pr to c.Stdout
-	c.goroutine = append(c.goroutine, func() error {
-		_, err := io.Copy(c.Stdout, pr)
-		pr.Close()
-		return err
-	})
+	c.copyOutput(pr, c.Stdout, 1)
 
 	return fd, nil, nil
 }
@@ -464,15 +826,18 @@ func (c *Cmd) setupStderr(fileActions *C.posix_spawn_file_actions_t) (int, io.Cl
 	}
 
 	if f, ok := c.Stderr.(*os.File); ok {
-		fd := int(f.Fd())
-		if ret := C.add_dup2_action(fileActions, C.int(fd), 2); ret != 0 {
+		fd, err := c.childFd(f, 2)
+		if err != nil {
+			return -1, nil, err
+		}
+		if ret := C.add_inherit_action(fileActions, C.int(fd), 2); ret != 0 {
 			return -1, nil, syscall.Errno(ret)
 		}
 		return -1, nil, nil
 	}
 
 	// Create a pipe for stderr
-	pr, pw, err := os.Pipe()
+	pr, pw, err := outputPipe()
 	if err != nil {
 		return -1, nil, err
 	}
@@ -483,47 +848,11 @@ func (c *Cmd) setupStderr(fileActions *C.posix_spawn_file_actions_t) (int, io.Cl
 		return -1, nil, syscall.Errno(ret)
 	}
 	c.childIOFiles = append(c.childIOFiles, pw)
-
-	// Start goroutine to copy from pr to c.Stderr
-	c.goroutine = append(c.goroutine, func() error {
-		_, err := io.Copy(c.Stderr, pr)
-		pr.Close()
-		return err
-	})
+	c.copyOutput(pr, c.Stderr, 2)
 
 	return fd, nil, nil
 }
 
-// startGoroutines starts the I/O copying goroutines
-func (c *Cmd) startGoroutines() {
-	c.goroutineErr = make([]error, len(c.goroutine))
-	for i, fn := range c.goroutine {
-		i, fn := i, fn
-		go func() {
-			err := fn()
-			c.goroutineMu.Lock()
-			c.goroutineErr[i] = err
-			c.goroutineMu.Unlock()
-		}()
-	}
-}
-
-// watchContext monitors the context and kills the process if it's canceled
-func (c *Cmd) watchContext() {
-	go func() {
-		select {
-		case <-c.ctx.Done():
-			if c.Process != nil {
-				if c.Cancel != nil {
-					c.Cancel()
-				} else {
-					c.Process.Kill()
-				}
-			}
-		}
-	}()
-}
-
 // Wait waits for the command to exit and waits for any copying to
 // stdin or copying from stdout or stderr to complete.
 //
@@ -540,7 +869,11 @@ func (c *Cmd) watchContext() {
 // for the respective I/O loop copying to or from the process to complete.
 //
 // Wait releases any resources associated with the Cmd.
-func (c *Cmd) Wait() error {
+func (c *Cmd) Wait() (err error) {
+	if c.startDone != nil {
+		// A Start that timed out may still be spawning.
+		<-c.startDone
+	}
 	if c.Process == nil {
 		return errors.New("exec: not started")
 	}
@@ -548,40 +881,18 @@ func (c *Cmd) Wait() error {
 		return errors.New("exec: Wait was already called")
 	}
 	c.finished = true
-
-	// Wait for the process
-	state, err := c.Process.Wait()
-	if err != nil {
-		return err
+	if c.ctxCancel != nil {
+		defer c.ctxCancel()
 	}
-	c.ProcessState = state
+	defer func() { c.removeWorkspace(err) }()
+	defer c.unregister()
+	defer c.unlockInstance()
+	defer c.closeMuxPipe()
 
-	// Close parent side of pipes to signal EOF to goroutines
-	for _, f := range c.parentIOPipes {
-		f.Close()
-	}
-	c.parentIOPipes = nil
-
-	// Wait for I/O goroutines (give them a moment to complete)
-	// In a more robust implementation, we'd use a WaitGroup
-	var copyErr error
-	c.goroutineMu.Lock()
-	for _, e := range c.goroutineErr {
-		if e != nil && copyErr == nil {
-			copyErr = e
-		}
+	if c.osCmd != nil {
+		return c.waitOSExec()
 	}
-	c.goroutineMu.Unlock()
-
-	if !state.Success() {
-		return &ExitError{ProcessState: state}
-	}
-
-	if copyErr != nil {
-		return copyErr
-	}
-
-	return nil
+	return c.waitProcess()
 }
 
 // closeClosers closes all the closers in the slice
@@ -593,6 +904,16 @@ func closeClosers(closers []io.Closer) {
 	}
 }
 
+// isBadFormat reports whether errno is posix_spawn's report of a file it
+// does not recognise as an executable for this machine.
+func isBadFormat(errno syscall.Errno) bool {
+	switch errno {
+	case syscall.ENOEXEC, syscall.EBADARCH, syscall.EBADEXEC, syscall.EBADMACHO:
+		return true
+	}
+	return false
+}
+
 // isAbs reports whether path is absolute
 func isAbs(path string) bool {
 	return len(path) > 0 && path[0] == '/'
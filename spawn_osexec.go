@@ -0,0 +1,535 @@
+package spawnexec
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// startOSExec starts c with os/exec, once Start has checked it and
+// resolved its standard I/O. It is how commands are started on platforms
+// other than darwin, and on darwin with BackendOSExec.
+func (c *Cmd) startOSExec() error {
+	// FdMap is checked before any pipe is made for the output.
+	extraFiles, err := c.extraFiles()
+	if err != nil {
+		c.closeStartFiles()
+		return err
+	}
+	openFiles, err := c.openFiles()
+	if err != nil {
+		c.closeStartFiles()
+		return err
+	}
+
+	// Create the underlying os/exec.Cmd
+	var osCmd *exec.Cmd
+	if c.ctx != nil {
+		osCmd = exec.CommandContext(c.ctx, c.Path)
+	} else {
+		osCmd = exec.Command(c.Path)
+	}
+	// c.Path has already been looked up, if it needed to be, and is to be
+	// executed as it is, even if it has no slash.
+	osCmd.Path, osCmd.Err = c.Path, nil
+	// Args[0] need not be the name of the command.
+	if len(c.Args) > 0 {
+		osCmd.Args = c.Args
+	}
+
+	osCmd.Dir = c.Dir
+	osCmd.Env = c.Env
+	if c.DirFD != nil {
+		if c.SysProcAttr != nil && c.SysProcAttr.Chroot != "" {
+			c.closeStartFiles()
+			return errors.New("exec: DirFD cannot be combined with Chroot")
+		}
+		if osCmd.Dir, err = dirFDPath(c.DirFD); err != nil {
+			c.closeStartFiles()
+			return err
+		}
+		// os/exec would otherwise set PWD to the path above.
+		if osCmd.Env == nil {
+			osCmd.Env = slices.DeleteFunc(os.Environ(), func(kv string) bool {
+				return strings.HasPrefix(kv, "PWD=")
+			})
+		}
+	}
+	osCmd.Stdout = c.Stdout
+	osCmd.Stderr = c.Stderr
+	if err := c.setupSharedOutput(osCmd); err != nil {
+		c.closeStartFiles()
+		return err
+	}
+	c.countOSExecOutput(osCmd)
+	osCmd.ExtraFiles = extraFiles
+	osCmd.WaitDelay = time.Duration(c.WaitDelay)
+	if c.ctx != nil && c.Cancel != nil {
+		osCmd.Cancel = c.Cancel
+	}
+
+	// Copy a non-file Stdin through a pipe of our own, so that CloseStdin
+	// can close it.
+	var stdinPipe io.WriteCloser
+	switch c.Stdin.(type) {
+	case nil, *os.File:
+		osCmd.Stdin = c.Stdin
+	default:
+		pw, err := osCmd.StdinPipe()
+		if err != nil {
+			c.closeStartFiles()
+			return err
+		}
+		noSIGPIPE(pw)
+		stdinPipe = pw
+		c.stdinCloser = pw
+	}
+
+	if c.SysProcAttr != nil {
+		osCmd.SysProcAttr = &syscall.SysProcAttr{
+			Setsid:     c.SysProcAttr.Setsid,
+			Setpgid:    c.SysProcAttr.Setpgid,
+			Setctty:    c.SysProcAttr.Setctty,
+			Noctty:     c.SysProcAttr.Noctty,
+			Ctty:       c.SysProcAttr.Ctty,
+			Foreground: c.SysProcAttr.Foreground,
+			Pgid:       c.SysProcAttr.Pgid,
+			Chroot:     c.SysProcAttr.Chroot,
+		}
+	}
+
+	if err := c.setUserNamespace(osCmd); err != nil {
+		c.closeStartFiles()
+		return err
+	}
+	cgroupDir, err := c.setCgroup(osCmd)
+	if err != nil {
+		c.closeStartFiles()
+		return err
+	}
+	if cgroupDir != nil {
+		defer cgroupDir.Close()
+	}
+
+	opened, err := c.openChildFiles(osCmd, openFiles)
+	if err != nil {
+		c.closeStartFiles()
+		return err
+	}
+	if c.BeforeResume != nil || c.CoreDumps != CoreDumpsInherit || c.execFD() != nil {
+		if err := c.execTrampoline(osCmd); err != nil {
+			closeFiles(opened)
+			c.closeStartFiles()
+			return err
+		}
+	}
+
+	if err := c.checkPinned(); err != nil {
+		closeFiles(opened)
+		c.closeStartFiles()
+		return err
+	}
+	var wd *watchdog
+	if !c.setParentDeathSignal(osCmd) {
+		if wd, err = c.startWatchdog(); err != nil {
+			closeFiles(opened)
+			c.closeStartFiles()
+			return err
+		}
+	}
+	c.timing.Marshaled = time.Now()
+	err = osCmd.Start()
+	if errors.Is(err, syscall.ENOEXEC) && c.ShellFallback && c.trampolineStatus == nil {
+		// os/exec cannot start the same Cmd twice, so the shell is
+		// started by a Cmd of its own, given stdin through a new pipe if
+		// it was given one.
+		osCmd, err = c.shellCmd(osCmd), nil
+		if stdinPipe != nil {
+			osCmd.Stdin = nil
+			var pw io.WriteCloser
+			if pw, err = osCmd.StdinPipe(); err == nil {
+				noSIGPIPE(pw)
+				stdinPipe, c.stdinCloser = pw, pw
+			}
+		}
+		if err == nil {
+			err = osCmd.Start()
+		}
+	}
+	c.timing.Spawned = time.Now()
+	for _, f := range opened {
+		f.Close()
+	}
+	if err != nil {
+		err = c.osExecError(err)
+		c.logSpawned(err)
+		wd.stop()
+		c.closeStartFiles()
+		return err
+	}
+
+	// Close files that were set up for child
+	for _, f := range c.childIOFiles {
+		f.Close()
+	}
+	c.childIOFiles = nil
+
+	// Store the process
+	c.Process = newProcess(osCmd.Process.Pid, osCmd.Process)
+	c.Process.watchdog = wd
+	wd.watch(c.Process.Pid)
+	c.Process.reap()
+	c.logSpawned(nil)
+
+	c.startGoroutines()
+
+	if stdinPipe != nil {
+		c.stdinCopyErr = make(chan error, 1)
+		go func() {
+			n, err := c.copyBuffer(stdinPipe, c.Stdin)
+			c.ioStats[0].Add(n)
+			if closeErr := stdinPipe.Close(); err == nil {
+				err = closeErr
+			}
+			c.stdinCopyErr <- err
+		}()
+	}
+
+	// Store reference to os/exec.Cmd for Wait
+	c.osCmd = osCmd
+
+	if c.Background {
+		if err := setBackground(c.Process.Pid); err != nil {
+			c.Process.Kill()
+			c.Wait()
+			c.closeStartFiles()
+			return err
+		}
+	}
+
+	exited := false
+	if c.BeforeResume != nil {
+		// The trampoline may instead have failed and exited, which its
+		// status then reports.
+		stopped, err := waitStopped(c.Process.Pid)
+		if err != nil {
+			// Do not leave the trampoline stopped and unreaped.
+			c.Process.Kill()
+			c.Wait()
+			if r := c.trampolineStatus; r != nil {
+				c.trampolineStatus = nil
+				r.Close()
+			}
+			c.closeStartFiles()
+			return err
+		}
+		if stopped {
+			if err := c.resume(); err != nil {
+				c.closeStartFiles()
+				return err
+			}
+		}
+		exited = !stopped
+	}
+	if r := c.trampolineStatus; r != nil {
+		c.trampolineStatus = nil
+		err := c.readTrampolineStatus(r)
+		if err == nil && exited {
+			err = errors.New("exec: trampoline exited before stopping")
+		}
+		if err != nil {
+			c.Wait()
+			return err
+		}
+	}
+	return nil
+}
+
+// shellCmd returns a Cmd for os/exec to run the file osCmd failed to
+// execute with ENOEXEC as a script of shellPath, with osCmd's settings.
+func (c *Cmd) shellCmd(osCmd *exec.Cmd) *exec.Cmd {
+	path, _ := execPath(c.Dir, c.Path)
+	var sh *exec.Cmd
+	if c.ctx != nil {
+		sh = exec.CommandContext(c.ctx, shellPath)
+		if c.Cancel != nil {
+			sh.Cancel = c.Cancel
+		}
+	} else {
+		sh = exec.Command(shellPath)
+	}
+	sh.Args = shellArgs(path, osCmd.Args)
+	sh.Env = osCmd.Env
+	sh.Dir = osCmd.Dir
+	sh.Stdout = osCmd.Stdout
+	sh.Stderr = osCmd.Stderr
+	sh.Stdin = osCmd.Stdin
+	sh.ExtraFiles = osCmd.ExtraFiles
+	sh.SysProcAttr = osCmd.SysProcAttr
+	sh.WaitDelay = osCmd.WaitDelay
+	return sh
+}
+
+// osExecError converts the *fs.PathError with which os/exec reports a
+// failure to execute c into the *Error posix_spawn's failures produce.
+func (c *Cmd) osExecError(err error) error {
+	var pe *fs.PathError
+	if !errors.As(err, &pe) || pe.Op != "fork/exec" {
+		return err
+	}
+	errno, ok := pe.Err.(syscall.Errno)
+	if !ok {
+		return err
+	}
+	path, _ := execPath(c.Dir, c.Path)
+	return &Error{Name: c.Path, Path: path, Err: errno}
+}
+
+// waitOSExec waits for c, started by startOSExec, to exit, once Wait has
+// checked it.
+func (c *Cmd) waitOSExec() error {
+	osCmd, ok := c.osCmd.(*exec.Cmd)
+	if !ok || osCmd == nil {
+		return errors.New("exec: internal error: osCmd is nil or wrong type")
+	}
+
+	// A child handed to the shared reaper is reaped by it, after which
+	// os/exec fails to wait for it but still finishes the I/O, as for a
+	// child reaped by TryWait.
+	if c.Process.reaperDone != nil {
+		<-c.Process.reaperDone
+	}
+
+	// Hold the Process's wait lock so that os/exec does not race a
+	// concurrent Process.Wait or TryWait to reap the child.
+	c.Process.waitMu.Lock()
+	err := osCmd.Wait()
+	c.Process.waitMu.Unlock()
+	c.timing.Waited = time.Now()
+
+	// os/exec closes its end of the stdin pipe once the process has
+	// exited, which ends our copier; ignore the errors that causes, as
+	// os/exec does.
+	if c.stdinCopyErr != nil {
+		copyErr := <-c.stdinCopyErr
+		if err == nil && copyErr != nil && !errors.Is(copyErr, syscall.EPIPE) && !errors.Is(copyErr, os.ErrClosed) {
+			err = copyErr
+		}
+	}
+
+	// Close parent side of pipes created by the *Pipe methods
+	for _, f := range c.parentIOPipes {
+		f.Close()
+	}
+	c.parentIOPipes = nil
+
+	// Wait for the output handed to the shared copier.
+	if copyErr := c.awaitGoroutines(); err == nil {
+		err = copyErr
+	}
+
+	// Convert os.ProcessState to our ProcessState. If the process was
+	// already reaped by TryWait, os/exec fails to wait for it but still
+	// finishes the I/O; use the state TryWait recorded.
+	if osCmd.ProcessState != nil {
+		c.ProcessState = newProcessState(osCmd.ProcessState, c.Process.start)
+		c.Process.setReaped(c.ProcessState)
+	} else if ps := c.Process.reaped(); ps != nil {
+		c.ProcessState = ps
+		err = nil
+		if !ps.Success() {
+			err = &exec.ExitError{}
+		}
+	}
+	c.logReaped(err)
+
+	if err != nil {
+		var ctxErr error
+		if c.ctx != nil && c.ctx.Err() != nil {
+			ctxErr = contextError(c.ctx)
+		}
+		if _, ok := err.(*exec.ExitError); ok {
+			return &ExitError{ProcessState: c.ProcessState, ctxErr: ctxErr}
+		}
+		if ctxErr != nil && errors.Is(err, c.ctx.Err()) {
+			return ctxErr
+		}
+		if err == exec.ErrWaitDelay {
+			return ErrWaitDelay
+		}
+		return err
+	}
+
+	return nil
+}
+
+// execTrampoline makes osCmd start as a trampoline that sets c's
+// RLIMIT_CORE, if CoreDumps asks for it, and stops itself if BeforeResume
+// is set, before executing the command, or ExecFD, which it is given after
+// osCmd's ExtraFiles, as a shell script if ShellFallback calls for it. The
+// trampoline is given a status pipe after those, whose read end is left
+// in c.trampolineStatus, so that Start can report its failures as os/exec
+// reports those of executing a command directly.
+func (c *Cmd) execTrampoline(osCmd *exec.Cmd) error {
+	tr := trampoline{stop: c.BeforeResume != nil, coreDumps: c.CoreDumps, shell: c.ShellFallback}
+	if tr.stop && !canWaitStopped {
+		return errors.New("exec: BeforeResume is not supported on this platform")
+	}
+	if tr.coreDumps < CoreDumpsInherit || tr.coreDumps > CoreDumpsDisabled {
+		return fmt.Errorf("exec: unknown CoreDumps %d", tr.coreDumps)
+	}
+	if c.SysProcAttr != nil && c.SysProcAttr.Chroot != "" {
+		// The trampoline is not to be found in the new root.
+		return errors.New("exec: BeforeResume, CoreDumps, ExecFD and ShellFallback cannot be combined with Chroot")
+	}
+	path, err := execPath(c.Dir, osCmd.Path)
+	if err != nil {
+		return err
+	}
+	env := osCmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	pr, pw, err := outputPipe()
+	if err != nil {
+		return err
+	}
+	extra := slices.Clip(osCmd.ExtraFiles)
+	if f := c.execFD(); f != nil {
+		tr.execFD = 3 + len(extra)
+		extra = append(extra, f)
+	}
+	tr.status = 3 + len(extra)
+	if osCmd.Path, osCmd.Env, err = tr.spawnArgs(path, env); err != nil {
+		pr.Close()
+		pw.Close()
+		return wrapError("exec: ", err)
+	}
+	osCmd.ExtraFiles = append(extra, pw)
+	c.childIOFiles = append(c.childIOFiles, pw)
+	c.trampolineStatus = pr
+	return nil
+}
+
+// setupSharedOutput gives osCmd pipes of our own for the Stdout and Stderr
+// writers that the shared copier can serve, so that os/exec does not start
+// a goroutine for each of them, and for the writers whose output is to be
+// copied with the buffers CopyBufferSize and CopyBufferPool ask for, or
+// with IgnoreBrokenPipe.
+func (c *Cmd) setupSharedOutput(osCmd *exec.Cmd) error {
+	ours := func(w io.Writer) bool {
+		if useSharedCopier(w) {
+			return true
+		}
+		_, isFile := w.(*os.File)
+		return w != nil && !isFile && (c.customCopyBuffer() || c.IgnoreBrokenPipe)
+	}
+	if !ours(c.Stdout) && !ours(c.Stderr) {
+		return nil
+	}
+	pipe := func(w io.Writer, fd int) (*os.File, error) {
+		pr, pw, err := outputPipe()
+		if err != nil {
+			return nil, err
+		}
+		c.childIOFiles = append(c.childIOFiles, pw)
+		c.copyOutput(pr, w, fd)
+		return pw, nil
+	}
+	if ours(c.Stdout) {
+		pw, err := pipe(c.Stdout, 1)
+		if err != nil {
+			return err
+		}
+		osCmd.Stdout = pw
+		if c.Stderr == c.Stdout {
+			osCmd.Stderr = pw
+			return nil
+		}
+	}
+	if ours(c.Stderr) {
+		pw, err := pipe(c.Stderr, 2)
+		if err != nil {
+			c.closeStartFiles()
+			return err
+		}
+		osCmd.Stderr = pw
+	}
+	return nil
+}
+
+// countOSExecOutput has the output os/exec is to copy to writers, rather
+// than to files, counted as it is copied. Output written to the same
+// writer stays on one pipe, counted as standard output.
+func (c *Cmd) countOSExecOutput(osCmd *exec.Cmd) {
+	counted := func(w io.Writer, fd int) io.Writer {
+		if _, ok := w.(*os.File); ok || w == nil {
+			return w
+		}
+		return &countingWriter{w, &c.ioStats[fd]}
+	}
+	if osCmd.Stderr == osCmd.Stdout {
+		osCmd.Stdout = counted(osCmd.Stdout, 1)
+		osCmd.Stderr = osCmd.Stdout
+		return
+	}
+	osCmd.Stdout = counted(osCmd.Stdout, 1)
+	osCmd.Stderr = counted(osCmd.Stderr, 2)
+}
+
+// openChildFiles opens the files in opens, as returned by c.openFiles,
+// and installs them in osCmd. os/exec cannot have the child open them, so
+// the parent does; the caller closes the returned files once the child
+// has started.
+func (c *Cmd) openChildFiles(osCmd *exec.Cmd, opens []OpenFile) ([]*os.File, error) {
+	if len(opens) == 0 {
+		return nil, nil
+	}
+	osCmd.ExtraFiles = slices.Clone(osCmd.ExtraFiles)
+	var opened []*os.File
+	var stdout *os.File
+	for _, of := range opens {
+		if of.Fd < 0 {
+			closeFiles(opened)
+			return nil, fmt.Errorf("exec: invalid OpenFiles descriptor %d", of.Fd)
+		}
+		var f *os.File
+		if of.dupStdout {
+			f = stdout
+		} else {
+			path := of.Path
+			if osCmd.Dir != "" && !isAbs(path) {
+				path = joinPath(osCmd.Dir, path)
+			}
+			var err error
+			f, err = os.OpenFile(path, of.Flag, of.Perm)
+			if err != nil {
+				closeFiles(opened)
+				return nil, err
+			}
+			opened = append(opened, f)
+		}
+		switch of.Fd {
+		case 0:
+			osCmd.Stdin = f
+		case 1:
+			osCmd.Stdout = f
+			stdout = f
+		case 2:
+			osCmd.Stderr = f
+		default:
+			for len(osCmd.ExtraFiles) <= of.Fd-3 {
+				osCmd.ExtraFiles = append(osCmd.ExtraFiles, nil)
+			}
+			osCmd.ExtraFiles[of.Fd-3] = f
+		}
+	}
+	return opened, nil
+}
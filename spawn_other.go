@@ -6,26 +6,25 @@ import (
 	"errors"
 	"io"
 	"os"
-	"os/exec"
 	"syscall"
-
-	"golang.org/x/sys/unix"
+	"time"
 )
 
-// On non-darwin platforms, we fall back to using os/exec.
-// This provides API compatibility while not benefiting from posix_spawn.
+// On non-darwin platforms, we fall back to using os/exec; see
+// spawn_osexec.go. This provides API compatibility while not benefiting
+// from posix_spawn.
 
-// Start starts the specified command but does not wait for it to complete.
-// On non-darwin platforms, this falls back to os/exec.
-func (c *Cmd) Start() error {
-	if c.lookPathErr != nil {
-		return c.lookPathErr
-	}
-	if c.Process != nil {
-		return errors.New("exec: already started")
+// nativeBackend is the Backend used unless SetBackend says otherwise.
+const nativeBackend = BackendOSExec
+
+// start starts c with os/exec, or through its broker, for Start.
+func (c *Cmd) start() (err error) {
+	c.timing.Start = time.Now()
+	if err := lookPathError(c.lookPathErr, c.DotPolicy); err != nil {
+		return err
 	}
-	if c.finished {
-		return errors.New("exec: already finished")
+	if err := c.validate(); err != nil {
+		return err
 	}
 
 	// Check if context is already done
@@ -37,48 +36,41 @@ func (c *Cmd) Start() error {
 		}
 	}
 
-	// Create the underlying os/exec.Cmd
-	var osCmd *exec.Cmd
-	if c.ctx != nil {
-		osCmd = exec.CommandContext(c.ctx, c.Path, c.Args[1:]...)
-	} else {
-		osCmd = exec.Command(c.Path, c.Args[1:]...)
+	// The command is validated before its SingleInstance lock is taken,
+	// which Start releases if this fails.
+	if err := c.lockInstance(); err != nil {
+		return err
 	}
-
-	osCmd.Dir = c.Dir
-	osCmd.Env = c.Env
-	osCmd.Stdin = c.Stdin
-	osCmd.Stdout = c.Stdout
-	osCmd.Stderr = c.Stderr
-	osCmd.ExtraFiles = c.ExtraFiles
-
-	if c.SysProcAttr != nil {
-		osCmd.SysProcAttr = &syscall.SysProcAttr{
-			Setpgid:    c.SysProcAttr.Setpgid,
-			Setctty:    c.SysProcAttr.Setctty,
-			Noctty:     c.SysProcAttr.Noctty,
-			Ctty:       c.SysProcAttr.Ctty,
-			Foreground: c.SysProcAttr.Foreground,
-			Pgid:       c.SysProcAttr.Pgid,
-		}
+	if err := c.createWorkspace(); err != nil {
+		return err
 	}
+	defer func() {
+		if err != nil {
+			c.removeWorkspace(err)
+		}
+	}()
 
-	if err := osCmd.Start(); err != nil {
+	restoreStdio, err := c.resolveStdio()
+	if err != nil {
 		return err
 	}
+	defer restoreStdio()
 
-	// Store the process
-	c.Process = &Process{Pid: osCmd.Process.Pid}
-
-	// Store reference to os/exec.Cmd for Wait
-	c.osCmd = osCmd
-
-	return nil
+	c.backend = CurrentBackend()
+	c.logStart()
+	if c.Broker != nil {
+		return c.startBrokered()
+	}
+	return c.startOSExec()
 }
 
 // Wait waits for the command to exit.
 // On non-darwin platforms, this falls back to os/exec.
-func (c *Cmd) Wait() error {
+func (c *Cmd) Wait() (err error) {
+	if c.startDone != nil {
+		// A Start that timed out may still be spawning.
+		<-c.startDone
+	}
 	if c.Process == nil {
 		return errors.New("exec: not started")
 	}
@@ -86,61 +78,19 @@ func (c *Cmd) Wait() error {
 		return errors.New("exec: Wait was already called")
 	}
 	c.finished = true
-
-	osCmd, ok := c.osCmd.(*exec.Cmd)
-	if !ok || osCmd == nil {
-		return errors.New("exec: internal error: osCmd is nil or wrong type")
-	}
-
-	err := osCmd.Wait()
-
-	// Convert os.ProcessState to our ProcessState
-	if osCmd.ProcessState != nil {
-		ps := osCmd.ProcessState
-		var rusage *unix.Rusage
-		if r, ok := ps.SysUsage().(*syscall.Rusage); ok && r != nil {
-			rusage = convertSyscallRusage(r)
-		}
-		c.ProcessState = &ProcessState{
-			pid:    ps.Pid(),
-			status: unix.WaitStatus(ps.Sys().(syscall.WaitStatus)),
-			rusage: rusage,
-		}
+	if c.ctxCancel != nil {
+		defer c.ctxCancel()
 	}
+	defer func() { c.removeWorkspace(err) }()
+	defer c.unregister()
+	defer c.unlockInstance()
+	defer c.closeMuxPipe()
 
-	if err != nil {
-		if _, ok := err.(*exec.ExitError); ok {
-			return &ExitError{ProcessState: c.ProcessState}
-		}
-		return err
+	if c.Broker != nil {
+		return c.waitProcess()
 	}
 
-	return nil
-}
-
-// convertSyscallRusage converts syscall.Rusage to unix.Rusage
-func convertSyscallRusage(r *syscall.Rusage) *unix.Rusage {
-	if r == nil {
-		return nil
-	}
-	return &unix.Rusage{
-		Utime:    unix.Timeval{Sec: r.Utime.Sec, Usec: int32(r.Utime.Usec)},
-		Stime:    unix.Timeval{Sec: r.Stime.Sec, Usec: int32(r.Stime.Usec)},
-		Maxrss:   r.Maxrss,
-		Ixrss:    r.Ixrss,
-		Idrss:    r.Idrss,
-		Isrss:    r.Isrss,
-		Minflt:   r.Minflt,
-		Majflt:   r.Majflt,
-		Nswap:    r.Nswap,
-		Inblock:  r.Inblock,
-		Oublock:  r.Oublock,
-		Msgsnd:   r.Msgsnd,
-		Msgrcv:   r.Msgrcv,
-		Nsignals: r.Nsignals,
-		Nvcsw:    r.Nvcsw,
-		Nivcsw:   r.Nivcsw,
-	}
+	return c.waitOSExec()
 }
 
 // hasChdir reports whether posix_spawn_file_actions_addchdir_np is available.
@@ -158,6 +108,12 @@ func closeClosers(closers []io.Closer) {
 	}
 }
 
+// isBadFormat reports whether errno is execve's report of a file it does
+// not recognise as an executable.
+func isBadFormat(errno syscall.Errno) bool {
+	return errno == syscall.ENOEXEC
+}
+
 // isAbs reports whether path is absolute
 func isAbs(path string) bool {
 	return len(path) > 0 && path[0] == '/'
@@ -1,17 +1,43 @@
 package spawnexec
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"log/slog"
+	"net"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
 )
 
+// TestMain runs the test binary as one of the package's helper processes
+// when the tests start it as one.
+func TestMain(m *testing.M) {
+	Main()
+	os.Exit(m.Run())
+}
+
 // TestCommand tests the basic Command function
 func TestCommand(t *testing.T) {
 	cmd := Command("echo", "hello")
@@ -289,6 +315,102 @@ func TestContextCancel(t *testing.T) {
 	}
 }
 
+// TestContextCause tests that Wait errors carry the context's cause
+func TestContextCause(t *testing.T) {
+	errShutdown := errors.New("shutting down")
+	ctx, cancel := context.WithCancelCause(context.Background())
+
+	cmd := CommandContext(ctx, "sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	cancel(errShutdown)
+
+	err := cmd.Wait()
+	if !errors.Is(err, errShutdown) {
+		t.Errorf("Wait() error = %v, want to wrap the cause", err)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Wait() error = %v, want errors.Is(err, context.Canceled)", err)
+	}
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) || exitErr.Signal() != syscall.SIGKILL {
+		t.Errorf("Wait() error = %v, want *ExitError killed by SIGKILL", err)
+	}
+}
+
+// TestContextDeadlineError tests errors.Is with context.DeadlineExceeded
+func TestContextDeadlineError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := CommandContext(ctx, "sleep", "10").Run()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Run() error = %v, want errors.Is(err, context.DeadlineExceeded)", err)
+	}
+
+	// A command that finishes on its own is not blamed on the context.
+	if err := CommandContext(context.Background(), "sh", "-c", "exit 3").Run(); errors.Unwrap(err) != nil {
+		t.Errorf("Run() error = %v unwraps to %v, want nothing", err, errors.Unwrap(err))
+	}
+}
+
+// TestCancelCloseStdin tests canceling a filter by closing its stdin
+func TestCancelCloseStdin(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := CommandContext(ctx, "cat")
+	cmd.Cancel = cmd.CloseStdin
+	if _, err := cmd.StdinPipe(); err != nil {
+		t.Fatalf("StdinPipe() error = %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Wait() error = %v, want context.Canceled", err)
+		}
+		if !cmd.ProcessState.Success() {
+			t.Errorf("ProcessState = %v, want clean exit after stdin EOF", cmd.ProcessState)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait() timed out after closing stdin")
+	}
+}
+
+// TestCancelWaitDelayEscalation tests that WaitDelay kills a child ignoring EOF
+func TestCancelWaitDelayEscalation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := CommandContext(ctx, "sleep", "10")
+	cmd.Stdin = strings.NewReader("")
+	cmd.Cancel = cmd.CloseStdin
+	cmd.WaitDelay = int64(100 * time.Millisecond)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		var exitErr *ExitError
+		if !errors.As(err, &exitErr) || exitErr.Signal() != syscall.SIGKILL {
+			t.Errorf("Wait() error = %v, want SIGKILL after WaitDelay", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait() timed out, WaitDelay did not escalate")
+	}
+}
+
 // TestLookPath tests the LookPath function
 func TestLookPath(t *testing.T) {
 	path, err := LookPath("echo")
@@ -369,6 +491,32 @@ func TestExitCode(t *testing.T) {
 	}
 }
 
+// TestExitErrorSignal tests that signal deaths are reported by ExitError
+func TestExitErrorSignal(t *testing.T) {
+	cmd := Command("sh", "-c", "kill -SEGV $$")
+	err := cmd.Run()
+	exitErr, ok := err.(*ExitError)
+	if !ok {
+		t.Fatalf("error type = %T, want *ExitError", err)
+	}
+	if !exitErr.Signaled() {
+		t.Error("Signaled() = false, want true")
+	}
+	if exitErr.Signal() != syscall.SIGSEGV {
+		t.Errorf("Signal() = %v, want SIGSEGV", exitErr.Signal())
+	}
+	if exitErr.ExitCode() != -1 {
+		t.Errorf("ExitCode() = %d, want -1", exitErr.ExitCode())
+	}
+
+	if err := Command("sh", "-c", "exit 1").Run(); err != nil {
+		exitErr := err.(*ExitError)
+		if exitErr.Signaled() || exitErr.Signal() != -1 {
+			t.Errorf("Signaled() = %v, Signal() = %v, want false, -1", exitErr.Signaled(), exitErr.Signal())
+		}
+	}
+}
+
 // TestProcessState tests that ProcessState is populated after Wait
 func TestProcessState(t *testing.T) {
 	cmd := Command("echo", "hello")
@@ -389,6 +537,48 @@ func TestProcessState(t *testing.T) {
 	}
 }
 
+// TestProcessStateTimes tests the StartTime, EndTime and Duration methods
+func TestProcessStateTimes(t *testing.T) {
+	before := time.Now()
+	cmd := Command("sleep", "0.1")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	after := time.Now()
+
+	ps := cmd.ProcessState
+	if ps.StartTime().Before(before) || ps.EndTime().After(after) {
+		t.Errorf("StartTime() = %v, EndTime() = %v, want within [%v, %v]", ps.StartTime(), ps.EndTime(), before, after)
+	}
+	if ps.Duration() < 100*time.Millisecond || ps.Duration() > after.Sub(before) {
+		t.Errorf("Duration() = %v, want between 100ms and %v", ps.Duration(), after.Sub(before))
+	}
+}
+
+// TestRusageInfo tests that extended rusage is collected only on darwin
+func TestRusageInfo(t *testing.T) {
+	cmd := Command("sh", "-c", "i=0; while [ $i -lt 1000 ]; do i=$((i+1)); done")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	info := cmd.ProcessState.RusageInfo()
+	if runtime.GOOS != "darwin" {
+		if info != nil {
+			t.Errorf("RusageInfo() = %+v, want nil on %s", info, runtime.GOOS)
+		}
+		return
+	}
+	if info == nil {
+		t.Fatal("RusageInfo() = nil, want non-nil on darwin")
+	}
+	if info.PhysFootprint == 0 || info.LifetimeMaxPhysFootprint == 0 {
+		t.Errorf("RusageInfo() footprint = %d/%d, want > 0", info.PhysFootprint, info.LifetimeMaxPhysFootprint)
+	}
+	if info.UserTime+info.SystemTime <= 0 {
+		t.Errorf("RusageInfo() CPU time = %v, want > 0", info.UserTime+info.SystemTime)
+	}
+}
+
 // TestString tests the String method
 func TestString(t *testing.T) {
 	cmd := Command("echo", "hello", "world")
@@ -742,14 +932,15 @@ func TestStdinBinaryData(t *testing.T) {
 // TestStdinSlowReader tests stdin with a slow-reading process
 func TestStdinSlowReader(t *testing.T) {
 	// Use a shell script that reads one byte at a time with small delays
-	// This tests that the stdin pipe doesn't close prematurely
+	// This tests that the stdin pipe doesn't close prematurely.
+	// read -n1 is a bash extension, so run the script under bash explicitly.
 	script := `
 while IFS= read -r -n1 char; do
 	printf '%s' "$char"
 done
 printf '\n'
 `
-	cmd := Command("sh", "-c", script)
+	cmd := Command("bash", "-c", script)
 	cmd.Stdin = strings.NewReader("slow")
 
 	done := make(chan []byte, 1)
@@ -894,3 +1085,3934 @@ type immediateEOFReader struct{}
 func (r *immediateEOFReader) Read(p []byte) (n int, err error) {
 	return 0, io.EOF
 }
+
+// TestDefaultCommander tests that DefaultCommander produces working Runners
+func TestDefaultCommander(t *testing.T) {
+	var r Runner = DefaultCommander.Command("sh", "-c", "echo $TEST_VAR; pwd")
+	tmpDir := t.TempDir()
+	r.SetEnv([]string{"TEST_VAR=from_runner"})
+	r.SetDir(tmpDir)
+
+	out, err := r.Output()
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 2 || lines[0] != "from_runner" {
+		t.Fatalf("output = %q, want from_runner followed by cwd", out)
+	}
+	wantResolved, _ := filepath.EvalSymlinks(tmpDir)
+	gotResolved, _ := filepath.EvalSymlinks(lines[1])
+	if gotResolved != wantResolved {
+		t.Errorf("cwd = %q, want %q", gotResolved, wantResolved)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r = DefaultCommander.CommandContext(ctx, "true")
+	if err := r.Run(); err == nil {
+		t.Error("Run() with canceled context error = nil, want error")
+	}
+}
+
+// TestStdoutScanner tests line scanning of stdout, including long lines
+func TestStdoutScanner(t *testing.T) {
+	cmd := Command("sh", "-c", "echo first; head -c 100000 /dev/zero | tr '\\0' 'x'; echo; echo last")
+	sc, err := cmd.StdoutScanner()
+	if err != nil {
+		t.Fatalf("StdoutScanner() error = %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	var lines []string
+	for sc.Scan() {
+		lines = append(lines, sc.Text())
+	}
+	if err := sc.Err(); err != nil {
+		t.Errorf("Scan() error = %v", err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("Wait() error = %v", err)
+	}
+	if len(lines) != 3 || lines[0] != "first" || len(lines[1]) != 100000 || lines[2] != "last" {
+		t.Errorf("got %d lines, want first, 100000 x's, last", len(lines))
+	}
+}
+
+// TestStderrScannerAfterWait tests that scanning after Wait ends cleanly
+func TestStderrScannerAfterWait(t *testing.T) {
+	cmd := Command("true")
+	sc, err := cmd.StderrScanner()
+	if err != nil {
+		t.Fatalf("StderrScanner() error = %v", err)
+	}
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	for sc.Scan() {
+	}
+	if err := sc.Err(); err != nil {
+		t.Errorf("Err() after Wait = %v, want nil", err)
+	}
+}
+
+// TestForEachLine tests the ForEachLine convenience method
+func TestForEachLine(t *testing.T) {
+	var lines []string
+	err := Command("printf", "a\\nb\\nc").ForEachLine(func(line string) {
+		lines = append(lines, line)
+	})
+	if err != nil {
+		t.Fatalf("ForEachLine() error = %v", err)
+	}
+	if strings.Join(lines, ",") != "a,b,c" {
+		t.Errorf("lines = %q, want [a b c]", lines)
+	}
+
+	err = Command("sh", "-c", "head -c 2000000 /dev/zero").ForEachLine(func(string) {})
+	if !errors.Is(err, bufio.ErrTooLong) {
+		t.Errorf("ForEachLine() with long line error = %v, want bufio.ErrTooLong", err)
+	}
+}
+
+// TestOutputBoth tests capturing stdout and stderr separately
+func TestOutputBoth(t *testing.T) {
+	stdout, stderr, err := Command("sh", "-c", "echo out; echo err >&2").OutputBoth()
+	if err != nil {
+		t.Fatalf("OutputBoth() error = %v", err)
+	}
+	if string(stdout) != "out\n" || string(stderr) != "err\n" {
+		t.Errorf("OutputBoth() = %q, %q, want %q, %q", stdout, stderr, "out\n", "err\n")
+	}
+
+	_, stderr, err = Command("sh", "-c", "echo failed >&2; exit 2").OutputBoth()
+	exitErr, ok := err.(*ExitError)
+	if !ok {
+		t.Fatalf("OutputBoth() error = %T, want *ExitError", err)
+	}
+	if string(exitErr.Stderr) != "failed\n" || string(stderr) != "failed\n" {
+		t.Errorf("stderr = %q, ExitError.Stderr = %q, want %q", stderr, exitErr.Stderr, "failed\n")
+	}
+
+	cmd := Command("echo")
+	cmd.Stderr = os.Stderr
+	if _, _, err := cmd.OutputBoth(); err == nil {
+		t.Error("OutputBoth() with Stderr already set error = nil, want error")
+	}
+}
+
+// TestOutputBothLimit tests that capped streams keep their ends
+func TestOutputBothLimit(t *testing.T) {
+	script := "printf start; head -c 10000 /dev/zero | tr '\\0' 'x'; printf end"
+	stdout, _, err := Command("sh", "-c", script).OutputBothLimit(100, 0)
+	if err != nil {
+		t.Fatalf("OutputBothLimit() error = %v", err)
+	}
+	if !bytes.HasPrefix(stdout, []byte("start")) || !bytes.HasSuffix(stdout, []byte("end")) {
+		t.Errorf("stdout = %q, want prefix start and suffix end", stdout)
+	}
+	if !bytes.Contains(stdout, []byte("omitting")) || len(stdout) > 200 {
+		t.Errorf("len(stdout) = %d, want about 100 with an omission note", len(stdout))
+	}
+}
+
+// TestRateLimitedWriter tests that child output is throttled
+func TestRateLimitedWriter(t *testing.T) {
+	var buf bytes.Buffer
+	cmd := Command("sh", "-c", "head -c 3000 /dev/zero")
+	cmd.Stdout = NewRateLimitedWriter(&buf, 10000, 1000)
+
+	start := time.Now()
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	elapsed := time.Since(start)
+
+	if buf.Len() != 3000 {
+		t.Errorf("output length = %d, want 3000", buf.Len())
+	}
+	// 1000 bytes of burst are free, the remaining 2000 take 200ms.
+	if elapsed < 150*time.Millisecond {
+		t.Errorf("Run() took %v, want at least 150ms", elapsed)
+	}
+}
+
+// TestPrefixWriter tests prefixing of child output lines
+func TestPrefixWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewPrefixWriter("worker-3 | ", &buf)
+	cmd := Command("sh", "-c", "printf 'one\\ntw'; printf 'o\\n'; echo three >&2; printf four")
+	cmd.Stdout = w
+	cmd.Stderr = w
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	for _, want := range []string{"worker-3 | one\n", "worker-3 | two\n", "worker-3 | three\n", "worker-3 | four\n"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("output = %q, want to contain %q", buf.String(), want)
+		}
+	}
+	if n := strings.Count(buf.String(), "\n"); n != 4 {
+		t.Errorf("output has %d lines, want 4", n)
+	}
+}
+
+// TestTimestampWriter tests timestamping of output lines
+func TestTimestampWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewTimestampWriter(&buf)
+	io.WriteString(w, "hello\n")
+
+	line := buf.String()
+	ts, rest, ok := strings.Cut(line, " ")
+	if !ok || rest != "hello\n" {
+		t.Fatalf("line = %q, want timestamp followed by hello", line)
+	}
+	if _, err := time.Parse(TimestampFormat, ts); err != nil {
+		t.Errorf("timestamp %q does not parse: %v", ts, err)
+	}
+}
+
+// TestProcessTryWait tests polling a process for exit without blocking
+func TestProcessTryWait(t *testing.T) {
+	cmd := Command("sh", "-c", "sleep 0.2; exit 3")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	ps, done, err := cmd.Process.TryWait()
+	if err != nil || done || ps != nil {
+		t.Fatalf("TryWait() = %v, %v, %v, want nil, false, nil", ps, done, err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !done {
+		if time.Now().After(deadline) {
+			t.Fatal("TryWait() never reported the process as done")
+		}
+		time.Sleep(10 * time.Millisecond)
+		ps, done, err = cmd.Process.TryWait()
+		if err != nil {
+			t.Fatalf("TryWait() error = %v", err)
+		}
+	}
+	if ps.ExitCode() != 3 {
+		t.Errorf("TryWait() exit code = %d, want 3", ps.ExitCode())
+	}
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != os.ErrProcessDone {
+		t.Errorf("Signal() after TryWait error = %v, want os.ErrProcessDone", err)
+	}
+
+	err = cmd.Wait()
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("Wait() error = %v, want *ExitError", err)
+	}
+	if cmd.ProcessState != ps {
+		t.Errorf("Wait() ProcessState = %v, want the one from TryWait", cmd.ProcessState)
+	}
+}
+
+// TestFindProcess tests re-adopting a process that is not our child
+func TestFindProcess(t *testing.T) {
+	// The shell's background sleep is the shell's child, not ours.
+	cmd := Command("sh", "-c", "sleep 0.3 & echo $!; wait")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("StdoutPipe() error = %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer cmd.Wait()
+
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading pid: %v", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil {
+		t.Fatalf("parsing pid %q: %v", line, err)
+	}
+
+	p, err := FindProcess(pid)
+	if err != nil {
+		t.Fatalf("FindProcess(%d) error = %v", pid, err)
+	}
+	if _, done, err := p.TryWait(); done || err != nil {
+		t.Errorf("TryWait() = %v, %v, want false, nil", done, err)
+	}
+	ps, err := p.Wait()
+	if err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+	if ps.Exited() || ps.Success() || ps.ExitCode() != -1 {
+		t.Errorf("ProcessState = %v, want unknown status", ps)
+	}
+	if err := p.Signal(syscall.SIGTERM); err != os.ErrProcessDone {
+		t.Errorf("Signal() after Wait error = %v, want os.ErrProcessDone", err)
+	}
+
+	if _, err := FindProcess(pid); !errors.Is(err, os.ErrProcessDone) {
+		t.Errorf("FindProcess() of exited process error = %v, want os.ErrProcessDone", err)
+	}
+}
+
+// TestWaitAny tests collecting commands in the order they exit
+func TestWaitAny(t *testing.T) {
+	cmds := []*Cmd{
+		Command("sh", "-c", "sleep 0.4; exit 1"),
+		Command("sh", "-c", "sleep 0.05"),
+		Command("sh", "-c", "sleep 0.2; exit 2"),
+	}
+	for _, c := range cmds {
+		if err := c.Start(); err != nil {
+			t.Fatalf("Start() error = %v", err)
+		}
+	}
+
+	var order []int
+	for {
+		i, err := WaitAny(cmds...)
+		if i < 0 {
+			break
+		}
+		if code := cmds[i].ProcessState.ExitCode(); code != []int{1, 0, 2}[i] {
+			t.Errorf("command %d exit code = %d, err = %v", i, code, err)
+		}
+		order = append(order, i)
+	}
+	if fmt.Sprint(order) != "[1 2 0]" {
+		t.Errorf("WaitAny() order = %v, want [1 2 0]", order)
+	}
+}
+
+// TestWaitAnyReaped tests the fallback that waits for any process on
+// notifications from the shared reaper
+func TestWaitAnyReaped(t *testing.T) {
+	cmds := []*Cmd{
+		Command("sleep", "5"),
+		Command("sh", "-c", "sleep 0.05"),
+	}
+	for _, c := range cmds {
+		if err := c.Start(); err != nil {
+			t.Fatalf("Start() error = %v", err)
+		}
+	}
+	defer cmds[0].Process.Kill()
+
+	i, err := waitAnyReaped([]*Process{cmds[0].Process, cmds[1].Process})
+	if i != 1 || err != nil {
+		t.Fatalf("waitAnyReaped() = %d, %v, want 1, nil", i, err)
+	}
+	if err := cmds[1].Wait(); err != nil {
+		t.Errorf("Wait() error = %v", err)
+	}
+	cmds[0].Process.Kill()
+	cmds[0].Wait()
+}
+
+// TestWaitAll tests that WaitAll aggregates command errors
+func TestWaitAll(t *testing.T) {
+	cmds := []*Cmd{
+		Command("true"),
+		Command("sh", "-c", "exit 3"),
+		Command("sh", "-c", "exit 4"),
+	}
+	for _, c := range cmds {
+		if err := c.Start(); err != nil {
+			t.Fatalf("Start() error = %v", err)
+		}
+	}
+
+	err := WaitAll(cmds...)
+	if err == nil {
+		t.Fatal("WaitAll() error = nil, want error")
+	}
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) {
+		t.Errorf("WaitAll() error = %v, want to wrap *ExitError", err)
+	}
+	for _, want := range []string{"exit status 3", "exit status 4"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("WaitAll() error = %q, want to contain %q", err, want)
+		}
+	}
+	for i, c := range cmds {
+		if c.ProcessState == nil {
+			t.Errorf("command %d was not waited for", i)
+		}
+	}
+}
+
+// TestProcessConcurrentSignalWait tests signaling a process while another
+// goroutine waits for it
+func TestProcessConcurrentSignalWait(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		cmd := Command("sleep", "10")
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("Start() error = %v", err)
+		}
+
+		var wg sync.WaitGroup
+		results := make(chan *ProcessState, 2)
+		for j := 0; j < 2; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ps, err := cmd.Process.Wait()
+				if err != nil {
+					t.Errorf("Process.Wait() error = %v", err)
+				}
+				results <- ps
+			}()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				err := cmd.Process.Kill()
+				if err == os.ErrProcessDone {
+					return
+				}
+				if err != nil {
+					t.Errorf("Kill() error = %v", err)
+					return
+				}
+				cmd.Process.TryWait()
+			}
+		}()
+		wg.Wait()
+
+		if ps1, ps2 := <-results, <-results; ps1 != ps2 || ps1 == nil {
+			t.Fatalf("Process.Wait() returned %p and %p, want the same ProcessState", ps1, ps2)
+		}
+		if err := cmd.Wait(); err == nil {
+			t.Error("Wait() error = nil, want killed")
+		}
+	}
+}
+
+// TestWaitCopiesAllOutput tests that Wait returns only after all output
+// has been copied
+func TestWaitCopiesAllOutput(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		var stdout, stderr bytes.Buffer
+		cmd := Command("sh", "-c", "seq 1 20000; seq 1 20000 >&2")
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("Run() error = %v", err)
+		}
+		if n := strings.Count(stdout.String(), "\n"); n != 20000 {
+			t.Fatalf("stdout has %d lines, want 20000", n)
+		}
+		if n := strings.Count(stderr.String(), "\n"); n != 20000 {
+			t.Fatalf("stderr has %d lines, want 20000", n)
+		}
+	}
+}
+
+// TestWaitDelayInheritedPipe tests that WaitDelay bounds the wait for a
+// grandchild holding the output pipe open
+func TestWaitDelayInheritedPipe(t *testing.T) {
+	var stdout bytes.Buffer
+	cmd := Command("sh", "-c", "echo hi; sleep 10 &")
+	cmd.Stdout = &stdout
+	cmd.WaitDelay = int64(100 * time.Millisecond)
+
+	start := time.Now()
+	err := cmd.Run()
+	if !errors.Is(err, ErrWaitDelay) {
+		t.Errorf("Run() error = %v, want ErrWaitDelay", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Run() took %v, want WaitDelay to cut it short", elapsed)
+	}
+	if stdout.String() != "hi\n" {
+		t.Errorf("stdout = %q, want %q", stdout.String(), "hi\n")
+	}
+}
+
+// TestWaitDelaySharedCopier tests that once WaitDelay has cut Wait short,
+// the shared copier no longer writes to the command's buffer, which the
+// caller is then free to use
+func TestWaitDelaySharedCopier(t *testing.T) {
+	var stdout bytes.Buffer
+	// The grandchild keeps writing until the pipe is closed.
+	cmd := Command("sh", "-c", "yes &")
+	cmd.Stdout = &stdout
+	cmd.WaitDelay = int64(50 * time.Millisecond)
+	if err := cmd.Run(); !errors.Is(err, ErrWaitDelay) {
+		t.Fatalf("Run() error = %v, want ErrWaitDelay", err)
+	}
+	// The race detector reports any write still made to stdout.
+	for range 20 {
+		stdout.Reset()
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestSharedCopier tests that output captured in buffers is copied without
+// a goroutine per stream
+func TestSharedCopier(t *testing.T) {
+	const n = 50
+	before := runtime.NumGoroutine()
+
+	cmds := make([]*Cmd, n)
+	outs := make([]*bytes.Buffer, n)
+	errs := make([]*bytes.Buffer, n)
+	for i := range cmds {
+		cmds[i] = Command("sh", "-c", "echo out $0; echo err $0 >&2; sleep 0.2", strconv.Itoa(i))
+		outs[i], errs[i] = new(bytes.Buffer), new(bytes.Buffer)
+		cmds[i].Stdout, cmds[i].Stderr = outs[i], errs[i]
+		if err := cmds[i].Start(); err != nil {
+			t.Fatalf("Start() error = %v", err)
+		}
+	}
+	if grown := runtime.NumGoroutine() - before; grown >= n {
+		t.Errorf("%d goroutines started for %d commands, want fewer than one per command", grown, n)
+	}
+
+	if err := WaitAll(cmds...); err != nil {
+		t.Fatalf("WaitAll() error = %v", err)
+	}
+	for i := range cmds {
+		if want := fmt.Sprintf("out %d\n", i); outs[i].String() != want {
+			t.Errorf("command %d stdout = %q, want %q", i, outs[i].String(), want)
+		}
+		if want := fmt.Sprintf("err %d\n", i); errs[i].String() != want {
+			t.Errorf("command %d stderr = %q, want %q", i, errs[i].String(), want)
+		}
+	}
+}
+
+// TestArgvBlock tests packing argv and env into a single C block
+func TestArgvBlock(t *testing.T) {
+	argv := []string{"/bin/echo", "hello", "", "world"}
+	env := []string{"A=1", "B=two"}
+	b, err := newArgvBlock("/bin/echo", argv, env)
+	if err != nil {
+		t.Fatalf("newArgvBlock() error = %v", err)
+	}
+	defer b.release()
+
+	if got := unix.BytePtrToString((*byte)(b.path)); got != "/bin/echo" {
+		t.Errorf("path = %q, want /bin/echo", got)
+	}
+	readArray := func(p unsafe.Pointer) []string {
+		var strs []string
+		for _, ptr := range unsafe.Slice((**byte)(p), 16) {
+			if ptr == nil {
+				return strs
+			}
+			strs = append(strs, unix.BytePtrToString(ptr))
+		}
+		t.Fatal("array is not NULL-terminated")
+		return nil
+	}
+	if got := readArray(b.argv); !slices.Equal(got, argv) {
+		t.Errorf("argv = %q, want %q", got, argv)
+	}
+	if got := readArray(b.envp); !slices.Equal(got, env) {
+		t.Errorf("envp = %q, want %q", got, env)
+	}
+}
+
+// TestArgvBlockAllocs tests that reused argv blocks do not allocate
+func TestArgvBlockAllocs(t *testing.T) {
+	argv := []string{"/bin/echo", "hello"}
+	env := os.Environ()
+	allocs := testing.AllocsPerRun(100, func() {
+		b, err := newArgvBlock(argv[0], argv, env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.release()
+	})
+	if allocs != 0 {
+		t.Errorf("newArgvBlock() allocates %v times per run, want 0", allocs)
+	}
+}
+
+// TestPreparedCommand tests running a prepared command repeatedly
+func TestPreparedCommand(t *testing.T) {
+	p, err := Prepare("sh", []string{"-c", "echo $GREETING $0", "x"}, []string{"GREETING=hello"})
+	if err != nil {
+		t.Fatalf("Prepare() error = %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		out, err := p.Command().Output()
+		if err != nil {
+			t.Fatalf("Output() error = %v", err)
+		}
+		if string(out) != "hello x\n" {
+			t.Errorf("Output() = %q, want %q", out, "hello x\n")
+		}
+	}
+
+	// A Cmd whose arguments were changed runs with the new ones.
+	cmd := p.Command()
+	cmd.Args[3] = "y"
+	if out, err := cmd.Output(); err != nil || string(out) != "hello y\n" {
+		t.Errorf("Output() with changed Args = %q, %v, want %q", out, err, "hello y\n")
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if out, err := p.Command().Output(); err != nil || string(out) != "hello x\n" {
+		t.Errorf("Output() after Close = %q, %v, want %q", out, err, "hello x\n")
+	}
+
+	if _, err := Prepare("nonexistent-command-12345", nil, nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Prepare() of missing command error = %v, want ErrNotFound", err)
+	}
+}
+
+// TestBroker tests spawning commands through a spawn broker
+func TestBroker(t *testing.T) {
+	b, err := StartBroker()
+	if err != nil {
+		t.Fatalf("StartBroker() error = %v", err)
+	}
+	defer b.Close()
+
+	cmd := Command("sh", "-c", "read line; echo got $line; echo oops >&2; exit 3")
+	cmd.Broker = b
+	cmd.Stdin = strings.NewReader("input\n")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+		t.Fatalf("Output() error = %v, want exit status 3", err)
+	}
+	if string(out) != "got input\n" || stderr.String() != "oops\n" {
+		t.Errorf("stdout = %q, stderr = %q", out, stderr.String())
+	}
+	if cmd.ProcessState.Pid() != cmd.Process.Pid {
+		t.Errorf("ProcessState.Pid() = %d, want %d", cmd.ProcessState.Pid(), cmd.Process.Pid)
+	}
+
+	cmd = Command("sleep", "10")
+	cmd.Broker = b
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	if err := cmd.Process.Kill(); err != nil {
+		t.Fatalf("Kill() error = %v", err)
+	}
+	if err := cmd.Wait(); cmd.ProcessState == nil || cmd.ProcessState.Signal() != syscall.SIGKILL {
+		t.Errorf("Wait() error = %v, want killed", err)
+	}
+	if err := cmd.Process.Kill(); err != os.ErrProcessDone {
+		t.Errorf("Kill() after Wait error = %v, want os.ErrProcessDone", err)
+	}
+
+	cmd = Command("/nonexistent/program")
+	cmd.Broker = b
+	if err := cmd.Start(); !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("Start() of missing program error = %v, want ENOENT", err)
+	}
+
+	// Setsid is applied by the broker; fields it cannot apply are refused.
+	cmd = Command("sh", "-c", `ps -o sid= -p $$; echo $$`)
+	cmd.Broker = b
+	cmd.SysProcAttr = &SysProcAttr{Setsid: true}
+	out, err = cmd.Output()
+	if f := strings.Fields(string(out)); err != nil || len(f) != 2 || f[0] != f[1] {
+		t.Errorf("Output() with Setsid = %q, %v, want the command to lead its session", out, err)
+	}
+	for _, attr := range []*SysProcAttr{
+		{Setsid: true, Setctty: true},
+		{Noctty: true},
+		{Foreground: true},
+		{Chroot: "/"},
+		{UidMappings: []SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}},
+		{CgroupPath: "/sys/fs/cgroup"},
+	} {
+		cmd = Command("true")
+		cmd.Broker = b
+		cmd.SysProcAttr = attr
+		if err := cmd.Run(); err == nil || !strings.Contains(err.Error(), "Broker") {
+			t.Errorf("Run() with %+v through a Broker error = %v, want it refused", *attr, err)
+		}
+	}
+}
+
+// TestFdMap tests placing files at exact descriptor numbers in the child
+func TestFdMap(t *testing.T) {
+	r5, w5, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r5.Close()
+	r9, w9, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r9.Close()
+
+	cmd := Command("sh", "-c", "echo five >&5; echo nine >&9; echo three >&3 2>/dev/null || echo closed")
+	cmd.FdMap = map[int]*os.File{5: w5, 9: w9}
+	out, err := cmd.Output()
+	w5.Close()
+	w9.Close()
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+	if string(out) != "closed\n" {
+		t.Errorf("stdout = %q, want fd 3 to be closed", out)
+	}
+	for _, tt := range []struct {
+		r    *os.File
+		want string
+	}{{r5, "five\n"}, {r9, "nine\n"}} {
+		got, _ := io.ReadAll(tt.r)
+		if string(got) != tt.want {
+			t.Errorf("read %q, want %q", got, tt.want)
+		}
+	}
+
+	cmd = Command("true")
+	cmd.ExtraFiles = []*os.File{w5}
+	cmd.FdMap = map[int]*os.File{3: w9}
+	if err := cmd.Run(); err == nil {
+		t.Error("Run() with FdMap colliding with ExtraFiles succeeded, want error")
+	}
+
+	// An FdMap that is refused leaves no pipes made for the output open.
+	before := openFiles(t)
+	for range 20 {
+		cmd = Command("true")
+		cmd.Stdout = new(strings.Builder)
+		cmd.CopyBufferSize = 4096
+		cmd.FdMap = map[int]*os.File{1: w9}
+		if err := cmd.Run(); err == nil {
+			t.Fatal("Run() with FdMap descriptor 1 succeeded, want error")
+		}
+	}
+	if after := openFiles(t); after > before {
+		t.Errorf("%d descriptors open after refused FdMaps, want at most %d", after, before)
+	}
+}
+
+// TestOpenFiles tests that files listed in OpenFiles are opened at the
+// given descriptors in the child.
+func TestOpenFiles(t *testing.T) {
+	dir := t.TempDir()
+	for range 2 {
+		cmd := Command("sh", "-c", "echo hi >&5")
+		cmd.Dir = dir
+		cmd.OpenFiles = []OpenFile{{
+			Fd:   5,
+			Path: "log",
+			Flag: os.O_WRONLY | os.O_CREATE | os.O_APPEND,
+			Perm: 0644,
+		}}
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("Run() error = %v", err)
+		}
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hi\nhi\n" {
+		t.Errorf("log = %q, want %q", got, "hi\nhi\n")
+	}
+
+	cmd := Command("cat")
+	cmd.OpenFiles = []OpenFile{{Fd: 0, Path: filepath.Join(dir, "log"), Flag: os.O_RDONLY}}
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+	if string(out) != "hi\nhi\n" {
+		t.Errorf("Output() = %q, want %q", out, "hi\nhi\n")
+	}
+
+	cmd = Command("true")
+	cmd.OpenFiles = []OpenFile{{Fd: 3, Path: filepath.Join(dir, "missing"), Flag: os.O_RDONLY}}
+	if err := cmd.Start(); err == nil {
+		cmd.Wait()
+		t.Error("Start() with missing OpenFiles path succeeded, want error")
+	}
+}
+
+// TestStdioPaths tests redirecting standard I/O to files by path.
+func TestStdioPaths(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in")
+	if err := os.WriteFile(in, []byte("input\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := Command("sh", "-c", "cat; echo err >&2")
+	cmd.StdinPath = in
+	cmd.StdoutPath = filepath.Join(dir, "out")
+	cmd.StderrPath = filepath.Join(dir, "err")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	for name, want := range map[string]string{"out": "input\n", "err": "err\n"} {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+
+	cmd = Command("sh", "-c", "echo out; echo err >&2")
+	cmd.Dir = dir
+	cmd.StdoutPath = "both"
+	cmd.StderrPath = "both"
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "both"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "out\nerr\n" {
+		t.Errorf("both = %q, want %q", got, "out\nerr\n")
+	}
+
+	cmd = Command("true")
+	cmd.StdoutPath = filepath.Join(dir, "out")
+	if _, err := cmd.Output(); err == nil {
+		t.Error("Output() with StdoutPath succeeded, want error")
+	}
+}
+
+// TestOutputFlag tests appending output to files with OutputFlag and
+// creating them with OutputPerm.
+func TestOutputFlag(t *testing.T) {
+	dir := t.TempDir()
+	log := filepath.Join(dir, "log")
+	for _, word := range []string{"one", "two"} {
+		cmd := Command("echo", word)
+		cmd.StdoutPath = log
+		cmd.OutputFlag = os.O_CREATE | os.O_APPEND
+		cmd.OutputPerm = 0600
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("Run() error = %v", err)
+		}
+	}
+	got, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "one\ntwo\n" {
+		t.Errorf("log = %q, want %q", got, "one\ntwo\n")
+	}
+	if fi, err := os.Stat(log); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode().Perm() != 0600 {
+		t.Errorf("log mode = %v, want %v", fi.Mode().Perm(), os.FileMode(0600))
+	}
+
+	// An *os.File positioned at the start is switched to append mode.
+	f, err := os.OpenFile(log, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	cmd := Command("echo", "three")
+	cmd.Stdout = f
+	cmd.OutputFlag = os.O_APPEND
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	got, err = os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "one\ntwo\nthree\n" {
+		t.Errorf("log = %q, want %q", got, "one\ntwo\nthree\n")
+	}
+}
+
+// TestExtraFilesInherited tests that the child can use each of its
+// ExtraFiles at descriptor 3+i, in blocking mode, and that nil entries are
+// left closed.
+func TestExtraFilesInherited(t *testing.T) {
+	r1, w1, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r1.Close()
+	r2, w2, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r2.Close()
+	defer w2.Close()
+
+	// The child reads r2 before anything has been written to it, which
+	// fails with EAGAIN if it inherits the descriptor in non-blocking mode.
+	cmd := Command("sh", "-c", "echo one >&3; cat <&5; if (: >&4) 2>/dev/null; then echo four open; fi")
+	cmd.ExtraFiles = []*os.File{w1, nil, r2}
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	w1.Close()
+	time.Sleep(100 * time.Millisecond)
+	io.WriteString(w2, "five\n")
+	w2.Close()
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+	if out.String() != "five\n" {
+		t.Errorf("stdout = %q, want %q", out.String(), "five\n")
+	}
+	got, _ := io.ReadAll(r1)
+	if string(got) != "one\n" {
+		t.Errorf("fd 3 got %q, want %q", got, "one\n")
+	}
+}
+
+// TestConnStdio tests that network connections given as standard I/O are
+// handed to the child directly instead of being copied.
+func TestConnStdio(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := Command("cat")
+	cmd.Stdin = server
+	cmd.Stdout = server
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	if len(cmd.goroutine) != 0 || len(cmd.copyStreams) != 0 {
+		t.Errorf("Start() set up copying for a connection")
+	}
+	if cmd.Stdin != server || cmd.Stdout != server {
+		t.Errorf("Start() changed Stdin or Stdout")
+	}
+	server.Close()
+
+	io.WriteString(client, "hello\n")
+	client.(*net.TCPConn).CloseWrite()
+	got, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello\n" {
+		t.Errorf("read %q, want %q", got, "hello\n")
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+}
+
+// TestStdioConn tests talking to a command over a single socket connected
+// to its standard input and output.
+func TestStdioConn(t *testing.T) {
+	cmd := Command("sh", "-c", "read line; echo got $line; cat")
+	conn, err := cmd.StdioConn()
+	if err != nil {
+		t.Fatalf("StdioConn() error = %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	io.WriteString(conn, "one\n")
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "got one\n" {
+		t.Errorf("read %q, want %q", line, "got one\n")
+	}
+
+	io.WriteString(conn, "two\n")
+	if err := cmd.CloseStdin(); err != nil {
+		t.Fatalf("CloseStdin() error = %v", err)
+	}
+	rest, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != "two\n" {
+		t.Errorf("read %q, want %q", rest, "two\n")
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+
+	cmd = Command("true")
+	cmd.Stdout = io.Discard
+	if _, err := cmd.StdioConn(); err == nil {
+		t.Error("StdioConn() with Stdout set succeeded, want error")
+	}
+}
+
+// TestInheritStdio tests connecting a command to the parent's own standard
+// I/O.
+func TestInheritStdio(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	dir := t.TempDir()
+	cmd := Command("sh", "-c", "echo out; echo err >&2")
+	cmd.InheritStdio = true
+	cmd.StderrPath = filepath.Join(dir, "err")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	w.Close()
+	if cmd.Stdout != nil {
+		t.Errorf("Run() left Stdout set")
+	}
+	got, _ := io.ReadAll(r)
+	if string(got) != "out\n" {
+		t.Errorf("stdout = %q, want %q", got, "out\n")
+	}
+	got, _ = os.ReadFile(filepath.Join(dir, "err"))
+	if string(got) != "err\n" {
+		t.Errorf("stderr = %q, want %q", got, "err\n")
+	}
+}
+
+// TestProcessChildren tests listing the children and descendants of a
+// process.
+func TestProcessChildren(t *testing.T) {
+	cmd := Command("sh", "-c", "sleep 10 & (sleep 10; :) & wait")
+	cmd.SysProcAttr = &SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer func() {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		cmd.Wait()
+	}()
+
+	var children, descendants []int
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var err error
+		if children, err = cmd.Process.Children(); err != nil {
+			t.Fatalf("Children() error = %v", err)
+		}
+		if descendants, err = cmd.Process.Descendants(); err != nil {
+			t.Fatalf("Descendants() error = %v", err)
+		}
+		if len(children) == 2 && len(descendants) == 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(children) != 2 || len(descendants) != 3 {
+		t.Fatalf("Children() = %v, Descendants() = %v; want 2 and 3 pids", children, descendants)
+	}
+	for _, pid := range children {
+		if !slices.Contains(descendants, pid) {
+			t.Errorf("Descendants() = %v, missing child %d", descendants, pid)
+		}
+	}
+
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	cmd.Wait()
+	if _, err := cmd.Process.Children(); !errors.Is(err, os.ErrProcessDone) {
+		t.Errorf("Children() after Wait error = %v, want os.ErrProcessDone", err)
+	}
+}
+
+// TestCgroupPath tests creating a child directly in a cgroup.
+func TestCgroupPath(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("cgroups are only supported on Linux")
+	}
+	cmd := Command("true")
+	cmd.SysProcAttr = &SysProcAttr{CgroupPath: filepath.Join(t.TempDir(), "missing")}
+	if err := cmd.Run(); err == nil {
+		t.Error("Run() with missing CgroupPath succeeded, want error")
+	}
+
+	var root string
+	for _, dir := range []string{"/sys/fs/cgroup", "/sys/fs/cgroup/unified"} {
+		if _, err := os.Stat(filepath.Join(dir, "cgroup.controllers")); err == nil {
+			root = dir
+			break
+		}
+	}
+	if root == "" {
+		t.Skip("no cgroup v2 hierarchy")
+	}
+	name := fmt.Sprintf("spawnexec-test-%d", os.Getpid())
+	cgroup := filepath.Join(root, name)
+	if err := os.Mkdir(cgroup, 0755); err != nil {
+		t.Skipf("cannot create cgroup: %v", err)
+	}
+	defer os.Remove(cgroup)
+
+	cmd = Command("cat", "/proc/self/cgroup")
+	cmd.SysProcAttr = &SysProcAttr{CgroupPath: cgroup}
+	out, err := cmd.Output()
+	if err != nil {
+		t.Skipf("cannot start in cgroup: %v", err)
+	}
+	if !strings.Contains(string(out), "0::/"+name+"\n") {
+		t.Errorf("child cgroups = %q, want it in %s", out, name)
+	}
+}
+
+// TestDarwinAttr tests that a command runs with a generous memory limit
+// and with its exception ports reset, which are ignored on other
+// platforms.
+func TestDarwinAttr(t *testing.T) {
+	cmd := Command("echo", "ok")
+	cmd.DarwinAttr = &DarwinAttr{MemoryLimit: 1 << 30}
+	out, err := cmd.Output()
+	if errors.Is(err, syscall.ENOTSUP) {
+		t.Skip("jetsam attributes are unavailable")
+	}
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+	if string(out) != "ok\n" {
+		t.Errorf("Output() = %q, want %q", out, "ok\n")
+	}
+
+	cmd = Command("echo", "ok")
+	cmd.DarwinAttr = &DarwinAttr{ResetExceptionPorts: true}
+	if out, err := cmd.Output(); err != nil || string(out) != "ok\n" {
+		t.Errorf("Output() with ResetExceptionPorts = %q, %v; want %q", out, err, "ok\n")
+	}
+}
+
+// TestExceptionPorts tests that a command is given task exception ports
+// on darwin, and that they are refused for a Broker.
+func TestExceptionPorts(t *testing.T) {
+	// EXC_MASK_CRASH, sent nowhere.
+	ports := []ExceptionPort{{Mask: 1 << 10}}
+	b, err := StartBroker()
+	if err != nil {
+		t.Fatalf("StartBroker() error = %v", err)
+	}
+	defer b.Close()
+	cmd := Command("true")
+	cmd.Broker = b
+	cmd.DarwinAttr = &DarwinAttr{ExceptionPorts: ports}
+	if err := cmd.Run(); err == nil || !strings.Contains(err.Error(), "ExceptionPorts") {
+		t.Errorf("Run() through a Broker error = %v, want ExceptionPorts refused", err)
+	}
+
+	if runtime.GOOS != "darwin" {
+		t.Skip("exception ports are only set on darwin")
+	}
+	// EXCEPTION_DEFAULT, with THREAD_STATE_NONE for the architecture.
+	ports[0].Behavior, ports[0].Flavor = 1, 13
+	if runtime.GOARCH == "arm64" {
+		ports[0].Flavor = 5
+	}
+	cmd = Command("echo", "ok")
+	cmd.DarwinAttr = &DarwinAttr{ResetExceptionPorts: true, ExceptionPorts: ports}
+	if out, err := cmd.Output(); err != nil || string(out) != "ok\n" {
+		t.Errorf("Output() with ExceptionPorts = %q, %v; want %q", out, err, "ok\n")
+	}
+}
+
+// TestLaunchdPlist tests describing a command as a launchd job and parsing
+// the job's status.
+func TestLaunchdPlist(t *testing.T) {
+	cmd := Command("/bin/sh", "-c", "echo <done> & exit")
+	cmd.Dir = "/tmp"
+	cmd.Env = []string{"A=1", "B=2", "A=3"}
+	cmd.StdoutPath = "/tmp/out.log"
+	plist := string(launchdPlist("com.example.job", cmd))
+	for _, want := range []string{
+		"<key>Label</key>\n<string>com.example.job</string>",
+		"<string>-c</string>\n<string>echo &lt;done&gt; &amp; exit</string>",
+		"<key>WorkingDirectory</key>\n<string>/tmp</string>",
+		"<key>B</key>\n<string>2</string>\n<key>A</key>\n<string>3</string>",
+		"<key>StandardOutPath</key>\n<string>/tmp/out.log</string>",
+	} {
+		if !strings.Contains(plist, want) {
+			t.Errorf("plist lacks %q:\n%s", want, plist)
+		}
+	}
+	if strings.Contains(plist, "StandardErrorPath") {
+		t.Errorf("plist has StandardErrorPath:\n%s", plist)
+	}
+
+	st := parseLaunchdStatus([]byte("user/501/com.example.job = {\n\tstate = running\n\tpid = 1234\n\tlast exit code = (never exited)\n}\n"))
+	if want := (LaunchdStatus{Running: true, Pid: 1234, LastExitCode: -1}); st != want {
+		t.Errorf("parseLaunchdStatus() = %+v, want %+v", st, want)
+	}
+	st = parseLaunchdStatus([]byte("\tstate = not running\n\tlast exit code = 3\n"))
+	if want := (LaunchdStatus{LastExitCode: 3}); st != want {
+		t.Errorf("parseLaunchdStatus() = %+v, want %+v", st, want)
+	}
+
+	if _, err := SubmitLaunchdJob("com.example.job", Command("true"), ""); runtime.GOOS != "darwin" && err == nil {
+		t.Error("SubmitLaunchdJob() succeeded without launchd")
+	}
+}
+
+// TestTrampoline tests running a command in a directory through the
+// trampoline used where posix_spawn cannot change directory.
+func TestTrampoline(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh, err := LookPath("sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := trampoline{dir: dir}
+	path, env, err := tr.spawnArgs(sh, append(os.Environ(), "FOO=bar"))
+	if err != nil {
+		t.Fatalf("spawnArgs() error = %v", err)
+	}
+	cmd := Command(path)
+	cmd.Args = []string{"sh", "-c", `echo "$0 $(pwd) $FOO ${SPAWNEXEC_TRAMPOLINE_DIR-unset}"`}
+	cmd.Env = env
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+	if want := "sh " + dir + " bar unset\n"; string(out) != want {
+		t.Errorf("Output() = %q, want %q", out, want)
+	}
+
+	failing := []trampoline{
+		{dir: filepath.Join(dir, "missing")},
+		{setctty: true, ctty: 0}, // standard input is not a terminal
+	}
+	if tty, err := os.Open("/dev/tty"); err == nil {
+		tty.Close()
+	} else {
+		failing = append(failing, trampoline{foreground: true})
+	}
+	for _, tr := range failing {
+		path, env, err = tr.spawnArgs(sh, os.Environ())
+		if err != nil {
+			t.Fatalf("spawnArgs() error = %v", err)
+		}
+		cmd = Command(path)
+		cmd.Env = env
+		var ee *ExitError
+		if err := cmd.Run(); !errors.As(err, &ee) || ee.ExitCode() != 127 {
+			t.Errorf("Run() with %+v error = %v, want exit status 127", tr, err)
+		}
+	}
+}
+
+// TestForeground tests that Foreground puts the command's process group
+// in the foreground of the controlling terminal, where there is one.
+func TestForeground(t *testing.T) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		t.Skipf("no controlling terminal: %v", err)
+	}
+	defer tty.Close()
+	fd := int(tty.Fd())
+	fg, err := unix.IoctlGetInt(fd, unix.TIOCGPGRP)
+	if err != nil {
+		t.Skipf("TIOCGPGRP: %v", err)
+	}
+	// The terminal is taken back from the command's group once SIGTTOU,
+	// sent to background groups that try, is ignored.
+	signal.Ignore(syscall.SIGTTOU)
+	defer signal.Reset(syscall.SIGTTOU)
+	defer unix.IoctlSetPointerInt(fd, unix.TIOCSPGRP, fg)
+
+	cmd := Command("sleep", "10")
+	cmd.SysProcAttr = &SysProcAttr{Foreground: true, Ctty: fd}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		pgrp, err := unix.IoctlGetInt(fd, unix.TIOCGPGRP)
+		if err == nil && pgrp == cmd.Process.Pid {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("foreground process group = %d, %v, want %d", pgrp, err, cmd.Process.Pid)
+		}
+	}
+}
+
+// TestNoctty tests that Noctty leaves the command without a controlling
+// terminal on darwin, where it starts a new session.
+func TestNoctty(t *testing.T) {
+	if runtime.GOOS != "darwin" {
+		t.Skip("Noctty only starts a new session on darwin")
+	}
+	cmd := Command("true")
+	cmd.SysProcAttr = &SysProcAttr{Noctty: true, Setpgid: true}
+	if err := cmd.Run(); err == nil {
+		t.Error("Run() with Noctty and Setpgid succeeded")
+	}
+
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		t.Skipf("no controlling terminal: %v", err)
+	}
+	tty.Close()
+	cmd = Command("sh", "-c", "exec 3</dev/tty")
+	cmd.SysProcAttr = &SysProcAttr{Noctty: true}
+	if err := cmd.Run(); err == nil {
+		t.Error("command with Noctty opened /dev/tty")
+	}
+	if err := Command("sh", "-c", "exec 3</dev/tty").Run(); err != nil {
+		t.Errorf("command without Noctty could not open /dev/tty: %v", err)
+	}
+}
+
+// TestKillOnParentExit tests that a command started with KillOnParentExit
+// is killed once the thread that started it exits on Linux, and otherwise
+// once the calling process's end of the watchdog pipe is closed without
+// the watchdog being stopped, as happens when it exits.
+func TestKillOnParentExit(t *testing.T) {
+	cmd := Command("true")
+	cmd.KillOnParentExit = true
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	cmd = Command("sleep", "10")
+	cmd.KillOnParentExit = true
+	if runtime.GOOS == "linux" {
+		// The thread exits with the goroutine that started the command
+		// on it, as the calling process's threads do when it exits. The
+		// runtime never ends the main thread, so that is held by another.
+		started := make(chan error, 1)
+		var start func()
+		start = func() {
+			runtime.LockOSThread()
+			if unix.Gettid() == unix.Getpid() {
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+					start()
+				}()
+				<-done
+				runtime.UnlockOSThread()
+				return
+			}
+			started <- cmd.Start()
+		}
+		go start()
+		if err := <-started; err != nil {
+			t.Fatalf("Start() error = %v", err)
+		}
+		if cmd.Process.watchdog != nil {
+			t.Error("Start() started a watchdog on Linux")
+		}
+	} else {
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("Start() error = %v", err)
+		}
+		cmd.Process.watchdog.w.Close()
+	}
+	err := cmd.Wait()
+	if cmd.ProcessState == nil || cmd.ProcessState.Signal() != syscall.SIGKILL {
+		t.Errorf("Wait() error = %v, want the command killed", err)
+	}
+
+	// A command started through a Broker is watched everywhere.
+	b, err := StartBroker()
+	if err != nil {
+		t.Fatalf("StartBroker() error = %v", err)
+	}
+	defer b.Close()
+	cmd = Command("sleep", "10")
+	cmd.KillOnParentExit = true
+	cmd.Broker = b
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("brokered Start() error = %v", err)
+	}
+	cmd.Process.watchdog.w.Close()
+	err = cmd.Wait()
+	if cmd.ProcessState == nil || cmd.ProcessState.Signal() != syscall.SIGKILL {
+		t.Errorf("brokered Wait() error = %v, want the command killed", err)
+	}
+}
+
+// TestReaper tests that the shared reaper reaps commands that are never
+// waited for, and hands the results to those that are.
+func TestReaper(t *testing.T) {
+	EnableReaper()
+	t.Cleanup(func() {
+		reaper.mu.Lock()
+		reaper.enabled = false
+		reaper.mu.Unlock()
+	})
+
+	cmd := Command("sh", "-c", "exit 3")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	select {
+	case <-cmd.Process.reaperDone:
+	case <-time.After(10 * time.Second):
+		t.Fatal("command was not reaped")
+	}
+	if ps, done, err := cmd.Process.TryWait(); !done || err != nil || ps.ExitCode() != 3 {
+		t.Errorf("TryWait() = %v, %v, %v, want exit status 3", ps, done, err)
+	}
+	var ee *ExitError
+	if err := cmd.Wait(); !errors.As(err, &ee) || ee.ExitCode() != 3 {
+		t.Errorf("Wait() error = %v, want exit status 3", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			out, err := Command("echo", "hello").Output()
+			if err != nil || string(out) != "hello\n" {
+				t.Errorf("Output() = %q, %v, want %q", out, err, "hello\n")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// TestReleaseDetaches tests that a released child is reaped once it
+// exits rather than left a zombie.
+func TestReleaseDetaches(t *testing.T) {
+	cmd := Command("true")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	pid := cmd.Process.Pid
+	if err := cmd.Process.Release(); err != nil {
+		t.Fatalf("Release() error = %v", err)
+	}
+	if cmd.Process.Pid != -1 {
+		t.Errorf("Pid = %d after Release, want -1", cmd.Process.Pid)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for syscall.Kill(pid, 0) != syscall.ESRCH {
+		if time.Now().After(deadline) {
+			t.Fatalf("released process %d was not reaped", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestInvalidArgs tests that Start rejects values holding NUL bytes and
+// malformed environment entries with an InvalidArgError.
+func TestInvalidArgs(t *testing.T) {
+	tests := []struct {
+		setup func(*Cmd)
+		field string
+		index int
+	}{
+		{func(c *Cmd) { c.Path += "\x00x" }, "Path", -1},
+		{func(c *Cmd) { c.Args = append(c.Args, "a\x00b") }, "Args", 2},
+		{func(c *Cmd) { c.Dir = "/tmp\x00" }, "Dir", -1},
+		{func(c *Cmd) { c.Env = []string{"A=1", "B=\x00"} }, "Env", 1},
+		{func(c *Cmd) { c.Env = []string{"NOVALUE"} }, "Env", 0},
+	}
+	for _, tt := range tests {
+		cmd := Command("echo", "ok")
+		tt.setup(cmd)
+		var ae *InvalidArgError
+		if err := cmd.Run(); !errors.As(err, &ae) || ae.Field != tt.field || ae.Index != tt.index {
+			t.Errorf("Run() with bad %s error = %v, want InvalidArgError for %s[%d]", tt.field, err, tt.field, tt.index)
+		}
+	}
+
+	if _, err := Prepare("echo", []string{"a\x00b"}, nil); err == nil {
+		t.Error("Prepare() with NUL byte in argument succeeded")
+	}
+}
+
+// TestRelativePathParity tests that a relative Path is resolved relative
+// to Dir as os/exec resolves it.
+func TestRelativePathParity(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := func(path, name string) {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("#!/bin/sh\necho "+name+"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	script(filepath.Join(dir, "prog"), "top")
+	script(filepath.Join(dir, "bin", "prog"), "bin")
+	script(filepath.Join(dir, "real", "prog"), "real")
+	if err := os.Mkdir(filepath.Join(dir, "real", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "real", "sub"), filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(dir)
+
+	tests := []struct {
+		dir, path, want string
+	}{
+		{filepath.Join(dir, "bin"), "./prog", "bin"},
+		{filepath.Join(dir, "bin"), "../prog", "top"},
+		{filepath.Join(dir, "bin"), "prog", "bin"},
+		{"bin", "./prog", "bin"},
+		{"bin", "../prog", "top"},
+		{"", "bin/prog", "bin"},
+		// ".." follows the symbolic link rather than being cleaned away.
+		{"link", "../prog", "real"},
+	}
+	for _, tt := range tests {
+		osCmd := exec.Command("prog")
+		osCmd.Path, osCmd.Dir, osCmd.Err = tt.path, tt.dir, nil
+		want, err := osCmd.Output()
+		if err != nil || string(want) != tt.want+"\n" {
+			t.Fatalf("os/exec with Dir %q and Path %q: %q, %v", tt.dir, tt.path, want, err)
+		}
+
+		cmd := Command("prog")
+		cmd.Path, cmd.Dir, cmd.lookPathErr = tt.path, tt.dir, nil
+		if got, err := cmd.Output(); err != nil || string(got) != string(want) {
+			t.Errorf("Output() with Dir %q and Path %q = %q, %v, want %q", tt.dir, tt.path, got, err, want)
+		}
+	}
+
+	got, err := execPath("bin", "../prog")
+	if want := dir + "/bin/../prog"; err != nil || got != want {
+		t.Errorf("execPath() = %q, %v, want %q", got, err, want)
+	}
+}
+
+// TestStringQuoting tests that String quotes arguments that need it and
+// that StringEnv shows the environment as asked.
+func TestStringQuoting(t *testing.T) {
+	cmd := &Cmd{Path: "/bin/echo", Args: []string{"echo", "plain", "two words", "", "it's", "tab\there", "$HOME"}}
+	want := `/bin/echo plain 'two words' '' 'it'\''s' "tab\there" '$HOME'`
+	if got := cmd.String(); got != want {
+		t.Errorf("String() = %s, want %s", got, want)
+	}
+
+	cmd = &Cmd{Path: "/bin/true", Args: []string{"true"}, Env: []string{"A=1", "SECRET=x y"}}
+	if got, want := cmd.StringEnv(EnvShown), `A=1 'SECRET=x y' /bin/true`; got != want {
+		t.Errorf("StringEnv(EnvShown) = %s, want %s", got, want)
+	}
+	if got := cmd.StringEnv(EnvElided); got != "/bin/true" {
+		t.Errorf("StringEnv(EnvElided) = %s, want /bin/true", got)
+	}
+	hashed := cmd.StringEnv(EnvHashed)
+	if !strings.HasPrefix(hashed, "env=sha256:") || !strings.HasSuffix(hashed, " /bin/true") || strings.Contains(hashed, "SECRET") {
+		t.Errorf("StringEnv(EnvHashed) = %s, want a digest of the environment", hashed)
+	}
+	cmd.Env = []string{"A=1", "SECRET=other"}
+	if cmd.StringEnv(EnvHashed) == hashed {
+		t.Error("StringEnv(EnvHashed) is the same for different environments")
+	}
+}
+
+// TestRedactArgs tests that RedactArgs keeps arguments out of String and
+// the errors returned by Start.
+func TestRedactArgs(t *testing.T) {
+	cmd := &Cmd{Path: "/usr/bin/login", Args: []string{"login", "--password", "hunter2"}, RedactArgs: RedactIndices(2)}
+	if got, want := cmd.String(), "/usr/bin/login --password [redacted]"; got != want {
+		t.Errorf("String() = %s, want %s", got, want)
+	}
+
+	cmd = Command("echo", "token=abc\x00def")
+	cmd.RedactArgs = func(i int, arg string) string {
+		if strings.HasPrefix(arg, "token=") {
+			return "token=***"
+		}
+		return arg
+	}
+	err := cmd.Run()
+	if err == nil || strings.Contains(err.Error(), "abc") {
+		t.Errorf("Run() error = %v, want an error without the token", err)
+	}
+}
+
+// TestSpec tests that a Spec survives a round trip through JSON and
+// reconstructs the command it describes.
+func TestSpec(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	spec := Spec{
+		Path:       "sh",
+		Args:       []string{"-c", `echo "$GREETING"; echo oops >&2`},
+		Env:        []string{"GREETING=hello"},
+		StdoutPath: out,
+		Stderr:     StdioStdout,
+		Timeout:    time.Minute,
+	}
+	data, err := json.Marshal(spec)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	if !strings.Contains(string(data), `"timeout":"1m0s"`) {
+		t.Errorf("Marshal() = %s, want the timeout as a string", data)
+	}
+	var got Spec
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, spec) {
+		t.Errorf("Unmarshal() = %+v, want %+v", got, spec)
+	}
+
+	cmd, err := got.Command()
+	if err != nil {
+		t.Fatalf("Command() error = %v", err)
+	}
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if b, _ := os.ReadFile(out); string(b) != "hello\noops\n" {
+		t.Errorf("output = %q, want %q", b, "hello\noops\n")
+	}
+
+	if err := json.Unmarshal([]byte(`{"path":"true","env":[]}`), &got); err != nil || got.Env == nil {
+		t.Errorf("Unmarshal() of an empty environment = %v, %v, want an empty, non-nil Env", got.Env, err)
+	}
+	if _, err := (&Spec{Path: "true", Stdin: "bogus"}).Command(); err == nil {
+		t.Error("Command() with an unknown stdin mode succeeded")
+	}
+
+	spec = Spec{Path: "sleep", Args: []string{"10"}, Timeout: 50 * time.Millisecond}
+	if cmd, err = spec.Command(); err != nil {
+		t.Fatalf("Command() error = %v", err)
+	}
+	if err := cmd.Run(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Run() with Timeout error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// TestSpawnTiming tests that the phases of spawning are recorded in order.
+func TestSpawnTiming(t *testing.T) {
+	cmd := Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	tm := cmd.Timing()
+	phases := []time.Time{tm.LookPathStart, tm.LookPathEnd, tm.Start, tm.Marshaled, tm.Spawned, tm.Waited}
+	for i, p := range phases {
+		if p.IsZero() {
+			t.Fatalf("phase %d of %+v is not recorded", i, tm)
+		}
+		if i > 0 && p.Before(phases[i-1]) {
+			t.Errorf("phase %d of %+v is before the one preceding it", i, tm)
+		}
+	}
+	if tm.LookPath() < 0 || tm.Setup() < 0 || tm.Spawn() < 0 {
+		t.Errorf("durations of %+v are negative", tm)
+	}
+
+	if tm := (&Cmd{Path: "/bin/true"}).Timing(); !tm.LookPathStart.IsZero() {
+		t.Errorf("Timing() of a Cmd not made by Command = %+v, want no lookup", tm)
+	}
+}
+
+// TestBeforeResume tests that BeforeResume runs before any of the
+// command's code, and that its failure kills the command.
+func TestBeforeResume(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "ran")
+	cmd := Command("sh", "-c", `: > "$0"`, marker)
+	var hookPid int
+	cmd.BeforeResume = func(pid int) error {
+		hookPid = pid
+		time.Sleep(50 * time.Millisecond)
+		if _, err := os.Stat(marker); err == nil {
+			t.Error("command ran before BeforeResume returned")
+		}
+		return nil
+	}
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if hookPid != cmd.Process.Pid {
+		t.Errorf("BeforeResume called with pid %d, want %d", hookPid, cmd.Process.Pid)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("command did not run: %v", err)
+	}
+
+	os.Remove(marker)
+	hookErr := errors.New("no thanks")
+	cmd = Command("sh", "-c", `: > "$0"`, marker)
+	cmd.BeforeResume = func(int) error { return hookErr }
+	if err := cmd.Start(); err != hookErr {
+		t.Errorf("Start() error = %v, want %v", err, hookErr)
+	}
+	if ps := cmd.ProcessState; ps == nil || ps.Signal() != syscall.SIGKILL {
+		t.Errorf("ProcessState = %v, want killed", ps)
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("command ran although BeforeResume failed")
+	}
+}
+
+// TestGroup tests that a failing command of a Group tears down the others
+// and that Wait reports only the failure.
+func TestGroup(t *testing.T) {
+	g, ctx := NewGroup(context.Background())
+	g.Command("true")
+	g.Command("sh", "-c", "exit 3")
+	sleeper := g.Command("sleep", "10")
+	start := time.Now()
+	err := g.Wait()
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Wait() took %v, want the sleeper torn down", elapsed)
+	}
+	var ee *ExitError
+	if !errors.As(err, &ee) || ee.ExitCode() != 3 {
+		t.Errorf("Wait() error = %v, want exit status 3", err)
+	}
+	if strings.Contains(err.Error(), "sleep") {
+		t.Errorf("Wait() error = %v, want the torn down sleeper left out", err)
+	}
+	if sleeper.ProcessState == nil || sleeper.ProcessState.Success() {
+		t.Errorf("sleeper ProcessState = %v, want killed", sleeper.ProcessState)
+	}
+	if ctx.Err() == nil {
+		t.Error("group context not canceled after Wait")
+	}
+
+	g, _ = NewGroup(context.Background())
+	g.Command("true")
+	g.Command("echo", "ok")
+	if err := g.Wait(); err != nil {
+		t.Errorf("Wait() error = %v, want nil", err)
+	}
+
+	g, _ = NewGroup(context.Background())
+	g.Command("/nonexistent/command")
+	sleeper = g.Command("sleep", "10")
+	if err := g.Start(); err == nil {
+		t.Error("Start() with a missing command succeeded")
+	}
+	if err := g.Wait(); err == nil {
+		t.Error("Wait() after a failed Start succeeded")
+	}
+	if sleeper.Process != nil {
+		t.Error("command after the failed one was started")
+	}
+}
+
+// TestRotatingWriter tests that a RotatingWriter rotates a log, keeps
+// only MaxFiles old logs and compresses them if asked, and that it can
+// take a command's output.
+func TestRotatingWriter(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "out.log")
+		w, err := NewRotatingWriter(path, RotateOptions{MaxSize: 10, MaxFiles: 2, Compress: compress})
+		if err != nil {
+			t.Fatalf("NewRotatingWriter() error = %v", err)
+		}
+		for i := 1; i <= 4; i++ {
+			fmt.Fprintf(w, "line%d\n", i)
+		}
+		cmd := Command("echo", "line5")
+		cmd.Stdout = w
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("Run() error = %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close() error = %v", err)
+		}
+
+		read := func(name string) string {
+			b, err := os.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !compress || name == path {
+				return string(b)
+			}
+			zr, err := gzip.NewReader(bytes.NewReader(b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err = io.ReadAll(zr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return string(b)
+		}
+		suffix := ""
+		if compress {
+			suffix = ".gz"
+		}
+		for name, want := range map[string]string{
+			path:                 "line5\n",
+			path + ".1" + suffix: "line4\n",
+			path + ".2" + suffix: "line3\n",
+		} {
+			if got := read(name); got != want {
+				t.Errorf("compress=%v: %s = %q, want %q", compress, filepath.Base(name), got, want)
+			}
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) != 3 {
+			t.Errorf("compress=%v: %d files, want the log and 2 rotated ones", compress, len(entries))
+		}
+	}
+}
+
+// TestRotatingWriterFailedRotate tests that a RotatingWriter whose
+// rotation fails goes on writing to its log.
+func TestRotatingWriterFailedRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.log")
+	w, err := NewRotatingWriter(path, RotateOptions{MaxSize: 100, MaxFiles: 1})
+	if err != nil {
+		t.Fatalf("NewRotatingWriter() error = %v", err)
+	}
+	defer w.Close()
+	// A directory that cannot be removed is in the way of the rotated log.
+	if err := os.MkdirAll(filepath.Join(path+".1", "busy"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(w, "before")
+	if err := w.Rotate(); err == nil {
+		t.Fatal("Rotate() error = nil, want the rename error")
+	}
+	if _, err := fmt.Fprintln(w, "after"); err != nil {
+		t.Fatalf("Write() after a failed Rotate error = %v", err)
+	}
+	if b, _ := os.ReadFile(path); string(b) != "before\nafter\n" {
+		t.Errorf("log = %q, want both lines", b)
+	}
+}
+
+// TestLineCallbacks tests that OnStdoutLine and OnStderrLine see each line
+// of output, including an unterminated last one, alongside Stdout.
+func TestLineCallbacks(t *testing.T) {
+	var stdoutLines, stderrLines []string
+	var stdout bytes.Buffer
+	cmd := Command("sh", "-c", `printf 'a\nb\r\n\nc'; printf 'e1\ne2\n' >&2`)
+	cmd.Stdout = &stdout
+	cmd.OnStdoutLine = func(line string) { stdoutLines = append(stdoutLines, line) }
+	cmd.OnStderrLine = func(line string) { stderrLines = append(stderrLines, line) }
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if want := []string{"a", "b", "", "c"}; !slices.Equal(stdoutLines, want) {
+		t.Errorf("stdout lines = %q, want %q", stdoutLines, want)
+	}
+	if want := []string{"e1", "e2"}; !slices.Equal(stderrLines, want) {
+		t.Errorf("stderr lines = %q, want %q", stderrLines, want)
+	}
+	if got, want := stdout.String(), "a\nb\r\n\nc"; got != want {
+		t.Errorf("Stdout = %q, want %q", got, want)
+	}
+	if cmd.Stdout != &stdout || cmd.Stderr != nil {
+		t.Errorf("Stdout and Stderr were not restored after Start")
+	}
+
+	cmd = Command("true")
+	cmd.StdoutPath = filepath.Join(t.TempDir(), "out")
+	cmd.OnStdoutLine = func(string) {}
+	if err := cmd.Run(); err == nil {
+		t.Errorf("Run() with OnStdoutLine and StdoutPath succeeded")
+	}
+
+	// With Stdout and Stderr the same writer, the combined output is
+	// written to it by one goroutine and each line passed once.
+	var lines []string
+	cmd = Command("sh", "-c", `i=0; while [ $i -lt 200 ]; do echo out; echo err >&2; i=$((i+1)); done`)
+	cmd.OnStdoutLine = func(line string) { lines = append(lines, line) }
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("CombinedOutput() error = %v", err)
+	}
+	if len(lines) != 400 || strings.Count(string(out), "\n") != 400 {
+		t.Errorf("CombinedOutput() with OnStdoutLine: %d lines passed, output %d lines; want 400", len(lines), strings.Count(string(out), "\n"))
+	}
+}
+
+// TestOutputContext tests that OutputContext and CombinedOutputContext
+// return the output captured before the context expired along with the
+// error.
+func TestOutputContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	cmd := Command("sh", "-c", "echo before; echo oops >&2; exec sleep 10")
+	out, err := cmd.OutputContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("OutputContext() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if string(out) != "before\n" {
+		t.Errorf("OutputContext() = %q, want %q", out, "before\n")
+	}
+	var ee *ExitError
+	if !errors.As(err, &ee) || string(ee.Stderr) != "oops\n" {
+		t.Errorf("ExitError.Stderr = %q, want %q", ee.Stderr, "oops\n")
+	}
+
+	// The command's own context still applies.
+	own, ownCancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer ownCancel()
+	cmd = CommandContext(own, "sh", "-c", "echo out; echo err >&2; exec sleep 10")
+	out, err = cmd.CombinedOutputContext(context.Background())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("CombinedOutputContext() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if string(out) != "out\nerr\n" {
+		t.Errorf("CombinedOutputContext() = %q, want %q", out, "out\nerr\n")
+	}
+
+	// And so does the one passed in, alongside the command's own.
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel2()
+	cmd = CommandContext(context.Background(), "sh", "-c", "echo hi; exec sleep 10")
+	out, err = cmd.CombinedOutputContext(ctx2)
+	if !errors.Is(err, context.DeadlineExceeded) || string(out) != "hi\n" {
+		t.Errorf("CombinedOutputContext() = %q, %v, want %q, %v", out, err, "hi\n", context.DeadlineExceeded)
+	}
+}
+
+// TestDotPolicy tests that a command found through PATH relative to the
+// current directory is rejected, allowed or not even reported according
+// to the DotPolicy.
+func TestDotPolicy(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "prog"), []byte("#!/bin/sh\necho ran\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(dir)
+	t.Setenv("PATH", ".")
+
+	if lp, err := LookPath("prog"); lp != "prog" || !errors.Is(err, ErrDot) {
+		t.Errorf("LookPath() = %q, %v, want %q, %v", lp, err, "prog", ErrDot)
+	}
+	if _, err := Command("prog").Output(); !errors.Is(err, ErrDot) {
+		t.Errorf("Output() error = %v, want %v", err, ErrDot)
+	}
+	cmd := Command("prog")
+	cmd.DotPolicy = AllowDot
+	if out, err := cmd.Output(); err != nil || string(out) != "ran\n" {
+		t.Errorf("Output() with AllowDot = %q, %v, want %q", out, err, "ran\n")
+	}
+
+	prev := SetDotPolicy(LegacyImplicitDot)
+	defer SetDotPolicy(prev)
+	if lp, err := LookPath("prog"); lp != "prog" || err != nil {
+		t.Errorf("LookPath() with LegacyImplicitDot = %q, %v, want %q, nil", lp, err, "prog")
+	}
+	if out, err := Command("prog").Output(); err != nil || string(out) != "ran\n" {
+		t.Errorf("Output() with LegacyImplicitDot = %q, %v, want %q", out, err, "ran\n")
+	}
+	cmd = Command("prog")
+	cmd.DotPolicy = RejectDot
+	SetDotPolicy(RejectDot)
+	if _, err := cmd.Output(); !errors.Is(err, ErrDot) {
+		t.Errorf("Output() with RejectDot = %v, want %v", err, ErrDot)
+	}
+}
+
+// TestPathResolver tests that a PathResolver searches its own path,
+// tries PATHEXT-style extensions, and is used by Command once set.
+func TestPathResolver(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"tool.exe", "both", "both.bat"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := PathResolver{Path: dir, PathExt: ".COM;.EXE;bat"}
+	for _, tt := range []struct {
+		file, want string
+	}{
+		{"tool", filepath.Join(dir, "tool.exe")},
+		{"tool.exe", filepath.Join(dir, "tool.exe")},
+		{"both", filepath.Join(dir, "both")},
+		{filepath.Join(dir, "tool"), filepath.Join(dir, "tool.exe")},
+	} {
+		if got, err := r.LookPath(tt.file); got != tt.want || err != nil {
+			t.Errorf("LookPath(%q) = %q, %v, want %q, nil", tt.file, got, err, tt.want)
+		}
+	}
+	for _, file := range []string{"missing", "both.com.exe", "tool.bat"} {
+		if _, err := r.LookPath(file); !errors.Is(err, ErrNotFound) {
+			t.Errorf("LookPath(%q) error = %v, want %v", file, err, ErrNotFound)
+		}
+	}
+
+	prev := SetResolver(r)
+	defer SetResolver(prev)
+	if cmd := Command("tool"); cmd.Path != filepath.Join(dir, "tool.exe") || cmd.Args[0] != "tool" {
+		t.Errorf("Command() Path, Args[0] = %q, %q, want %q, %q", cmd.Path, cmd.Args[0], filepath.Join(dir, "tool.exe"), "tool")
+	}
+}
+
+// TestExpectedSHA256 tests that a command whose executable does not have
+// the expected digest, or fails Verify, is not started.
+func TestExpectedSHA256(t *testing.T) {
+	script := []byte("#!/bin/sh\necho ok\n")
+	path := filepath.Join(t.TempDir(), "tool")
+	if err := os.WriteFile(path, script, 0755); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(script)
+	good := fmt.Sprintf("%X", sum)
+
+	cmd := Command(path)
+	cmd.ExpectedSHA256 = good
+	var verified string
+	cmd.Verify = func(p string) error {
+		verified = p
+		return nil
+	}
+	if out, err := cmd.Output(); err != nil || string(out) != "ok\n" {
+		t.Fatalf("Output() = %q, %v, want %q", out, err, "ok\n")
+	}
+	if verified != path {
+		t.Errorf("Verify called with %q, want %q", verified, path)
+	}
+
+	cmd = Command(path)
+	cmd.ExpectedSHA256 = strings.Repeat("0", 64)
+	var ce *ChecksumError
+	if err := cmd.Run(); !errors.As(err, &ce) || ce.Got != strings.ToLower(good) {
+		t.Errorf("Run() error = %v, want a *ChecksumError", err)
+	}
+	if cmd.Process != nil {
+		t.Errorf("command with the wrong digest was started")
+	}
+
+	errBad := errors.New("not allowed")
+	cmd = Command(path)
+	cmd.Verify = func(string) error { return errBad }
+	if err := cmd.Run(); !errors.Is(err, errBad) {
+		t.Errorf("Run() error = %v, want %v", err, errBad)
+	}
+}
+
+// TestCodeSignature tests that CodeSignature admits a validly signed
+// system binary and rejects one signed by another team on darwin, and
+// fails elsewhere.
+func TestCodeSignature(t *testing.T) {
+	cmd := Command("/bin/ls", "/")
+	cmd.CodeSignature = &CodeSignature{TeamID: `X" or true`}
+	if err := cmd.Run(); err == nil || cmd.Process != nil {
+		t.Errorf("Run() with a malformed Team ID error = %v, want an error", err)
+	}
+
+	cmd = Command("/bin/ls", "/")
+	cmd.CodeSignature = &CodeSignature{}
+	err := cmd.Run()
+	if runtime.GOOS != "darwin" {
+		if err == nil {
+			t.Errorf("Run() with CodeSignature succeeded on %s", runtime.GOOS)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	cmd = Command("/bin/ls", "/")
+	cmd.CodeSignature = &CodeSignature{TeamID: "ABCDE12345"}
+	var se *SignatureError
+	if err := cmd.Run(); !errors.As(err, &se) {
+		t.Errorf("Run() error = %v, want a *SignatureError", err)
+	}
+}
+
+// TestTranslocation tests that an executable outside any translocated app
+// bundle runs under every TranslocationPolicy, from where it is.
+func TestTranslocation(t *testing.T) {
+	for _, policy := range []TranslocationPolicy{TranslocationResolve, TranslocationReject, TranslocationAllow} {
+		cmd := Command("/bin/sh", "-c", "exit 0")
+		cmd.Translocation = policy
+		if err := cmd.Run(); err != nil {
+			t.Errorf("Run() with policy %d error = %v", policy, err)
+		}
+		if cmd.Path != "/bin/sh" {
+			t.Errorf("Path = %q after Run() with policy %d, want /bin/sh", cmd.Path, policy)
+		}
+	}
+
+	err := &TranslocatedError{
+		Path:     "/private/var/folders/x/T/AppTranslocation/1234/d/Tool.app/Contents/MacOS/tool",
+		Original: "/Users/me/Downloads/Tool.app/Contents/MacOS/tool",
+	}
+	if !strings.Contains(err.Error(), "originally /Users/me/Downloads/Tool.app") {
+		t.Errorf("TranslocatedError.Error() = %q, want it to name the original", err.Error())
+	}
+}
+
+// TestBackend tests that commands can be started with BackendOSExec on
+// any platform, and that posix_spawn is only offered on darwin.
+func TestBackend(t *testing.T) {
+	want := BackendOSExec
+	if runtime.GOOS == "darwin" && os.Getenv("SPAWNEXEC_BACKEND") == "" {
+		want = BackendPosixSpawn
+	}
+	if got := CurrentBackend(); got != want {
+		t.Errorf("CurrentBackend() = %v, want %v", got, want)
+	}
+	if _, err := SetBackend(BackendPosixSpawn); (err == nil) != (runtime.GOOS == "darwin") {
+		t.Errorf("SetBackend(%v) error = %v on %s", BackendPosixSpawn, err, runtime.GOOS)
+	}
+
+	prev, err := SetBackend(BackendOSExec)
+	if err != nil {
+		t.Fatalf("SetBackend(%v) error = %v", BackendOSExec, err)
+	}
+	defer SetBackend(prev)
+	cmd := Command("sh", "-c", "echo hello; echo oops >&2; exit 3")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	var ee *ExitError
+	if !errors.As(err, &ee) || ee.ExitCode() != 3 {
+		t.Errorf("Output() error = %v, want exit status 3", err)
+	}
+	if string(out) != "hello\n" || stderr.String() != "oops\n" {
+		t.Errorf("Output() = %q with stderr %q, want %q and %q", out, stderr.String(), "hello\n", "oops\n")
+	}
+}
+
+// TestBackendCapabilities tests that the capabilities reported for the
+// backends match the platform, and that a Cmd reports its backend.
+func TestBackendCapabilities(t *testing.T) {
+	caps := BackendOSExec.Capabilities()
+	if !caps.Chdir || !caps.Setsid || !caps.Pty || caps.Credentials || caps.DarwinAttr {
+		t.Errorf("BackendOSExec.Capabilities() = %+v", caps)
+	}
+	if caps.Cgroups != (runtime.GOOS == "linux") {
+		t.Errorf("BackendOSExec.Capabilities().Cgroups = %v on %s", caps.Cgroups, runtime.GOOS)
+	}
+	caps = BackendPosixSpawn.Capabilities()
+	if caps.DarwinAttr != (runtime.GOOS == "darwin") || (runtime.GOOS != "darwin" && caps != Capabilities{}) {
+		t.Errorf("BackendPosixSpawn.Capabilities() = %+v on %s", caps, runtime.GOOS)
+	}
+
+	cmd := Command("true")
+	if cmd.Backend() != CurrentBackend() {
+		t.Errorf("Backend() before Start = %v, want %v", cmd.Backend(), CurrentBackend())
+	}
+	prev, err := SetBackend(BackendOSExec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetBackend(prev)
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	SetBackend(prev)
+	if cmd.Backend() != BackendOSExec {
+		t.Errorf("Backend() after Run = %v, want %v", cmd.Backend(), BackendOSExec)
+	}
+}
+
+// TestSpawnAttr tests that the SpawnAttr hook sees the spawn attributes
+// before the process is spawned on darwin, and can stop it.
+func TestSpawnAttr(t *testing.T) {
+	if runtime.GOOS != "darwin" {
+		t.Skip("SpawnAttr is only used with posix_spawn on darwin")
+	}
+	var got unsafe.Pointer
+	cmd := Command("true")
+	cmd.DarwinAttr = &DarwinAttr{SpawnAttr: func(attr unsafe.Pointer) error {
+		got = attr
+		return nil
+	}}
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if got == nil {
+		t.Errorf("SpawnAttr was not called")
+	}
+
+	errHook := errors.New("refused")
+	cmd = Command("true")
+	cmd.DarwinAttr = &DarwinAttr{SpawnAttr: func(unsafe.Pointer) error { return errHook }}
+	if err := cmd.Run(); !errors.Is(err, errHook) || cmd.Process != nil {
+		t.Errorf("Run() error = %v, want %v before spawning", err, errHook)
+	}
+}
+
+// TestPreSpawnHook tests that registered hooks see every command in
+// order, can change it or stop it from being spawned, and can be
+// unregistered.
+func TestPreSpawnHook(t *testing.T) {
+	var seen []string
+	errDenied := errors.New("curl is not allowed")
+	unregister1 := RegisterPreSpawnHook(func(c *Cmd) error {
+		seen = append(seen, c.Args[0])
+		if filepath.Base(c.Path) == "curl" {
+			return errDenied
+		}
+		return nil
+	})
+	defer unregister1()
+	unregister2 := RegisterPreSpawnHook(func(c *Cmd) error {
+		c.Env = append(slices.DeleteFunc(c.Environ(), func(kv string) bool {
+			return strings.HasPrefix(kv, "SECRET=")
+		}), "SCRUBBED=1")
+		return nil
+	})
+
+	t.Setenv("SECRET", "hunter2")
+	out, err := Command("sh", "-c", `echo "$SECRET/$SCRUBBED"`).Output()
+	if err != nil || string(out) != "/1\n" {
+		t.Errorf("Output() = %q, %v, want %q", out, err, "/1\n")
+	}
+	cmd := Command("curl", "https://example.com/install.sh")
+	cmd.Path = "/usr/bin/curl"
+	if err := cmd.Run(); !errors.Is(err, errDenied) || cmd.Process != nil {
+		t.Errorf("Run() error = %v, want %v before spawning", err, errDenied)
+	}
+	if want := []string{"sh", "curl"}; !slices.Equal(seen, want) {
+		t.Errorf("hook saw %q, want %q", seen, want)
+	}
+
+	unregister2()
+	unregister1()
+	seen = nil
+	if out, err := Command("sh", "-c", `echo "$SECRET"`).Output(); err != nil || string(out) != "hunter2\n" {
+		t.Errorf("Output() after unregistering = %q, %v, want %q", out, err, "hunter2\n")
+	}
+	if len(seen) != 0 {
+		t.Errorf("unregistered hook saw %q", seen)
+	}
+}
+
+// TestLogger tests that the internals of running a command are logged at
+// debug level to its Logger, and not at all without one.
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	cmd := Command("sh", "-c", "echo hi")
+	cmd.Logger = slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	cmd.Stdout = new(strings.Builder)
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	log := buf.String()
+	for _, want := range []string{
+		"spawnexec: starting",
+		"spawnexec: spawned",
+		"pid=" + strconv.Itoa(cmd.Process.Pid),
+		"spawnexec: reaped",
+		`status="exit status 0"`,
+		"spawnexec: output copied",
+	} {
+		if !strings.Contains(log, want) {
+			t.Errorf("log lacks %q:\n%s", want, log)
+		}
+	}
+
+	buf.Reset()
+	cmd = Command("/nonexistent/tool")
+	cmd.Logger = slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	if err := cmd.Run(); err == nil {
+		t.Fatal("Run() of a nonexistent command succeeded")
+	}
+	if !strings.Contains(buf.String(), "spawnexec: spawn failed") {
+		t.Errorf("log lacks the spawn failure:\n%s", buf.String())
+	}
+
+	// Info level, as is usual, keeps the debug output out.
+	buf.Reset()
+	prev := SetLogger(slog.New(slog.NewTextHandler(&buf, nil)))
+	defer SetLogger(prev)
+	if err := Command("true").Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("logged at info level:\n%s", buf.String())
+	}
+}
+
+// TestSession tests driving an interactive command through a Session.
+func TestSession(t *testing.T) {
+	s, err := StartSession(Command("sh", "-c", `while read l; do echo "got $l"; done`), SessionOptions{})
+	if err != nil {
+		t.Fatalf("StartSession() error = %v", err)
+	}
+	if err := s.SendLine("one"); err != nil {
+		t.Fatalf("SendLine() error = %v", err)
+	}
+	if err := s.WaitIdle(100*time.Millisecond, 5*time.Second); err != nil {
+		t.Fatalf("WaitIdle() error = %v", err)
+	}
+	if got := string(s.TakeOutput()); got != "got one\n" {
+		t.Errorf("TakeOutput() = %q, want %q", got, "got one\n")
+	}
+	if got := s.Output(); len(got) != 0 {
+		t.Errorf("Output() after TakeOutput = %q, want empty", got)
+	}
+	s.SendLine("two")
+	if err := s.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+	if got := string(s.Output()); got != "got two\n" {
+		t.Errorf("Output() = %q, want %q", got, "got two\n")
+	}
+
+	// A command ignoring its closed input is signaled.
+	s, err = StartSession(Command("sleep", "60"), SessionOptions{CloseTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("StartSession() error = %v", err)
+	}
+	if err := s.Close(); err == nil {
+		t.Error("Close() of a command that was signaled succeeded")
+	}
+
+	if _, err := StartSession(&Cmd{Path: "/bin/true", Stdout: io.Discard}, SessionOptions{}); err == nil {
+		t.Error("StartSession() with Stdout set succeeded")
+	}
+
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		return
+	}
+	s, err = StartSession(Command("sh", "-c", `if [ -t 0 ]; then echo tty; fi; read l; echo "got $l"`), SessionOptions{PTY: true})
+	if err != nil {
+		t.Fatalf("StartSession() on a PTY error = %v", err)
+	}
+	s.SendLine("pty")
+	if err := s.Wait(); err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+	out := string(s.Output())
+	for _, want := range []string{"tty", "got pty"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Output() = %q, lacks %q", out, want)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("Close() after exit error = %v", err)
+	}
+}
+
+// TestExpect tests waiting for prompts with Expect and ExpectBatch.
+func TestExpect(t *testing.T) {
+	s, err := StartSession(Command("sh", "-c", `printf 'name? '; read n; printf 'age of %s? ' "$n"; read a; echo "$n is $a"`), SessionOptions{})
+	if err != nil {
+		t.Fatalf("StartSession() error = %v", err)
+	}
+	defer s.Close()
+	m, err := s.ExpectBatch([]ExpectStep{
+		{Expect: regexp.MustCompile(`name\? $`), Send: "ann\n"},
+		{Expect: regexp.MustCompile(`age of (\w+)\? $`), Send: "42\n"},
+		{Expect: regexp.MustCompile(`(\w+) is (\d+)`)},
+	}, 5*time.Second)
+	if err != nil {
+		t.Fatalf("ExpectBatch() error = %v", err)
+	}
+	if len(m) != 3 || m[1][1] != "ann" || m[2][2] != "42" {
+		t.Errorf("ExpectBatch() = %q", m)
+	}
+	if got := string(s.Output()); got != "\n" {
+		t.Errorf("Output() after matching = %q, want %q", got, "\n")
+	}
+
+	var expectErr *ExpectError
+	if err := s.ExpectString("more", 5*time.Second); !errors.As(err, &expectErr) || !errors.Is(err, ErrSessionExited) {
+		t.Errorf("ExpectString() after exit error = %v, want ErrSessionExited", err)
+	}
+
+	s, err = StartSession(Command("sleep", "60"), SessionOptions{CloseTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("StartSession() error = %v", err)
+	}
+	defer s.Close()
+	if err := s.ExpectString("never", 50*time.Millisecond); !errors.Is(err, ErrSessionTimeout) {
+		t.Errorf("ExpectString() error = %v, want ErrSessionTimeout", err)
+	}
+}
+
+// TestWorkspace tests the lifecycle of a command's private temporary
+// directory.
+func TestWorkspace(t *testing.T) {
+	parent := t.TempDir()
+	ws := &Workspace{Parent: parent}
+	cmd := Command("sh", "-c", `pwd; echo "$TMPDIR"; touch "$TMPDIR/scratch"`)
+	cmd.Workspace = ws
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+	if ws.Path == "" || filepath.Dir(ws.Path) != parent {
+		t.Fatalf("Workspace.Path = %q, want a directory in %q", ws.Path, parent)
+	}
+	real, _ := filepath.EvalSymlinks(parent)
+	want := filepath.Join(real, filepath.Base(ws.Path)) + "\n" + ws.Path + "\n"
+	if string(out) != want {
+		t.Errorf("Output() = %q, want %q", out, want)
+	}
+	if _, err := os.Stat(ws.Path); !os.IsNotExist(err) {
+		t.Errorf("workspace left behind after Wait: %v", err)
+	}
+
+	// A killed command's workspace is removed too, unless it is to be
+	// preserved on failure.
+	for _, preserve := range []bool{false, true} {
+		ws := &Workspace{Parent: parent, PreserveOnFailure: preserve}
+		cmd := Command("sleep", "60")
+		cmd.Workspace = ws
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("Start() error = %v", err)
+		}
+		cmd.Process.Kill()
+		if err := cmd.Wait(); err == nil {
+			t.Fatal("Wait() of a killed command succeeded")
+		}
+		if _, err := os.Stat(ws.Path); (err == nil) != preserve {
+			t.Errorf("PreserveOnFailure = %v: workspace stat error = %v", preserve, err)
+		}
+	}
+
+	// So is one whose command fails to start.
+	ws = &Workspace{Parent: parent}
+	cmd = Command("/nonexistent/tool")
+	cmd.Workspace = ws
+	if err := cmd.Start(); err == nil {
+		t.Fatal("Start() of a nonexistent command succeeded")
+	}
+	if ws.Path == "" {
+		t.Error("no workspace created for a command that failed to start")
+	} else if _, err := os.Stat(ws.Path); !os.IsNotExist(err) {
+		t.Errorf("workspace left behind after Start failed: %v", err)
+	}
+}
+
+// TestGroupUsage tests summing the resource usage of a group's commands.
+func TestGroupUsage(t *testing.T) {
+	g, _ := NewGroup(context.Background())
+	for range 3 {
+		g.Command("sh", "-c", "i=0; while [ $i -lt 20000 ]; do i=$((i+1)); done")
+	}
+	if u := g.Usage(); u.Processes != 0 {
+		t.Errorf("Usage() before Wait = %+v, want nothing counted", u)
+	}
+	if err := g.Wait(); err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+	u := g.Usage()
+	if u.Processes != 3 {
+		t.Errorf("Usage().Processes = %d, want 3", u.Processes)
+	}
+	if u.UserTime+u.SystemTime <= 0 {
+		t.Errorf("Usage() CPU time = %v + %v, want some", u.UserTime, u.SystemTime)
+	}
+	// Even a shell takes more than a hundred kilobytes.
+	if u.MaxRSS < 100<<10 {
+		t.Errorf("Usage().MaxRSS = %d, want at least 100 KiB", u.MaxRSS)
+	}
+
+	var sum Usage
+	for _, cmd := range g.cmds {
+		sum.Add(cmd.ProcessState)
+	}
+	if sum != u {
+		t.Errorf("Usage() = %+v, want the sum %+v", u, sum)
+	}
+}
+
+// TestIOStats tests counting the bytes copied on each standard stream.
+func TestIOStats(t *testing.T) {
+	var stdout, stderr strings.Builder
+	cmd := Command("sh", "-c", "cat; echo oops >&2")
+	cmd.Stdin = strings.NewReader("hello, world\n")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	want := IOStats{Stdin: 13, Stdout: 13, Stderr: 5}
+	if got := cmd.IOStats(); got != want {
+		t.Errorf("IOStats() = %+v, want %+v", got, want)
+	}
+
+	// Output and CombinedOutput go through the shared copier.
+	cmd = Command("sh", "-c", "echo out; echo err >&2")
+	if _, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("CombinedOutput() error = %v", err)
+	}
+	if got := cmd.IOStats(); got != (IOStats{Stdout: 8}) {
+		t.Errorf("IOStats() after CombinedOutput = %+v, want 8 bytes of Stdout", got)
+	}
+
+	// A command that reads only part of its input.
+	cmd = Command("head", "-c", "1")
+	cmd.Stdin = strings.NewReader(strings.Repeat("x", 1<<20))
+	cmd.Stdout = io.Discard
+	cmd.Run()
+	if got := cmd.IOStats(); got.Stdin >= 1<<20 || got.Stdout != 1 {
+		t.Errorf("IOStats() of a partial reader = %+v, want less than all of Stdin", got)
+	}
+
+	// Files are not copied, so not counted.
+	f, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	cmd = Command("echo", "direct")
+	cmd.Stdout = f
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if got := cmd.IOStats(); got != (IOStats{}) {
+		t.Errorf("IOStats() with a file = %+v, want nothing counted", got)
+	}
+}
+
+// TestStartTimeout tests giving up on a Start that takes too long.
+func TestStartTimeout(t *testing.T) {
+	cmd := Command("true")
+	cmd.StartTimeout = 10 * time.Second
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Run() with a StartTimeout error = %v", err)
+	}
+
+	// A Verify that hangs stands in for a hung filesystem.
+	release := make(chan struct{})
+	verified := make(chan struct{})
+	cmd = Command("sleep", "60")
+	cmd.StartTimeout = 50 * time.Millisecond
+	cmd.Verify = func(string) error {
+		defer close(verified)
+		<-release
+		return nil
+	}
+	start := time.Now()
+	err := cmd.Start()
+	var timeoutErr *StartTimeoutError
+	if !errors.As(err, &timeoutErr) || timeoutErr.Timeout != cmd.StartTimeout {
+		t.Fatalf("Start() error = %v, want a *StartTimeoutError", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Start() error = %v, want it to match context.DeadlineExceeded", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Start() took %v despite its StartTimeout", d)
+	}
+	close(release)
+	<-verified
+	// Wait waits for the abandoned spawn, whose process is killed.
+	if err := cmd.Wait(); err == nil {
+		t.Error("Wait() after StartTimeout error = nil, want the killed command's error")
+	}
+
+	// Reset waits for it too, and the command can then be run again.
+	release = make(chan struct{})
+	cmd = Command("true")
+	cmd.StartTimeout = 50 * time.Millisecond
+	cmd.Verify = func(string) error {
+		<-release
+		return nil
+	}
+	if err := cmd.Start(); !errors.As(err, &timeoutErr) {
+		t.Fatalf("Start() error = %v, want a *StartTimeoutError", err)
+	}
+	close(release)
+	if err := cmd.Reset(); err != nil {
+		t.Fatalf("Reset() after StartTimeout error = %v", err)
+	}
+	if err := cmd.Run(); err != nil {
+		t.Errorf("Run() after StartTimeout and Reset error = %v", err)
+	}
+}
+
+// TestEnvOverrides tests adjusting the inherited environment.
+func TestEnvOverrides(t *testing.T) {
+	t.Setenv("SPAWNEXEC_KEEP", "kept")
+	t.Setenv("SPAWNEXEC_DROP", "dropped")
+	t.Setenv("SPAWNEXEC_CHANGE", "old")
+
+	cmd := Command("sh", "-c", `echo "$SPAWNEXEC_KEEP ${SPAWNEXEC_DROP-unset} $SPAWNEXEC_CHANGE $SPAWNEXEC_NEW"`)
+	cmd.EnvOverrides = map[string]string{"SPAWNEXEC_CHANGE": "new", "SPAWNEXEC_NEW": "added"}
+	cmd.EnvRemove = []string{"SPAWNEXEC_DROP"}
+	env := cmd.Environ()
+	if !slices.Contains(env, "SPAWNEXEC_CHANGE=new") || slices.Contains(env, "SPAWNEXEC_CHANGE=old") {
+		t.Errorf("Environ() = %q, want SPAWNEXEC_CHANGE replaced", env)
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+	if got, want := string(out), "kept unset new added\n"; got != want {
+		t.Errorf("Output() = %q, want %q", got, want)
+	}
+
+	// Overrides apply on top of an explicit Env too.
+	cmd = Command("sh", "-c", `echo "$A $B"`)
+	cmd.Env = []string{"A=1", "B=2"}
+	cmd.EnvOverrides = map[string]string{"B": "3"}
+	if got := cmd.StringEnv(EnvShown); !strings.HasPrefix(got, "A=1 B=3 ") {
+		t.Errorf("StringEnv() = %q, want the overridden environment", got)
+	}
+	if out, err := cmd.Output(); err != nil || string(out) != "1 3\n" {
+		t.Errorf("Output() = %q, %v, want %q", out, err, "1 3\n")
+	}
+}
+
+// TestIOPolicy tests starting commands with a disk I/O policy and a QoS
+// clamp.
+func TestIOPolicy(t *testing.T) {
+	if runtime.GOOS != "darwin" {
+		t.Skip("I/O policies and QoS clamps are only supported on darwin")
+	}
+	cmd := Command("sh", "-c", "echo throttled")
+	cmd.DarwinAttr = &DarwinAttr{IOPolicy: IOPolicyThrottle, QoSClamp: QoSClampBackground}
+	out, err := cmd.Output()
+	if err != nil || string(out) != "throttled\n" {
+		t.Errorf("Output() = %q, %v, want %q", out, err, "throttled\n")
+	}
+
+	cmd = Command("true")
+	cmd.DarwinAttr = &DarwinAttr{IOPolicy: 42}
+	if err := cmd.Run(); err == nil {
+		t.Error("Run() with an unknown IOPolicy succeeded")
+	}
+}
+
+// TestMitigations tests opting a command into CPU security mitigations.
+func TestMitigations(t *testing.T) {
+	if got := (Mitigations{NoSMT: true, TECS: true}).flags(); got != 0x6 {
+		t.Errorf("flags() = %#x, want 0x6", got)
+	}
+	if runtime.GOOS != "darwin" {
+		t.Skip("mitigations are only set with posix_spawn on darwin")
+	}
+	cmd := Command("true")
+	cmd.DarwinAttr = &DarwinAttr{Mitigations: Mitigations{NoSMT: true}}
+	if err := cmd.Run(); err != nil && !errors.Is(err, syscall.ENOTSUP) {
+		t.Errorf("Run() error = %v", err)
+	}
+}
+
+// TestUserNamespace tests running a command as root of its own user
+// namespace.
+func TestUserNamespace(t *testing.T) {
+	if !CurrentBackend().Capabilities().UserNamespaces {
+		t.Skip("user namespaces are not supported here")
+	}
+	cmd := Command("id", "-u")
+	cmd.SysProcAttr = &SysProcAttr{
+		UidMappings: []SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings: []SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+	}
+	out, err := cmd.Output()
+	if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOSPC) {
+		t.Skipf("user namespaces are unavailable: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+	if got := strings.TrimSpace(string(out)); got != "0" {
+		t.Errorf("id -u in the namespace = %q, want 0", got)
+	}
+}
+
+// TestChroot tests changing the root directory of a command.
+func TestChroot(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Chroot is only supported on Linux")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("changing the root directory needs root")
+	}
+	cmd := Command("/bin/true")
+	cmd.SysProcAttr = &SysProcAttr{Chroot: "/"}
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Run() with Chroot / error = %v", err)
+	}
+
+	// The program is not found in an empty root.
+	root := t.TempDir()
+	cmd = Command("/bin/true")
+	cmd.SysProcAttr = &SysProcAttr{Chroot: root}
+	if err := cmd.Run(); err == nil {
+		t.Error("Run() in a root without the program succeeded")
+	}
+}
+
+// TestBackground tests running a command as a background task.
+func TestBackground(t *testing.T) {
+	cmd := Command("sh", "-c", "sleep 0.2; echo ok")
+	cmd.Background = true
+	out, err := cmd.Output()
+	if err != nil || string(out) != "ok\n" {
+		t.Fatalf("Output() = %q, %v, want %q", out, err, "ok\n")
+	}
+	if runtime.GOOS != "linux" {
+		return
+	}
+	// The shell reads its own nice value, field 19 of its stat, once
+	// Start has set it.
+	cmd = Command("sh", "-c", `sleep 0.2; read -r stat < /proc/$$/stat; set -- ${stat#*) }; shift 16; echo "$1"`)
+	cmd.Background = true
+	out, err = cmd.Output()
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+	if got := strings.TrimSpace(string(out)); got != "19" {
+		t.Errorf("nice value = %q, want 19", got)
+	}
+}
+
+// TestCoreDumps tests that CoreDumps sets the command's RLIMIT_CORE
+// without changing the caller's, and that CoreFile finds the core.
+func TestCoreDumps(t *testing.T) {
+	var before unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_CORE, &before); err != nil {
+		t.Fatal(err)
+	}
+	limit := func(cd CoreDumps, arg string) string {
+		t.Helper()
+		cmd := Command("sh", "-c", "ulimit "+arg)
+		cmd.CoreDumps = cd
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("CoreDumps %d: %v", cd, err)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	if got := limit(CoreDumpsDisabled, "-c"); got != "0" {
+		t.Errorf("CoreDumpsDisabled: soft limit %q, want 0", got)
+	}
+	if before.Max == 0 {
+		cmd := Command("true")
+		cmd.CoreDumps = CoreDumpsEnabled
+		if err := cmd.Run(); err == nil {
+			t.Error("CoreDumpsEnabled with a hard limit of 0 succeeded")
+		}
+		t.Skip("RLIMIT_CORE hard limit is 0")
+	}
+	if got, want := limit(CoreDumpsEnabled, "-c"), limit(CoreDumpsInherit, "-Hc"); got != want {
+		t.Errorf("CoreDumpsEnabled: soft limit %q, want the hard limit %q", got, want)
+	}
+	var after unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_CORE, &after); err != nil {
+		t.Fatal(err)
+	}
+	if after != before {
+		t.Errorf("caller's RLIMIT_CORE changed from %+v to %+v", before, after)
+	}
+
+	cmd := Command("sh", "-c", "kill -SEGV $$")
+	cmd.Dir = t.TempDir()
+	cmd.CoreDumps = CoreDumpsEnabled
+	if err := cmd.Run(); err == nil {
+		t.Fatal("crashing command succeeded")
+	}
+	if !cmd.ProcessState.CoreDumped() {
+		t.Log("no core dumped; the system may not allow it")
+		return
+	}
+	path, err := cmd.CoreFile()
+	if err != nil {
+		t.Logf("CoreFile: %v", err)
+		return
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("CoreFile %q: %v", path, err)
+	}
+	if _, err := Command("true").CoreFile(); err == nil {
+		t.Error("CoreFile before Wait succeeded")
+	}
+}
+
+// TestExpandCorePattern tests the expansion of core file patterns.
+func TestExpandCorePattern(t *testing.T) {
+	spec := func(verb byte) (string, bool) {
+		switch verb {
+		case 'p':
+			return "42", true
+		case 'e':
+			return "a*b", true
+		}
+		return "", false
+	}
+	for _, tt := range []struct {
+		pattern, name string
+		glob          bool
+	}{
+		{"core", "core", false},
+		{"core.%p", "core.42", false},
+		{"/cores/%e-%%-%p", "/cores/a*b-%-42", false},
+		{"core.%e.%t", `core.a\*b.*`, true},
+		{"core%", "core%", false},
+	} {
+		name, glob := expandCorePattern(tt.pattern, spec)
+		if name != tt.name || glob != tt.glob {
+			t.Errorf("expandCorePattern(%q) = %q, %v; want %q, %v", tt.pattern, name, glob, tt.name, tt.glob)
+		}
+	}
+}
+
+// TestRegistry tests that EnableRegistry tracks started commands until
+// they are waited for.
+func TestRegistry(t *testing.T) {
+	EnableRegistry()
+	cmd := Command("sleep", "10", "secret")
+	cmd.RedactArgs = RedactIndices(2)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	find := func() *CommandInfo {
+		for _, info := range RegisteredCommands() {
+			if info.Cmd == cmd {
+				return &info
+			}
+		}
+		return nil
+	}
+	info := find()
+	if info == nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		t.Fatal("started command is not registered")
+	}
+	wantArgs := []string{"sleep", "10", "[redacted]"}
+	if info.Pid != cmd.Process.Pid || !slices.Equal(info.Args, wantArgs) || info.State != CommandRunning || info.Start.IsZero() {
+		t.Errorf("registered %+v", *info)
+	}
+	var buf bytes.Buffer
+	if err := DumpRegistry(&buf); err != nil {
+		t.Fatal(err)
+	}
+	dump := buf.String()
+	if !strings.Contains(dump, strconv.Itoa(cmd.Process.Pid)) || !strings.Contains(dump, "running") || strings.Contains(dump, "secret") {
+		t.Errorf("DumpRegistry:\n%s", dump)
+	}
+
+	cmd.Process.Kill()
+	cmd.Wait()
+	if find() != nil {
+		t.Error("command is still registered after Wait")
+	}
+}
+
+// TestSingleInstance tests that SingleInstance refuses to start a second
+// instance of a command while the first is running.
+func TestSingleInstance(t *testing.T) {
+	lock := filepath.Join(t.TempDir(), "job.lock")
+	first := Command("sleep", "10")
+	first.SingleInstance = lock
+	if err := first.Start(); err != nil {
+		t.Fatal(err)
+	}
+	second := Command("true")
+	second.SingleInstance = lock
+	if err := second.Run(); !errors.Is(err, ErrAlreadyRunning) {
+		t.Errorf("second instance: got %v, want ErrAlreadyRunning", err)
+	}
+	// Starting the first again fails without releasing its lock.
+	if err := first.Start(); err == nil || errors.Is(err, ErrAlreadyRunning) {
+		t.Errorf("restarting the first instance: got %v, want already started", err)
+	}
+	if err := second.Run(); !errors.Is(err, ErrAlreadyRunning) {
+		t.Errorf("after restarting the first instance: got %v, want ErrAlreadyRunning", err)
+	}
+	first.Process.Kill()
+	first.Wait()
+	third := Command("true")
+	third.SingleInstance = lock
+	if err := third.Run(); err != nil {
+		t.Errorf("after the first instance exited: %v", err)
+	}
+
+	// A failed start releases the lock.
+	missing := Command("/nonexistent/spawnexec-test")
+	missing.SingleInstance = lock
+	if err := missing.Run(); err == nil || errors.Is(err, ErrAlreadyRunning) {
+		t.Errorf("missing command: got %v", err)
+	}
+	again := Command("true")
+	again.SingleInstance = lock
+	if err := again.Run(); err != nil {
+		t.Errorf("after a failed start: %v", err)
+	}
+}
+
+// TestClone tests that Clone copies a command's configuration but not its
+// run state.
+func TestClone(t *testing.T) {
+	template := Command("sh", "-c", `echo "$GREETING $1"`, "sh", "world")
+	template.EnvOverrides = map[string]string{"GREETING": "hello"}
+	template.SysProcAttr = &SysProcAttr{Setpgid: true}
+
+	for range 2 {
+		cmd := template.Clone()
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(out); got != "hello world\n" {
+			t.Errorf("output %q, want %q", got, "hello world\n")
+		}
+	}
+	if template.Process != nil || template.ProcessState != nil {
+		t.Error("running a clone changed the template's run state")
+	}
+
+	clone := template.Clone()
+	clone.Args[4] = "there"
+	clone.EnvOverrides["GREETING"] = "hi"
+	clone.SysProcAttr.Setpgid = false
+	if template.Args[4] != "world" || template.EnvOverrides["GREETING"] != "hello" || !template.SysProcAttr.Setpgid {
+		t.Error("changing a clone changed the template")
+	}
+
+	if err := template.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := template.Output(); err == nil {
+		t.Error("second run of the template succeeded")
+	}
+	if clone := template.Clone(); clone.Process != nil || clone.ProcessState != nil || clone.Stdout != nil {
+		t.Error("clone of a finished command has run state")
+	}
+}
+
+// TestReset tests that Reset lets a finished command be run again.
+func TestReset(t *testing.T) {
+	cmd := Command("sh", "-c", `echo "$PWD"`)
+	cmd.Workspace = &Workspace{}
+	var dirs []string
+	for range 2 {
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dirs = append(dirs, strings.TrimSpace(string(out)))
+		if err := cmd.Reset(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dirs[0] == dirs[1] {
+		t.Errorf("both runs used workspace %q", dirs[0])
+	}
+	if cmd.Process != nil || cmd.ProcessState != nil || cmd.Stdout != nil || cmd.Dir != "" {
+		t.Errorf("Reset left Process %v, ProcessState %v, Stdout %v, Dir %q", cmd.Process, cmd.ProcessState, cmd.Stdout, cmd.Dir)
+	}
+
+	cmd = Command("cat")
+	for _, want := range []string{"one", "two"} {
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if err := cmd.Reset(); err == nil {
+			t.Error("Reset of a running command succeeded")
+		}
+		io.WriteString(stdin, want)
+		stdin.Close()
+		got, err := io.ReadAll(stdout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cmd.Wait(); err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		if err := cmd.Reset(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A failed start can be retried once the problem is fixed.
+	cmd = Command("true")
+	cmd.Dir = "/nonexistent/spawnexec-test"
+	if err := cmd.Run(); err == nil {
+		t.Fatal("Run in a missing directory succeeded")
+	}
+	if err := cmd.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	cmd.Dir = ""
+	if err := cmd.Run(); err != nil {
+		t.Errorf("retry: %v", err)
+	}
+
+	// The context of one OutputContext call does not outlive it.
+	cmd = Command("true")
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := cmd.OutputContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := cmd.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cmd.OutputContext(context.Background()); err != nil {
+		t.Errorf("OutputContext after Reset: %v", err)
+	}
+}
+
+// TestExitCodeHelpers tests ExitCode, IsExitCode and ExitCodeError.
+func TestExitCodeHelpers(t *testing.T) {
+	err := Command("sh", "-c", "exit 3").Run()
+	if code, ok := ExitCode(err); code != 3 || !ok {
+		t.Errorf("ExitCode = %d, %v; want 3, true", code, ok)
+	}
+	wrapped := fmt.Errorf("build: %w", err)
+	if !IsExitCode(wrapped, 3) || IsExitCode(wrapped, 2) {
+		t.Errorf("IsExitCode(%v) wrong", wrapped)
+	}
+	if !errors.Is(wrapped, ExitCodeError(3)) || errors.Is(wrapped, ExitCodeError(1)) {
+		t.Errorf("errors.Is(%v, ExitCodeError) wrong", wrapped)
+	}
+
+	err = Command("sh", "-c", "kill -TERM $$").Run()
+	if code, ok := ExitCode(err); code != -1 || ok {
+		t.Errorf("ExitCode of a signaled process = %d, %v; want -1, false", code, ok)
+	}
+	if code, ok := ExitCode(errors.New("other")); code != -1 || ok {
+		t.Errorf("ExitCode of another error = %d, %v; want -1, false", code, ok)
+	}
+	if IsExitCode(nil, 0) {
+		t.Error("IsExitCode(nil, 0) = true")
+	}
+}
+
+// TestSpawnErrorKinds tests that failures to execute a command match
+// ErrExecutableNotFound, ErrPermission and ErrBadFormat.
+func TestSpawnErrorKinds(t *testing.T) {
+	dir := t.TempDir()
+	noExec := filepath.Join(dir, "noexec")
+	if err := os.WriteFile(noExec, []byte("#!/bin/sh\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	garbage := filepath.Join(dir, "garbage")
+	if err := os.WriteFile(garbage, []byte("\x00\x01\x02\x03 not an executable"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	kinds := []error{ErrExecutableNotFound, ErrPermission, ErrBadFormat}
+	for _, tt := range []struct {
+		path string
+		want error
+	}{
+		{filepath.Join(dir, "missing"), ErrExecutableNotFound},
+		{noExec, ErrPermission},
+		{garbage, ErrBadFormat},
+	} {
+		err := Command(tt.path).Run()
+		for _, kind := range kinds {
+			if got := errors.Is(err, kind); got != (kind == tt.want) {
+				t.Errorf("%s: errors.Is(%v, %v) = %v", filepath.Base(tt.path), err, kind, got)
+			}
+		}
+		var e *Error
+		if !errors.As(err, &e) || e.Path != tt.path {
+			t.Errorf("%s: error %#v does not carry the path", filepath.Base(tt.path), err)
+		}
+	}
+
+	if err := Command("spawnexec-no-such-command").Run(); !errors.Is(err, ErrExecutableNotFound) {
+		t.Errorf("command not found in PATH: %v", err)
+	}
+}
+
+// TestTrampolineExecFailure tests that Start reports a trampoline's
+// failure to execute the command, as it does a failure to spawn it.
+func TestTrampolineExecFailure(t *testing.T) {
+	if CurrentBackend() != BackendOSExec {
+		t.Skip("trampolines report exec failures at Start only on the os/exec backend")
+	}
+	garbage := filepath.Join(t.TempDir(), "garbage")
+	if err := os.WriteFile(garbage, []byte("\x00\x01\x02\x03 not an executable"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(t.TempDir(), "missing")
+	for _, tt := range []struct {
+		path string
+		want error
+	}{
+		{missing, ErrExecutableNotFound},
+		{garbage, ErrBadFormat},
+	} {
+		cmd := Command(tt.path)
+		cmd.CoreDumps = CoreDumpsDisabled
+		err := cmd.Start()
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: Start() error = %v, want %v", filepath.Base(tt.path), err, tt.want)
+		}
+		var e *Error
+		if !errors.As(err, &e) || e.Path != tt.path {
+			t.Errorf("%s: error %#v does not carry the path", filepath.Base(tt.path), err)
+		}
+		if cmd.ProcessState == nil || cmd.ProcessState.ExitCode() != 127 {
+			t.Errorf("%s: trampoline not reaped: %v", filepath.Base(tt.path), cmd.ProcessState)
+		}
+	}
+
+	called := false
+	cmd := Command(missing)
+	cmd.BeforeResume = func(int) error {
+		called = true
+		return nil
+	}
+	if err := cmd.Start(); !errors.Is(err, ErrExecutableNotFound) {
+		t.Errorf("BeforeResume: Start() error = %v, want ErrExecutableNotFound", err)
+	}
+	if !called {
+		t.Error("BeforeResume was not called")
+	}
+
+	// A command that is executed starts as usual.
+	cmd = Command("true")
+	cmd.CoreDumps = CoreDumpsDisabled
+	if err := cmd.Run(); err != nil {
+		t.Errorf("Run() error = %v", err)
+	}
+}
+
+// TestShellFallback tests that ShellFallback runs an executable file
+// without a "#!" line as a shell script.
+func TestShellFallback(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "legacy")
+	if err := os.WriteFile(script, []byte("echo \"$0:$1:$2\"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := Command(script).Run(); !errors.Is(err, ErrBadFormat) {
+		t.Fatalf("without ShellFallback: %v, want ErrBadFormat", err)
+	}
+	cmd := Command(script, "a", "b c")
+	cmd.ShellFallback = true
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(out), script+":a:b c\n"; got != want {
+		t.Errorf("output %q, want %q", got, want)
+	}
+
+	// Stdin copied through a pipe reaches the shell.
+	script = filepath.Join(t.TempDir(), "cat")
+	if err := os.WriteFile(script, []byte("cat\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	cmd = Command(script)
+	cmd.ShellFallback = true
+	cmd.Stdin = strings.NewReader("piped")
+	if out, err := cmd.Output(); err != nil || string(out) != "piped" {
+		t.Errorf("cat script: %q, %v", out, err)
+	}
+
+	// Real programs are run as they are.
+	cmd = Command("echo", "direct")
+	cmd.ShellFallback = true
+	if out, err := cmd.Output(); err != nil || string(out) != "direct\n" {
+		t.Errorf("echo: %q, %v", out, err)
+	}
+}
+
+// TestMainRequired tests that features needing a helper process fail to
+// start until Main has been called.
+func TestMainRequired(t *testing.T) {
+	mainCalled.Store(false)
+	defer mainCalled.Store(true)
+	if b, err := StartBroker(); err == nil {
+		b.Close()
+		t.Error("StartBroker() without Main succeeded")
+	}
+	cmd := Command("true")
+	cmd.KillOnParentExit = true
+	err := cmd.Run()
+	if runtime.GOOS == "linux" {
+		// The kernel kills the command; no watchdog is needed.
+		if err != nil {
+			t.Errorf("KillOnParentExit without Main: Run() error = %v", err)
+		}
+	} else if !errors.Is(err, errNoMain) {
+		t.Errorf("KillOnParentExit without Main: Run() error = %v, want errNoMain", err)
+	}
+}
+
+// TestMultiplexedPipe tests that MultiplexedPipe delivers both output
+// streams over one pipe, and that Demultiplex separates them again.
+func TestMultiplexedPipe(t *testing.T) {
+	cmd := Command("sh", "-c", `echo out1; echo err1 >&2; echo out2; echo err2 >&2`)
+	r, err := cmd.MultiplexedPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cmd.MultiplexedPipe(); err == nil {
+		t.Error("second MultiplexedPipe succeeded")
+	}
+	var stdout, stderr bytes.Buffer
+	demuxed := make(chan error, 1)
+	go func() {
+		demuxed <- Demultiplex(r, &stdout, &stderr)
+	}()
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-demuxed; err != nil {
+		t.Fatalf("Demultiplex: %v", err)
+	}
+	if got, want := stdout.String(), "out1\nout2\n"; got != want {
+		t.Errorf("stdout %q, want %q", got, want)
+	}
+	if got, want := stderr.String(), "err1\nerr2\n"; got != want {
+		t.Errorf("stderr %q, want %q", got, want)
+	}
+
+	// The frames are those of docker attach.
+	frame := []byte{MuxStderr, 0, 0, 0, 0, 0, 0, 3, 'e', 'r', 'r'}
+	stderr.Reset()
+	if err := Demultiplex(bytes.NewReader(frame), nil, &stderr); err != nil || stderr.String() != "err" {
+		t.Errorf("Demultiplex(%q) = %v, stderr %q", frame, err, stderr.String())
+	}
+	if err := Demultiplex(bytes.NewReader(frame[:9]), nil, nil); err != io.ErrUnexpectedEOF {
+		t.Errorf("Demultiplex of a truncated frame = %v, want io.ErrUnexpectedEOF", err)
+	}
+	if err := Demultiplex(bytes.NewReader([]byte{9, 0, 0, 0, 0, 0, 0, 0}), nil, nil); err == nil {
+		t.Error("Demultiplex of an unknown stream succeeded")
+	}
+}
+
+// TestPeek tests that Peek shows the last output of a running command
+// without taking it from its writers.
+func TestPeek(t *testing.T) {
+	cmd := Command("sh", "-c", `i=0; while [ $i -lt 100 ]; do echo "line $i"; i=$((i+1)); done; echo oops >&2; read x; exit 0`)
+	cmd.PeekSize = 16
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		out, errOut := cmd.Peek(0)
+		if string(out) == "line 98\nline 99\n" && string(errOut) == "oops\n" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Peek(0) = %q, %q", out, errOut)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if out, _ := cmd.Peek(8); string(out) != "line 99\n" {
+		t.Errorf("Peek(8) = %q, want %q", out, "line 99\n")
+	}
+	stdin.Close()
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stdout.String(), "line 0\nline 1\n") || !strings.HasSuffix(stdout.String(), "line 99\n") {
+		t.Errorf("Stdout did not get all the output: %q", stdout.String())
+	}
+	if out, _ := cmd.Peek(0); string(out) != "line 98\nline 99\n" {
+		t.Errorf("Peek after Wait = %q", out)
+	}
+
+	if out, errOut := Command("true").Peek(0); out != nil || errOut != nil {
+		t.Errorf("Peek without PeekSize = %q, %q", out, errOut)
+	}
+}
+
+// TestPeekCombinedOutput tests that peeking at a command whose Stdout and
+// Stderr are the same writer has its output written to it by one
+// goroutine at a time, and retained combined.
+func TestPeekCombinedOutput(t *testing.T) {
+	cmd := Command("sh", "-c", `i=0; while [ $i -lt 200 ]; do echo out; echo err >&2; i=$((i+1)); done; echo last`)
+	cmd.PeekSize = 64
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("CombinedOutput() error = %v", err)
+	}
+	if n := strings.Count(string(out), "out\n") + strings.Count(string(out), "err\n"); n != 400 {
+		t.Errorf("CombinedOutput() has %d lines, want 400 and the last", n)
+	}
+	stdout, stderr := cmd.Peek(0)
+	if !strings.HasSuffix(string(stdout), "last\n") || !bytes.Equal(stdout, stderr) {
+		t.Errorf("Peek(0) = %q, %q, want the combined output twice", stdout, stderr)
+	}
+}
+
+// TestRingBuffer tests that a ringBuffer retains the last bytes written.
+func TestRingBuffer(t *testing.T) {
+	r := newRingBuffer(5)
+	if got := r.last(0); len(got) != 0 {
+		t.Errorf("empty: %q", got)
+	}
+	r.Write([]byte("abc"))
+	if got := string(r.last(0)); got != "abc" {
+		t.Errorf("got %q, want abc", got)
+	}
+	r.Write([]byte("defg"))
+	if got := string(r.last(0)); got != "cdefg" {
+		t.Errorf("got %q, want cdefg", got)
+	}
+	r.Write([]byte("0123456789"))
+	if got := string(r.last(3)); got != "789" {
+		t.Errorf("got %q, want 789", got)
+	}
+}
+
+// TestSessionSize tests setting the window size of a session's
+// pseudo-terminal and following that of another terminal.
+func TestSessionSize(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("pseudo-terminals are only supported on darwin and Linux")
+	}
+	// Another pseudo-terminal stands in for this process's terminal.
+	term, termReplica, err := openPTY()
+	if err != nil {
+		t.Fatalf("openPTY() error = %v", err)
+	}
+	defer term.Close()
+	defer termReplica.Close()
+	if err := setPTYSize(term, 30, 100); err != nil {
+		t.Fatalf("setPTYSize() error = %v", err)
+	}
+
+	s, err := StartSession(Command("sh", "-c", `stty size; read l; stty size`), SessionOptions{PTY: true, Terminal: termReplica})
+	if err != nil {
+		t.Fatalf("StartSession() error = %v", err)
+	}
+	defer s.Close()
+	if err := s.ExpectString("30 100", 5*time.Second); err != nil {
+		t.Fatalf("ExpectString(initial size) error = %v, output %q", err, s.Output())
+	}
+
+	if err := setPTYSize(term, 50, 150); err != nil {
+		t.Fatalf("setPTYSize() error = %v", err)
+	}
+	syscall.Kill(os.Getpid(), syscall.SIGWINCH)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rows, cols, err := s.Size()
+		if err != nil {
+			t.Fatalf("Size() error = %v", err)
+		}
+		if rows == 50 && cols == 150 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Size() after SIGWINCH = %d, %d, want 50, 150", rows, cols)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := s.SetSize(40, 120); err != nil {
+		t.Fatalf("SetSize() error = %v", err)
+	}
+	s.SendLine("again")
+	if err := s.ExpectString("40 120", 5*time.Second); err != nil {
+		t.Errorf("ExpectString(set size) error = %v, output %q", err, s.Output())
+	}
+	if err := s.SetSize(-1, 80); err == nil {
+		t.Error("SetSize(-1, 80) succeeded")
+	}
+
+	s, err = StartSession(Command("true"), SessionOptions{})
+	if err != nil {
+		t.Fatalf("StartSession() error = %v", err)
+	}
+	defer s.Close()
+	if err := s.SetSize(24, 80); err == nil {
+		t.Error("SetSize() without a pseudo-terminal succeeded")
+	}
+}
+
+// maxWriteRecorder records the largest write made to it.
+type maxWriteRecorder struct {
+	mu    sync.Mutex
+	max   int
+	total int
+}
+
+func (w *maxWriteRecorder) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.max = max(w.max, len(p))
+	w.total += len(p)
+	return len(p), nil
+}
+
+// TestCopyBuffer tests copying input and output with the buffers
+// CopyBufferSize and CopyBufferPool ask for.
+func TestCopyBuffer(t *testing.T) {
+	const size = 200000
+	out := &maxWriteRecorder{}
+	cmd := Command("cat")
+	cmd.Stdin = struct{ io.Reader }{bytes.NewReader(make([]byte, size))}
+	cmd.Stdout = out
+	cmd.CopyBufferSize = 4096
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if out.total != size || out.max > 4096 {
+		t.Errorf("with CopyBufferSize 4096, wrote %d bytes in writes of up to %d, want %d in writes of up to 4096", out.total, out.max, size)
+	}
+
+	pool := &sync.Pool{New: func() any {
+		b := make([]byte, 1024)
+		return &b
+	}}
+	for range 2 {
+		out := &maxWriteRecorder{}
+		cmd := Command("head", "-c", strconv.Itoa(size), "/dev/zero")
+		cmd.Stdout = out
+		cmd.CopyBufferPool = pool
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("Run() error = %v", err)
+		}
+		if out.total != size || out.max > 1024 {
+			t.Errorf("with CopyBufferPool, wrote %d bytes in writes of up to %d, want %d in writes of up to 1024", out.total, out.max, size)
+		}
+	}
+	if b, ok := pool.Get().(*[]byte); !ok || len(*b) != 1024 {
+		t.Errorf("CopyBufferPool holds %v after use, want a 1024-byte buffer", b)
+	}
+}
+
+// openFiles returns the number of descriptors the test process has open.
+func openFiles(t *testing.T) int {
+	t.Helper()
+	ents, err := os.ReadDir("/dev/fd")
+	if err != nil {
+		t.Skipf("reading /dev/fd: %v", err)
+	}
+	return len(ents)
+}
+
+// checkFailedStartCloses tests that commands set up by setup, which fail to
+// start, leave no descriptors open.
+func checkFailedStartCloses(t *testing.T, setup func(*Cmd)) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "noexec")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	before := openFiles(t)
+	for range 20 {
+		cmd := Command(path)
+		setup(cmd)
+		if err := cmd.Start(); err == nil {
+			cmd.Wait()
+			t.Fatalf("Start() of a file that is not executable succeeded")
+		}
+	}
+	if after := openFiles(t); after > before {
+		t.Errorf("%d descriptors open after failed starts, want at most %d", after, before)
+	}
+}
+
+// TestCopyBufferFailedStart tests that a command using CopyBufferSize that
+// fails to start closes the pipes made for copying.
+func TestCopyBufferFailedStart(t *testing.T) {
+	checkFailedStartCloses(t, func(cmd *Cmd) {
+		cmd.Stdout = new(strings.Builder)
+		cmd.Stderr = new(strings.Builder)
+		cmd.CopyBufferSize = 4096
+	})
+}
+
+// brokenPipeWriter fails every write as a pipe whose reader has gone
+// away does.
+type brokenPipeWriter struct{}
+
+func (brokenPipeWriter) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: "|1", Err: syscall.EPIPE}
+}
+
+// TestIgnoreBrokenPipe tests that a broken pipe writing output is only
+// reported without IgnoreBrokenPipe, and that one writing input never is.
+func TestIgnoreBrokenPipe(t *testing.T) {
+	cmd := Command("echo", "hello")
+	cmd.Stdout = brokenPipeWriter{}
+	if err := cmd.Run(); !errors.Is(err, syscall.EPIPE) {
+		t.Errorf("Run() error = %v, want EPIPE", err)
+	}
+
+	cmd = Command("echo", "hello")
+	cmd.Stdout = brokenPipeWriter{}
+	cmd.IgnoreBrokenPipe = true
+	if err := cmd.Run(); err != nil {
+		t.Errorf("Run() with IgnoreBrokenPipe error = %v", err)
+	}
+
+	// The command exits without reading the input, which outgrows the
+	// pipe's buffer.
+	cmd = Command("true")
+	cmd.Stdin = struct{ io.Reader }{bytes.NewReader(make([]byte, 1<<20))}
+	if err := cmd.Run(); err != nil {
+		t.Errorf("Run() with unread Stdin error = %v", err)
+	}
+}
+
+// TestIgnoreBrokenPipeFailedStart tests that a command using
+// IgnoreBrokenPipe that fails to start closes the pipes made for copying.
+func TestIgnoreBrokenPipeFailedStart(t *testing.T) {
+	checkFailedStartCloses(t, func(cmd *Cmd) {
+		cmd.Stdout = brokenPipeWriter{}
+		cmd.IgnoreBrokenPipe = true
+	})
+}
+
+// TestPipes tests the modes of the ends of the pipes made for commands,
+// and that they are counted.
+func TestPipes(t *testing.T) {
+	nonblock := func(f *os.File) bool {
+		flags, err := unix.FcntlInt(f.Fd(), unix.F_GETFL, 0)
+		if err != nil {
+			t.Fatalf("fcntl(F_GETFL) error = %v", err)
+		}
+		return flags&unix.O_NONBLOCK != 0
+	}
+	cloexec := func(f *os.File) bool {
+		flags, err := unix.FcntlInt(f.Fd(), unix.F_GETFD, 0)
+		if err != nil {
+			t.Fatalf("fcntl(F_GETFD) error = %v", err)
+		}
+		return flags&unix.FD_CLOEXEC != 0
+	}
+	for _, tt := range []struct {
+		name         string
+		make         func() (r, w *os.File, err error)
+		parentIsRead bool
+	}{
+		{"inputPipe", inputPipe, false},
+		{"outputPipe", outputPipe, true},
+	} {
+		r, w, err := tt.make()
+		if err != nil {
+			t.Fatalf("%s() error = %v", tt.name, err)
+		}
+		parent, child := w, r
+		if tt.parentIsRead {
+			parent, child = r, w
+		}
+		// Fd would put the parent's end in blocking mode.
+		rc, err := parent.SyscallConn()
+		if err != nil {
+			t.Fatalf("SyscallConn() error = %v", err)
+		}
+		var parentNonblock bool
+		rc.Control(func(fd uintptr) {
+			flags, _ := unix.FcntlInt(fd, unix.F_GETFL, 0)
+			parentNonblock = flags&unix.O_NONBLOCK != 0
+		})
+		if !parentNonblock {
+			t.Errorf("%s(): parent's end is in blocking mode", tt.name)
+		}
+		if nonblock(child) {
+			t.Errorf("%s(): command's end is in non-blocking mode", tt.name)
+		}
+		if !cloexec(r) || !cloexec(w) {
+			t.Errorf("%s(): ends are not close-on-exec", tt.name)
+		}
+		r.Close()
+		w.Close()
+	}
+
+	before := PipesMade()
+	cmd := Command("cat")
+	cmd.Stdin = strings.NewReader("hello")
+	if out, err := cmd.Output(); err != nil || string(out) != "hello" {
+		t.Fatalf("Output() = %q, %v, want %q", out, err, "hello")
+	}
+	if n := PipesMade() - before; n < 2 {
+		t.Errorf("PipesMade() grew by %d running a command with piped input and output, want at least 2", n)
+	}
+}
+
+// TestGraph tests running commands that depend on one another.
+func TestGraph(t *testing.T) {
+	dir := t.TempDir()
+	sh := func(script string) *Cmd {
+		cmd := Command("sh", "-c", script)
+		cmd.Dir = dir
+		return cmd
+	}
+	// a and b each wait for the other's file, so they must run at once; c
+	// needs both files, so it must run after them.
+	var g Graph
+	g.Add("c", sh(`test -f a && test -f b && touch c`), "a", "b")
+	g.Add("a", sh(`touch a; i=0; while [ ! -f b ] && [ $i -lt 500 ]; do sleep 0.01; i=$((i+1)); done; test -f b`))
+	g.Add("b", sh(`touch b; i=0; while [ ! -f a ] && [ $i -lt 500 ]; do sleep 0.01; i=$((i+1)); done; test -f a`))
+	if err := g.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "c")); err != nil {
+		t.Errorf("c did not run: %v", err)
+	}
+
+	// x fails, so y is never started and z is killed.
+	g = Graph{}
+	g.Add("x", sh(`echo boom; exit 3`))
+	g.Add("y", sh(`touch y`), "x")
+	g.Add("z", Command("sleep", "60"))
+	start := time.Now()
+	err := g.Run(context.Background())
+	var gerr *GraphError
+	if !errors.As(err, &gerr) || gerr.Name != "x" || string(gerr.Output) != "boom\n" || !IsExitCode(err, 3) {
+		t.Errorf("Run() error = %v, want a GraphError for x with its output and exit status 3", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Run() took %v, want z killed", elapsed)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "y")); err == nil {
+		t.Error("y ran after x failed")
+	}
+
+	for _, tt := range []struct {
+		name  string
+		build func(g *Graph)
+	}{
+		{"cycle", func(g *Graph) {
+			g.Add("p", Command("true"), "q")
+			g.Add("q", Command("true"), "p")
+		}},
+		{"unknown", func(g *Graph) { g.Add("p", Command("true"), "nope") }},
+		{"duplicate", func(g *Graph) {
+			g.Add("p", Command("true"))
+			g.Add("p", Command("true"))
+		}},
+	} {
+		var g Graph
+		tt.build(&g)
+		if err := g.Run(context.Background()); err == nil {
+			t.Errorf("Run() with a %s succeeded", tt.name)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	g = Graph{MaxParallel: 1}
+	g.Add("slow", Command("sleep", "60"))
+	if err := g.Run(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Run() with an expiring context error = %v, want DeadlineExceeded", err)
+	}
+}
+
+// TestScript tests running commands in sequence with a shared directory
+// and environment and a transcript.
+func TestScript(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cont := range []bool{false, true} {
+		s := &Script{Dir: dir, Env: []string{"GREETING=hello", "PATH=" + os.Getenv("PATH")}, ContinueOnError: cont}
+		s.Command("sh", "-c", `echo "$GREETING"; pwd`)
+		s.Command("sh", "-c", `echo oops >&2; exit 2`)
+		var own bytes.Buffer
+		s.Command("echo", "last").Stdout = &own
+		err := s.Run(context.Background())
+		if !IsExitCode(err, 2) {
+			t.Errorf("ContinueOnError %v: Run() error = %v, want exit status 2", cont, err)
+		}
+		transcript := string(s.Transcript())
+		for _, want := range []string{"sh -c 'echo oops >&2; exit 2'\n", "hello\n" + dir + "\n", "oops\n", "# exit status 2\n"} {
+			if !strings.Contains(transcript, want) {
+				t.Errorf("ContinueOnError %v: Transcript() = %q, lacks %q", cont, transcript, want)
+			}
+		}
+		if ran := strings.Contains(transcript, "last\n"); ran != cont || (own.String() == "last\n") != cont {
+			t.Errorf("ContinueOnError %v: last command ran = %v, output %q, transcript %q", cont, ran, own.String(), transcript)
+		}
+	}
+}
+
+// TestWatch tests rerunning a command when a watched file changes.
+func TestWatch(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("Watch is only supported on darwin and Linux")
+	}
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input")
+	runs := filepath.Join(t.TempDir(), "runs")
+	if err := os.WriteFile(input, []byte("one\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	countRuns := func(want int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			b, _ := os.ReadFile(runs)
+			if n := strings.Count(string(b), "\n"); n >= want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("runs = %q, want %d", b, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Each run records the input, then runs until it is stopped.
+	cmd := Command("sh", "-c", `cat "$1" >> "$2"; exec sleep 60`, "sh", input, runs)
+	exits := make(chan error, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- Watch(ctx, cmd, WatchOptions{Paths: []string{input}, Debounce: 20 * time.Millisecond, OnExit: func(err error) { exits <- err }})
+	}()
+	countRuns(1)
+
+	// Replace the file, as editors do, so the new one must be watched.
+	tmp := filepath.Join(dir, "input.tmp")
+	if err := os.WriteFile(tmp, []byte("two\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, input); err != nil {
+		t.Fatal(err)
+	}
+	countRuns(2)
+	select {
+	case err := <-exits:
+		if err == nil {
+			t.Error("OnExit() of the stopped run got nil, want an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("OnExit() not called for the stopped run")
+	}
+
+	if err := os.WriteFile(input, []byte("three\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	countRuns(3)
+	if b, _ := os.ReadFile(runs); string(b) != "one\ntwo\nthree\n" {
+		t.Errorf("runs = %q, want each version of the input", b)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Watch() error = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watch() did not return once its context was canceled")
+	}
+	if cmd.Process != nil {
+		t.Error("Watch() started the template command")
+	}
+
+	if err := Watch(context.Background(), cmd, WatchOptions{Paths: []string{filepath.Join(dir, "missing")}}); err == nil {
+		t.Error("Watch() of a missing path succeeded")
+	}
+}
+
+// TestDirFD tests running a command in a directory given as an open
+// descriptor, which holds even once the directory's path is taken over.
+func TestDirFD(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("DirFD is only supported on darwin and Linux")
+	}
+	base := t.TempDir()
+	orig := filepath.Join(base, "work")
+	if err := os.Mkdir(orig, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(orig, "genuine"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := os.Open(orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+
+	// Swap another directory in under the path.
+	moved := filepath.Join(base, "moved")
+	if err := os.Rename(orig, moved); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(orig, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(orig, "impostor"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ls, err := LookPath("ls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The relative StdoutPath is opened in DirFD too.
+	cmd := &Cmd{Path: ls, Args: []string{"ls"}, DirFD: dir, StdoutPath: "out.txt"}
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	out, err := os.ReadFile(filepath.Join(moved, "out.txt"))
+	if err != nil {
+		t.Fatalf("StdoutPath not opened in DirFD: %v", err)
+	}
+	if got := strings.Fields(string(out)); !slices.Contains(got, "genuine") || slices.Contains(got, "impostor") {
+		t.Errorf("ls in DirFD = %q, want the listing of the original directory", out)
+	}
+
+	for _, tt := range []struct {
+		name string
+		cmd  *Cmd
+	}{
+		{"Dir and DirFD", &Cmd{Path: ls, DirFD: dir, Dir: base}},
+		{"a relative Path", &Cmd{Path: "./ls", DirFD: dir}},
+	} {
+		if err := tt.cmd.Run(); err == nil {
+			t.Errorf("Run() with %s succeeded", tt.name)
+		}
+	}
+	file, err := os.Open(filepath.Join(moved, "genuine"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := (&Cmd{Path: ls, DirFD: file}).Run(); err == nil {
+		t.Error("Run() with a DirFD that is not a directory succeeded")
+	}
+}
+
+// TestExecFD tests that ExecFD runs the open executable rather than the
+// file at Path, without the command inheriting it.
+func TestExecFD(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("ExecFD is only supported on Linux")
+	}
+	sh, err := os.ReadFile("/bin/sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tool := filepath.Join(t.TempDir(), "tool")
+	if err := os.WriteFile(tool, sh, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	exe, err := os.Open(tool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exe.Close()
+
+	// Swap another file in under the path.
+	if err := os.Remove(tool); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tool, []byte("#!/bin/sh\necho impostor\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256(sh)
+	cmd := &Cmd{
+		Path:           tool,
+		Args:           []string{"sh", "-c", "echo genuine; ls -l /proc/$$/fd"},
+		ExecFD:         exe,
+		ExpectedSHA256: fmt.Sprintf("%x", sum),
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+	if !strings.HasPrefix(string(out), "genuine\n") {
+		t.Errorf("Output() = %q, want the output of the open executable", out)
+	}
+	if strings.Contains(string(out), tool) {
+		t.Errorf("command inherited ExecFD:\n%s", out)
+	}
+
+	cmd = &Cmd{Path: tool, ExecFD: exe, ExpectedSHA256: strings.Repeat("0", 64)}
+	var cerr *ChecksumError
+	if err := cmd.Run(); !errors.As(err, &cerr) {
+		t.Errorf("Run() with the wrong digest of ExecFD error = %v, want a *ChecksumError", err)
+	}
+}
+
+// TestLookPathPinned tests that a command started from a pinned
+// executable does not run a file swapped in under its path.
+func TestLookPathPinned(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("pinned executables are only tested on darwin and Linux")
+	}
+	sh, err := os.ReadFile("/bin/sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	tool := filepath.Join(dir, "tool")
+	if err := os.WriteFile(tool, sh, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	p, err := LookPathPinned(tool)
+	if err != nil {
+		t.Fatalf("LookPathPinned() error = %v", err)
+	}
+	defer p.Close()
+	if p.Path != tool {
+		t.Errorf("Path = %q, want %q", p.Path, tool)
+	}
+	if out, err := p.Command("-c", "echo genuine").Output(); err != nil || string(out) != "genuine\n" {
+		t.Fatalf("Output() = %q, %v, want the pinned executable's output", out, err)
+	}
+
+	// Swap another file in under the path.
+	if err := os.Remove(tool); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tool, []byte("#!/bin/sh\necho impostor\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	out, err := p.Command("-c", "echo genuine").Output()
+	if runtime.GOOS == "linux" {
+		if err != nil || string(out) != "genuine\n" {
+			t.Errorf("Output() after the swap = %q, %v, want the pinned executable's output", out, err)
+		}
+	} else if !errors.Is(err, ErrExecutableChanged) {
+		t.Errorf("Output() after the swap = %q, %v, want ErrExecutableChanged", out, err)
+	}
+
+	cmd := p.Command()
+	cmd.ExecFD = p.file
+	if err := cmd.Run(); err == nil {
+		t.Error("Run() with ExecFD and Pinned succeeded")
+	}
+	notExec := filepath.Join(dir, "data")
+	if err := os.WriteFile(notExec, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LookPathPinned(notExec); err == nil {
+		t.Error("LookPathPinned() of a file that is not executable succeeded")
+	}
+}
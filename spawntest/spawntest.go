@@ -0,0 +1,476 @@
+// Package spawntest provides a programmable fake implementation of
+// spawnexec.Commander for use in tests.
+//
+// A Fake never starts a real process. Tests register the commands they
+// expect to be run, together with the canned output, exit code, delay or
+// spawn failure each should produce, and afterwards assert on what was
+// actually run:
+//
+//	fake := spawntest.New()
+//	fake.Expect("git", "describe").Stdout("v1.2.3\n")
+//
+//	out, err := fake.Command("git", "describe").Output()
+//
+//	fake.AssertExpectations(t)
+package spawntest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/orospakr/spawnexec"
+	"golang.org/x/sys/unix"
+)
+
+// Call records a single command run through a Fake.
+type Call struct {
+	// Args holds the command name followed by its arguments.
+	Args []string
+	// Dir and Env are the values configured on the command when it started.
+	Dir string
+	Env []string
+	// Stdin holds everything the command read from its standard input.
+	// It is only complete once the command has been waited for.
+	Stdin []byte
+}
+
+// String returns the command line of the call, for use in messages.
+func (c Call) String() string {
+	return strings.Join(c.Args, " ")
+}
+
+// Expectation describes a command a Fake expects to run and how the fake
+// command behaves when it does. Its methods return the Expectation so that
+// they can be chained.
+type Expectation struct {
+	args     []string
+	stdout   []byte
+	stderr   []byte
+	exitCode int
+	delay    time.Duration
+	startErr error
+	times    int // 0 means any number of times
+
+	calls int // guarded by Fake.mu
+}
+
+// Stdout sets the data the command writes to its standard output.
+func (e *Expectation) Stdout(s string) *Expectation {
+	e.stdout = []byte(s)
+	return e
+}
+
+// Stderr sets the data the command writes to its standard error.
+func (e *Expectation) Stderr(s string) *Expectation {
+	e.stderr = []byte(s)
+	return e
+}
+
+// ExitCode sets the exit status the command finishes with.
+func (e *Expectation) ExitCode(code int) *Expectation {
+	e.exitCode = code
+	return e
+}
+
+// Delay makes the command run for d before it exits. If the command was
+// created with CommandContext and the context is done first, the command
+// is reported as killed by SIGKILL, like a real one would be.
+func (e *Expectation) Delay(d time.Duration) *Expectation {
+	e.delay = d
+	return e
+}
+
+// StartError makes Start fail with err, as if the process could not be
+// spawned.
+func (e *Expectation) StartError(err error) *Expectation {
+	e.startErr = err
+	return e
+}
+
+// Times limits the expectation to matching exactly n runs. By default an
+// expectation matches any number of runs.
+func (e *Expectation) Times(n int) *Expectation {
+	e.times = n
+	return e
+}
+
+func (e *Expectation) String() string {
+	return strings.Join(e.args, " ")
+}
+
+// Fake is a spawnexec.Commander whose commands are served from registered
+// Expectations. Running a command that matches no Expectation fails in
+// Start. A Fake is safe for concurrent use.
+type Fake struct {
+	mu           sync.Mutex
+	expectations []*Expectation
+	calls        []*Call
+	nextPid      int
+}
+
+var _ spawnexec.Commander = (*Fake)(nil)
+
+// New returns a Fake with no expectations.
+func New() *Fake {
+	return &Fake{nextPid: 10000}
+}
+
+// Expect registers a command the fake should accept. The name and args
+// must match those passed to Command exactly. When several expectations
+// match, the earliest registered one that is not exhausted wins.
+func (f *Fake) Expect(name string, arg ...string) *Expectation {
+	e := &Expectation{args: append([]string{name}, arg...)}
+	f.mu.Lock()
+	f.expectations = append(f.expectations, e)
+	f.mu.Unlock()
+	return e
+}
+
+// Command returns a fake command for the named program.
+func (f *Fake) Command(name string, arg ...string) spawnexec.Runner {
+	return &Cmd{fake: f, args: append([]string{name}, arg...)}
+}
+
+// CommandContext is like Command but includes a context.
+func (f *Fake) CommandContext(ctx context.Context, name string, arg ...string) spawnexec.Runner {
+	if ctx == nil {
+		panic("nil Context")
+	}
+	return &Cmd{fake: f, ctx: ctx, args: append([]string{name}, arg...)}
+}
+
+// Calls returns a copy of every command started so far, in order,
+// including those that failed to start.
+func (f *Fake) Calls() []Call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	calls := make([]Call, len(f.calls))
+	for i, c := range f.calls {
+		calls[i] = *c
+	}
+	return calls
+}
+
+// AssertExpectations fails the test if any expectation was not met: an
+// expectation without Times must have run at least once, and one with
+// Times(n) exactly n times.
+func (f *Fake) AssertExpectations(t testing.TB) {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, e := range f.expectations {
+		switch {
+		case e.times == 0 && e.calls == 0:
+			t.Errorf("spawntest: expected command %q was never run", e)
+		case e.times > 0 && e.calls != e.times:
+			t.Errorf("spawntest: command %q ran %d times, want %d", e, e.calls, e.times)
+		}
+	}
+}
+
+// AssertRan fails the test if no command with the given name and args was
+// started.
+func (f *Fake) AssertRan(t testing.TB, name string, arg ...string) {
+	t.Helper()
+	want := append([]string{name}, arg...)
+	for _, c := range f.Calls() {
+		if equalArgs(c.Args, want) {
+			return
+		}
+	}
+	t.Errorf("spawntest: command %q was not run", strings.Join(want, " "))
+}
+
+// AssertNotRan fails the test if a command with the given name and args
+// was started.
+func (f *Fake) AssertNotRan(t testing.TB, name string, arg ...string) {
+	t.Helper()
+	want := append([]string{name}, arg...)
+	for _, c := range f.Calls() {
+		if equalArgs(c.Args, want) {
+			t.Errorf("spawntest: command %q was run", strings.Join(want, " "))
+			return
+		}
+	}
+}
+
+// start records call and returns the expectation it matches.
+func (f *Fake) start(call *Call) (*Expectation, int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, call)
+	for _, e := range f.expectations {
+		if e.times > 0 && e.calls >= e.times {
+			continue
+		}
+		if equalArgs(e.args, call.Args) {
+			e.calls++
+			f.nextPid++
+			return e, f.nextPid, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("spawntest: unexpected command %q", call)
+}
+
+func equalArgs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Cmd is the spawnexec.Runner returned by a Fake.
+type Cmd struct {
+	fake *Fake
+	ctx  context.Context
+	args []string
+
+	dir    string
+	env    []string
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+
+	// Pipes handed out by the *Pipe methods; the fake command closes
+	// the write ends when it exits.
+	stdinPipe  *io.PipeReader
+	stdoutPipe *io.PipeWriter
+	stderrPipe *io.PipeWriter
+
+	call     *Call
+	started  bool
+	finished bool
+	done     chan struct{}
+	state    *spawnexec.ProcessState
+	stdinErr error
+}
+
+var _ spawnexec.Runner = (*Cmd)(nil)
+
+func (c *Cmd) SetDir(dir string)       { c.dir = dir }
+func (c *Cmd) SetEnv(env []string)     { c.env = env }
+func (c *Cmd) SetStdin(in io.Reader)   { c.stdin = in }
+func (c *Cmd) SetStdout(out io.Writer) { c.stdout = out }
+func (c *Cmd) SetStderr(out io.Writer) { c.stderr = out }
+
+// String returns the command line.
+func (c *Cmd) String() string {
+	return strings.Join(c.args, " ")
+}
+
+// ProcessState returns the fabricated state of the finished command, or
+// nil if it has not been waited for.
+func (c *Cmd) ProcessState() *spawnexec.ProcessState {
+	return c.state
+}
+
+// Start looks up the matching expectation and starts the fake command.
+func (c *Cmd) Start() error {
+	if c.started {
+		return errors.New("exec: already started")
+	}
+	if c.ctx != nil {
+		select {
+		case <-c.ctx.Done():
+			return c.ctx.Err()
+		default:
+		}
+	}
+	c.call = &Call{
+		Args: append([]string(nil), c.args...),
+		Dir:  c.dir,
+		Env:  append([]string(nil), c.env...),
+	}
+	e, pid, err := c.fake.start(c.call)
+	if err != nil {
+		return err
+	}
+	if e.startErr != nil {
+		return e.startErr
+	}
+	c.started = true
+	c.done = make(chan struct{})
+	go c.run(e, pid)
+	return nil
+}
+
+// run plays back the expectation e. Like a filter process, the fake
+// command consumes all of its standard input before it exits.
+func (c *Cmd) run(e *Expectation, pid int) {
+	defer close(c.done)
+
+	stdinDone := make(chan struct{})
+	if c.stdin != nil {
+		go func() {
+			defer close(stdinDone)
+			var buf bytes.Buffer
+			_, err := io.Copy(&buf, c.stdin)
+			c.fake.mu.Lock()
+			c.call.Stdin = buf.Bytes()
+			c.fake.mu.Unlock()
+			c.stdinErr = err
+		}()
+	} else {
+		close(stdinDone)
+	}
+
+	var ctxDone <-chan struct{}
+	if c.ctx != nil {
+		ctxDone = c.ctx.Done()
+	}
+	status := unix.WaitStatus(e.exitCode&0xff) << 8
+	timer := time.NewTimer(e.delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		select {
+		case <-stdinDone:
+		case <-ctxDone:
+			status = unix.WaitStatus(syscall.SIGKILL)
+		}
+	case <-ctxDone:
+		status = unix.WaitStatus(syscall.SIGKILL)
+	}
+	if status.Exited() {
+		if c.stdout != nil {
+			c.stdout.Write(e.stdout)
+		}
+		if c.stderr != nil {
+			c.stderr.Write(e.stderr)
+		}
+	}
+
+	// The process is gone, so nothing reads its stdin any more.
+	if c.stdinPipe != nil {
+		c.stdinPipe.Close()
+	}
+	if c.stdoutPipe != nil {
+		c.stdoutPipe.Close()
+	}
+	if c.stderrPipe != nil {
+		c.stderrPipe.Close()
+	}
+	if status.Exited() {
+		<-stdinDone
+	}
+	c.state = spawnexec.NewProcessState(pid, status)
+}
+
+// Wait waits for the fake command to finish.
+func (c *Cmd) Wait() error {
+	if !c.started {
+		return errors.New("exec: not started")
+	}
+	if c.finished {
+		return errors.New("exec: Wait was already called")
+	}
+	c.finished = true
+	<-c.done
+	if !c.state.Success() {
+		return &spawnexec.ExitError{ProcessState: c.state}
+	}
+	if c.stdinErr != nil && c.stdinPipe == nil {
+		return c.stdinErr
+	}
+	return nil
+}
+
+// Run starts the fake command and waits for it to finish.
+func (c *Cmd) Run() error {
+	if err := c.Start(); err != nil {
+		return err
+	}
+	return c.Wait()
+}
+
+// Output runs the fake command and returns its standard output.
+func (c *Cmd) Output() ([]byte, error) {
+	if c.stdout != nil {
+		return nil, errors.New("exec: Stdout already set")
+	}
+	var stdout, stderr bytes.Buffer
+	c.stdout = &stdout
+	captureErr := c.stderr == nil
+	if captureErr {
+		c.stderr = &stderr
+	}
+	err := c.Run()
+	if ee, ok := err.(*spawnexec.ExitError); ok && captureErr {
+		ee.Stderr = stderr.Bytes()
+	}
+	return stdout.Bytes(), err
+}
+
+// CombinedOutput runs the fake command and returns its standard output
+// followed by its standard error.
+func (c *Cmd) CombinedOutput() ([]byte, error) {
+	if c.stdout != nil {
+		return nil, errors.New("exec: Stdout already set")
+	}
+	if c.stderr != nil {
+		return nil, errors.New("exec: Stderr already set")
+	}
+	var b bytes.Buffer
+	c.stdout = &b
+	c.stderr = &b
+	err := c.Run()
+	return b.Bytes(), err
+}
+
+// StdinPipe returns a pipe whose contents are recorded as the command's
+// standard input.
+func (c *Cmd) StdinPipe() (io.WriteCloser, error) {
+	if c.stdin != nil {
+		return nil, errors.New("exec: Stdin already set")
+	}
+	if c.started {
+		return nil, errors.New("exec: StdinPipe after process started")
+	}
+	pr, pw := io.Pipe()
+	c.stdin = pr
+	c.stdinPipe = pr
+	return pw, nil
+}
+
+// StdoutPipe returns a pipe that delivers the command's canned standard
+// output.
+func (c *Cmd) StdoutPipe() (io.ReadCloser, error) {
+	if c.stdout != nil {
+		return nil, errors.New("exec: Stdout already set")
+	}
+	if c.started {
+		return nil, errors.New("exec: StdoutPipe after process started")
+	}
+	pr, pw := io.Pipe()
+	c.stdout = pw
+	c.stdoutPipe = pw
+	return pr, nil
+}
+
+// StderrPipe returns a pipe that delivers the command's canned standard
+// error.
+func (c *Cmd) StderrPipe() (io.ReadCloser, error) {
+	if c.stderr != nil {
+		return nil, errors.New("exec: Stderr already set")
+	}
+	if c.started {
+		return nil, errors.New("exec: StderrPipe after process started")
+	}
+	pr, pw := io.Pipe()
+	c.stderr = pw
+	c.stderrPipe = pw
+	return pr, nil
+}
@@ -0,0 +1,166 @@
+package spawntest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/orospakr/spawnexec"
+)
+
+// TestFakeOutput tests canned stdout and call recording
+func TestFakeOutput(t *testing.T) {
+	fake := New()
+	fake.Expect("git", "describe").Stdout("v1.2.3\n")
+
+	r := fake.Command("git", "describe")
+	r.SetDir("/src")
+	out, err := r.Output()
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+	if string(out) != "v1.2.3\n" {
+		t.Errorf("Output() = %q, want %q", out, "v1.2.3\n")
+	}
+
+	fake.AssertExpectations(t)
+	fake.AssertRan(t, "git", "describe")
+	fake.AssertNotRan(t, "git", "status")
+
+	calls := fake.Calls()
+	if len(calls) != 1 || calls[0].Dir != "/src" {
+		t.Errorf("Calls() = %+v, want one call in /src", calls)
+	}
+}
+
+// TestFakeExitCode tests that a nonzero exit code produces an *ExitError
+func TestFakeExitCode(t *testing.T) {
+	fake := New()
+	fake.Expect("false").Stderr("boom").ExitCode(3)
+
+	_, err := fake.Command("false").Output()
+	var exitErr *spawnexec.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("Output() error = %v, want *ExitError", err)
+	}
+	if exitErr.ExitCode() != 3 {
+		t.Errorf("ExitCode() = %d, want 3", exitErr.ExitCode())
+	}
+	if string(exitErr.Stderr) != "boom" {
+		t.Errorf("ExitError.Stderr = %q, want %q", exitErr.Stderr, "boom")
+	}
+}
+
+// TestFakeUnexpected tests that unregistered commands fail to start
+func TestFakeUnexpected(t *testing.T) {
+	fake := New()
+	if err := fake.Command("rm", "-rf", "/").Run(); err == nil {
+		t.Error("Run() of unexpected command error = nil, want error")
+	}
+	if len(fake.Calls()) != 1 {
+		t.Errorf("len(Calls()) = %d, want 1", len(fake.Calls()))
+	}
+}
+
+// TestFakeStartError tests simulated spawn failures
+func TestFakeStartError(t *testing.T) {
+	fake := New()
+	fake.Expect("missing").StartError(syscall.ENOENT)
+
+	err := fake.Command("missing").Run()
+	if !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("Run() error = %v, want ENOENT", err)
+	}
+}
+
+// TestFakeTimes tests that exhausted expectations fall through to later ones
+func TestFakeTimes(t *testing.T) {
+	fake := New()
+	fake.Expect("flaky").ExitCode(1).Times(2)
+	fake.Expect("flaky")
+
+	for i, wantErr := range []bool{true, true, false} {
+		err := fake.Command("flaky").Run()
+		if (err != nil) != wantErr {
+			t.Errorf("run %d: error = %v, want error %v", i, err, wantErr)
+		}
+	}
+	fake.AssertExpectations(t)
+}
+
+// TestFakeDelayContext tests that context cancellation interrupts a delay
+func TestFakeDelayContext(t *testing.T) {
+	fake := New()
+	fake.Expect("sleep", "10").Delay(10 * time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := fake.CommandContext(ctx, "sleep", "10").Run()
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("Run() did not return after context deadline")
+	}
+	var exitErr *spawnexec.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("Run() error = %v, want *ExitError", err)
+	}
+	if exitErr.Signal() != syscall.SIGKILL {
+		t.Errorf("Signal() = %v, want SIGKILL", exitErr.Signal())
+	}
+}
+
+// TestFakePipes tests stdin recording and stdout pipes
+func TestFakePipes(t *testing.T) {
+	fake := New()
+	fake.Expect("cat").Stdout("done")
+
+	r := fake.Command("cat")
+	stdin, err := r.StdinPipe()
+	if err != nil {
+		t.Fatalf("StdinPipe() error = %v", err)
+	}
+	stdout, err := r.StdoutPipe()
+	if err != nil {
+		t.Fatalf("StdoutPipe() error = %v", err)
+	}
+	if err := r.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	go func() {
+		io.WriteString(stdin, "input")
+		stdin.Close()
+	}()
+	out, err := io.ReadAll(stdout)
+	if err != nil {
+		t.Errorf("ReadAll() error = %v", err)
+	}
+	if err := r.Wait(); err != nil {
+		t.Errorf("Wait() error = %v", err)
+	}
+	if string(out) != "done" {
+		t.Errorf("stdout = %q, want %q", out, "done")
+	}
+	if got := string(fake.Calls()[0].Stdin); got != "input" {
+		t.Errorf("recorded stdin = %q, want %q", got, "input")
+	}
+}
+
+// TestFakeStdinReader tests that a Reader stdin is recorded
+func TestFakeStdinReader(t *testing.T) {
+	fake := New()
+	fake.Expect("wc", "-c").Stdout("5\n")
+
+	r := fake.Command("wc", "-c")
+	r.SetStdin(strings.NewReader("hello"))
+	if _, err := r.Output(); err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+	if got := string(fake.Calls()[0].Stdin); got != "hello" {
+		t.Errorf("recorded stdin = %q, want %q", got, "hello")
+	}
+}
@@ -0,0 +1,186 @@
+package spawnexec
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Spec describes a command declaratively, so that job queues and
+// configuration files can hold commands as JSON and workers can
+// reconstruct them with Command. Durations are written in JSON as strings
+// such as "1m30s".
+type Spec struct {
+	// Path is the command to run, looked up as Command looks up its name.
+	Path string `json:"path"`
+	// Args are the command's arguments, not including the command itself.
+	Args []string `json:"args,omitempty"`
+	// Env is the command's environment. If it is nil, the command inherits
+	// the environment of the process that runs it; an empty environment
+	// is written as [].
+	Env []string `json:"env,omitzero"`
+	// Dir is the command's working directory.
+	Dir string `json:"dir,omitempty"`
+
+	// Stdin, Stdout and Stderr select the command's standard I/O. Each is
+	// connected to the null device unless it is StdioInherit, or its path
+	// is set, or, for Stderr, it is StdioStdout.
+	Stdin  StdioMode `json:"stdin,omitempty"`
+	Stdout StdioMode `json:"stdout,omitempty"`
+	Stderr StdioMode `json:"stderr,omitempty"`
+	// StdinPath, StdoutPath and StderrPath are files to connect to the
+	// command's standard I/O, as for the Cmd fields of the same names.
+	StdinPath  string `json:"stdin_path,omitempty"`
+	StdoutPath string `json:"stdout_path,omitempty"`
+	StderrPath string `json:"stderr_path,omitempty"`
+	// Append makes StdoutPath and StderrPath be appended to rather than
+	// truncated.
+	Append bool `json:"append,omitempty"`
+
+	// Timeout, if positive, is how long the command may run before it is
+	// killed.
+	Timeout time.Duration `json:"-"`
+	// WaitDelay is the Cmd's WaitDelay.
+	WaitDelay time.Duration `json:"-"`
+	// MemoryLimit, if positive, is the command's memory limit in bytes on
+	// darwin, as for DarwinAttr.
+	MemoryLimit int64 `json:"memory_limit,omitempty"`
+	// KillOnParentExit is the Cmd's KillOnParentExit.
+	KillOnParentExit bool `json:"kill_on_parent_exit,omitempty"`
+}
+
+// StdioMode selects how a Spec connects one of the command's standard I/O
+// streams.
+type StdioMode string
+
+const (
+	// StdioNull connects the stream to the null device. It is the default.
+	StdioNull StdioMode = "null"
+	// StdioInherit connects the stream to the same stream of the process
+	// that runs the command.
+	StdioInherit StdioMode = "inherit"
+	// StdioStdout, for Stderr only, sends standard error wherever
+	// standard output goes.
+	StdioStdout StdioMode = "stdout"
+)
+
+// specJSON is the JSON form of a Spec, with its durations as strings.
+type specJSON struct {
+	specFields
+	Timeout   string `json:"timeout,omitempty"`
+	WaitDelay string `json:"wait_delay,omitempty"`
+}
+
+// specFields is Spec without its methods, so that specJSON can embed it
+// without inheriting MarshalJSON and UnmarshalJSON.
+type specFields Spec
+
+// MarshalJSON implements json.Marshaler.
+func (s Spec) MarshalJSON() ([]byte, error) {
+	j := specJSON{specFields: specFields(s)}
+	if s.Timeout != 0 {
+		j.Timeout = s.Timeout.String()
+	}
+	if s.WaitDelay != 0 {
+		j.WaitDelay = s.WaitDelay.String()
+	}
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (s *Spec) UnmarshalJSON(data []byte) error {
+	var j specJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	*s = Spec(j.specFields)
+	var err error
+	if j.Timeout != "" {
+		if s.Timeout, err = time.ParseDuration(j.Timeout); err != nil {
+			return fmt.Errorf("exec: spec timeout: %w", err)
+		}
+	}
+	if j.WaitDelay != "" {
+		if s.WaitDelay, err = time.ParseDuration(j.WaitDelay); err != nil {
+			return fmt.Errorf("exec: spec wait_delay: %w", err)
+		}
+	}
+	return nil
+}
+
+// Command returns a Cmd that runs the command s describes.
+func (s *Spec) Command() (*Cmd, error) {
+	if s.Timeout > 0 {
+		return s.CommandContext(context.Background())
+	}
+	return s.command(Command(s.Path, s.Args...))
+}
+
+// CommandContext is like Command but includes a context, like the
+// package-level CommandContext. If s has a Timeout, the command is killed
+// once it expires as well as when ctx is done.
+func (s *Spec) CommandContext(ctx context.Context) (*Cmd, error) {
+	cmd := CommandContext(ctx, s.Path, s.Args...)
+	if s.Timeout > 0 {
+		cmd.ctx, cmd.ctxCancel = context.WithTimeout(ctx, s.Timeout)
+	}
+	return s.command(cmd)
+}
+
+// command sets up cmd, which runs s.Path with s.Args, as s describes.
+func (s *Spec) command(cmd *Cmd) (*Cmd, error) {
+	cmd.Env = s.Env
+	cmd.Dir = s.Dir
+	cmd.StdinPath = s.StdinPath
+	cmd.StdoutPath = s.StdoutPath
+	cmd.StderrPath = s.StderrPath
+	if s.Append {
+		cmd.OutputFlag = os.O_CREATE | os.O_APPEND
+	}
+	cmd.WaitDelay = int64(s.WaitDelay)
+	cmd.KillOnParentExit = s.KillOnParentExit
+	if s.MemoryLimit > 0 {
+		cmd.DarwinAttr = &DarwinAttr{MemoryLimit: s.MemoryLimit}
+	}
+
+	if inherit, err := s.Stdin.inherit("stdin", s.StdinPath); err != nil {
+		return nil, err
+	} else if inherit {
+		cmd.Stdin = os.Stdin
+	}
+	if inherit, err := s.Stdout.inherit("stdout", s.StdoutPath); err != nil {
+		return nil, err
+	} else if inherit {
+		cmd.Stdout = os.Stdout
+	}
+	if s.Stderr == StdioStdout {
+		if s.StderrPath != "" {
+			return nil, fmt.Errorf("exec: spec stderr is both %q and %s", s.Stderr, s.StderrPath)
+		}
+		cmd.Stderr = cmd.Stdout
+		cmd.StderrPath = s.StdoutPath
+	} else if inherit, err := s.Stderr.inherit("stderr", s.StderrPath); err != nil {
+		return nil, err
+	} else if inherit {
+		cmd.Stderr = os.Stderr
+	}
+	return cmd, nil
+}
+
+// inherit reports whether m inherits the stream called name, which is
+// also to be connected to path if that is not empty.
+func (m StdioMode) inherit(name, path string) (bool, error) {
+	switch m {
+	case "", StdioNull:
+		return false, nil
+	case StdioInherit:
+		if path != "" {
+			return false, fmt.Errorf("exec: spec %s is both inherited and %s", name, path)
+		}
+		return true, nil
+	default:
+		return false, fmt.Errorf("exec: spec %s has unknown mode %q", name, m)
+	}
+}
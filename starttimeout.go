@@ -0,0 +1,97 @@
+package spawnexec
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// StartTimeoutError is returned by Start when it does not complete within
+// the command's StartTimeout.
+type StartTimeoutError struct {
+	// Name is the command's Path.
+	Name string
+	// Timeout is the StartTimeout that expired.
+	Timeout time.Duration
+}
+
+func (e *StartTimeoutError) Error() string {
+	return "exec: " + e.Name + ": start did not complete within " + e.Timeout.String()
+}
+
+// Unwrap returns context.DeadlineExceeded, so that a StartTimeoutError
+// satisfies errors.Is with it as a context's deadline would.
+func (e *StartTimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// Start starts the specified command but does not wait for it to complete.
+// On platforms other than darwin, this falls back to os/exec.
+//
+// If Start returns successfully, the c.Process field will be set.
+//
+// After a successful call to Start the Wait method must be called in
+// order to release associated system resources.
+func (c *Cmd) Start() error {
+	if err := c.checkStart(); err != nil {
+		return err
+	}
+	if c.StartTimeout <= 0 {
+		return c.started(c.start())
+	}
+	started := make(chan error, 1)
+	go func() {
+		started <- c.start()
+	}()
+	timer := time.NewTimer(c.StartTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-started:
+		return c.started(err)
+	case <-timer.C:
+	}
+	if l := c.log(); l != nil {
+		l.Debug("spawnexec: StartTimeout expired", "path", c.Path, "start_timeout", c.StartTimeout)
+	}
+	// The spawn cannot be interrupted; whatever it starts, once it is
+	// done, is not wanted. Only the process is reaped here: the rest of
+	// the Cmd is left to the caller's Wait, which waits for startDone.
+	c.startDone = make(chan struct{})
+	go func() {
+		defer close(c.startDone)
+		if err := <-started; err == nil {
+			c.Process.Kill()
+			c.Process.Wait()
+		} else {
+			c.unlockInstance()
+			c.closeMuxPipe()
+		}
+	}()
+	return &StartTimeoutError{Name: c.Path, Timeout: c.StartTimeout}
+}
+
+// checkStart checks that c has not been started, before start takes its
+// SingleInstance lock, so that a Start refused because c has been started
+// already does not release the lock its first Start took.
+func (c *Cmd) checkStart() error {
+	if c.Process != nil || c.startDone != nil {
+		return errors.New("exec: already started")
+	}
+	if c.finished {
+		return errors.New("exec: already finished")
+	}
+	return nil
+}
+
+// started finishes a Start whose spawn returned err, releasing the
+// SingleInstance lock and closing the MultiplexedPipe if it failed, and
+// registering the command if it did not.
+func (c *Cmd) started(err error) error {
+	if err != nil {
+		c.unlockInstance()
+		c.closeMuxPipe()
+		return err
+	}
+	c.register()
+	return nil
+}
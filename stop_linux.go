@@ -0,0 +1,29 @@
+package spawnexec
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// canWaitStopped reports whether waitStopped is supported.
+const canWaitStopped = true
+
+// cldStopped is the si_code of a child that has stopped.
+const cldStopped = 5 // CLD_STOPPED
+
+// waitStopped waits for the child pid to stop or exit, leaving it to be
+// waited for again, and reports whether it stopped.
+func waitStopped(pid int) (bool, error) {
+	var info unix.Siginfo
+	for {
+		err := unix.Waitid(unix.P_PID, pid, &info, unix.WSTOPPED|unix.WEXITED|unix.WNOWAIT, nil)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return false, os.NewSyscallError("waitid", err)
+		}
+		return info.Code == cldStopped, nil
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package spawnexec
+
+import "errors"
+
+// canWaitStopped reports whether waitStopped is supported.
+const canWaitStopped = false
+
+// waitStopped reports an error: the os/exec backend only supports
+// BeforeResume on Linux. On darwin, BackendPosixSpawn supports it.
+func waitStopped(pid int) (bool, error) {
+	return false, errors.New("exec: BeforeResume is not supported on this platform")
+}
@@ -0,0 +1,46 @@
+package spawnexec
+
+import "time"
+
+// SpawnTiming records when a command passed through each phase of being
+// spawned and waited for, so that the time a spawn takes can be broken
+// down without patching the package. Phases the command has not reached
+// are zero.
+type SpawnTiming struct {
+	// LookPathStart and LookPathEnd bracket the lookup of the command's
+	// name in Command, and are zero if the name was not looked up.
+	LookPathStart, LookPathEnd time.Time
+	// Start is when Start was called.
+	Start time.Time
+	// Marshaled is when the command's path, arguments and environment had
+	// been marshaled and everything else set up for spawning it. Elsewhere
+	// than darwin, it is when os/exec was asked to start the command.
+	Marshaled time.Time
+	// Spawned is when posix_spawn, or os/exec or the Broker, returned.
+	Spawned time.Time
+	// Waited is when Wait's wait for the process to exit returned, before
+	// Wait finished copying its output.
+	Waited time.Time
+}
+
+// Timing returns when c passed through each phase of being spawned and
+// waited for.
+func (c *Cmd) Timing() SpawnTiming {
+	return c.timing
+}
+
+// LookPath returns the time taken to look the command's name up.
+func (t SpawnTiming) LookPath() time.Duration {
+	return t.LookPathEnd.Sub(t.LookPathStart)
+}
+
+// Setup returns the time taken from Start being called to the command
+// being ready to spawn.
+func (t SpawnTiming) Setup() time.Duration {
+	return t.Marshaled.Sub(t.Start)
+}
+
+// Spawn returns the time taken to spawn the command once it was ready.
+func (t SpawnTiming) Spawn() time.Duration {
+	return t.Spawned.Sub(t.Marshaled)
+}
@@ -0,0 +1,293 @@
+package spawnexec
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// trampolinePathEnv and the other trampoline variables are the
+// environment variables through which a trampoline learns the program to
+// execute and what to do before executing it.
+const (
+	trampolinePathEnv       = "SPAWNEXEC_TRAMPOLINE_PATH"
+	trampolineDirEnv        = "SPAWNEXEC_TRAMPOLINE_DIR"
+	trampolineCttyEnv       = "SPAWNEXEC_TRAMPOLINE_CTTY"
+	trampolineForegroundEnv = "SPAWNEXEC_TRAMPOLINE_FOREGROUND"
+	trampolineStopEnv       = "SPAWNEXEC_TRAMPOLINE_STOP"
+	trampolineIOPolicyEnv   = "SPAWNEXEC_TRAMPOLINE_IOPOLICY"
+	trampolineCoreEnv       = "SPAWNEXEC_TRAMPOLINE_CORE"
+	trampolineStatusEnv     = "SPAWNEXEC_TRAMPOLINE_STATUS"
+	trampolineShellEnv      = "SPAWNEXEC_TRAMPOLINE_SHELL"
+	trampolineExecFDEnv     = "SPAWNEXEC_TRAMPOLINE_EXECFD"
+)
+
+// A trampoline sets up a new process in ways posix_spawn cannot on some
+// systems: the current executable is spawned in place of the command, and
+// Main, finding it started as a trampoline, sets the process up before
+// executing the command with the same arguments and environment.
+//
+// Failures to set the process up or to execute the command are then
+// reported by the trampoline exiting with status 127, rather than by
+// Start, unless the trampoline is given a status pipe: a descriptor it
+// marks close-on-exec, on which it writes its failure before exiting, so
+// that the parent reading it to EOF learns whether the command was
+// executed. See writeTrampolineStatus.
+type trampoline struct {
+	dir        string // directory to change to
+	setctty    bool   // make ctty the controlling terminal
+	ctty       int
+	foreground bool      // make the process group the terminal's foreground
+	stop       bool      // stop with SIGSTOP until continued
+	ioPolicy   IOPolicy  // disk I/O policy to set, if not zero
+	coreDumps  CoreDumps // RLIMIT_CORE to set, if not CoreDumpsInherit
+	status     int       // descriptor of the status pipe, if positive
+	shell      bool      // run a file failing with ENOEXEC with shellPath
+	execFD     int       // descriptor of the executable, if positive
+}
+
+// needed reports whether t has anything to do.
+func (t *trampoline) needed() bool {
+	return t.dir != "" || t.setctty || t.foreground || t.stop || t.ioPolicy != 0 || t.coreDumps != CoreDumpsInherit || t.shell || t.execFD > 0
+}
+
+// spawnArgs returns the path and environment with which to spawn t so
+// that it executes the program at path with the environment env. It makes
+// t.dir absolute, for resolving other paths relative to it.
+func (t *trampoline) spawnArgs(path string, env []string) (string, []string, error) {
+	exe, err := helperExecutable()
+	if err != nil {
+		return "", nil, err
+	}
+	if path, err = execPath(".", path); err != nil {
+		return "", nil, err
+	}
+	env = append(slices.Clip(env), trampolinePathEnv+"="+path)
+	if t.dir != "" {
+		if t.dir, err = filepath.Abs(t.dir); err != nil {
+			return "", nil, err
+		}
+		env = append(env, trampolineDirEnv+"="+t.dir)
+	}
+	if t.setctty {
+		env = append(env, trampolineCttyEnv+"="+strconv.Itoa(t.ctty))
+	}
+	if t.foreground {
+		env = append(env, trampolineForegroundEnv+"=1")
+	}
+	if t.stop {
+		env = append(env, trampolineStopEnv+"=1")
+	}
+	if t.ioPolicy != 0 {
+		env = append(env, trampolineIOPolicyEnv+"="+strconv.Itoa(int(t.ioPolicy)))
+	}
+	if t.coreDumps != CoreDumpsInherit {
+		env = append(env, trampolineCoreEnv+"="+strconv.Itoa(int(t.coreDumps)))
+	}
+	if t.shell {
+		env = append(env, trampolineShellEnv+"=1")
+	}
+	if t.status > 0 {
+		env = append(env, trampolineStatusEnv+"="+strconv.Itoa(t.status))
+	}
+	if t.execFD > 0 {
+		env = append(env, trampolineExecFDEnv+"="+strconv.Itoa(t.execFD))
+	}
+	return exe, env, nil
+}
+
+// runTrampoline sets up the process as the trampoline's environment says
+// and executes the program at path, or the one open on its executable
+// descriptor, with the trampoline's own arguments, and its environment
+// less the trampoline's variables. It only returns if that fails.
+func runTrampoline(path string) int {
+	dir := os.Getenv(trampolineDirEnv)
+	ctty := os.Getenv(trampolineCttyEnv)
+	foreground := os.Getenv(trampolineForegroundEnv) != ""
+	stop := os.Getenv(trampolineStopEnv) != ""
+	shell := os.Getenv(trampolineShellEnv) != ""
+	ioPolicy := os.Getenv(trampolineIOPolicyEnv)
+	coreDumps := os.Getenv(trampolineCoreEnv)
+	status := -1
+	if fd, err := strconv.Atoi(os.Getenv(trampolineStatusEnv)); err == nil && fd > 0 {
+		// The pipe is to close when the command is executed.
+		status = fd
+		unix.CloseOnExec(status)
+	}
+	execFD := -1
+	if fd, err := strconv.Atoi(os.Getenv(trampolineExecFDEnv)); err == nil && fd > 0 {
+		// The command is not to inherit the descriptor it is executed
+		// from.
+		execFD = fd
+		unix.CloseOnExec(execFD)
+	}
+	env := slices.DeleteFunc(os.Environ(), func(kv string) bool {
+		return strings.HasPrefix(kv, "SPAWNEXEC_TRAMPOLINE_")
+	})
+	if err := setupTrampoline(dir, ctty, ioPolicy, coreDumps, foreground, stop); err != nil {
+		if !writeTrampolineStatus(status, false, err) {
+			fmt.Fprintf(os.Stderr, "spawnexec: %v\n", err)
+		}
+		return 127
+	}
+	var err error
+	if execFD > 0 {
+		err = execveat(execFD, os.Args, env)
+	} else {
+		err = syscall.Exec(path, os.Args, env)
+	}
+	if err == syscall.ENOEXEC && shell {
+		script := path
+		if execFD > 0 {
+			// The shell is to read the script from the descriptor, which
+			// it can only open through /proc.
+			unix.FcntlInt(uintptr(execFD), unix.F_SETFD, 0)
+			script = procFDPath(execFD)
+		}
+		err = syscall.Exec(shellPath, shellArgs(script, os.Args), env)
+	}
+	if !writeTrampolineStatus(status, true, err) {
+		fmt.Fprintf(os.Stderr, "spawnexec: exec %s: %v\n", path, err)
+	}
+	return 127
+}
+
+// shellPath is the shell with which ShellFallback runs scripts.
+const shellPath = "/bin/sh"
+
+// shellArgs returns the arguments with which ShellFallback runs the file
+// at path, which was to be run with args, as a shell script: as execvp
+// does, the shell's path, path and args[1:].
+func shellArgs(path string, args []string) []string {
+	shArgs := []string{shellPath, path}
+	if len(args) > 1 {
+		shArgs = append(shArgs, args[1:]...)
+	}
+	return shArgs
+}
+
+// writeTrampolineStatus reports err, a failure to execute the command if
+// exec is set or to set the process up if not, on the status pipe fd, if
+// there is one, and reports whether it did. The report is a byte, 'e' or
+// 's', the errno err wraps, if any, as 4 big-endian bytes, and the error
+// message.
+func writeTrampolineStatus(fd int, exec bool, err error) bool {
+	if fd < 0 {
+		return false
+	}
+	kind := byte('s')
+	if exec {
+		kind = 'e'
+	}
+	var errno syscall.Errno
+	errors.As(err, &errno)
+	msg := append([]byte{kind, byte(errno >> 24), byte(errno >> 16), byte(errno >> 8), byte(errno)}, err.Error()...)
+	_, werr := unix.Write(fd, msg)
+	return werr == nil
+}
+
+// readTrampolineStatus reads the status pipe r of a trampoline started
+// for c to EOF, and closes it. It returns nil if the command was executed,
+// and otherwise the failure the trampoline reported: an *Error wrapping
+// the errno for a failure to execute the command, as posix_spawn reports
+// it, or a *trampolineError.
+func (c *Cmd) readTrampolineStatus(r *os.File) error {
+	b, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return wrapError("exec: trampoline status: ", err)
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	if len(b) < 5 {
+		return errors.New("exec: short trampoline status")
+	}
+	errno := syscall.Errno(uint32(b[1])<<24 | uint32(b[2])<<16 | uint32(b[3])<<8 | uint32(b[4]))
+	if b[0] == 'e' && errno != 0 {
+		path, _ := execPath(c.Dir, c.Path)
+		return &Error{Name: c.Path, Path: path, Err: errno}
+	}
+	return &trampolineError{msg: string(b[5:]), errno: errno}
+}
+
+// trampolineError is a trampoline's report of its failure to set up the
+// process for the command, such as to change directory or set a limit.
+type trampolineError struct {
+	msg   string
+	errno syscall.Errno
+}
+
+func (e *trampolineError) Error() string {
+	return "exec: " + e.msg
+}
+
+// Unwrap returns the errno of the failure, if it had one.
+func (e *trampolineError) Unwrap() error {
+	if e.errno == 0 {
+		return nil
+	}
+	return e.errno
+}
+
+// setupTrampoline changes to dir, makes the descriptor ctty the
+// controlling terminal, and sets the disk I/O policy ioPolicy and the
+// RLIMIT_CORE coreDumps asks for, which the command inherits, for those
+// that are not empty, and then puts the
+// process group in the foreground of the controlling terminal if asked.
+// Last, if stop is set, it stops itself until it is continued, so that
+// the command's code cannot run before whatever is waiting for it to stop
+// has continued it.
+func setupTrampoline(dir, ctty, ioPolicy, coreDumps string, foreground, stop bool) error {
+	if dir != "" {
+		if err := os.Chdir(dir); err != nil {
+			return err
+		}
+	}
+	if ctty != "" {
+		fd, err := strconv.Atoi(ctty)
+		if err != nil {
+			return fmt.Errorf("bad %s %q", trampolineCttyEnv, ctty)
+		}
+		if err := unix.IoctlSetInt(fd, unix.TIOCSCTTY, 0); err != nil {
+			return os.NewSyscallError("ioctl TIOCSCTTY", err)
+		}
+	}
+	if ioPolicy != "" {
+		policy, err := strconv.Atoi(ioPolicy)
+		if err != nil {
+			return fmt.Errorf("bad %s %q", trampolineIOPolicyEnv, ioPolicy)
+		}
+		if err := setIOPolicy(IOPolicy(policy)); err != nil {
+			return err
+		}
+	}
+	if coreDumps != "" {
+		cd, err := strconv.Atoi(coreDumps)
+		if err != nil {
+			return fmt.Errorf("bad %s %q", trampolineCoreEnv, coreDumps)
+		}
+		if err := setCoreDumps(CoreDumps(cd)); err != nil {
+			return err
+		}
+	}
+	if foreground {
+		if err := setForeground(); err != nil {
+			return err
+		}
+	}
+	if stop {
+		if err := unix.Kill(os.Getpid(), unix.SIGSTOP); err != nil {
+			return os.NewSyscallError("kill", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+//go:build darwin
+
+package spawnexec
+
+/*
+#include <errno.h>
+#include <signal.h>
+#include <sys/resource.h>
+#include <unistd.h>
+
+// set_foreground makes the process group of the caller the foreground
+// process group of the terminal fd. The group is still in the background,
+// so the terminal would stop it with SIGTTOU; blocking the signal in the
+// calling thread meanwhile, rather than ignoring it, leaves its disposition
+// at the default for the command executed next.
+static int set_foreground(int fd) {
+    sigset_t set, old;
+    sigemptyset(&set);
+    sigaddset(&set, SIGTTOU);
+    pthread_sigmask(SIG_BLOCK, &set, &old);
+    int ret = tcsetpgrp(fd, getpgrp()) == 0 ? 0 : errno;
+    pthread_sigmask(SIG_SETMASK, &old, NULL);
+    return ret;
+}
+
+// set_iopolicy sets the disk I/O policy of the whole process, which
+// processes it executes and spawns inherit.
+static int set_iopolicy(int policy) {
+    return setiopolicy_np(IOPOL_TYPE_DISK, IOPOL_SCOPE_PROCESS, policy) == 0 ? 0 : errno;
+}
+*/
+import "C"
+import (
+	"os"
+	"syscall"
+)
+
+// setForeground makes the process group of the trampoline the foreground
+// process group of its controlling terminal.
+func setForeground() error {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer tty.Close()
+	if ret := C.set_foreground(C.int(tty.Fd())); ret != 0 {
+		return os.NewSyscallError("tcsetpgrp", syscall.Errno(ret))
+	}
+	return nil
+}
+
+// setIOPolicy sets the disk I/O policy of the trampoline, for the command
+// it executes to inherit.
+func setIOPolicy(policy IOPolicy) error {
+	if ret := C.set_iopolicy(C.int(policy)); ret != 0 {
+		return os.NewSyscallError("setiopolicy_np", syscall.Errno(ret))
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build !darwin
+
+package spawnexec
+
+import "errors"
+
+// setForeground reports an error: elsewhere os/exec puts the child in the
+// foreground itself, and trampolines are not used for it.
+func setForeground() error {
+	return errors.New("trampoline foreground is only supported on darwin")
+}
+
+// setIOPolicy reports an error: disk I/O policies are only supported on
+// darwin.
+func setIOPolicy(policy IOPolicy) error {
+	return errors.New("I/O policies are only supported on darwin")
+}
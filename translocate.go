@@ -0,0 +1,59 @@
+package spawnexec
+
+// TranslocationPolicy says what Start does with an executable inside an
+// app bundle that macOS has translocated: run from a randomized read-only
+// mount, because the bundle is quarantined and has not been moved since
+// it was downloaded. A translocated binary cannot find resources stored
+// beside its bundle, which makes for confusing failures.
+type TranslocationPolicy int
+
+const (
+	// TranslocationResolve, the default, runs the executable from the
+	// bundle's original location instead, and fails with a
+	// *TranslocatedError if that cannot be found.
+	TranslocationResolve TranslocationPolicy = iota
+	// TranslocationReject fails with a *TranslocatedError.
+	TranslocationReject
+	// TranslocationAllow runs the translocated executable.
+	TranslocationAllow
+)
+
+// TranslocatedError is returned by Start when the executable is in a
+// translocated app bundle and Cmd.Translocation does not let it run.
+type TranslocatedError struct {
+	// Path is the translocated executable.
+	Path string
+	// Original is the executable at the bundle's original location, or ""
+	// if it could not be found.
+	Original string
+}
+
+func (e *TranslocatedError) Error() string {
+	msg := "exec: " + e.Path + " is in a translocated app bundle"
+	if e.Original != "" {
+		msg += " (originally " + e.Original + ")"
+	}
+	return msg + "; move the app or remove its quarantine attribute"
+}
+
+// untranslocate applies c.Translocation if c's executable is in a
+// translocated app bundle, pointing Path at the original executable if
+// need be.
+func (c *Cmd) untranslocate() error {
+	if c.Translocation == TranslocationAllow {
+		return nil
+	}
+	path, err := execPath(c.Dir, c.Path)
+	if err != nil {
+		return err
+	}
+	orig, ok := translocatedOriginal(path)
+	if !ok {
+		return nil
+	}
+	if c.Translocation == TranslocationResolve && orig != "" {
+		c.Path = orig
+		return nil
+	}
+	return &TranslocatedError{Path: path, Original: orig}
+}
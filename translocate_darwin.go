@@ -0,0 +1,84 @@
+//go:build darwin
+
+package spawnexec
+
+/*
+#include <dlfcn.h>
+#include <limits.h>
+#include <stdbool.h>
+#include <stdlib.h>
+#include <string.h>
+#include <CoreFoundation/CoreFoundation.h>
+
+typedef Boolean (*is_translocated_fn)(CFURLRef, bool *, CFErrorRef *);
+typedef CFURLRef (*original_path_fn)(CFURLRef, CFErrorRef *);
+
+// translocation_original reports whether path is in a translocated app
+// bundle, using the Security framework's SecTranslocate functions, which
+// are private API: 1 if it is, 0 if it is not, -1 if that cannot be told.
+// If it is, the original path is stored in orig, or orig is left empty if
+// it cannot be found.
+static int translocation_original(const char *path, char *orig, size_t len) {
+    static is_translocated_fn is_translocated;
+    static original_path_fn original_path;
+    if (is_translocated == NULL) {
+        is_translocated = (is_translocated_fn)dlsym(RTLD_DEFAULT, "SecTranslocateIsTranslocatedURL");
+        original_path = (original_path_fn)dlsym(RTLD_DEFAULT, "SecTranslocateCreateOriginalPathForURL");
+    }
+    if (is_translocated == NULL || original_path == NULL) {
+        return -1;
+    }
+
+    CFURLRef url = CFURLCreateFromFileSystemRepresentation(NULL, (const UInt8 *)path, strlen(path), false);
+    if (url == NULL) {
+        return -1;
+    }
+    bool translocated = false;
+    if (!is_translocated(url, &translocated, NULL)) {
+        CFRelease(url);
+        return -1;
+    }
+    if (!translocated) {
+        CFRelease(url);
+        return 0;
+    }
+    orig[0] = '\0';
+    CFURLRef o = original_path(url, NULL);
+    CFRelease(url);
+    if (o != NULL) {
+        if (!CFURLGetFileSystemRepresentation(o, true, (UInt8 *)orig, len)) {
+            orig[0] = '\0';
+        }
+        CFRelease(o);
+    }
+    return 1;
+}
+*/
+import "C"
+
+import (
+	"strings"
+	"unsafe"
+)
+
+// translocatedOriginal reports whether path is in a translocated app
+// bundle and, if it is, returns the path it was translocated from, or ""
+// if that cannot be found.
+func translocatedOriginal(path string) (orig string, ok bool) {
+	// Translocated bundles are always mounted under a directory of this
+	// name; spare other commands the lookup.
+	if !strings.Contains(path, "/AppTranslocation/") {
+		return "", false
+	}
+	cpath := C.CString(path)
+	defer C.free(unsafe.Pointer(cpath))
+	var buf [C.PATH_MAX]C.char
+	switch C.translocation_original(cpath, &buf[0], C.size_t(len(buf))) {
+	case 0:
+		return "", false
+	case 1:
+		return C.GoString(&buf[0]), true
+	}
+	// Without the SecTranslocate functions, go by the location alone.
+	return "", true
+}
@@ -0,0 +1,9 @@
+//go:build !darwin
+
+package spawnexec
+
+// translocatedOriginal reports that path is not translocated: app
+// translocation only happens on darwin.
+func translocatedOriginal(path string) (orig string, ok bool) {
+	return "", false
+}
@@ -0,0 +1,69 @@
+package spawnexec
+
+import (
+	"runtime"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Usage sums the resource usage of several exited processes, such as the
+// commands of a Group, for reporting what a job cost.
+//
+// The usage of each process is what the system reports when it is
+// reaped, which includes that of the descendants it waited for itself;
+// descendants it left running or did not wait for are not counted.
+type Usage struct {
+	// Processes is the number of processes counted.
+	Processes int
+
+	// UserTime and SystemTime are the total CPU time spent.
+	UserTime   time.Duration
+	SystemTime time.Duration
+
+	// MaxRSS is the largest peak resident set size of any one process,
+	// in bytes.
+	MaxRSS int64
+
+	// InBlocks and OutBlocks are the total block input and output
+	// operations.
+	InBlocks  int64
+	OutBlocks int64
+
+	// DiskBytesRead and DiskBytesWritten are the total bytes of disk I/O,
+	// counted only on darwin, where RusageInfo is available.
+	DiskBytesRead    uint64
+	DiskBytesWritten uint64
+}
+
+// Add adds the usage of the exited process ps to u.
+func (u *Usage) Add(ps *ProcessState) {
+	if ps == nil {
+		return
+	}
+	u.Processes++
+	u.UserTime += ps.UserTime()
+	u.SystemTime += ps.SystemTime()
+	if ru, ok := ps.SysUsage().(*unix.Rusage); ok && ru != nil {
+		maxRSS := int64(ru.Maxrss)
+		if runtime.GOOS != "darwin" {
+			// Reported in KiB everywhere but darwin.
+			maxRSS *= 1024
+		}
+		u.MaxRSS = max(u.MaxRSS, maxRSS)
+		u.InBlocks += int64(ru.Inblock)
+		u.OutBlocks += int64(ru.Oublock)
+	}
+	if info := ps.RusageInfo(); info != nil {
+		u.DiskBytesRead += info.DiskBytesRead
+		u.DiskBytesWritten += info.DiskBytesWritten
+	}
+}
+
+// Usage returns the usage of the commands of the group that have exited
+// so far. Once Wait has returned, it covers all of them.
+func (g *Group) Usage() Usage {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.usage
+}
@@ -0,0 +1,29 @@
+//go:build linux
+
+package spawnexec
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setUserNamespace has osCmd create its child in a new user namespace
+// with the ID mappings given by c.SysProcAttr, if it gives any.
+func (c *Cmd) setUserNamespace(osCmd *exec.Cmd) error {
+	attr := c.SysProcAttr
+	if attr == nil || (attr.UidMappings == nil && attr.GidMappings == nil) {
+		return nil
+	}
+	idMaps := func(maps []SysProcIDMap) []syscall.SysProcIDMap {
+		var out []syscall.SysProcIDMap
+		for _, m := range maps {
+			out = append(out, syscall.SysProcIDMap{ContainerID: m.ContainerID, HostID: m.HostID, Size: m.Size})
+		}
+		return out
+	}
+	osCmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER
+	osCmd.SysProcAttr.UidMappings = idMaps(attr.UidMappings)
+	osCmd.SysProcAttr.GidMappings = idMaps(attr.GidMappings)
+	osCmd.SysProcAttr.GidMappingsEnableSetgroups = attr.GidMappingsEnableSetgroups
+	return nil
+}
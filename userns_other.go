@@ -0,0 +1,17 @@
+//go:build !linux
+
+package spawnexec
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// setUserNamespace reports an error if c.SysProcAttr asks for a user
+// namespace: they are only supported on Linux.
+func (c *Cmd) setUserNamespace(osCmd *exec.Cmd) error {
+	if attr := c.SysProcAttr; attr != nil && (attr.UidMappings != nil || attr.GidMappings != nil) {
+		return errors.New("exec: user namespaces are only supported on Linux")
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package spawnexec
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ChecksumError is returned by Start when the executable's SHA-256 digest
+// is not Cmd.ExpectedSHA256.
+type ChecksumError struct {
+	// Path is the executable that was hashed.
+	Path string
+	// Want and Got are the expected and actual digests, hex-encoded.
+	Want, Got string
+}
+
+func (e *ChecksumError) Error() string {
+	return "exec: " + e.Path + ": SHA-256 is " + e.Got + ", want " + e.Want
+}
+
+// CodeSignature is a requirement on the code signature of an executable,
+// checked by Start on darwin; see Cmd.CodeSignature. The zero value only
+// requires a valid signature.
+type CodeSignature struct {
+	// TeamID, if set, is the Apple Developer Team ID that must have signed
+	// the executable, with a certificate issued by Apple.
+	TeamID string
+	// Requirement, if set, is a further requirement the signature must
+	// satisfy, in the code requirement language described in
+	// csreq(1), such as `identifier "com.example.tool"`.
+	Requirement string
+}
+
+// requirement returns s as a requirement in the code requirement language,
+// or "" if s only requires a valid signature.
+func (s *CodeSignature) requirement() (string, error) {
+	var reqs []string
+	if s.TeamID != "" {
+		if strings.Trim(s.TeamID, "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789") != "" {
+			return "", errors.New("exec: invalid code signature Team ID " + strconv.Quote(s.TeamID))
+		}
+		reqs = append(reqs, `anchor apple generic and certificate leaf[subject.OU] = "`+s.TeamID+`"`)
+	}
+	if s.Requirement != "" {
+		reqs = append(reqs, "("+s.Requirement+")")
+	}
+	return strings.Join(reqs, " and "), nil
+}
+
+// SignatureError is returned by Start when the executable's code signature
+// is missing, invalid or does not satisfy Cmd.CodeSignature.
+type SignatureError struct {
+	// Path is the executable whose signature was checked.
+	Path string
+	// TeamID is the Team ID of the signature, if it has one.
+	TeamID string
+	// Status is the OSStatus the Security framework reported.
+	Status int32
+	// Message describes Status.
+	Message string
+}
+
+func (e *SignatureError) Error() string {
+	msg := "exec: " + e.Path + ": code signature check failed: " + e.Message
+	if e.TeamID != "" {
+		msg += " (signed by team " + e.TeamID + ")"
+	}
+	return msg
+}
+
+// verify checks the executable c runs against ExpectedSHA256,
+// CodeSignature and Verify.
+func (c *Cmd) verify() error {
+	if c.ExpectedSHA256 == "" && c.CodeSignature == nil && c.Verify == nil {
+		return nil
+	}
+	path, err := execPath(c.Dir, c.Path)
+	if f := c.execFD(); f != nil {
+		path, err = execFDPath(f)
+	}
+	if err != nil {
+		return err
+	}
+	if c.ExpectedSHA256 != "" {
+		got, err := fileSHA256(path)
+		if err != nil {
+			return &Error{Name: c.Path, Err: err}
+		}
+		if want := strings.ToLower(c.ExpectedSHA256); got != want {
+			return &ChecksumError{Path: path, Want: want, Got: got}
+		}
+	}
+	if c.CodeSignature != nil {
+		req, err := c.CodeSignature.requirement()
+		if err != nil {
+			return err
+		}
+		if err := checkCodeSignature(path, req); err != nil {
+			return err
+		}
+	}
+	if c.Verify != nil {
+		if err := c.Verify(path); err != nil {
+			return &Error{Name: c.Path, Err: err}
+		}
+	}
+	return nil
+}
+
+// fileSHA256 returns the hex-encoded SHA-256 digest of the file at path.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
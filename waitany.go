@@ -0,0 +1,55 @@
+package spawnexec
+
+import (
+	"errors"
+	"fmt"
+)
+
+// WaitAny waits for the first of the given started commands to exit, then
+// calls its Wait method and returns its index together with the error
+// from Wait. Commands whose Wait method has already been called are
+// skipped, so WaitAny can be called repeatedly on the same commands to
+// collect them in the order they exit. If no command is left to wait for,
+// WaitAny returns -1 and an error.
+//
+// On darwin all the commands are watched with a single kqueue, and on
+// Linux with a pidfd each, polled together. Elsewhere, or where pidfds are
+// unsupported, WaitAny checks them each time the shared reaper's goroutine
+// is notified of SIGCHLD, rather than at intervals.
+func WaitAny(cmds ...*Cmd) (int, error) {
+	var procs []*Process
+	var index []int
+	for i, c := range cmds {
+		if c.finished {
+			continue
+		}
+		if c.Process == nil {
+			return i, errors.New("exec: not started")
+		}
+		procs = append(procs, c.Process)
+		index = append(index, i)
+	}
+	if len(procs) == 0 {
+		return -1, errors.New("exec: no commands to wait for")
+	}
+	j, err := waitAnyExit(procs)
+	if err != nil {
+		return -1, err
+	}
+	i := index[j]
+	return i, cmds[i].Wait()
+}
+
+// WaitAll waits for all of the given started commands to exit, calling
+// each one's Wait method. The errors from the commands that failed are
+// joined with errors.Join, each annotated with its command; WaitAll
+// returns nil if all of them succeeded.
+func WaitAll(cmds ...*Cmd) error {
+	var errs []error
+	for _, c := range cmds {
+		if err := c.Wait(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c, err))
+		}
+	}
+	return errors.Join(errs...)
+}
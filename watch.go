@@ -0,0 +1,140 @@
+package spawnexec
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// defaultDebounce is how long Watch waits for changes to settle if
+// WatchOptions.Debounce is zero.
+const defaultDebounce = 100 * time.Millisecond
+
+// WatchOptions configures Watch.
+type WatchOptions struct {
+	// Paths are the files and directories to watch. A directory's entries
+	// are watched, but not the contents of its subdirectories.
+	Paths []string
+
+	// Debounce is how long changes must stop for before the command is
+	// rerun, so that a burst of them, such as an editor saving a file or
+	// a build writing many, reruns it once. If it is zero, 100ms is used.
+	Debounce time.Duration
+
+	// OnExit, if non-nil, is called from Watch with the error each run of
+	// the command ended with, including runs stopped because of a change,
+	// but not the run stopped when the context is done.
+	OnExit func(err error)
+}
+
+// Watch runs a clone of cmd, as made by Clone, and whenever the paths in
+// opts change, stops the run if it is still going and runs a new clone,
+// as a development server wrapper does. A run is stopped as if its
+// context were done: it is killed, or canceled by its Cancel function,
+// with WaitDelay applying. cmd itself is never started.
+//
+// Watch continues until ctx is done, and then stops the current run and
+// returns ctx's error. It returns an error without running cmd if the
+// paths cannot be watched, and stops if watching them fails later.
+// Watching is supported on darwin, with kqueue, and Linux, with inotify.
+func Watch(ctx context.Context, cmd *Cmd, opts WatchOptions) error {
+	if len(opts.Paths) == 0 {
+		return errors.New("exec: Watch without Paths")
+	}
+	debounce := opts.Debounce
+	if debounce <= 0 {
+		debounce = defaultDebounce
+	}
+	w, err := watchPaths(opts.Paths)
+	if err != nil {
+		return err
+	}
+	defer w.close()
+
+	for {
+		runCtx, cancel := context.WithCancel(ctx)
+		done := make(chan error, 1)
+		run := cmd.Clone()
+		go func() {
+			done <- run.runContext(runCtx)
+		}()
+		// stop stops the run, if it is still going, and reports how it
+		// ended unless ctx is done.
+		stop := func() {
+			cancel()
+			if done == nil {
+				return
+			}
+			err := <-done
+			if opts.OnExit != nil && ctx.Err() == nil {
+				opts.OnExit(err)
+			}
+		}
+
+		// Wait for a change, and then for changes to stop.
+		var settle *time.Timer
+		var settled <-chan time.Time
+	wait:
+		for {
+			select {
+			case err := <-done:
+				done = nil
+				if opts.OnExit != nil && ctx.Err() == nil {
+					opts.OnExit(err)
+				}
+			case <-w.events:
+				if settle == nil {
+					settle = time.NewTimer(debounce)
+				} else {
+					settle.Reset(debounce)
+				}
+				settled = settle.C
+			case <-settled:
+				break wait
+			case err := <-w.errc:
+				stop()
+				return err
+			case <-ctx.Done():
+				stop()
+				return ctx.Err()
+			}
+		}
+		stop()
+	}
+}
+
+// pathWatcher reports changes to watched paths.
+type pathWatcher struct {
+	events  chan struct{} // holds a value once there have been changes
+	errc    chan error    // receives the error watching stopped with
+	closeFn func() error
+	closed  atomic.Bool
+}
+
+// newPathWatcher returns a pathWatcher that stops watching by calling
+// closeFn.
+func newPathWatcher(closeFn func() error) *pathWatcher {
+	return &pathWatcher{events: make(chan struct{}, 1), errc: make(chan error, 1), closeFn: closeFn}
+}
+
+// notify records that there have been changes.
+func (w *pathWatcher) notify() {
+	select {
+	case w.events <- struct{}{}:
+	default:
+	}
+}
+
+// fail reports the error that stopped watching, unless w was closed.
+func (w *pathWatcher) fail(err error) {
+	if !w.closed.Load() {
+		w.errc <- err
+	}
+}
+
+// close stops watching.
+func (w *pathWatcher) close() error {
+	w.closed.Store(true)
+	return w.closeFn()
+}
@@ -0,0 +1,128 @@
+//go:build darwin
+
+package spawnexec
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// kqueueNotes selects the changes to paths that Watch reacts to.
+const kqueueNotes = unix.NOTE_WRITE | unix.NOTE_EXTEND | unix.NOTE_ATTRIB |
+	unix.NOTE_DELETE | unix.NOTE_RENAME | unix.NOTE_REVOKE
+
+// kqueueWatcher watches paths with kqueue, through a descriptor opened on
+// each of them.
+type kqueueWatcher struct {
+	kq           int
+	wakeR, wakeW int // wakeW is closed to stop watching
+	paths        []string
+	fds          []int
+}
+
+// watchPaths watches paths with kqueue.
+func watchPaths(paths []string) (*pathWatcher, error) {
+	kq, err := unix.Kqueue()
+	if err != nil {
+		return nil, os.NewSyscallError("kqueue", err)
+	}
+	unix.CloseOnExec(kq)
+	var p [2]int
+	if err := unix.Pipe(p[:]); err != nil {
+		unix.Close(kq)
+		return nil, os.NewSyscallError("pipe", err)
+	}
+	unix.CloseOnExec(p[0])
+	unix.CloseOnExec(p[1])
+	kw := &kqueueWatcher{kq: kq, wakeR: p[0], wakeW: p[1], paths: paths}
+
+	var wake unix.Kevent_t
+	unix.SetKevent(&wake, kw.wakeR, unix.EVFILT_READ, unix.EV_ADD)
+	if _, err := unix.Kevent(kq, []unix.Kevent_t{wake}, nil, nil); err != nil {
+		kw.closeAll()
+		unix.Close(kw.wakeW)
+		return nil, os.NewSyscallError("kevent", err)
+	}
+	if err := kw.open(true); err != nil {
+		kw.closeAll()
+		unix.Close(kw.wakeW)
+		return nil, err
+	}
+
+	w := newPathWatcher(func() error { return unix.Close(kw.wakeW) })
+	go kw.loop(w)
+	return w, nil
+}
+
+// open opens and registers the watched paths, whose inodes may have been
+// replaced since they were last opened, as editors replace a file to save
+// it. A path that is missing is only an error when watching starts.
+func (kw *kqueueWatcher) open(initial bool) error {
+	kw.closePaths()
+	var changes []unix.Kevent_t
+	for _, path := range kw.paths {
+		fd, err := unix.Open(path, unix.O_EVTONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			if initial || err != unix.ENOENT {
+				return &os.PathError{Op: "open", Path: path, Err: err}
+			}
+			continue
+		}
+		kw.fds = append(kw.fds, fd)
+		var ev unix.Kevent_t
+		unix.SetKevent(&ev, fd, unix.EVFILT_VNODE, unix.EV_ADD|unix.EV_CLEAR)
+		ev.Fflags = kqueueNotes
+		changes = append(changes, ev)
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	if _, err := unix.Kevent(kw.kq, changes, nil, nil); err != nil {
+		return os.NewSyscallError("kevent", err)
+	}
+	return nil
+}
+
+// loop waits for changes until watching is stopped or fails.
+func (kw *kqueueWatcher) loop(w *pathWatcher) {
+	defer kw.closeAll()
+	events := make([]unix.Kevent_t, 16)
+	for {
+		n, err := unix.Kevent(kw.kq, nil, events, nil)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			w.fail(os.NewSyscallError("kevent", err))
+			return
+		}
+		for _, ev := range events[:n] {
+			if int(ev.Ident) == kw.wakeR {
+				return
+			}
+		}
+		if err := kw.open(false); err != nil {
+			w.fail(err)
+			return
+		}
+		w.notify()
+	}
+}
+
+// closePaths closes the descriptors of the watched paths, which removes
+// their events from the kqueue.
+func (kw *kqueueWatcher) closePaths() {
+	for _, fd := range kw.fds {
+		unix.Close(fd)
+	}
+	kw.fds = kw.fds[:0]
+}
+
+// closeAll closes the descriptors of the watched paths, the kqueue and
+// the reading end of the wakeup pipe.
+func (kw *kqueueWatcher) closeAll() {
+	kw.closePaths()
+	unix.Close(kw.kq)
+	unix.Close(kw.wakeR)
+}
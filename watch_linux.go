@@ -0,0 +1,66 @@
+package spawnexec
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// inotifyMask selects the changes to paths that Watch reacts to.
+const inotifyMask = unix.IN_MODIFY | unix.IN_ATTRIB | unix.IN_CLOSE_WRITE | unix.IN_CREATE |
+	unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_DELETE_SELF | unix.IN_MOVE_SELF
+
+// watchPaths watches paths with inotify.
+func watchPaths(paths []string) (*pathWatcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	// Non-blocking, so that closing it interrupts the read.
+	f := os.NewFile(uintptr(fd), "inotify")
+	rc, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	// add watches paths, whose inodes may have been replaced since they
+	// were last watched, as editors replace a file to save it. A path that
+	// is missing is only an error when watching starts.
+	add := func(initial bool) error {
+		var err error
+		rc.Control(func(fd uintptr) {
+			for _, path := range paths {
+				_, werr := unix.InotifyAddWatch(int(fd), path, inotifyMask)
+				if werr != nil && (initial || werr != unix.ENOENT) {
+					err = &os.PathError{Op: "inotify_add_watch", Path: path, Err: werr}
+					return
+				}
+			}
+		})
+		return err
+	}
+	if err := add(true); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	w := newPathWatcher(f.Close)
+	go func() {
+		buf := make([]byte, 64<<10)
+		for {
+			if _, err := f.Read(buf); err != nil {
+				if !errors.Is(err, os.ErrClosed) {
+					w.fail(err)
+				}
+				return
+			}
+			if err := add(false); err != nil {
+				w.fail(err)
+				return
+			}
+			w.notify()
+		}
+	}()
+	return w, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package spawnexec
+
+import (
+	"errors"
+)
+
+// watchPaths reports an error: watching paths is only supported on darwin
+// and Linux.
+func watchPaths(paths []string) (*pathWatcher, error) {
+	return nil, errors.New("exec: Watch is not supported on this platform")
+}
@@ -0,0 +1,113 @@
+package spawnexec
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// watchdogEnv is the environment variable that makes the current
+// executable run as a watchdog.
+const watchdogEnv = "SPAWNEXEC_WATCHDOG"
+
+// A watchdog kills a command started with KillOnParentExit if the calling
+// process exits before reaping it. darwin has no equivalent of Linux's
+// PR_SET_PDEATHSIG, and on Linux a command started through a Broker is
+// the broker's child, so the current executable is started as a separate
+// process holding the read end of a pipe: the calling process writes the
+// command's pid to it once the command has started, and disarms the
+// watchdog by writing to it again once the command has been reaped. If
+// the pipe is closed without being disarmed, the calling process has
+// exited, and the watchdog kills the command.
+type watchdog struct {
+	w    *os.File
+	once sync.Once
+}
+
+// startWatchdog starts a watchdog for c if c.KillOnParentExit is set, and
+// returns nil otherwise. It is started before the command, so that the
+// command never runs unwatched.
+func (c *Cmd) startWatchdog() (*watchdog, error) {
+	if !c.KillOnParentExit {
+		return nil, nil
+	}
+	exe, err := helperExecutable()
+	if err != nil {
+		return nil, err
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	proc, err := os.StartProcess(exe, []string{exe}, &os.ProcAttr{
+		Dir:   "/",
+		Env:   []string{watchdogEnv + "=1"},
+		Files: []*os.File{pr, nil, nil},
+		// Keep the watchdog out of the caller's process group, so that
+		// the terminal's job control signals do not reach it.
+		Sys: &syscall.SysProcAttr{Setpgid: true},
+	})
+	pr.Close()
+	if err != nil {
+		pw.Close()
+		return nil, err
+	}
+	go proc.Wait()
+	return &watchdog{w: pw}, nil
+}
+
+// watch arms w to kill pid. It does nothing if w is nil.
+func (w *watchdog) watch(pid int) {
+	if w == nil {
+		return
+	}
+	w.w.WriteString(strconv.Itoa(pid) + "\n")
+}
+
+// stop disarms w and lets the watchdog exit. It is called once the command
+// has been reaped, or if it could not be started. It does nothing if w is
+// nil.
+func (w *watchdog) stop() {
+	if w == nil {
+		return
+	}
+	w.once.Do(func() {
+		w.w.WriteString("\n")
+		w.w.Close()
+	})
+}
+
+// runWatchdog reads the pid to watch from r and kills it if r reaches
+// end of file before anything else is read.
+func runWatchdog(r io.Reader) int {
+	signal.Ignore(syscall.SIGHUP, syscall.SIGINT)
+	br := bufio.NewReader(r)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil || pid <= 0 {
+		return 0
+	}
+	kill := pidKiller(pid)
+	if runtime.GOOS == "darwin" || runtime.GOOS == "linux" {
+		// kqueue or a pidfd reports the command's exit without polling,
+		// after which its pid must not be signaled.
+		go func() {
+			if waitExit(pid) == nil {
+				os.Exit(0)
+			}
+		}()
+	}
+	if _, err := br.ReadByte(); err == io.EOF {
+		kill()
+	}
+	return 0
+}
@@ -0,0 +1,69 @@
+package spawnexec
+
+import (
+	"os"
+	"strings"
+)
+
+// Workspace gives a command a private temporary directory for the
+// length of its run, as build sandboxes want: Start creates it, and Wait
+// removes it with everything in it once the command has exited, however
+// it exited.
+type Workspace struct {
+	// Parent is the directory the workspace is created in. If it is
+	// empty, os.TempDir is used.
+	Parent string
+
+	// Pattern names the workspace as os.MkdirTemp does. If it is empty,
+	// "spawnexec-*" is used.
+	Pattern string
+
+	// PreserveOnFailure keeps the workspace when Start or Wait fails,
+	// including when the command exits unsuccessfully, so that what the
+	// command left behind can be examined.
+	PreserveOnFailure bool
+
+	// Path is the workspace, set by Start once it has created it.
+	Path string
+}
+
+// createWorkspace creates c's workspace, if it has one, and points the
+// command at it: TMPDIR is set to it in the command's environment, and
+// it becomes the working directory unless Dir or DirFD is set.
+func (c *Cmd) createWorkspace() error {
+	ws := c.Workspace
+	if ws == nil {
+		return nil
+	}
+	pattern := ws.Pattern
+	if pattern == "" {
+		pattern = "spawnexec-*"
+	}
+	dir, err := os.MkdirTemp(ws.Parent, pattern)
+	if err != nil {
+		return wrapError("exec: workspace: ", err)
+	}
+	ws.Path = dir
+
+	var env []string
+	for _, kv := range c.Environ() {
+		if !strings.HasPrefix(kv, "TMPDIR=") {
+			env = append(env, kv)
+		}
+	}
+	c.Env = append(env, "TMPDIR="+dir)
+	if c.Dir == "" && c.DirFD == nil {
+		c.Dir = dir
+	}
+	return nil
+}
+
+// removeWorkspace removes c's workspace, if it has one, unless err is a
+// failure the workspace is to be preserved for.
+func (c *Cmd) removeWorkspace(err error) {
+	ws := c.Workspace
+	if ws == nil || ws.Path == "" || (err != nil && ws.PreserveOnFailure) {
+		return
+	}
+	os.RemoveAll(ws.Path)
+}